@@ -0,0 +1,89 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/sirupsen/logrus"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+const procCgroupsPath = "/proc/cgroups"
+
+// agentService implements guest specific calls not covered by containerd's task API
+type agentService struct {
+	cgroupVersion uint32
+	exits         *exitNotifier
+	ooms          *oomWatcher
+}
+
+var _ proto.AgentService = &agentService{}
+
+func (s *agentService) Capabilities(ctx context.Context, req *proto.CapabilitiesRequest) (*proto.CapabilitiesResponse, error) {
+	resp := &proto.CapabilitiesResponse{
+		Pause:             pauseSupported(),
+		CgroupVersion:     s.cgroupVersion,
+		ExitNotifications: s.exits != nil,
+		OOMNotifications:  s.ooms != nil,
+	}
+
+	log.G(ctx).WithFields(logrus.Fields{
+		"pause":              resp.Pause,
+		"cgroup_version":     resp.CgroupVersion,
+		"exit_notifications": resp.ExitNotifications,
+		"oom_notifications":  resp.OOMNotifications,
+	}).Debug("capabilities")
+	return resp, nil
+}
+
+// pauseSupported checks whether freezer cgroup controller (required by runc to pause containers)
+// is enabled in the guest kernel
+func pauseSupported() bool {
+	controllers, err := cgroupControllers(procCgroupsPath)
+	if err != nil {
+		return false
+	}
+
+	return contains(controllers, "freezer")
+}
+
+// cgroupControllers returns cgroup controllers enabled in the guest kernel, as listed in /proc/cgroups
+func cgroupControllers(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var controllers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// #subsys_name hierarchy num_cgroups enabled
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 || strings.HasPrefix(fields[0], "#") || fields[3] != "1" {
+			continue
+		}
+
+		controllers = append(controllers, fields[0])
+	}
+
+	return controllers, scanner.Err()
+}
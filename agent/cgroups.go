@@ -0,0 +1,137 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	cgroupRootPath = "/sys/fs/cgroup"
+
+	cgroupV1 = 1
+	cgroupV2 = 2
+)
+
+// Controllers needed to enforce OCI resources on cgroup v2 (cgroup v1 equivalents are always available)
+var cgroupV2Controllers = []string{"cpu", "cpuset", "io", "memory", "pids"}
+
+// cgroupVersion detects whether the guest uses unified (v2) or legacy (v1) cgroup hierarchy
+func cgroupVersion() uint32 {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(cgroupRootPath, &stat); err == nil && stat.Type == unix.CGROUP2_SUPER_MAGIC {
+		return cgroupV2
+	}
+
+	return cgroupV1
+}
+
+// setupCgroups prepares guest cgroups for containers.
+// On cgroup v2 controllers have to be explicitly enabled for child cgroups, otherwise limits are silently not applied.
+// Controllers aren't touched unless enableControllers is set, as systemd manages them itself.
+func setupCgroups(ctx context.Context, enableControllers bool) uint32 {
+	version := cgroupVersion()
+	log.G(ctx).Infof("guest uses cgroup v%d", version)
+
+	if version != cgroupV2 || !enableControllers {
+		return version
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(cgroupRootPath, "cgroup.controllers"))
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to read available cgroup controllers")
+		return version
+	}
+
+	available := strings.Fields(string(data))
+	subtreeControl := filepath.Join(cgroupRootPath, "cgroup.subtree_control")
+
+	for _, controller := range cgroupV2Controllers {
+		if !contains(available, controller) {
+			log.G(ctx).Warnf("cgroup controller %q is not available, related resource limits won't be enforced", controller)
+			continue
+		}
+
+		if err := ioutil.WriteFile(subtreeControl, []byte("+"+controller), 0644); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to enable cgroup controller %q", controller)
+		}
+	}
+
+	return version
+}
+
+// checkResources warns about resources in the spec which can't be enforced with the given cgroup version
+func checkResources(ctx context.Context, specPath string, version uint32) {
+	if version != cgroupV2 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to read spec")
+		return
+	}
+
+	var spec specs.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to parse spec")
+		return
+	}
+
+	for _, name := range unsupportedV2Resources(spec.Linux) {
+		log.G(ctx).Warnf("%s is not supported on cgroup v2 and won't be enforced", name)
+	}
+}
+
+// unsupportedV2Resources lists cgroup v1 only resources requested in the spec
+func unsupportedV2Resources(linux *specs.Linux) []string {
+	if linux == nil || linux.Resources == nil || linux.Resources.Memory == nil {
+		return nil
+	}
+
+	var list []string
+	memory := linux.Resources.Memory
+
+	if memory.Kernel != nil {
+		list = append(list, "memory.kernel")
+	}
+
+	if memory.KernelTCP != nil {
+		list = append(list, "memory.kernelTCP")
+	}
+
+	if memory.Swappiness != nil {
+		list = append(list, "memory.swappiness")
+	}
+
+	return list
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,40 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnsupportedV2Resources(t *testing.T) {
+	assert.Empty(t, unsupportedV2Resources(nil))
+
+	limit := int64(1024)
+	swappiness := uint64(10)
+
+	linux := &specs.Linux{
+		Resources: &specs.LinuxResources{
+			Memory: &specs.LinuxMemory{
+				Limit:      &limit,
+				Kernel:     &limit,
+				Swappiness: &swappiness,
+			},
+		},
+	}
+
+	assert.Equal(t, []string{"memory.kernel", "memory.swappiness"}, unsupportedV2Resources(linux))
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/mdlayher/vsock"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+// Guest resolvers send queries to the agent at this address
+const dnsListenAddress = "127.0.0.1:53"
+
+type pendingQuery struct {
+	client net.Addr
+	id     uint16
+}
+
+// dnsForwarder forwards DNS queries received over UDP to the runtime over vsock connection.
+// Query IDs are rewritten, so queries of different clients using the same ID can't be mixed up.
+type dnsForwarder struct {
+	packetConn net.PacketConn
+
+	mu      sync.Mutex
+	host    net.Conn
+	nextID  uint16
+	pending map[uint16]pendingQuery
+}
+
+func newDNSForwarder(packetConn net.PacketConn) *dnsForwarder {
+	return &dnsForwarder{
+		packetConn: packetConn,
+		pending:    make(map[uint16]pendingQuery),
+	}
+}
+
+// dnsPort returns the vsock port configured on the host for DNS queries, 0 if DNS proxy is disabled
+func dnsPort() uint32 {
+	value, found, err := internal.ReadBootArg(internal.DNSPortBootArg)
+	if err != nil || !found {
+		return 0
+	}
+
+	port, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		log.L.Warnf("ignoring invalid DNS port %q", value)
+		return 0
+	}
+
+	return uint32(port)
+}
+
+// serveDNS accepts connections from the runtime on the given vsock port and forwards guest DNS queries to it
+func serveDNS(ctx context.Context, port uint32) error {
+	packetConn, err := net.ListenPacket("udp", dnsListenAddress)
+	if err != nil {
+		return err
+	}
+
+	listener, err := vsock.Listen(port)
+	if err != nil {
+		packetConn.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		packetConn.Close()
+	}()
+
+	log.G(ctx).Infof("forwarding DNS queries from %s to vsock port %d", dnsListenAddress, port)
+
+	forwarder := newDNSForwarder(packetConn)
+	go forwarder.serveClients(ctx)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go forwarder.serveHost(ctx, conn)
+	}
+}
+
+// serveClients forwards queries of guest clients to the host
+func (f *dnsForwarder) serveClients(ctx context.Context) {
+	buf := make([]byte, internal.MaxDNSMessageSize)
+	for {
+		n, addr, err := f.packetConn.ReadFrom(buf)
+		if err != nil {
+			log.G(ctx).WithError(err).Debug("stopped reading DNS queries")
+			return
+		}
+
+		if n < internal.DNSHeaderSize {
+			continue
+		}
+
+		if err := f.forward(addr, buf[:n]); err != nil {
+			log.G(ctx).WithError(err).Debug("failed to forward DNS query")
+		}
+	}
+}
+
+func (f *dnsForwarder) forward(client net.Addr, query []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.host == nil {
+		return nil
+	}
+
+	// Older query with the same ID (if any) is not expected to be answered anymore
+	id := f.nextID
+	f.nextID++
+	f.pending[id] = pendingQuery{client: client, id: binary.BigEndian.Uint16(query)}
+
+	binary.BigEndian.PutUint16(query, id)
+	return internal.WriteDNSMessage(f.host, query)
+}
+
+// serveHost sends responses received from the host back to the clients
+func (f *dnsForwarder) serveHost(ctx context.Context, conn net.Conn) {
+	f.mu.Lock()
+	if f.host != nil {
+		f.host.Close()
+	}
+	f.host = conn
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		if f.host == conn {
+			f.host = nil
+		}
+		f.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		resp, err := internal.ReadDNSMessage(conn)
+		if err != nil {
+			log.G(ctx).WithError(err).Debug("DNS connection to host closed")
+			return
+		}
+
+		if len(resp) < internal.DNSHeaderSize {
+			continue
+		}
+
+		f.mu.Lock()
+		query, ok := f.pending[binary.BigEndian.Uint16(resp)]
+		delete(f.pending, binary.BigEndian.Uint16(resp))
+		f.mu.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		binary.BigEndian.PutUint16(resp, query.id)
+		if _, err := f.packetConn.WriteTo(resp, query.client); err != nil {
+			log.G(ctx).WithError(err).Debug("failed to send DNS response")
+		}
+	}
+}
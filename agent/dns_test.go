@@ -0,0 +1,90 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+func TestDNSForwarder(t *testing.T) {
+	ctx := context.Background()
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer packetConn.Close()
+
+	agent, host := net.Pipe()
+	defer host.Close()
+
+	forwarder := newDNSForwarder(packetConn)
+	go forwarder.serveClients(ctx)
+	go forwarder.serveHost(ctx, agent)
+
+	// Wait for the host connection to be picked up
+	for connected := false; !connected; time.Sleep(time.Millisecond) {
+		forwarder.mu.Lock()
+		connected = forwarder.host != nil
+		forwarder.mu.Unlock()
+	}
+
+	// Two clients using the same query ID
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("udp", packetConn.LocalAddr().String())
+		require.NoError(t, err)
+		defer client.Close()
+
+		query := make([]byte, internal.DNSHeaderSize+1)
+		binary.BigEndian.PutUint16(query, 0xbeef)
+		query[internal.DNSHeaderSize] = byte(i)
+
+		_, err = client.Write(query)
+		require.NoError(t, err)
+		clients = append(clients, client)
+
+		// Keep the order of queries predictable
+		forwarded, err := internal.ReadDNSMessage(host)
+		require.NoError(t, err)
+		assert.Equal(t, uint16(i), binary.BigEndian.Uint16(forwarded), "query IDs must be unique on the host side")
+		assert.Equal(t, byte(i), forwarded[internal.DNSHeaderSize])
+	}
+
+	// Answer in reverse order
+	for i := len(clients) - 1; i >= 0; i-- {
+		forwarded := make([]byte, internal.DNSHeaderSize+1)
+		binary.BigEndian.PutUint16(forwarded, uint16(i))
+		forwarded[internal.DNSHeaderSize] = byte(i)
+		require.NoError(t, internal.WriteDNSMessage(host, forwarded))
+	}
+
+	for i, client := range clients {
+		require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+
+		resp := make([]byte, internal.MaxDNSMessageSize)
+		n, err := client.Read(resp)
+		require.NoError(t, err)
+		require.Equal(t, internal.DNSHeaderSize+1, n)
+		assert.Equal(t, uint16(0xbeef), binary.BigEndian.Uint16(resp), "client must get its own query ID back")
+		assert.Equal(t, byte(i), resp[internal.DNSHeaderSize], "client must get the response to its query")
+	}
+}
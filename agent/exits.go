@@ -0,0 +1,119 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/log"
+	"github.com/sirupsen/logrus"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// How long WaitExit blocks at most, the runtime calls it again if the process is still there
+const exitWaitTimeout = 30 * time.Second
+
+// exitNotifier receives events of the runc shim and keeps exits of processes until they are deleted,
+// so the runtime can learn about exits as they happen instead of polling process states
+type exitNotifier struct {
+	mu sync.Mutex
+	// Exits by process ID, which is the container ID for init processes and the exec ID otherwise
+	exits map[string]*eventstypes.TaskExit
+	// Closed and replaced on every exit
+	changed chan struct{}
+}
+
+var _ events.Publisher = &exitNotifier{}
+
+func newExitNotifier() *exitNotifier {
+	return &exitNotifier{
+		exits:   make(map[string]*eventstypes.TaskExit),
+		changed: make(chan struct{}),
+	}
+}
+
+// Publish records exit events, other events have no consumers in the guest
+func (n *exitNotifier) Publish(ctx context.Context, topic string, event events.Event) error {
+	exit, ok := event.(*eventstypes.TaskExit)
+	if !ok {
+		return nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.exits[exit.ID] = exit
+	close(n.changed)
+	n.changed = make(chan struct{})
+	return nil
+}
+
+// wait blocks until the given process exits, returns nil if it doesn't exit within the timeout
+func (n *exitNotifier) wait(ctx context.Context, processID string, timeout time.Duration) (*eventstypes.TaskExit, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		n.mu.Lock()
+		exit, ok := n.exits[processID]
+		changed := n.changed
+		n.mu.Unlock()
+
+		if ok {
+			return exit, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// forget drops the exit of a deleted process, so that its ID can be used again
+func (n *exitNotifier) forget(processID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.exits, processID)
+}
+
+// WaitExit reports the exit of the given process as soon as it happens
+func (s *agentService) WaitExit(ctx context.Context, req *proto.WaitExitRequest) (*proto.WaitExitResponse, error) {
+	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("wait exit")
+
+	exit, err := s.exits.wait(ctx, processID(req.ID, req.ExecID), exitWaitTimeout)
+	if err != nil || exit == nil {
+		return &proto.WaitExitResponse{}, err
+	}
+
+	return &proto.WaitExitResponse{Exited: true, ExitStatus: exit.ExitStatus}, nil
+}
+
+// processID returns the ID of a process as known by the runc shim
+func processID(id, execID string) string {
+	if execID != "" {
+		return execID
+	}
+
+	return id
+}
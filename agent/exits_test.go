@@ -0,0 +1,62 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitNotifier(t *testing.T) {
+	ctx := context.Background()
+	n := newExitNotifier()
+
+	// Other events are ignored
+	require.NoError(t, n.Publish(ctx, "/tasks/create", &eventstypes.TaskCreate{ContainerID: "app"}))
+	exit, err := n.wait(ctx, "app", 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Nil(t, exit, "nothing exited yet")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		n.Publish(ctx, "/tasks/exit", &eventstypes.TaskExit{ContainerID: "agent", ID: "shell", ExitStatus: 1})
+		n.Publish(ctx, "/tasks/exit", &eventstypes.TaskExit{ContainerID: "agent", ID: "app", ExitStatus: 2})
+	}()
+
+	exit, err = n.wait(ctx, processID("app", ""), time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, exit)
+	assert.EqualValues(t, 2, exit.ExitStatus)
+
+	// Exits are kept until the process is deleted
+	exit, err = n.wait(ctx, processID("app", "shell"), time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, exit)
+	assert.EqualValues(t, 1, exit.ExitStatus)
+
+	n.forget("shell")
+	exit, err = n.wait(ctx, "shell", 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Nil(t, exit)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = n.wait(canceled, "shell", time.Second)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// injectFiles writes files passed by the runtime into the rootfs of the container described by the spec, before
+// the container is created. Only paths and sizes are logged, content may be a secret.
+func injectFiles(ctx context.Context, specPath string, files []*proto.InjectedFile) error {
+	root, err := rootfsPath(specPath, bundleMountPath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := injectFile(root, file); err != nil {
+			return errors.Wrapf(err, "failed to inject file %s", file.Path)
+		}
+
+		log.G(ctx).WithFields(logrus.Fields{
+			"path": file.Path,
+			"mode": internal.InjectedFileMode(file.Mode),
+			"size": len(file.Content),
+		}).Debug("injected file")
+	}
+
+	return nil
+}
+
+// injectFile writes a file under root. Symlinks of the image are never followed on the way, so the file can't
+// end up outside of the container.
+func injectFile(root string, file *proto.InjectedFile) error {
+	if err := internal.ValidateInjectedFile(file.Path, file.Mode); err != nil {
+		return err
+	}
+
+	dir := root
+	components := strings.Split(strings.TrimPrefix(file.Path, "/"), "/")
+	for _, name := range components[:len(components)-1] {
+		dir = filepath.Join(dir, name)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("%s is a symlink", strings.TrimPrefix(dir, root))
+		}
+
+		if !info.IsDir() {
+			return errors.Errorf("%s isn't a directory", strings.TrimPrefix(dir, root))
+		}
+	}
+
+	path := filepath.Join(dir, components[len(components)-1])
+	mode := internal.InjectedFileMode(file.Mode)
+	fd, err := unix.Open(path, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(mode))
+	if err != nil {
+		return err
+	}
+
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+
+	// The mode of an existing file is kept by open, and the umask applies to new ones
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+
+	if _, err := f.Write(file.Content); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
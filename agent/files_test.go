@@ -0,0 +1,67 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+func TestInjectFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	require.NoError(t, injectFile(root, &proto.InjectedFile{Path: "/run/secrets/token", Content: []byte("secret")}))
+	content, err := ioutil.ReadFile(filepath.Join(root, "run/secrets/token"))
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(content))
+
+	info, err := os.Stat(filepath.Join(root, "run/secrets/token"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Existing files are replaced, with the requested mode
+	require.NoError(t, injectFile(root, &proto.InjectedFile{Path: "/run/secrets/token", Mode: 0644, Content: []byte("new")}))
+	content, err = ioutil.ReadFile(filepath.Join(root, "run/secrets/token"))
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(content))
+
+	info, err = os.Stat(filepath.Join(root, "run/secrets/token"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// Symlinks of the image could lead out of the container
+	outside, err := ioutil.TempDir("", "outside")
+	require.NoError(t, err)
+	defer os.RemoveAll(outside)
+
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "etc")))
+	assert.Error(t, injectFile(root, &proto.InjectedFile{Path: "/etc/ssl/ca.pem", Content: []byte("cert")}))
+
+	require.NoError(t, os.Symlink(filepath.Join(outside, "token"), filepath.Join(root, "token")))
+	assert.Error(t, injectFile(root, &proto.InjectedFile{Path: "/token", Content: []byte("secret")}))
+	assert.Error(t, injectFile(root, &proto.InjectedFile{Path: "/run/../../token", Content: []byte("secret")}))
+
+	entries, err := ioutil.ReadDir(outside)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/log"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// Time given to the response of the halt call to reach the runtime before the guest goes down
+const haltDelay = 100 * time.Millisecond
+
+// Halt shuts the guest down once the response is sent, so the VMM exits after guest filesystems are flushed
+func (s *agentService) Halt(ctx context.Context, req *proto.HaltRequest) (*proto.HaltResponse, error) {
+	log.G(ctx).Info("halt requested")
+
+	logger := log.G(ctx)
+	go func() {
+		time.Sleep(haltDelay)
+		shutdownInit(log.WithLogger(context.Background(), logger))
+	}()
+
+	return &proto.HaltResponse{}, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/sys"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+// Environment variable systemd sets for units of Type=notify
+const notifySocketEnvName = "NOTIFY_SOCKET"
+
+// initMount is a filesystem the agent mounts when it runs as PID 1
+type initMount struct {
+	source string
+	target string
+	fstype string
+	flags  uintptr
+	data   string
+}
+
+// Filesystems an init system normally sets up, needed by the agent and runc
+var initMounts = []initMount{
+	{"proc", "/proc", "proc", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+	{"sysfs", "/sys", "sysfs", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+	{"devtmpfs", "/dev", "devtmpfs", unix.MS_NOSUID, "mode=0755"},
+	{"devpts", "/dev/pts", "devpts", unix.MS_NOSUID | unix.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"},
+	{"shm", "/dev/shm", "tmpfs", unix.MS_NOSUID | unix.MS_NODEV, "mode=1777"},
+	{"tmpfs", "/run", "tmpfs", unix.MS_NOSUID | unix.MS_NODEV, "mode=0755"},
+	{"cgroup_root", cgroupRootPath, "tmpfs", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, "mode=0755"},
+}
+
+// initMode returns how the agent was started in the guest, as configured on the host
+func initMode() string {
+	value, found, err := internal.ReadBootArg(internal.InitModeBootArg)
+	if err != nil || !found {
+		return internal.InitModeMinimal
+	}
+
+	if !internal.IsValidInitMode(value) {
+		log.L.Warnf("ignoring invalid init mode %q", value)
+		return internal.InitModeMinimal
+	}
+
+	return value
+}
+
+// setupInit prepares the agent to launch and monitor containers according to the init mode.
+// isInit tells whether the agent runs as PID 1, in which case guest filesystems are expected to be mounted already.
+func setupInit(ctx context.Context, mode string, isInit bool) error {
+	log.G(ctx).WithField("mode", mode).Infof("agent init mode (pid %d)", os.Getpid())
+
+	if mode == internal.InitModeAgent && !isInit {
+		log.G(ctx).Warnf("init mode %q expects the agent to run as PID 1, check init= kernel argument", mode)
+	}
+
+	if isInit {
+		if mode != internal.InitModeAgent {
+			log.G(ctx).Warnf("agent runs as PID 1 but init mode is %q", mode)
+		}
+
+		// Orphaned processes are reparented to PID 1 anyway
+		return nil
+	}
+
+	// Container processes are reparented once runc exits, the agent has to receive them to track their exit.
+	// Otherwise they would end up with the init system, which reaps them without the agent noticing.
+	if err := sys.SetSubreaper(1); err != nil {
+		return errors.Wrap(err, "failed to become child subreaper")
+	}
+
+	return nil
+}
+
+// mountInitFilesystems mounts the filesystems normally set up by init, including cgroup v1 hierarchies.
+// Filesystems mounted already (for instance devtmpfs mounted by the kernel) are left as they are.
+func mountInitFilesystems(ctx context.Context) error {
+	for _, m := range initMounts {
+		if err := mountOnce(m); err != nil {
+			return err
+		}
+	}
+
+	controllers, err := cgroupControllers(procCgroupsPath)
+	if err != nil {
+		return err
+	}
+
+	for _, controller := range controllers {
+		m := initMount{"cgroup", filepath.Join(cgroupRootPath, controller), "cgroup", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, controller}
+		if err := mountOnce(m); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to mount cgroup controller %q", controller)
+		}
+	}
+
+	return nil
+}
+
+func mountOnce(m initMount) error {
+	if err := os.MkdirAll(m.target, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create mount point %s", m.target)
+	}
+
+	if err := unix.Mount(m.source, m.target, m.fstype, m.flags, m.data); err != nil && err != unix.EBUSY {
+		return errors.Wrapf(err, "failed to mount %s on %s", m.fstype, m.target)
+	}
+
+	return nil
+}
+
+// notifyReady tells systemd the agent is ready to serve, for units of Type=notify.
+// Does nothing in other init modes or if the unit doesn't expect the notification.
+func notifyReady(ctx context.Context, mode string) {
+	socket := os.Getenv(notifySocketEnvName)
+	if mode != internal.InitModeSystemd || socket == "" {
+		return
+	}
+
+	// Abstract socket names are given with @ prefix
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to notify systemd")
+		return
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("READY=1")); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to notify systemd")
+	}
+}
+
+// shutdownInit stops the VM once the agent running as PID 1 is done, as PID 1 exiting makes the kernel panic.
+// It's also used to halt the guest on request of the runtime.
+// Firecracker doesn't emulate power off, the VMM exits when the guest reboots.
+func shutdownInit(ctx context.Context) {
+	log.G(ctx).Info("shutting down the VM")
+	unix.Sync()
+	if err := unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART); err != nil {
+		log.G(ctx).WithError(err).Error("failed to shut down the VM")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+func TestCgroupControllers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroups")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cgroups")
+	data := "#subsys_name\thierarchy\tnum_cgroups\tenabled\ncpuset\t2\t1\t1\nfreezer\t0\t1\t0\nmemory\t3\t1\t1\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+
+	controllers, err := cgroupControllers(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cpuset", "memory"}, controllers)
+}
+
+func TestNotifyReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, os.Setenv(notifySocketEnvName, socket))
+	defer os.Unsetenv(notifySocketEnvName)
+
+	// Only systemd expects the notification
+	notifyReady(context.Background(), internal.InitModeMinimal)
+	notifyReady(context.Background(), internal.InitModeSystemd)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "READY=1", string(buf[:n]))
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = conn.Read(buf)
+	assert.Error(t, err, "only one notification expected")
+}
@@ -19,6 +19,7 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/containerd/containerd/log"
@@ -30,24 +31,47 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
 )
 
-const defaultPort = 10789
+const (
+	// Container ID used when the agent runs as PID 1 and isn't given one
+	defaultInitID = "1"
+)
 
 func main() {
 	var (
-		id    string
-		port  int
-		debug bool
+		id       string
+		port     uint
+		debug    bool
+		logLevel string
 	)
 
 	flag.StringVar(&id, "id", "", "ContainerID (required)")
-	flag.IntVar(&port, "port", defaultPort, "Vsock port to listen to")
+	flag.UintVar(&port, "port", 0, "Vsock port to listen to, overrides the port passed by runtime via kernel args")
 	flag.BoolVar(&debug, "debug", false, "Turn on debug mode")
+	flag.StringVar(&logLevel, "log-level", "", "Log level (panic, fatal, error, warning, info, debug), overrides the level passed by runtime via kernel args")
 	flag.Parse()
 
+	// As PID 1 the agent starts with nothing mounted, not even /proc the settings are read from
+	isInit := os.Getpid() == 1
+	if isInit {
+		if err := mountInitFilesystems(context.Background()); err != nil {
+			logrus.WithError(err).Error("failed to mount guest filesystems")
+		}
+
+		// Kernel doesn't pass arguments to init unless they follow "--" on its command line
+		if id == "" {
+			id = defaultInitID
+		}
+	}
+
 	if debug {
 		logrus.SetLevel(logrus.DebugLevel)
+	} else if err := setLogLevel(logLevel); err != nil {
+		logrus.WithError(err).Warn("failed to set log level")
 	}
 
 	signals := make(chan os.Signal, 32)
@@ -69,12 +93,30 @@ func main() {
 
 	log.G(ctx).WithField("id", id).Info("creating runc shim")
 
-	runcTaskService, err := runc.New(ctx, id, nil)
+	// Exits of processes are reported to the runtime through the agent service
+	exits := newExitNotifier()
+	runcTaskService, err := runc.New(ctx, id, exits)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatal("failed to create runc shim")
 	}
 
-	taskService := NewTaskService(runcTaskService, cancel)
+	mode := initMode()
+	if err := setupInit(ctx, mode, isInit); err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to set up init mode")
+	}
+
+	// Done before the runtime can connect, so containers never start on partially faulted memory
+	if prefaultEnabled() {
+		if err := prefaultMemory(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to prefault guest memory")
+		}
+	}
+
+	cgroupVersion := setupCgroups(ctx, mode != internal.InitModeSystemd)
+	ooms := newOOMWatcher(cgroupVersion)
+	go ooms.run(ctx)
+
+	taskService := NewTaskService(runcTaskService, cancel, stdioBufferSize(), vsockBufferSize(), stdioPorts(), cgroupVersion, exits, ooms)
 
 	server, err := ttrpc.NewServer()
 	if err != nil {
@@ -82,8 +124,12 @@ func main() {
 	}
 
 	shimapi.RegisterTaskService(server, taskService)
+	proto.RegisterAgentService(server, &agentService{cgroupVersion: cgroupVersion, exits: exits, ooms: ooms})
 
 	// Run ttrpc over vsock
+	if port == 0 {
+		port = uint(bootArgPort(internal.VsockPortBootArg, internal.DefaultVsockPort))
+	}
 
 	log.G(ctx).WithField("port", port).Info("listening to vsock")
 	listener, err := vsock.Listen(uint32(port))
@@ -95,6 +141,16 @@ func main() {
 		return server.Serve(ctx, listener)
 	})
 
+	notifyReady(ctx, mode)
+
+	if port := dnsPort(); port != 0 {
+		go func() {
+			if err := serveDNS(ctx, port); err != nil && ctx.Err() == nil {
+				log.G(ctx).WithError(err).Error("DNS proxy failed")
+			}
+		}()
+	}
+
 	group.Go(func() error {
 		defer func() {
 			log.G(ctx).Info("stopping ttrpc server")
@@ -129,4 +185,92 @@ func main() {
 	if _, err := runcTaskService.Shutdown(ctx, &shimapi.ShutdownRequest{ID: id, Now: true}); err != nil {
 		log.G(ctx).WithError(err).Error("runc shutdown error")
 	}
+
+	if isInit {
+		shutdownInit(ctx)
+	}
+}
+
+// setLogLevel applies the given log level. If empty, the level configured on the host
+// and passed via kernel command line is used.
+func setLogLevel(level string) error {
+	if level == "" {
+		value, found, err := internal.ReadBootArg(internal.AgentLogLevelBootArg)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return nil
+		}
+
+		level = value
+	}
+
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	logrus.SetLevel(parsed)
+	return nil
+}
+
+// stdioBufferSize returns the size of buffers used to copy stdio over vsock, as configured on the host
+func stdioBufferSize() int {
+	value, found, err := internal.ReadBootArg(internal.StdioBufferSizeBootArg)
+	if err != nil || !found {
+		return internal.DefaultBufferSize
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size < internal.MinBufferSize || size > internal.MaxBufferSize {
+		logrus.Warnf("ignoring invalid stdio buffer size %q", value)
+		return internal.DefaultBufferSize
+	}
+
+	return size
+}
+
+// vsockBufferSize returns the socket buffer size of stdio vsock connections as configured on the host,
+// 0 keeps the kernel default
+func vsockBufferSize() int {
+	value, found, err := internal.ReadBootArg(internal.VsockBufferSizeBootArg)
+	if err != nil || !found {
+		return 0
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size < internal.MinVsockBufferSize || size > internal.MaxVsockBufferSize {
+		logrus.Warnf("ignoring invalid vsock buffer size %q", value)
+		return 0
+	}
+
+	return size
+}
+
+// stdioPorts returns the stdio ports passed by the runtime: consecutive ports from a base, each of which can be
+// set on its own
+func stdioPorts() internal.StdioPorts {
+	ports := internal.StdioPortsFromBase(bootArgPort(internal.StdioPortBaseBootArg, internal.DefaultStdioPortBase))
+	ports.Stdin = bootArgPort(internal.StdinPortBootArg, ports.Stdin)
+	ports.Stdout = bootArgPort(internal.StdoutPortBootArg, ports.Stdout)
+	ports.Stderr = bootArgPort(internal.StderrPortBootArg, ports.Stderr)
+	return ports
+}
+
+// bootArgPort reads a vsock port passed by the runtime via the given kernel arg
+func bootArgPort(key string, defaultPort uint32) uint32 {
+	value, found, err := internal.ReadBootArg(key)
+	if err != nil || !found {
+		return defaultPort
+	}
+
+	port, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || port == 0 {
+		logrus.Warnf("ignoring invalid vsock port %s=%q", key, value)
+		return defaultPort
+	}
+
+	return uint32(port)
 }
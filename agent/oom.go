@@ -0,0 +1,342 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+const (
+	// How often memory cgroups of containers are checked for OOM kills
+	oomPollInterval = time.Second
+	// How long WaitOOM blocks at most, the runtime calls it again afterwards
+	oomWaitTimeout = 30 * time.Second
+	// How many events are kept for the runtime, older events are dropped
+	maxOOMEvents = 64
+)
+
+// oomCounters are OOM related counters of a memory cgroup
+type oomCounters struct {
+	// Processes of the cgroup killed by the OOM killer, for whatever reason
+	kills uint64
+	// How many times the cgroup reached its memory limit
+	limitHits uint64
+}
+
+// oomWatcher watches memory cgroups of containers and the guest kernel for OOM kills, and keeps them as
+// events for the runtime to publish.
+// Kills are counted by the kernel, both in memory cgroups (even when the guest as a whole is out of memory)
+// and globally (in /proc/vmstat), so they are found by polling the counters.
+type oomWatcher struct {
+	cgroupVersion uint32
+	cgroupRoot    string
+	procRoot      string
+
+	mu sync.Mutex
+	// Memory cgroup directories and last seen counters of containers, by container ID
+	containers map[string]*oomCgroup
+	// Last seen number of OOM kills in the guest
+	guestKills uint64
+	events     []*proto.OOMEvent
+	seq        uint64
+	// Closed and replaced on every new event
+	changed chan struct{}
+}
+
+type oomCgroup struct {
+	dir      string
+	counters oomCounters
+}
+
+func newOOMWatcher(cgroupVersion uint32) *oomWatcher {
+	return &oomWatcher{
+		cgroupVersion: cgroupVersion,
+		cgroupRoot:    cgroupRootPath,
+		procRoot:      "/proc",
+		containers:    make(map[string]*oomCgroup),
+		changed:       make(chan struct{}),
+	}
+}
+
+// add starts watching the memory cgroup of the container with the given init process
+func (w *oomWatcher) add(id string, pid uint32) error {
+	data, err := ioutil.ReadFile(filepath.Join(w.procRoot, strconv.FormatUint(uint64(pid), 10), "cgroup"))
+	if err != nil {
+		return err
+	}
+
+	path, err := memoryCgroupPath(data, w.cgroupVersion)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(w.cgroupRoot, path)
+	if w.cgroupVersion != cgroupV2 {
+		dir = filepath.Join(w.cgroupRoot, "memory", path)
+	}
+
+	counters, err := readOOMCounters(dir, w.cgroupVersion)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.containers[id] = &oomCgroup{dir: dir, counters: counters}
+	return nil
+}
+
+// remove stops watching a deleted container
+func (w *oomWatcher) remove(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.containers, id)
+}
+
+// run checks for OOM kills until ctx is canceled
+func (w *oomWatcher) run(ctx context.Context) {
+	if kills, err := w.readGuestKills(); err == nil {
+		w.mu.Lock()
+		w.guestKills = kills
+		w.mu.Unlock()
+	} else {
+		log.G(ctx).WithError(err).Warn("failed to read guest OOM kills, only container OOMs are reported")
+	}
+
+	ticker := time.NewTicker(oomPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.poll(ctx)
+		}
+	}
+}
+
+// poll records an event for each container with processes killed since the last poll, and one for kills
+// outside of containers
+func (w *oomWatcher) poll(ctx context.Context) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var containerKills uint64
+	for id, cgroup := range w.containers {
+		counters, err := readOOMCounters(cgroup.dir, w.cgroupVersion)
+		if err != nil {
+			// Likely removed along with an exited container
+			log.G(ctx).WithError(err).WithField("id", id).Debug("failed to read OOM counters")
+			continue
+		}
+
+		if counters.kills > cgroup.counters.kills {
+			containerKills += counters.kills - cgroup.counters.kills
+			// Not reaching the limit means the guest as a whole is out of memory
+			w.record(ctx, id, counters.limitHits == cgroup.counters.limitHits)
+		}
+
+		cgroup.counters = counters
+	}
+
+	kills, err := w.readGuestKills()
+	if err != nil {
+		return
+	}
+
+	// Kills in containers are counted by the guest too
+	if kills > w.guestKills && kills-w.guestKills > containerKills {
+		w.record(ctx, "", true)
+	}
+
+	w.guestKills = kills
+}
+
+// record adds an event, must be called with the lock held
+func (w *oomWatcher) record(ctx context.Context, id string, guest bool) {
+	w.seq++
+	w.events = append(w.events, &proto.OOMEvent{Seq: w.seq, ContainerID: id, Guest: guest})
+	if len(w.events) > maxOOMEvents {
+		w.events = w.events[len(w.events)-maxOOMEvents:]
+	}
+
+	close(w.changed)
+	w.changed = make(chan struct{})
+
+	log.G(ctx).WithFields(logrus.Fields{"id": id, "guest": guest}).Warn("processes killed due to lack of memory")
+}
+
+// wait returns events following the given sequence number, blocks until there are some or the timeout passes
+func (w *oomWatcher) wait(ctx context.Context, after uint64, timeout time.Duration) ([]*proto.OOMEvent, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		w.mu.Lock()
+		// The runtime knows sequence numbers of a previous agent instance, all events are new to it
+		if after > w.seq {
+			after = 0
+		}
+
+		var events []*proto.OOMEvent
+		for _, event := range w.events {
+			if event.Seq > after {
+				events = append(events, event)
+			}
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		if len(events) > 0 {
+			return events, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (w *oomWatcher) readGuestKills() (uint64, error) {
+	values, err := readKeyedValues(filepath.Join(w.procRoot, "vmstat"))
+	if err != nil {
+		return 0, err
+	}
+
+	kills, ok := values["oom_kill"]
+	if !ok {
+		return 0, errors.New("guest kernel doesn't count OOM kills")
+	}
+
+	return kills, nil
+}
+
+// memoryCgroupPath finds the memory cgroup of a process in its /proc/<pid>/cgroup file
+func memoryCgroupPath(data []byte, cgroupVersion uint32) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		if cgroupVersion == cgroupV2 {
+			if fields[0] == "0" && fields[1] == "" {
+				return fields[2], nil
+			}
+			continue
+		}
+
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "memory" {
+				return fields[2], nil
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", errors.New("process is not in a memory cgroup")
+}
+
+// readOOMCounters reads OOM counters of a memory cgroup. On cgroup v1, limit hits are counted by
+// memory.failcnt, which grows whenever usage reaches the limit, OOM or not.
+func readOOMCounters(dir string, cgroupVersion uint32) (oomCounters, error) {
+	if cgroupVersion == cgroupV2 {
+		events, err := readKeyedValues(filepath.Join(dir, "memory.events"))
+		if err != nil {
+			return oomCounters{}, err
+		}
+
+		return oomCounters{kills: events["oom_kill"], limitHits: events["oom"]}, nil
+	}
+
+	control, err := readKeyedValues(filepath.Join(dir, "memory.oom_control"))
+	if err != nil {
+		return oomCounters{}, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "memory.failcnt"))
+	if err != nil {
+		return oomCounters{}, err
+	}
+
+	failures, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return oomCounters{}, errors.Wrap(err, "invalid memory.failcnt")
+	}
+
+	return oomCounters{kills: control["oom_kill"], limitHits: failures}, nil
+}
+
+// readKeyedValues reads a file of "key value" lines, like memory.events or /proc/vmstat
+func readKeyedValues(path string) (map[string]uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value of %q in %s", fields[0], path)
+		}
+
+		values[fields[0]] = value
+	}
+
+	return values, nil
+}
+
+// WaitOOM reports OOM kills in the guest as they are found
+func (s *agentService) WaitOOM(ctx context.Context, req *proto.WaitOOMRequest) (*proto.WaitOOMResponse, error) {
+	log.G(ctx).WithField("after", req.After).Debug("wait oom")
+
+	events, err := s.ooms.wait(ctx, req.After, oomWaitTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.WaitOOMResponse{Events: events}, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCgroupPath(t *testing.T) {
+	v1 := "12:pids:/default/app\n4:cpu,cpuacct:/default/app\n3:memory:/default/app\n0::/\n"
+	path, err := memoryCgroupPath([]byte(v1), cgroupV1)
+	require.NoError(t, err)
+	assert.Equal(t, "/default/app", path)
+
+	path, err = memoryCgroupPath([]byte("0::/default/app\n"), cgroupV2)
+	require.NoError(t, err)
+	assert.Equal(t, "/default/app", path)
+
+	_, err = memoryCgroupPath([]byte("4:cpu,cpuacct:/default/app\n"), cgroupV1)
+	assert.Error(t, err)
+}
+
+func writeFile(t *testing.T, path, data string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+}
+
+func TestOOMWatcher(t *testing.T) {
+	root, err := ioutil.TempDir("", "oom")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	w := newOOMWatcher(cgroupV2)
+	w.cgroupRoot = filepath.Join(root, "cgroup")
+	w.procRoot = filepath.Join(root, "proc")
+
+	events := filepath.Join(w.cgroupRoot, "default/app/memory.events")
+	vmstat := filepath.Join(w.procRoot, "vmstat")
+	writeFile(t, filepath.Join(w.procRoot, "42/cgroup"), "0::/default/app\n")
+	writeFile(t, events, "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n")
+	writeFile(t, vmstat, "nr_free_pages 1024\noom_kill 5\n")
+
+	require.NoError(t, w.add("app", 42))
+	w.guestKills, err = w.readGuestKills()
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	w.poll(ctx)
+	found, err := w.wait(ctx, 0, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Empty(t, found, "nothing was killed yet")
+
+	// The container reached its limit
+	writeFile(t, events, "low 0\nhigh 0\nmax 5\noom 2\noom_kill 2\n")
+	writeFile(t, vmstat, "nr_free_pages 1024\noom_kill 6\n")
+	w.poll(ctx)
+
+	// The guest ran out of memory, killing processes of the container and another process
+	writeFile(t, events, "low 0\nhigh 0\nmax 5\noom 2\noom_kill 3\n")
+	writeFile(t, vmstat, "nr_free_pages 1024\noom_kill 8\n")
+	w.poll(ctx)
+
+	found, err = w.wait(ctx, 0, time.Second)
+	require.NoError(t, err)
+	require.Len(t, found, 3)
+	assert.Equal(t, "app", found[0].ContainerID)
+	assert.False(t, found[0].Guest)
+	assert.Equal(t, "app", found[1].ContainerID)
+	assert.True(t, found[1].Guest)
+	assert.Equal(t, "", found[2].ContainerID)
+	assert.True(t, found[2].Guest)
+
+	found, err = w.wait(ctx, 2, time.Second)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.EqualValues(t, 3, found[0].Seq)
+
+	// Sequence numbers of a previous agent are unknown
+	found, err = w.wait(ctx, 10, time.Second)
+	require.NoError(t, err)
+	assert.Len(t, found, 3)
+
+	w.remove("app")
+	assert.Empty(t, w.containers)
+}
+
+func TestReadOOMCountersV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oom")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "memory.oom_control"), "oom_kill_disable 0\nunder_oom 0\noom_kill 2\n")
+	writeFile(t, filepath.Join(dir, "memory.failcnt"), "7\n")
+
+	counters, err := readOOMCounters(dir, cgroupV1)
+	require.NoError(t, err)
+	assert.Equal(t, oomCounters{kills: 2, limitHits: 7}, counters)
+}
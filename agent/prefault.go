@@ -0,0 +1,112 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+const (
+	procMeminfoPath = "/proc/meminfo"
+
+	// Memory left untouched, so the guest kernel and the agent don't run out of memory while prefaulting
+	prefaultReserve = 32 * 1024 * 1024
+)
+
+// prefaultEnabled returns whether the host asked to prefault guest memory at boot
+func prefaultEnabled() bool {
+	value, found, err := internal.ReadBootArg(internal.PrefaultMemoryBootArg)
+	if err != nil || !found {
+		return false
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.L.Warnf("ignoring invalid memory prefault setting %q", value)
+		return false
+	}
+
+	return enabled
+}
+
+// prefaultMemory touches all available guest memory once. Firecracker allocates guest memory on the host
+// on first access, touching it at boot makes the host back all of it, so workloads don't stall on faults later.
+// Freed pages stay backed by the host, as the guest has no way to return them.
+func prefaultMemory(ctx context.Context) error {
+	available, err := memAvailable(procMeminfoPath)
+	if err != nil {
+		return err
+	}
+
+	size := available - prefaultReserve
+	if size <= 0 {
+		return nil
+	}
+
+	start := time.Now()
+
+	// MAP_POPULATE makes the kernel fault the whole writable mapping in at once
+	mem, err := unix.Mmap(-1, 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+	if err != nil {
+		return errors.Wrapf(err, "failed to allocate %d bytes", size)
+	}
+
+	if err := unix.Munmap(mem); err != nil {
+		return err
+	}
+
+	log.G(ctx).Infof("prefaulted %d MiB of guest memory in %s", size/1024/1024, time.Since(start))
+	return nil
+}
+
+// memAvailable returns MemAvailable from the given meminfo file in bytes
+func memAvailable(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	// Format is "MemAvailable:    123456 kB"
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemAvailable:" && fields[2] == "kB" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+
+			return kb * 1024, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, errors.Errorf("MemAvailable not found in %s", path)
+}
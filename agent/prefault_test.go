@@ -0,0 +1,90 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestMemAvailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meminfo")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "meminfo")
+	meminfo := "MemTotal:         250000 kB\nMemFree:          200000 kB\nMemAvailable:     210000 kB\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(meminfo), 0600))
+
+	available, err := memAvailable(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(210000*1024), available)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("MemTotal: 250000 kB\n"), 0600))
+	_, err = memAvailable(path)
+	assert.Error(t, err)
+}
+
+const benchmarkMemorySize = 64 * 1024 * 1024
+
+func touchPages(mem []byte) {
+	pageSize := os.Getpagesize()
+	for i := 0; i < len(mem); i += pageSize {
+		mem[i] = 1
+	}
+}
+
+// BenchmarkMemoryAccess compares the first access to memory (page faults on every page) with access to prefaulted memory.
+// In a VM the first access faults both in the guest and on the host, so the gap is larger than measured here.
+func BenchmarkMemoryAccess(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		flags int
+	}{
+		{"first_touch", unix.MAP_PRIVATE | unix.MAP_ANONYMOUS},
+		{"prefaulted", unix.MAP_PRIVATE | unix.MAP_ANONYMOUS | unix.MAP_POPULATE},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(benchmarkMemorySize)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				mem, err := unix.Mmap(-1, 0, benchmarkMemorySize, unix.PROT_READ|unix.PROT_WRITE, bench.flags)
+				require.NoError(b, err)
+				b.StartTimer()
+
+				touchPages(mem)
+
+				b.StopTimer()
+				require.NoError(b, unix.Munmap(mem))
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// BenchmarkPrefault measures the boot time cost of prefaulting memory
+func BenchmarkPrefault(b *testing.B) {
+	b.SetBytes(benchmarkMemorySize)
+	for i := 0; i < b.N; i++ {
+		mem, err := unix.Mmap(-1, 0, benchmarkMemorySize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+		require.NoError(b, err)
+		require.NoError(b, unix.Munmap(mem))
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/containerd/containerd/log"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+var ioprioClasses = map[string]int{
+	"IOPRIO_CLASS_RT":   1,
+	"IOPRIO_CLASS_BE":   2,
+	"IOPRIO_CLASS_IDLE": 3,
+}
+
+// processPriority holds process priority settings defined by newer revisions of the OCI spec
+// (process.scheduler and process.ioPriority). runc in the guest doesn't know about them, so the agent
+// applies them itself to the container process after it's created and before it runs the workload.
+type processPriority struct {
+	Scheduler  *processScheduler  `json:"scheduler,omitempty"`
+	IOPriority *processIOPriority `json:"ioPriority,omitempty"`
+}
+
+type processScheduler struct {
+	Policy string `json:"policy"`
+	Nice   int    `json:"nice"`
+}
+
+type processIOPriority struct {
+	Class    string `json:"class"`
+	Priority int    `json:"priority"`
+}
+
+// readProcessPriority reads priority settings of the container process, nil is returned if none are set
+func readProcessPriority(specPath string) (*processPriority, error) {
+	data, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec struct {
+		Process *processPriority `json:"process"`
+	}
+
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+
+	priority := spec.Process
+	if priority == nil || (priority.Scheduler == nil && priority.IOPriority == nil) {
+		return nil, nil
+	}
+
+	return priority, priority.validate()
+}
+
+func (p *processPriority) validate() error {
+	var result *multierror.Error
+
+	if p.Scheduler != nil {
+		if policy := p.Scheduler.Policy; policy != "" && policy != "SCHED_OTHER" {
+			result = multierror.Append(result, errors.Errorf("scheduler policy %q is not supported, only nice can be set", policy))
+		}
+
+		if p.Scheduler.Nice < -20 || p.Scheduler.Nice > 19 {
+			result = multierror.Append(result, errors.Errorf("nice value %d is out of range [-20, 19]", p.Scheduler.Nice))
+		}
+	}
+
+	if p.IOPriority != nil {
+		if _, ok := ioprioClasses[p.IOPriority.Class]; !ok {
+			result = multierror.Append(result, errors.Errorf("invalid I/O priority class %q", p.IOPriority.Class))
+		}
+
+		if p.IOPriority.Priority < 0 || p.IOPriority.Priority > 7 {
+			result = multierror.Append(result, errors.Errorf("I/O priority %d is out of range [0, 7]", p.IOPriority.Priority))
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// ioprio returns the value expected by ioprio_set syscall
+func (p *processPriority) ioprio() int {
+	return ioprioClasses[p.IOPriority.Class]<<ioprioClassShift | p.IOPriority.Priority
+}
+
+// apply sets the priority of the given process, children of the process inherit it
+func (p *processPriority) apply(ctx context.Context, pid int) error {
+	if p.Scheduler != nil {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, pid, p.Scheduler.Nice); err != nil {
+			return errors.Wrapf(err, "failed to set nice %d", p.Scheduler.Nice)
+		}
+
+		log.G(ctx).Debugf("set nice of process %d to %d", pid, p.Scheduler.Nice)
+	}
+
+	if p.IOPriority != nil {
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(p.ioprio())); errno != 0 {
+			return errors.Wrapf(errno, "failed to set I/O priority %s/%d", p.IOPriority.Class, p.IOPriority.Priority)
+		}
+
+		log.G(ctx).Debugf("set I/O priority of process %d to %s/%d", pid, p.IOPriority.Class, p.IOPriority.Priority)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func writeSpec(t *testing.T, dir, spec string) string {
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(spec), 0600))
+	return path
+}
+
+func TestReadProcessPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priority")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	priority, err := readProcessPriority(writeSpec(t, dir, `{"process": {"args": ["sh"]}}`))
+	require.NoError(t, err)
+	assert.Nil(t, priority)
+
+	priority, err = readProcessPriority(writeSpec(t, dir, `{"process": {
+		"scheduler": {"nice": 5},
+		"ioPriority": {"class": "IOPRIO_CLASS_BE", "priority": 7}
+	}}`))
+
+	require.NoError(t, err)
+	assert.Equal(t, 5, priority.Scheduler.Nice)
+	assert.Equal(t, 2<<13|7, priority.ioprio())
+
+	for _, spec := range []string{
+		`{"process": {"scheduler": {"nice": 20}}}`,
+		`{"process": {"scheduler": {"policy": "SCHED_FIFO", "priority": 10}}}`,
+		`{"process": {"ioPriority": {"class": "IOPRIO_CLASS_NONE"}}}`,
+		`{"process": {"ioPriority": {"class": "IOPRIO_CLASS_BE", "priority": 8}}}`,
+	} {
+		_, err := readProcessPriority(writeSpec(t, dir, spec))
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestApplyProcessPriority(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	pid := cmd.Process.Pid
+	priority := &processPriority{
+		Scheduler:  &processScheduler{Nice: 10},
+		IOPriority: &processIOPriority{Class: "IOPRIO_CLASS_IDLE"},
+	}
+
+	require.NoError(t, priority.apply(context.Background(), pid))
+
+	// getpriority syscall returns 20 - nice
+	value, err := unix.Getpriority(unix.PRIO_PROCESS, pid)
+	require.NoError(t, err)
+	assert.Equal(t, 10, 20-value)
+
+	ioprio, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(pid), 0)
+	require.Zero(t, errno)
+	assert.Equal(t, uintptr(priority.ioprio()), ioprio)
+}
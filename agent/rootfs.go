@@ -0,0 +1,93 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// rootfsPath reads the container root path from the OCI spec, relative paths are relative to the bundle
+func rootfsPath(specPath, bundle string) (string, error) {
+	data, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return "", err
+	}
+
+	var spec struct {
+		Root *struct {
+			Path string `json:"path"`
+		} `json:"root"`
+	}
+
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return "", err
+	}
+
+	if spec.Root == nil || spec.Root.Path == "" {
+		return "", errors.New("spec doesn't have root path")
+	}
+
+	if filepath.IsAbs(spec.Root.Path) {
+		return spec.Root.Path, nil
+	}
+
+	return filepath.Join(bundle, spec.Root.Path), nil
+}
+
+func isReadOnlyMount(path string) (bool, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return false, err
+	}
+
+	return stat.Flags&unix.ST_RDONLY != 0, nil
+}
+
+// ensureReadOnlyRootfs makes sure the container rootfs is mounted read-only. The rootfs is mounted by the guest
+// image before the agent starts, a read-write mount (possible if the image ignores the drive being read-only,
+// for instance for a filesystem without journal) is remounted read-only. It's never remounted read-write.
+func ensureReadOnlyRootfs(ctx context.Context, path string) error {
+	readOnly, err := isReadOnlyMount(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check rootfs mount %s", path)
+	}
+
+	if readOnly {
+		return nil
+	}
+
+	log.G(ctx).WithField("path", path).Warn("rootfs is mounted read-write, remounting read-only")
+	if err := unix.Mount("", path, "", unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		return errors.Wrapf(err, "failed to remount rootfs %s read-only", path)
+	}
+
+	return nil
+}
+
+// readOnlyRootfs keeps the rootfs of the container described by the spec read-only
+func readOnlyRootfs(ctx context.Context, specPath string) error {
+	path, err := rootfsPath(specPath, bundleMountPath)
+	if err != nil {
+		return err
+	}
+
+	return ensureReadOnlyRootfs(ctx, path)
+}
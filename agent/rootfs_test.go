@@ -0,0 +1,59 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootfsPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	specPath := filepath.Join(dir, "config.json")
+
+	require.NoError(t, ioutil.WriteFile(specPath, []byte(`{"root": {"path": "rootfs", "readonly": true}}`), 0600))
+	path, err := rootfsPath(specPath, "/container")
+	require.NoError(t, err)
+	assert.Equal(t, "/container/rootfs", path)
+
+	require.NoError(t, ioutil.WriteFile(specPath, []byte(`{"root": {"path": "/rootfs"}}`), 0600))
+	path, err = rootfsPath(specPath, "/container")
+	require.NoError(t, err)
+	assert.Equal(t, "/rootfs", path)
+
+	require.NoError(t, ioutil.WriteFile(specPath, []byte(`{"process": {}}`), 0600))
+	_, err = rootfsPath(specPath, "/container")
+	assert.Error(t, err)
+}
+
+func TestIsReadOnlyMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rootfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	readOnly, err := isReadOnlyMount(dir)
+	require.NoError(t, err)
+	assert.False(t, readOnly)
+
+	_, err = isReadOnlyMount(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
@@ -23,13 +23,14 @@ import (
 	"syscall"
 
 	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/runtime/v2/shim"
 	shimapi "github.com/containerd/containerd/runtime/v2/task"
 	"github.com/containerd/fifo"
 	"github.com/gogo/protobuf/types"
-	"github.com/mdlayher/vsock"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/firecracker-microvm/firecracker-containerd/internal"
@@ -38,7 +39,7 @@ import (
 
 const (
 	defaultNamespace = "default"
-	bundleMountPath  = "/container"
+	bundleMountPath  = internal.GuestBundlePath
 	defaultStdioPath = "/container/fifo"
 )
 
@@ -47,15 +48,27 @@ const (
 // - Add debug logging to simplify debugging
 // - Make place for future extensions as needed
 type TaskService struct {
-	runc    shim.Shim
-	cancels []context.CancelFunc
-	io      *cio.FIFOSet
+	runc            shim.Shim
+	cancels         []context.CancelFunc
+	io              *cio.FIFOSet
+	stdioBufferSize int
+	vsockBufferSize int
+	stdioPorts      internal.StdioPorts
+	cgroupVersion   uint32
+	exits           *exitNotifier
+	ooms            *oomWatcher
 }
 
-func NewTaskService(runc shim.Shim, cancel context.CancelFunc) shimapi.TaskService {
+func NewTaskService(runc shim.Shim, cancel context.CancelFunc, stdioBufferSize, vsockBufferSize int, stdioPorts internal.StdioPorts, cgroupVersion uint32, exits *exitNotifier, ooms *oomWatcher) shimapi.TaskService {
 	return &TaskService{
-		runc:    runc,
-		cancels: []context.CancelFunc{cancel},
+		runc:            runc,
+		cancels:         []context.CancelFunc{cancel},
+		stdioBufferSize: stdioBufferSize,
+		vsockBufferSize: vsockBufferSize,
+		stdioPorts:      stdioPorts,
+		cgroupVersion:   cgroupVersion,
+		exits:           exits,
+		ooms:            ooms,
 	}
 }
 
@@ -63,11 +76,34 @@ func (ts *TaskService) Create(ctx context.Context, req *shimapi.CreateTaskReques
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "bundle": req.Bundle}).Info("create")
 
 	// Passthrough runcOptions
-	opts, err := unpackBundle(filepath.Join(bundleMountPath, "config.json"), req.Options)
+	specPath := filepath.Join(bundleMountPath, "config.json")
+	extraData, err := unpackBundle(specPath, req.Options)
 	if err != nil {
 		return nil, err
 	}
-	req.Options = opts
+	req.Options = extraData.RuncOptions
+	checkResources(ctx, specPath, ts.cgroupVersion)
+
+	priority, err := readProcessPriority(specPath)
+	if err != nil {
+		err = errors.Wrap(errdefs.ErrInvalidArgument, err.Error())
+		log.G(ctx).WithError(err).Error("invalid process priority")
+		return nil, errdefs.ToGRPC(err)
+	}
+	if extraData.ReadOnlyRootfs {
+		if err := readOnlyRootfs(ctx, specPath); err != nil {
+			log.G(ctx).WithError(err).Error("failed to keep rootfs read-only")
+			return nil, err
+		}
+	}
+
+	if len(extraData.Files) > 0 {
+		if err := injectFiles(ctx, specPath, extraData.Files); err != nil {
+			log.G(ctx).WithError(err).Error("failed to inject files")
+			return nil, err
+		}
+	}
+
 	// Use mount path instead of bundle path inside the VM
 	req.Bundle = bundleMountPath
 
@@ -84,7 +120,7 @@ func (ts *TaskService) Create(ctx context.Context, req *shimapi.CreateTaskReques
 	req.Stdout = ts.io.Stdout
 	ioctx, cancel := context.WithCancel(ctx)
 	ts.cancels = append(ts.cancels, cancel)
-	ts.proxyStdio(ioctx, req.Stdin, req.Stdout, req.Stderr)
+	ts.proxyStdio(ioctx, req.Stdin, req.Stdout, req.Stderr, req.Terminal)
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
 	// before create call ensure we remove any existing .init.pid file
 	// We can ignore errors since it's valid for the file to not be present
@@ -97,63 +133,103 @@ func (ts *TaskService) Create(ctx context.Context, req *shimapi.CreateTaskReques
 		return nil, err
 	}
 
+	// The process is blocked until start, so the workload runs with the requested priority from the beginning
+	if priority != nil {
+		if err := priority.apply(ctx, int(resp.Pid)); err != nil {
+			log.G(ctx).WithError(err).Error("failed to apply process priority")
+			if _, delErr := ts.runc.Delete(ctx, &shimapi.DeleteRequest{ID: req.ID}); delErr != nil {
+				log.G(ctx).WithError(delErr).Error("failed to delete container")
+			}
+
+			return nil, err
+		}
+	}
+
+	if err := ts.ooms.add(req.ID, resp.Pid); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to watch container for OOM kills")
+	}
+
 	log.G(ctx).WithField("pid", resp.Pid).Debugf("create succeeded")
 	return resp, nil
 }
 
-func (ts *TaskService) proxyStdio(ctx context.Context, stdin, stdout, stderr string) {
-	go proxyIO(ctx, stdin, internal.StdinPort, true)
-	go proxyIO(ctx, stdout, internal.StdoutPort, false)
-	go proxyIO(ctx, stderr, internal.StderrPort, false)
+func (ts *TaskService) proxyStdio(ctx context.Context, stdin, stdout, stderr string, terminal bool) {
+	for _, stream := range internal.StdioStreams(ts.stdioPorts, stdin, stdout, stderr, terminal) {
+		stream.VsockBufferSize = ts.vsockBufferSize
+		go proxyIO(ctx, stream, ts.stdioBufferSize)
+	}
 }
 
-func proxyIO(ctx context.Context, path string, port uint32, in bool) {
-	if path == "" {
-		return
-	}
-	log.G(ctx).Debug("setting up IO for " + path)
-	f, err := fifo.OpenFifo(ctx, path, syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CREAT, 0700)
+func proxyIO(ctx context.Context, stream internal.StdioStream, bufferSize int) {
+	log.G(ctx).Debug("setting up IO for " + stream.Path)
+	f, err := fifo.OpenFifo(ctx, stream.Path, syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CREAT, 0700)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("error opening fifo")
 		return
 	}
-	listener, err := vsock.Listen(port)
+	listener, err := internal.ListenVsock(stream.Port, stream.VsockBufferSize)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("unable to listen on vsock")
 		f.Close()
 		return
 	}
 
-	var conn net.Conn
-	for {
-		// accept is non-blocking so try to accept until we get
-		// a connection
-		// TODO: investigate if there is a way to distinguish
-		// transient errors from permanent ones.
-		conn, err = listener.Accept()
-		if err != nil {
-			continue
-		}
-		break
+	defer listener.Close()
+
+	conn, err := acceptStdio(ctx, listener)
+	if err != nil {
+		f.Close()
+		return
 	}
+
+	// The runtime reconnects once the connection drops
+	stdioConn := internal.NewStdioConn(conn, func() (io.ReadWriteCloser, error) {
+		conn, err := acceptStdio(ctx, listener)
+		if err == nil {
+			log.G(ctx).WithField("port", stream.Port).Info("stdio reconnected")
+		}
+		return conn, err
+	})
 	go func() {
 		<-ctx.Done()
-		conn.Close()
+		stdioConn.Close()
 		f.Close()
+		listener.Close()
 	}()
 	log.G(ctx).Debug("begin copying io")
-	buf := make([]byte, internal.DefaultBufferSize)
-	if in {
-		_, err = io.CopyBuffer(f, conn, buf)
+	buf := make([]byte, bufferSize)
+	if stream.Stdin {
+		err = stdioConn.CopyFrom(f, buf, true)
+		// Runtime closes the connection on stdin EOF. Once this end of the FIFO is closed too,
+		// the process gets EOF as soon as runc closes its end on CloseIO.
+		f.Close()
 	} else {
-		_, err = io.CopyBuffer(conn, f, buf)
+		err = stdioConn.CopyTo(f, buf)
 	}
 	if err != nil {
 		log.G(ctx).WithError(err).Error("error with stdio")
 	}
 }
 
-func unpackBundle(path string, bundle *types.Any) (*types.Any, error) {
+// acceptStdio waits for the runtime to connect to a stdio stream until ctx is canceled
+func acceptStdio(ctx context.Context, listener net.Listener) (net.Conn, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// accept is non-blocking so try to accept until we get
+		// a connection
+		// TODO: investigate if there is a way to distinguish
+		// transient errors from permanent ones.
+		conn, err := listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+	}
+}
+
+func unpackBundle(path string, bundle *types.Any) (*proto.ExtraData, error) {
 	// get json bytes from task request
 	extraData := &proto.ExtraData{}
 	err := types.UnmarshalAny(bundle, extraData)
@@ -165,7 +241,7 @@ func unpackBundle(path string, bundle *types.Any) (*types.Any, error) {
 	if err != nil {
 		return nil, err
 	}
-	return extraData.RuncOptions, nil
+	return extraData, nil
 }
 
 func (ts *TaskService) State(ctx context.Context, req *shimapi.StateRequest) (*shimapi.StateResponse, error) {
@@ -211,6 +287,11 @@ func (ts *TaskService) Delete(ctx context.Context, req *shimapi.DeleteRequest) (
 		return nil, err
 	}
 
+	ts.exits.forget(processID(req.ID, req.ExecID))
+	if req.ExecID == "" {
+		ts.ooms.remove(req.ID)
+	}
+
 	log.G(ctx).WithFields(logrus.Fields{
 		"pid":         resp.Pid,
 		"exit_status": resp.ExitStatus,
@@ -235,6 +316,12 @@ func (ts *TaskService) Pids(ctx context.Context, req *shimapi.PidsRequest) (*shi
 func (ts *TaskService) Pause(ctx context.Context, req *shimapi.PauseRequest) (*types.Empty, error) {
 	log.G(ctx).WithField("id", req.ID).Debug("pause")
 
+	if !pauseSupported() {
+		err := errors.Wrap(errdefs.ErrNotImplemented, "pause requires freezer cgroup which is not available in guest")
+		log.G(ctx).WithError(err).Error("pause failed")
+		return nil, errdefs.ToGRPC(err)
+	}
+
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
 	resp, err := ts.runc.Pause(ctx, req)
 	if err != nil {
@@ -362,7 +449,17 @@ func (ts *TaskService) Stats(ctx context.Context, req *shimapi.StatsRequest) (*s
 	log.G(ctx).WithField("id", req.ID).Debug("stats")
 
 	ctx = namespaces.WithNamespace(ctx, defaultNamespace)
-	resp, err := ts.runc.Stats(ctx, req)
+	var (
+		resp *shimapi.StatsResponse
+		err  error
+	)
+	// runc shim only knows cgroup v1
+	if ts.cgroupVersion == cgroupV2 {
+		resp, err = ts.cgroupV2Stats(ctx, req.ID)
+	} else {
+		resp, err = ts.runc.Stats(ctx, req)
+	}
+
 	if err != nil {
 		log.G(ctx).WithError(err).Error("stats failed")
 		return nil, err
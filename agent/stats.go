@@ -0,0 +1,240 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/cgroups"
+	shimapi "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/containerd/typeurl"
+	"github.com/pkg/errors"
+)
+
+// cgroupV2Stats reports cgroup stats of the container with the given ID
+func (ts *TaskService) cgroupV2Stats(ctx context.Context, id string) (*shimapi.StatsResponse, error) {
+	state, err := ts.runc.State(ctx, &shimapi.StateRequest{ID: id})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.FormatUint(uint64(state.Pid), 10), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := memoryCgroupPath(data, cgroupV2)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := readCgroupV2Metrics(filepath.Join(cgroupRootPath, path))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read cgroup stats")
+	}
+
+	stats, err := typeurl.MarshalAny(metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shimapi.StatsResponse{Stats: stats}, nil
+}
+
+// readCgroupV2Metrics reads stats of a cgroup v2 directory in the format of cgroup v1 metrics reported by runc
+// shims, which don't support cgroup v2 (containerd's tools only understand the v1 format). Counters of
+// controllers which are not enabled for the cgroup are left out.
+func readCgroupV2Metrics(dir string) (*cgroups.Metrics, error) {
+	metrics := &cgroups.Metrics{}
+
+	if cpu, err := readKeyedValues(filepath.Join(dir, "cpu.stat")); err == nil {
+		// cgroup v2 counts CPU time in microseconds
+		metrics.CPU = &cgroups.CPUStat{
+			Usage: &cgroups.CPUUsage{
+				Total:  cpu["usage_usec"] * 1000,
+				User:   cpu["user_usec"] * 1000,
+				Kernel: cpu["system_usec"] * 1000,
+			},
+			Throttling: &cgroups.Throttle{
+				Periods:          cpu["nr_periods"],
+				ThrottledPeriods: cpu["nr_throttled"],
+				ThrottledTime:    cpu["throttled_usec"] * 1000,
+			},
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if memory, err := readCgroupV2Memory(dir); err == nil {
+		metrics.Memory = memory
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if blkio, err := readCgroupV2IO(filepath.Join(dir, "io.stat")); err == nil {
+		metrics.Blkio = blkio
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if current, err := readCgroupValue(filepath.Join(dir, "pids.current")); err == nil {
+		limit, err := readCgroupValue(filepath.Join(dir, "pids.max"))
+		if err != nil {
+			return nil, err
+		}
+
+		metrics.Pids = &cgroups.PidsStat{Current: current, Limit: limit}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return metrics, nil
+}
+
+func readCgroupV2Memory(dir string) (*cgroups.MemoryStat, error) {
+	stat, err := readKeyedValues(filepath.Join(dir, "memory.stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := readCgroupValue(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := readCgroupValue(filepath.Join(dir, "memory.max"))
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := readKeyedValues(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return nil, err
+	}
+
+	memory := &cgroups.MemoryStat{
+		Cache:        stat["file"],
+		RSS:          stat["anon"],
+		RSSHuge:      stat["anon_thp"],
+		MappedFile:   stat["file_mapped"],
+		Dirty:        stat["file_dirty"],
+		Writeback:    stat["file_writeback"],
+		PgFault:      stat["pgfault"],
+		PgMajFault:   stat["pgmajfault"],
+		InactiveAnon: stat["inactive_anon"],
+		ActiveAnon:   stat["active_anon"],
+		InactiveFile: stat["inactive_file"],
+		ActiveFile:   stat["active_file"],
+		Unevictable:  stat["unevictable"],
+		Usage:        &cgroups.MemoryEntry{Usage: usage, Limit: limit, Failcnt: events["max"]},
+	}
+
+	// Swap accounting might be disabled in the guest kernel
+	if swap, err := readCgroupValue(filepath.Join(dir, "memory.swap.current")); err == nil {
+		swapLimit, err := readCgroupValue(filepath.Join(dir, "memory.swap.max"))
+		if err != nil {
+			return nil, err
+		}
+
+		memory.Swap = &cgroups.MemoryEntry{Usage: swap, Limit: swapLimit}
+	}
+
+	return memory, nil
+}
+
+// readCgroupV2IO reads io.stat, made of lines like "254:0 rbytes=1024 wbytes=0 rios=2 wios=0 dbytes=0 dios=0"
+func readCgroupV2IO(path string) (*cgroups.BlkIOStat, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	blkio := &cgroups.BlkIOStat{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var major, minor uint64
+		device := strings.SplitN(fields[0], ":", 2)
+		if len(device) == 2 {
+			major, _ = strconv.ParseUint(device[0], 10, 64)
+			minor, _ = strconv.ParseUint(device[1], 10, 64)
+		}
+
+		for _, field := range fields[1:] {
+			pair := strings.SplitN(field, "=", 2)
+			if len(pair) != 2 {
+				continue
+			}
+
+			value, err := strconv.ParseUint(pair[1], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value of %q in %s", pair[0], path)
+			}
+
+			entry := &cgroups.BlkIOEntry{Major: major, Minor: minor, Value: value}
+			switch pair[0] {
+			case "rbytes":
+				entry.Op = "Read"
+				blkio.IoServiceBytesRecursive = append(blkio.IoServiceBytesRecursive, entry)
+			case "wbytes":
+				entry.Op = "Write"
+				blkio.IoServiceBytesRecursive = append(blkio.IoServiceBytesRecursive, entry)
+			case "rios":
+				entry.Op = "Read"
+				blkio.IoServicedRecursive = append(blkio.IoServicedRecursive, entry)
+			case "wios":
+				entry.Op = "Write"
+				blkio.IoServicedRecursive = append(blkio.IoServicedRecursive, entry)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return blkio, nil
+}
+
+// readCgroupValue reads a single value cgroup file, "max" (no limit) is read as the largest value
+func readCgroupValue(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return math.MaxUint64, nil
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid value in %s", path)
+	}
+
+	return parsed, nil
+}
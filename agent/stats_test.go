@@ -0,0 +1,74 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/cgroups"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCgroupV2Metrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "cpu.stat"), "usage_usec 300\nuser_usec 200\nsystem_usec 100\nnr_periods 5\nnr_throttled 1\nthrottled_usec 10\n")
+	writeFile(t, filepath.Join(dir, "memory.stat"), "anon 4096\nfile 8192\npgfault 12\npgmajfault 1\n")
+	writeFile(t, filepath.Join(dir, "memory.current"), "12288\n")
+	writeFile(t, filepath.Join(dir, "memory.max"), "max\n")
+	writeFile(t, filepath.Join(dir, "memory.events"), "low 0\nhigh 0\nmax 3\noom 0\noom_kill 0\n")
+	writeFile(t, filepath.Join(dir, "io.stat"), "254:0 rbytes=1024 wbytes=512 rios=2 wios=1 dbytes=0 dios=0\n")
+	writeFile(t, filepath.Join(dir, "pids.current"), "3\n")
+	writeFile(t, filepath.Join(dir, "pids.max"), "100\n")
+
+	metrics, err := readCgroupV2Metrics(dir)
+	require.NoError(t, err)
+
+	assert.Equal(t, &cgroups.CPUUsage{Total: 300000, User: 200000, Kernel: 100000}, metrics.CPU.Usage)
+	assert.Equal(t, &cgroups.Throttle{Periods: 5, ThrottledPeriods: 1, ThrottledTime: 10000}, metrics.CPU.Throttling)
+
+	assert.EqualValues(t, 4096, metrics.Memory.RSS)
+	assert.EqualValues(t, 8192, metrics.Memory.Cache)
+	assert.EqualValues(t, 12, metrics.Memory.PgFault)
+	assert.Equal(t, &cgroups.MemoryEntry{Usage: 12288, Limit: math.MaxUint64, Failcnt: 3}, metrics.Memory.Usage)
+	assert.Nil(t, metrics.Memory.Swap)
+
+	assert.Equal(t, []*cgroups.BlkIOEntry{
+		{Op: "Read", Major: 254, Value: 1024},
+		{Op: "Write", Major: 254, Value: 512},
+	}, metrics.Blkio.IoServiceBytesRecursive)
+	assert.Equal(t, []*cgroups.BlkIOEntry{
+		{Op: "Read", Major: 254, Value: 2},
+		{Op: "Write", Major: 254, Value: 1},
+	}, metrics.Blkio.IoServicedRecursive)
+
+	assert.Equal(t, &cgroups.PidsStat{Current: 3, Limit: 100}, metrics.Pids)
+
+	// Controllers not enabled for the cgroup are left out
+	require.NoError(t, os.Remove(filepath.Join(dir, "pids.current")))
+	metrics, err = readCgroupV2Metrics(dir)
+	require.NoError(t, err)
+	assert.Nil(t, metrics.Pids)
+
+	writeFile(t, filepath.Join(dir, "memory.current"), "lots\n")
+	_, err = readCgroupV2Metrics(dir)
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+const (
+	sysBlockPath        = "/sys/block"
+	devPath             = "/dev"
+	virtioBlockPrefix   = "vd"
+	volumeDirectoryMode = 0755
+)
+
+func (s *agentService) MountVolumes(ctx context.Context, req *proto.MountVolumesRequest) (*proto.MountVolumesResponse, error) {
+	devices, err := findDevicesByUUID(ctx, sysBlockPath, devPath)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to list block devices")
+		return nil, err
+	}
+
+	for _, volume := range req.Volumes {
+		found := devices[volume.UUID]
+		if len(found) != 1 {
+			err := errors.Wrapf(errdefs.ErrNotFound, "no drive with filesystem UUID %s for volume %s", volume.UUID, volume.GuestPath)
+			if len(found) > 1 {
+				err = errors.Wrapf(errdefs.ErrFailedPrecondition, "drives %v have the same filesystem UUID %s", found, volume.UUID)
+			}
+
+			log.G(ctx).WithError(err).Error("failed to mount volume")
+			return nil, errdefs.ToGRPC(err)
+		}
+
+		device := found[0]
+
+		if err := mountVolume(device, volume); err != nil {
+			log.G(ctx).WithError(err).Error("failed to mount volume")
+			return nil, err
+		}
+
+		log.G(ctx).Infof("mounted volume %s (%s) at %s", volume.UUID, device, volume.GuestPath)
+	}
+
+	return &proto.MountVolumesResponse{}, nil
+}
+
+// findDevicesByUUID maps filesystem UUIDs to virtio block devices.
+// Device names depend on the order drives were attached in, while UUIDs are stable.
+// Snapshots of the same image share the UUID, so more than one device might be found.
+func findDevicesByUUID(ctx context.Context, sysBlockDir, devDir string) (map[string][]string, error) {
+	entries, err := ioutil.ReadDir(sysBlockDir)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[string][]string)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), virtioBlockPrefix) {
+			continue
+		}
+
+		device := filepath.Join(devDir, entry.Name())
+		uuid, err := internal.ReadFilesystemUUID(device)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("skipping device %s", device)
+			continue
+		}
+
+		devices[uuid] = append(devices[uuid], device)
+	}
+
+	return devices, nil
+}
+
+func mountVolume(device string, volume *proto.Volume) error {
+	if err := os.MkdirAll(volume.GuestPath, volumeDirectoryMode); err != nil {
+		return errors.Wrapf(err, "failed to create mount point %s", volume.GuestPath)
+	}
+
+	var flags uintptr
+	if volume.ReadOnly {
+		flags |= unix.MS_RDONLY
+	}
+
+	// Older runtimes only supported ext4 volumes and don't pass the type
+	fsType := volume.FSType
+	if fsType == "" {
+		fsType = internal.FSTypeExt4
+	}
+
+	if err := unix.Mount(device, volume.GuestPath, fsType, flags, ""); err != nil {
+		return errors.Wrapf(err, "failed to mount %s at %s", device, volume.GuestPath)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeDevice creates a fake block device holding ext4 superblock with the given UUID
+func writeDevice(t *testing.T, sysBlockDir, devDir, name string, uuid byte) {
+	require.NoError(t, os.Mkdir(filepath.Join(sysBlockDir, name), 0700))
+
+	image := make([]byte, 2048)
+	image[1024+0x38] = 0x53
+	image[1024+0x39] = 0xEF
+	for i := 0; i < 16; i++ {
+		image[1024+0x68+i] = uuid
+	}
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(devDir, name), image, 0600))
+}
+
+func TestFindDevicesByUUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volumes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sysBlockDir := filepath.Join(dir, "sys")
+	devDir := filepath.Join(dir, "dev")
+	require.NoError(t, os.Mkdir(sysBlockDir, 0700))
+	require.NoError(t, os.Mkdir(devDir, 0700))
+
+	// Root drive is not an ext4 filesystem, volumes are attached in a different order
+	// than their UUIDs would suggest, loop device is ignored
+	require.NoError(t, os.Mkdir(filepath.Join(sysBlockDir, "vda"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(devDir, "vda"), make([]byte, 2048), 0600))
+	writeDevice(t, sysBlockDir, devDir, "vdb", 0x11)
+	writeDevice(t, sysBlockDir, devDir, "vdc", 0x33)
+	writeDevice(t, sysBlockDir, devDir, "vdd", 0x22)
+	writeDevice(t, sysBlockDir, devDir, "vde", 0x22)
+	writeDevice(t, sysBlockDir, devDir, "loop0", 0x44)
+
+	devices, err := findDevicesByUUID(context.Background(), sysBlockDir, devDir)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"11111111-1111-1111-1111-111111111111": {filepath.Join(devDir, "vdb")},
+		"33333333-3333-3333-3333-333333333333": {filepath.Join(devDir, "vdc")},
+		"22222222-2222-2222-2222-222222222222": {filepath.Join(devDir, "vdd"), filepath.Join(devDir, "vde")},
+	}, devices)
+}
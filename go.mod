@@ -5,17 +5,20 @@ require (
 	github.com/Microsoft/go-winio v0.4.11 // indirect
 	github.com/Microsoft/hcsshim v0.8.1 // indirect
 	github.com/boltdb/bolt v1.3.1 // indirect
-	github.com/containerd/cgroups v0.0.0-20181105182409-82cb49fc1779 // indirect
+	github.com/containerd/cgroups v0.0.0-20181105182409-82cb49fc1779
 	github.com/containerd/console v0.0.0-20181022165439-0650fd9eeb50 // indirect
 	github.com/containerd/containerd v1.2.0
 	github.com/containerd/continuity v0.0.0-20181027224239-bea7585dbfac
 	github.com/containerd/fifo v0.0.0-20180307165137-3d5202aec260
 	github.com/containerd/go-runc v0.0.0-20180907222934-5a6d9f37cfa3 // indirect
 	github.com/containerd/ttrpc v0.0.0-20181001154009-f51df4475b76
-	github.com/containerd/typeurl v0.0.0-20181015155603-461401dc8f19 // indirect
+	github.com/containerd/typeurl v0.0.0-20181015155603-461401dc8f19
+	github.com/containernetworking/cni v0.6.0
 	github.com/coreos/go-systemd v0.0.0-20181031085051-9002847aa142 // indirect
 	github.com/docker/go-units v0.3.3
 	github.com/firecracker-microvm/firecracker-go-sdk v0.0.0-20181220230332-433f262dc33b
+	github.com/go-openapi/runtime v0.17.1
+	github.com/go-openapi/strfmt v0.17.1
 	github.com/godbus/dbus v0.0.0-20181025153459-66d97aec3384 // indirect
 	github.com/gogo/protobuf v1.1.1
 	github.com/google/go-cmp v0.2.0 // indirect
@@ -23,7 +26,7 @@ require (
 	github.com/mdlayher/vsock v0.0.0-20181130155850-676f733b747c
 	github.com/opencontainers/go-digest v1.0.0-rc1 // indirect
 	github.com/opencontainers/runc v0.1.1 // indirect
-	github.com/opencontainers/runtime-spec v0.1.2-0.20181106065543-31e0d16c1cb7 // indirect
+	github.com/opencontainers/runtime-spec v0.1.2-0.20181106065543-31e0d16c1cb7
 	github.com/pkg/errors v0.8.0
 	github.com/sirupsen/logrus v1.2.0
 	github.com/stretchr/testify v1.2.2
@@ -0,0 +1,67 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+const (
+	// DependsOnAnnotation is a comma separated list of container IDs (sharing the same VM)
+	// the annotated container depends on. Dependent containers are stopped before their dependencies.
+	DependsOnAnnotation = "firecracker-containerd.depends-on"
+
+	// SandboxAnnotation marks the container as the sandbox of the VM ("true" or "false").
+	// Exit of the sandbox container stops all other containers and tears down the VM.
+	SandboxAnnotation = "firecracker-containerd.sandbox"
+
+	// PrefaultMemoryAnnotation overrides prefault_memory runtime setting ("true" or "false") for the VM
+	// started for the annotated container. It has no effect on containers joining a running VM.
+	PrefaultMemoryAnnotation = "firecracker-containerd.prefault-memory"
+
+	// InitModeAnnotation overrides init_mode runtime setting for the VM started for the annotated container
+	InitModeAnnotation = "firecracker-containerd.init-mode"
+
+	// RootDriveAnnotation is the ID of the configured drive to use as root device of the VM
+	// started for the annotated container
+	RootDriveAnnotation = "firecracker-containerd.root-drive"
+
+	// AgentMaxInFlightAnnotation overrides agent_max_inflight runtime setting for the VM started for the annotated container
+	AgentMaxInFlightAnnotation = "firecracker-containerd.agent-max-inflight"
+
+	// VolumesAnnotation is a JSON array of volumes (like the volumes runtime setting) to attach to the VM
+	// started for the annotated container, in addition to the configured ones
+	VolumesAnnotation = "firecracker-containerd.volumes"
+
+	// Rate limiters (JSON objects like the drive_rate_limiter runtime setting) of the VM started for the
+	// annotated container. They can only be tighter than the configured ones.
+	DriveRateLimiterAnnotation     = "firecracker-containerd.drive-rate-limiter"
+	NetworkRxRateLimiterAnnotation = "firecracker-containerd.network-rx-rate-limiter"
+	NetworkTxRateLimiterAnnotation = "firecracker-containerd.network-tx-rate-limiter"
+
+	// MetadataAnnotation is a JSON object served by the microVM metadata service (MMDS) of the VM started
+	// for the annotated container, replacing the metadata runtime setting
+	MetadataAnnotation = "firecracker-containerd.metadata"
+
+	// VcpuAffinityAnnotation is a list of host CPUs (like "2-5") vCPUs of the VM started for the annotated
+	// container are pinned to, overriding the vcpu_affinity runtime setting. It can only narrow the
+	// configured list.
+	VcpuAffinityAnnotation = "firecracker-containerd.vcpu-affinity"
+
+	// ReadinessProbeAnnotation is a JSON array with the command line of the readiness probe,
+	// the probe is run inside of the container after start until it succeeds.
+	ReadinessProbeAnnotation = "firecracker-containerd.readiness-probe"
+
+	// ReadinessProbeExitCodeAnnotation is the exit code expected from a passing probe (0 if not set)
+	ReadinessProbeExitCodeAnnotation = "firecracker-containerd.readiness-probe.exit-code"
+
+	// ReadinessProbeTimeoutAnnotation bounds the time to wait for the probe to pass (like "30s")
+	ReadinessProbeTimeoutAnnotation = "firecracker-containerd.readiness-probe.timeout"
+)
@@ -14,11 +14,22 @@
 package internal
 
 const (
-	// vsock ports to use for stdio
-	StdinPort  = 11000
-	StdoutPort = 11001
-	StderrPort = 11002
+	// Default vsock port of the agent API
+	DefaultVsockPort = 10789
+
+	// Default vsock port of stdin (stdout and stderr use the next two ports)
+	DefaultStdioPortBase = 11000
 
 	// Default buffer size for io in bytes
 	DefaultBufferSize = 1024
+
+	// Lower limit for the configurable stdio buffer size in bytes, smaller buffers make
+	// copying stdio cost a syscall per few bytes
+	MinBufferSize = 512
+
+	// Upper limit for the configurable stdio buffer size in bytes
+	MaxBufferSize = 4 * 1024 * 1024
+
+	// Directory the container bundle is placed in inside the guest, relative rootfs paths are relative to it
+	GuestBundlePath = "/container"
 )
@@ -0,0 +1,62 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DNSPortBootArg is the vsock port the agent forwards DNS queries to (DNS proxy is disabled if not set)
+	DNSPortBootArg = "fc_agent.dns_port"
+
+	// MaxDNSMessageSize is the largest DNS message that fits the 2 bytes length prefix
+	MaxDNSMessageSize = 65535
+
+	// DNSHeaderSize is the size of the fixed DNS message header, the first 2 bytes of which hold the query ID
+	DNSHeaderSize = 12
+)
+
+// ReadDNSMessage reads a DNS message from a stream, messages are prefixed with their length
+// the same way as DNS over TCP does (RFC 1035, section 4.2.2)
+func ReadDNSMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// WriteDNSMessage writes a length prefixed DNS message to a stream
+func WriteDNSMessage(w io.Writer, msg []byte) error {
+	if len(msg) > MaxDNSMessageSize {
+		return errors.Errorf("DNS message of %d bytes is too large", len(msg))
+	}
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
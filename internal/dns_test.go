@@ -0,0 +1,45 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSMessageFraming(t *testing.T) {
+	var buf bytes.Buffer
+
+	require.NoError(t, WriteDNSMessage(&buf, []byte("first")))
+	require.NoError(t, WriteDNSMessage(&buf, []byte("second")))
+	assert.Equal(t, []byte{0, 5}, buf.Bytes()[:2])
+
+	msg, err := ReadDNSMessage(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(msg))
+
+	msg, err = ReadDNSMessage(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(msg))
+
+	assert.Error(t, WriteDNSMessage(&buf, make([]byte, MaxDNSMessageSize+1)))
+
+	// Truncated message
+	buf.Write([]byte{0, 10, 1, 2})
+	_, err = ReadDNSMessage(&buf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Filesystem types of drives attached to VMs
+const (
+	FSTypeExt4 = "ext4"
+	FSTypeXFS  = "xfs"
+)
+
+const (
+	ext4SuperblockOffset = 1024
+	ext4SuperblockSize   = 1024
+	ext4MagicOffset      = 0x38
+	ext4UUIDOffset       = 0x68
+	ext4Magic            = 0xEF53
+
+	// XFS superblock is at the start of the device, its fields are big endian
+	xfsMagic      = 0x58465342 // "XFSB"
+	xfsUUIDOffset = 0x20
+)
+
+// ReadFilesystemUUID reads UUID of the filesystem (ext2/3/4 or XFS) stored in the given image file or block device.
+// The UUID is formatted the same way as blkid does.
+func ReadFilesystemUUID(path string) (string, error) {
+	_, uuid, err := ReadFilesystem(path)
+	return uuid, err
+}
+
+// ReadFilesystem detects type (FSTypeExt4 or FSTypeXFS) and UUID of the filesystem stored in the given image file
+// or block device. Ext2 and ext3 filesystems are reported as ext4, which mounts them as well.
+func ReadFilesystem(path string) (string, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer file.Close()
+
+	sb := make([]byte, ext4SuperblockOffset+ext4SuperblockSize)
+	if _, err := io.ReadFull(file, sb); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return "", "", errors.Errorf("%s is too small to hold a filesystem", path)
+		}
+
+		return "", "", err
+	}
+
+	if binary.BigEndian.Uint32(sb) == xfsMagic {
+		return FSTypeXFS, formatUUID(sb[xfsUUIDOffset : xfsUUIDOffset+16]), nil
+	}
+
+	ext4 := sb[ext4SuperblockOffset:]
+	if binary.LittleEndian.Uint16(ext4[ext4MagicOffset:]) == ext4Magic {
+		return FSTypeExt4, formatUUID(ext4[ext4UUIDOffset : ext4UUIDOffset+16]), nil
+	}
+
+	return "", "", errors.Errorf("%s doesn't contain ext4 or xfs filesystem", path)
+}
+
+func formatUUID(uuid []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
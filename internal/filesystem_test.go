@@ -0,0 +1,66 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFilesystemUUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	image := make([]byte, 4096)
+	image[1024+0x38] = 0x53
+	image[1024+0x39] = 0xEF
+	copy(image[1024+0x68:], []byte{0x5f, 0x2b, 0x1e, 0x4c, 0x93, 0x0e, 0x4d, 0x5a, 0x8b, 0x6c, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab})
+
+	path := filepath.Join(dir, "volume.img")
+	require.NoError(t, ioutil.WriteFile(path, image, 0600))
+
+	uuid, err := ReadFilesystemUUID(path)
+	require.NoError(t, err)
+	assert.Equal(t, "5f2b1e4c-930e-4d5a-8b6c-0123456789ab", uuid)
+
+	fsType, _, err := ReadFilesystem(path)
+	require.NoError(t, err)
+	assert.Equal(t, FSTypeExt4, fsType)
+
+	image = make([]byte, 4096)
+	copy(image, "XFSB")
+	copy(image[0x20:], []byte{0x0b, 0x6f, 0x2d, 0x7e, 0x11, 0x22, 0x43, 0x33, 0x84, 0x44, 0x55, 0x55, 0x66, 0x66, 0x77, 0x77})
+	require.NoError(t, ioutil.WriteFile(path, image, 0600))
+
+	fsType, uuid, err = ReadFilesystem(path)
+	require.NoError(t, err)
+	assert.Equal(t, FSTypeXFS, fsType)
+	assert.Equal(t, "0b6f2d7e-1122-4333-8444-555566667777", uuid)
+
+	// Not a filesystem
+	require.NoError(t, ioutil.WriteFile(path, make([]byte, 4096), 0600))
+	_, err = ReadFilesystemUUID(path)
+	assert.Error(t, err)
+
+	// Too small
+	require.NoError(t, ioutil.WriteFile(path, make([]byte, 512), 0600))
+	_, err = ReadFilesystemUUID(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultInjectedFileMode is the mode of injected files which don't ask for one
+const DefaultInjectedFileMode os.FileMode = 0600
+
+// ValidateInjectedFile checks a file injected into the container rootfs stays within the container and only
+// asks for permission bits (no setuid, setgid or sticky bits)
+func ValidateInjectedFile(path string, mode uint32) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path || path == "/" {
+		return errors.Errorf("injected file path %q should be a clean absolute path of a file in the container", path)
+	}
+
+	if os.FileMode(mode)&^os.ModePerm != 0 {
+		return errors.Errorf("injected file %s can only have permission bits in its mode, not %#o", path, mode)
+	}
+
+	return nil
+}
+
+// InjectedFileMode returns the mode an injected file is written with
+func InjectedFileMode(mode uint32) os.FileMode {
+	if mode == 0 {
+		return DefaultInjectedFileMode
+	}
+
+	return os.FileMode(mode)
+}
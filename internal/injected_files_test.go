@@ -0,0 +1,34 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateInjectedFile(t *testing.T) {
+	assert.NoError(t, ValidateInjectedFile("/etc/ssl/certs/ca.pem", 0644))
+	assert.NoError(t, ValidateInjectedFile("/run/secrets/token", 0))
+
+	for _, path := range []string{"", "/", "token", "/run/../../token", "/run/secrets/"} {
+		assert.Error(t, ValidateInjectedFile(path, 0600), path)
+	}
+
+	assert.Error(t, ValidateInjectedFile("/usr/bin/tool", 04755))
+	assert.Equal(t, DefaultInjectedFileMode, InjectedFileMode(0))
+	assert.Equal(t, os.FileMode(0444), InjectedFileMode(0444))
+}
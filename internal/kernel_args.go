@@ -0,0 +1,99 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// Kernel command line parameters used by the runtime to pass settings to the agent
+	AgentLogLevelBootArg   = "fc_agent.log_level"
+	StdioBufferSizeBootArg = "fc_agent.stdio_buffer_size"
+	VsockBufferSizeBootArg = "fc_agent.vsock_buffer_size"
+	PrefaultMemoryBootArg  = "fc_agent.prefault_memory"
+	InitModeBootArg        = "fc_agent.init_mode"
+	VsockPortBootArg       = "fc_agent.vsock_port"
+	StdioPortBaseBootArg   = "fc_agent.stdio_port_base"
+	StdinPortBootArg       = "fc_agent.stdin_port"
+	StdoutPortBootArg      = "fc_agent.stdout_port"
+	StderrPortBootArg      = "fc_agent.stderr_port"
+
+	// AgentBootArgPrefix is the common prefix of parameters passed to the agent
+	AgentBootArgPrefix = "fc_agent."
+
+	kernelCmdlinePath = "/proc/cmdline"
+)
+
+// Guest init modes (values of InitModeBootArg), describing how the agent is started in the guest
+const (
+	// InitModeMinimal is an init system (like OpenRC or busybox init) starting the agent as a service
+	InitModeMinimal = "minimal"
+	// InitModeSystemd is systemd starting the agent as a unit
+	InitModeSystemd = "systemd"
+	// InitModeAgent is the agent itself running as PID 1
+	InitModeAgent = "agent"
+)
+
+// IsValidInitMode returns true if the agent supports the given init mode
+func IsValidInitMode(mode string) bool {
+	switch mode {
+	case InitModeMinimal, InitModeSystemd, InitModeAgent:
+		return true
+	default:
+		return false
+	}
+}
+
+// FormatBootArg formats a kernel command line parameter
+func FormatBootArg(key, value string) string {
+	return fmt.Sprintf("%s=%s", key, value)
+}
+
+// FindBootArg looks up the value of the given parameter in the kernel command line.
+// If the parameter is specified more than once, the last value wins (same as kernel does).
+func FindBootArg(cmdline, key string) (string, bool) {
+	var (
+		value string
+		found bool
+	)
+
+	for _, field := range strings.Fields(cmdline) {
+		parts := strings.SplitN(field, "=", 2)
+		if parts[0] != key {
+			continue
+		}
+
+		found = true
+		value = ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+	}
+
+	return value, found
+}
+
+// ReadBootArg reads the value of the given parameter from the current kernel command line
+func ReadBootArg(key string) (string, bool, error) {
+	data, err := ioutil.ReadFile(kernelCmdlinePath)
+	if err != nil {
+		return "", false, err
+	}
+
+	value, found := FindBootArg(string(data), key)
+	return value, found, nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindBootArg(t *testing.T) {
+	cmdline := "console=ttyS0 noapic reboot=k panic=1 fc_agent.log_level=info rw fc_agent.log_level=debug\n"
+
+	value, found := FindBootArg(cmdline, AgentLogLevelBootArg)
+	assert.True(t, found)
+	assert.Equal(t, "debug", value)
+
+	value, found = FindBootArg(cmdline, "noapic")
+	assert.True(t, found)
+	assert.Equal(t, "", value)
+
+	_, found = FindBootArg(cmdline, "root")
+	assert.False(t, found)
+
+	assert.Equal(t, "fc_agent.log_level=warning", FormatBootArg(AgentLogLevelBootArg, "warning"))
+}
+
+func TestIsValidInitMode(t *testing.T) {
+	for _, mode := range []string{InitModeMinimal, InitModeSystemd, InitModeAgent} {
+		assert.True(t, IsValidInitMode(mode), mode)
+	}
+
+	assert.False(t, IsValidInitMode(""))
+	assert.False(t, IsValidInitMode("upstart"))
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"io"
+	"sync"
+)
+
+// StdioStream describes a stdio FIFO of a process proxied over vsock between the runtime and the agent
+type StdioStream struct {
+	Path string
+	Port uint32
+	// Stdin is copied from the runtime to the agent, other streams the other way around
+	Stdin bool
+	// Socket buffer size of the stream's vsock connections in bytes, 0 for the kernel default
+	VsockBufferSize int
+}
+
+// StdioPorts are the vsock ports stdin, stdout and stderr of processes are proxied over
+type StdioPorts struct {
+	Stdin  uint32
+	Stdout uint32
+	Stderr uint32
+}
+
+// StdioPortsFromBase returns consecutive vsock ports for stdin, stdout and stderr, starting from the given base
+func StdioPortsFromBase(base uint32) StdioPorts {
+	return StdioPorts{Stdin: base, Stdout: base + 1, Stderr: base + 2}
+}
+
+// StdioStreams returns streams to proxy for a process with the given FIFOs, skipping FIFOs which aren't set.
+// A process with a terminal has a single console: its output (including stderr) goes to stdout, so stderr
+// isn't proxied.
+func StdioStreams(ports StdioPorts, stdin, stdout, stderr string, terminal bool) []StdioStream {
+
+	candidates := []StdioStream{
+		{Path: stdin, Port: ports.Stdin, Stdin: true},
+		{Path: stdout, Port: ports.Stdout},
+	}
+
+	if !terminal {
+		candidates = append(candidates, StdioStream{Path: stderr, Port: ports.Stderr})
+	}
+
+	var streams []StdioStream
+	for _, stream := range candidates {
+		if stream.Path != "" {
+			streams = append(streams, stream)
+		}
+	}
+
+	return streams
+}
+
+// StdioConn is a connection carrying a stdio stream, which gets replaced by a new connection once it breaks,
+// so the stream survives a dropped vsock connection
+type StdioConn struct {
+	reconnect func() (io.ReadWriteCloser, error)
+
+	mu     sync.Mutex
+	conn   io.ReadWriteCloser
+	closed bool
+}
+
+// NewStdioConn returns a stream over conn. Once a connection breaks, reconnect is called for a new one and
+// copying stops if it fails. Without reconnect, copying stops with the error of the broken connection.
+func NewStdioConn(conn io.ReadWriteCloser, reconnect func() (io.ReadWriteCloser, error)) *StdioConn {
+	return &StdioConn{conn: conn, reconnect: reconnect}
+}
+
+// Close closes the current connection and stops reconnecting, making copying stop
+func (c *StdioConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	return c.conn.Close()
+}
+
+func (c *StdioConn) current() io.ReadWriteCloser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn
+}
+
+func (c *StdioConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+// replace closes the broken connection and returns a new one, or the error that broke it if the stream is
+// closed or can't reconnect
+func (c *StdioConn) replace(broken io.ReadWriteCloser, cause error) (io.ReadWriteCloser, error) {
+	broken.Close()
+	if c.reconnect == nil || c.isClosed() {
+		return nil, cause
+	}
+
+	conn, err := c.reconnect()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		conn.Close()
+		return nil, cause
+	}
+
+	c.conn = conn
+	return conn, nil
+}
+
+// CopyTo copies src to the stream until src reaches EOF. Data which wasn't written to a broken connection
+// is written to the next one, and data is never read from src again, so nothing is sent twice (though data in
+// flight on the broken connection may be lost).
+func (c *StdioConn) CopyTo(src io.Reader, buf []byte) error {
+	conn := c.current()
+	for {
+		n, readErr := src.Read(buf)
+		for off := 0; off < n; {
+			written, err := conn.Write(buf[off:n])
+			off += written
+			if err != nil {
+				if conn, err = c.replace(conn, err); err != nil {
+					return err
+				}
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// CopyFrom copies the stream to dst. If eofEnds is set, EOF on the connection ends the stream, otherwise
+// it's handled as a broken connection.
+func (c *StdioConn) CopyFrom(dst io.Writer, buf []byte, eofEnds bool) error {
+	conn := c.current()
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+
+		if err == nil {
+			continue
+		}
+		if err == io.EOF && eofEnds {
+			return nil
+		}
+		if conn, err = c.replace(conn, err); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStdioStreams(t *testing.T) {
+	streams := StdioStreams(StdioPortsFromBase(DefaultStdioPortBase), "in", "out", "err", false)
+	assert.Equal(t, []StdioStream{
+		{Path: "in", Port: 11000, Stdin: true},
+		{Path: "out", Port: 11001},
+		{Path: "err", Port: 11002},
+	}, streams)
+
+	// Console output is all on stdout
+	streams = StdioStreams(StdioPortsFromBase(DefaultStdioPortBase), "in", "out", "err", true)
+	assert.Equal(t, []StdioStream{
+		{Path: "in", Port: 11000, Stdin: true},
+		{Path: "out", Port: 11001},
+	}, streams)
+
+	streams = StdioStreams(StdioPortsFromBase(20000), "", "out", "", false)
+	assert.Equal(t, []StdioStream{{Path: "out", Port: 20001}}, streams)
+
+	// Ports don't have to be consecutive
+	streams = StdioStreams(StdioPorts{Stdin: 5000, Stdout: 7000, Stderr: 6000}, "in", "out", "err", false)
+	assert.Equal(t, []StdioStream{
+		{Path: "in", Port: 5000, Stdin: true},
+		{Path: "out", Port: 7000},
+		{Path: "err", Port: 6000},
+	}, streams)
+}
+
+// brokenConn takes limit bytes and fails afterwards
+type brokenConn struct {
+	bytes.Buffer
+	limit  int
+	closed bool
+}
+
+func (c *brokenConn) Write(b []byte) (int, error) {
+	if len(b) > c.limit {
+		n, _ := c.Buffer.Write(b[:c.limit])
+		c.limit = 0
+		return n, errors.New("connection reset")
+	}
+	c.limit -= len(b)
+	return c.Buffer.Write(b)
+}
+
+func (c *brokenConn) Read(b []byte) (int, error) {
+	n, err := c.Buffer.Read(b)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func (c *brokenConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (c *bufferConn) Close() error {
+	return nil
+}
+
+func TestStdioConnCopyTo(t *testing.T) {
+	broken := &brokenConn{limit: 3}
+	next := &bufferConn{}
+	conn := NewStdioConn(broken, func() (io.ReadWriteCloser, error) { return next, nil })
+
+	require.NoError(t, conn.CopyTo(strings.NewReader("hello world"), make([]byte, 8)))
+	assert.True(t, broken.closed)
+
+	// Data written to the broken connection isn't sent again
+	assert.Equal(t, "hel", broken.String())
+	assert.Equal(t, "lo world", next.String())
+}
+
+func TestStdioConnCopyToNoReconnect(t *testing.T) {
+	conn := NewStdioConn(&brokenConn{limit: 3}, nil)
+	assert.EqualError(t, conn.CopyTo(strings.NewReader("hello world"), make([]byte, 8)), "connection reset")
+
+	failed := errors.New("dial failed")
+	conn = NewStdioConn(&brokenConn{limit: 3}, func() (io.ReadWriteCloser, error) { return nil, failed })
+	assert.Equal(t, failed, conn.CopyTo(strings.NewReader("hello world"), make([]byte, 8)))
+}
+
+func TestStdioConnCopyFrom(t *testing.T) {
+	broken := &brokenConn{}
+	broken.WriteString("hello ")
+
+	next := &bufferConn{}
+	next.WriteString("world")
+
+	conn := NewStdioConn(broken, func() (io.ReadWriteCloser, error) { return next, nil })
+
+	var out bytes.Buffer
+	require.NoError(t, conn.CopyFrom(&out, make([]byte, 4), true))
+	assert.Equal(t, "hello world", out.String())
+	assert.True(t, broken.closed)
+}
+
+func TestStdioConnCopyFromReconnectOnEOF(t *testing.T) {
+	first := &bufferConn{}
+	first.WriteString("hello")
+
+	conn := NewStdioConn(first, nil)
+	reconnects := 0
+	conn.reconnect = func() (io.ReadWriteCloser, error) {
+		reconnects++
+		// The stream is closed while reconnecting
+		conn.Close()
+		return &bufferConn{}, nil
+	}
+
+	var out bytes.Buffer
+	assert.Equal(t, io.EOF, conn.CopyFrom(&out, make([]byte, 4), false))
+	assert.Equal(t, "hello", out.String())
+	assert.Equal(t, 1, reconnects)
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/mdlayher/vsock"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Lower limit for the configurable vsock socket buffer size in bytes
+	MinVsockBufferSize = 4 * 1024
+
+	// Upper limit for the configurable vsock socket buffer size in bytes, the buffer takes kernel memory
+	// on both ends of each connection
+	MaxVsockBufferSize = 64 * 1024 * 1024
+)
+
+// DialVsock connects to the port of the VM with the given context ID. Unless bufferSize is 0 (which keeps
+// the kernel default of 256KiB), the socket buffer is set to bufferSize bytes before connecting, which
+// bounds how much data is in flight on the connection.
+func DialVsock(cid, port uint32, bufferSize int) (net.Conn, error) {
+	if bufferSize == 0 {
+		return vsock.Dial(cid, port)
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create vsock socket")
+	}
+
+	if err := setVsockBufferSize(fd, bufferSize); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrapf(err, "failed to connect to vsock port %d of CID %d", port, cid)
+	}
+
+	return newVsockConn(fd)
+}
+
+// ListenVsock listens on the vsock port. Unless bufferSize is 0 (which keeps the kernel default), accepted
+// connections have their socket buffer set to bufferSize bytes, like the ones dialed by DialVsock.
+func ListenVsock(port uint32, bufferSize int) (net.Listener, error) {
+	if bufferSize == 0 {
+		return vsock.Listen(port)
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create vsock socket")
+	}
+
+	// Accepted sockets inherit the buffer size of the listening one
+	if err := setVsockBufferSize(fd, bufferSize); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrapf(err, "failed to bind vsock port %d", port)
+	}
+
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrapf(err, "failed to listen on vsock port %d", port)
+	}
+
+	file := os.NewFile(uintptr(fd), "vsock-listener")
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &vsockListener{file: file, raw: raw, addr: &vsock.Addr{ContextID: unix.VMADDR_CID_ANY, Port: port}}, nil
+}
+
+// setVsockBufferSize sets the buffer size of a vsock socket. The maximum is set first, as newer kernels cap
+// the size to it.
+func setVsockBufferSize(fd, size int) error {
+	for _, opt := range []int{unix.SO_VM_SOCKETS_BUFFER_MAX_SIZE, unix.SO_VM_SOCKETS_BUFFER_SIZE} {
+		// The options are 64-bit, which golang.org/x/sys doesn't have a setter for
+		value := uint64(size)
+		_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.AF_VSOCK, uintptr(opt),
+			uintptr(unsafe.Pointer(&value)), unsafe.Sizeof(value), 0)
+		if errno != 0 {
+			return errors.Wrapf(errno, "failed to set vsock buffer size to %d", size)
+		}
+	}
+
+	return nil
+}
+
+// vsockConn is a connected vsock socket
+type vsockConn struct {
+	*os.File
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.local }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
+
+// newVsockConn wraps a connected vsock socket, which is made non-blocking so deadlines work
+func newVsockConn(fd int) (net.Conn, error) {
+	local, err := vsockSockaddr(unix.Getsockname(fd))
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	remote, err := vsockSockaddr(unix.Getpeername(fd))
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "failed to make vsock socket non-blocking")
+	}
+
+	return &vsockConn{File: os.NewFile(uintptr(fd), "vsock"), local: local, remote: remote}, nil
+}
+
+func vsockSockaddr(sa unix.Sockaddr, err error) (*vsock.Addr, error) {
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get vsock address")
+	}
+
+	vm, ok := sa.(*unix.SockaddrVM)
+	if !ok {
+		return nil, errors.Errorf("unexpected vsock address %#v", sa)
+	}
+
+	return &vsock.Addr{ContextID: vm.CID, Port: vm.Port}, nil
+}
+
+// vsockListener is a listening vsock socket. Accept waits for a connection until the listener is closed.
+type vsockListener struct {
+	file *os.File
+	raw  syscall.RawConn
+	addr net.Addr
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	var (
+		fd  int
+		err error
+	)
+
+	readErr := l.raw.Read(func(lfd uintptr) bool {
+		fd, _, err = unix.Accept4(int(lfd), unix.SOCK_CLOEXEC)
+		return err != unix.EAGAIN
+	})
+
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to accept vsock connection")
+	}
+
+	return newVsockConn(fd)
+}
+
+func (l *vsockListener) Close() error   { return l.file.Close() }
+func (l *vsockListener) Addr() net.Addr { return l.addr }
@@ -0,0 +1,61 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Context ID of the host itself, served by the vsock_loopback module
+const localCID = 1
+
+func TestVsockBufferSize(t *testing.T) {
+	const (
+		port = 10999
+		size = 1024 * 1024
+	)
+
+	listener, err := ListenVsock(port, size)
+	if err != nil {
+		t.Skipf("vsock isn't available: %v", err)
+	}
+
+	defer listener.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_, err = conn.Write([]byte("ping"))
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	conn, err := DialVsock(localCID, port, size)
+	if err != nil {
+		t.Skipf("local vsock isn't available: %v", err)
+	}
+
+	defer conn.Close()
+
+	buf := make([]byte, 4)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	assert.NoError(t, <-accepted)
+}
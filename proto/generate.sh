@@ -2,5 +2,12 @@ protoc \
 	--gogo_out=\
 Mgoogle/protobuf/any.proto=github.com/gogo/protobuf/types:$GOPATH/src \
 	-I /usr/local/include \
+	-I $GOPATH/src \
 	-I . \
 	proto/types.proto
+
+protoc \
+	--gogottrpc_out=plugins=ttrpc:$GOPATH/src \
+	-I /usr/local/include \
+	-I . \
+	proto/agent.proto
@@ -6,6 +6,7 @@ package proto // import "github.com/firecracker-microvm/firecracker-containerd/p
 import proto "github.com/gogo/protobuf/proto"
 import fmt "fmt"
 import math "math"
+import cgroups "github.com/containerd/cgroups"
 import types "github.com/gogo/protobuf/types"
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -21,18 +22,33 @@ const _ = proto.GoGoProtoPackageIsVersion2 // please upgrade the proto package
 
 // Message to store bundle/config.json bytes
 type ExtraData struct {
-	JsonSpec             []byte     `protobuf:"bytes,1,opt,name=JsonSpec,proto3" json:"JsonSpec,omitempty"`
-	RuncOptions          *types.Any `protobuf:"bytes,2,opt,name=RuncOptions" json:"RuncOptions,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
-	XXX_unrecognized     []byte     `json:"-"`
-	XXX_sizecache        int32      `json:"-"`
+	JsonSpec    []byte     `protobuf:"bytes,1,opt,name=JsonSpec,proto3" json:"JsonSpec,omitempty"`
+	RuncOptions *types.Any `protobuf:"bytes,2,opt,name=RuncOptions" json:"RuncOptions,omitempty"`
+	// vCPU count of the VM started for the task, 0 means the runtime default
+	VcpuCount uint32 `protobuf:"varint,3,opt,name=VcpuCount,proto3" json:"VcpuCount,omitempty"`
+	// Attach the container rootfs as a read-only drive and keep it mounted read-only in the guest
+	ReadOnlyRootfs bool `protobuf:"varint,4,opt,name=ReadOnlyRootfs,proto3" json:"ReadOnlyRootfs,omitempty"`
+	// Kernel command line arguments of the VM started for the task, merged with the configured ones
+	KernelArgs string `protobuf:"bytes,5,opt,name=KernelArgs,proto3" json:"KernelArgs,omitempty"`
+	// Log level of the Firecracker process of the VM started for the task, empty means the configured log_level
+	LogLevel string `protobuf:"bytes,6,opt,name=LogLevel,proto3" json:"LogLevel,omitempty"`
+	// Initial size of the task's terminal, sent to the guest PTY before the task starts. Takes precedence over
+	// process.consoleSize of the bundle spec, 0 means not set
+	ConsoleWidth  uint32 `protobuf:"varint,7,opt,name=ConsoleWidth,proto3" json:"ConsoleWidth,omitempty"`
+	ConsoleHeight uint32 `protobuf:"varint,8,opt,name=ConsoleHeight,proto3" json:"ConsoleHeight,omitempty"`
+	// Files written into the container rootfs by the agent before the container is created, like TLS certificates
+	// or tokens the image is built without
+	Files                []*InjectedFile `protobuf:"bytes,10,rep,name=Files" json:"Files,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
+	XXX_unrecognized     []byte          `json:"-"`
+	XXX_sizecache        int32           `json:"-"`
 }
 
 func (m *ExtraData) Reset()         { *m = ExtraData{} }
 func (m *ExtraData) String() string { return proto.CompactTextString(m) }
 func (*ExtraData) ProtoMessage()    {}
 func (*ExtraData) Descriptor() ([]byte, []int) {
-	return fileDescriptor_types_fd1a0f9dde9f57da, []int{0}
+	return fileDescriptor_types_bab87210d157cec3, []int{0}
 }
 func (m *ExtraData) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ExtraData.Unmarshal(m, b)
@@ -66,24 +82,530 @@ func (m *ExtraData) GetRuncOptions() *types.Any {
 	return nil
 }
 
+func (m *ExtraData) GetVcpuCount() uint32 {
+	if m != nil {
+		return m.VcpuCount
+	}
+	return 0
+}
+
+func (m *ExtraData) GetReadOnlyRootfs() bool {
+	if m != nil {
+		return m.ReadOnlyRootfs
+	}
+	return false
+}
+
+func (m *ExtraData) GetKernelArgs() string {
+	if m != nil {
+		return m.KernelArgs
+	}
+	return ""
+}
+
+func (m *ExtraData) GetLogLevel() string {
+	if m != nil {
+		return m.LogLevel
+	}
+	return ""
+}
+
+func (m *ExtraData) GetConsoleWidth() uint32 {
+	if m != nil {
+		return m.ConsoleWidth
+	}
+	return 0
+}
+
+func (m *ExtraData) GetConsoleHeight() uint32 {
+	if m != nil {
+		return m.ConsoleHeight
+	}
+	return 0
+}
+
+func (m *ExtraData) GetFiles() []*InjectedFile {
+	if m != nil {
+		return m.Files
+	}
+	return nil
+}
+
+// File written into the container rootfs. Content may be a secret, it's never logged.
+type InjectedFile struct {
+	// Absolute path of the file within the container
+	Path string `protobuf:"bytes,1,opt,name=Path,proto3" json:"Path,omitempty"`
+	// Permission bits of the file, 0 means 0600
+	Mode                 uint32   `protobuf:"varint,2,opt,name=Mode,proto3" json:"Mode,omitempty"`
+	Content              []byte   `protobuf:"bytes,3,opt,name=Content,proto3" json:"Content,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *InjectedFile) Reset()         { *m = InjectedFile{} }
+func (m *InjectedFile) String() string { return proto.CompactTextString(m) }
+func (*InjectedFile) ProtoMessage()    {}
+func (*InjectedFile) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_bab87210d157cec3, []int{1}
+}
+func (m *InjectedFile) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_InjectedFile.Unmarshal(m, b)
+}
+func (m *InjectedFile) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_InjectedFile.Marshal(b, m, deterministic)
+}
+func (dst *InjectedFile) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_InjectedFile.Merge(dst, src)
+}
+func (m *InjectedFile) XXX_Size() int {
+	return xxx_messageInfo_InjectedFile.Size(m)
+}
+func (m *InjectedFile) XXX_DiscardUnknown() {
+	xxx_messageInfo_InjectedFile.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_InjectedFile proto.InternalMessageInfo
+
+func (m *InjectedFile) GetPath() string {
+	if m != nil {
+		return m.Path
+	}
+	return ""
+}
+
+func (m *InjectedFile) GetMode() uint32 {
+	if m != nil {
+		return m.Mode
+	}
+	return 0
+}
+
+func (m *InjectedFile) GetContent() []byte {
+	if m != nil {
+		return m.Content
+	}
+	return nil
+}
+
+// Counters of a VM accumulated from Firecracker metrics, published as an event whenever Firecracker flushes metrics
+type VMMetrics struct {
+	VMID string `protobuf:"bytes,1,opt,name=VMID,proto3" json:"VMID,omitempty"`
+	// Time Firecracker flushed the metrics, in milliseconds since Unix epoch
+	TimestampMs          int64    `protobuf:"varint,2,opt,name=TimestampMs,proto3" json:"TimestampMs,omitempty"`
+	BlockReadCount       uint64   `protobuf:"varint,3,opt,name=BlockReadCount,proto3" json:"BlockReadCount,omitempty"`
+	BlockWriteCount      uint64   `protobuf:"varint,4,opt,name=BlockWriteCount,proto3" json:"BlockWriteCount,omitempty"`
+	BlockReadBytes       uint64   `protobuf:"varint,5,opt,name=BlockReadBytes,proto3" json:"BlockReadBytes,omitempty"`
+	BlockWriteBytes      uint64   `protobuf:"varint,6,opt,name=BlockWriteBytes,proto3" json:"BlockWriteBytes,omitempty"`
+	NetRxBytes           uint64   `protobuf:"varint,7,opt,name=NetRxBytes,proto3" json:"NetRxBytes,omitempty"`
+	NetTxBytes           uint64   `protobuf:"varint,8,opt,name=NetTxBytes,proto3" json:"NetTxBytes,omitempty"`
+	VsockRxBytes         uint64   `protobuf:"varint,9,opt,name=VsockRxBytes,proto3" json:"VsockRxBytes,omitempty"`
+	VsockTxBytes         uint64   `protobuf:"varint,10,opt,name=VsockTxBytes,proto3" json:"VsockTxBytes,omitempty"`
+	VcpuExitIoIn         uint64   `protobuf:"varint,11,opt,name=VcpuExitIoIn,proto3" json:"VcpuExitIoIn,omitempty"`
+	VcpuExitIoOut        uint64   `protobuf:"varint,12,opt,name=VcpuExitIoOut,proto3" json:"VcpuExitIoOut,omitempty"`
+	VcpuExitMmioRead     uint64   `protobuf:"varint,13,opt,name=VcpuExitMmioRead,proto3" json:"VcpuExitMmioRead,omitempty"`
+	VcpuExitMmioWrite    uint64   `protobuf:"varint,14,opt,name=VcpuExitMmioWrite,proto3" json:"VcpuExitMmioWrite,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *VMMetrics) Reset()         { *m = VMMetrics{} }
+func (m *VMMetrics) String() string { return proto.CompactTextString(m) }
+func (*VMMetrics) ProtoMessage()    {}
+func (*VMMetrics) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_bab87210d157cec3, []int{2}
+}
+func (m *VMMetrics) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_VMMetrics.Unmarshal(m, b)
+}
+func (m *VMMetrics) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_VMMetrics.Marshal(b, m, deterministic)
+}
+func (dst *VMMetrics) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_VMMetrics.Merge(dst, src)
+}
+func (m *VMMetrics) XXX_Size() int {
+	return xxx_messageInfo_VMMetrics.Size(m)
+}
+func (m *VMMetrics) XXX_DiscardUnknown() {
+	xxx_messageInfo_VMMetrics.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_VMMetrics proto.InternalMessageInfo
+
+func (m *VMMetrics) GetVMID() string {
+	if m != nil {
+		return m.VMID
+	}
+	return ""
+}
+
+func (m *VMMetrics) GetTimestampMs() int64 {
+	if m != nil {
+		return m.TimestampMs
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetBlockReadCount() uint64 {
+	if m != nil {
+		return m.BlockReadCount
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetBlockWriteCount() uint64 {
+	if m != nil {
+		return m.BlockWriteCount
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetBlockReadBytes() uint64 {
+	if m != nil {
+		return m.BlockReadBytes
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetBlockWriteBytes() uint64 {
+	if m != nil {
+		return m.BlockWriteBytes
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetNetRxBytes() uint64 {
+	if m != nil {
+		return m.NetRxBytes
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetNetTxBytes() uint64 {
+	if m != nil {
+		return m.NetTxBytes
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetVsockRxBytes() uint64 {
+	if m != nil {
+		return m.VsockRxBytes
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetVsockTxBytes() uint64 {
+	if m != nil {
+		return m.VsockTxBytes
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetVcpuExitIoIn() uint64 {
+	if m != nil {
+		return m.VcpuExitIoIn
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetVcpuExitIoOut() uint64 {
+	if m != nil {
+		return m.VcpuExitIoOut
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetVcpuExitMmioRead() uint64 {
+	if m != nil {
+		return m.VcpuExitMmioRead
+	}
+	return 0
+}
+
+func (m *VMMetrics) GetVcpuExitMmioWrite() uint64 {
+	if m != nil {
+		return m.VcpuExitMmioWrite
+	}
+	return 0
+}
+
+// Startup of a VM, published once the agent in the VM is ready
+type VMBootMetrics struct {
+	VMID string `protobuf:"bytes,1,opt,name=VMID,proto3" json:"VMID,omitempty"`
+	// Time from creating the VMM until the agent answered, in milliseconds
+	BootTimeMs int64 `protobuf:"varint,2,opt,name=BootTimeMs,proto3" json:"BootTimeMs,omitempty"`
+	// Number of vsock dials it took to reach the agent
+	AgentDialAttempts    uint32   `protobuf:"varint,3,opt,name=AgentDialAttempts,proto3" json:"AgentDialAttempts,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *VMBootMetrics) Reset()         { *m = VMBootMetrics{} }
+func (m *VMBootMetrics) String() string { return proto.CompactTextString(m) }
+func (*VMBootMetrics) ProtoMessage()    {}
+func (*VMBootMetrics) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_bab87210d157cec3, []int{3}
+}
+func (m *VMBootMetrics) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_VMBootMetrics.Unmarshal(m, b)
+}
+func (m *VMBootMetrics) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_VMBootMetrics.Marshal(b, m, deterministic)
+}
+func (dst *VMBootMetrics) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_VMBootMetrics.Merge(dst, src)
+}
+func (m *VMBootMetrics) XXX_Size() int {
+	return xxx_messageInfo_VMBootMetrics.Size(m)
+}
+func (m *VMBootMetrics) XXX_DiscardUnknown() {
+	xxx_messageInfo_VMBootMetrics.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_VMBootMetrics proto.InternalMessageInfo
+
+func (m *VMBootMetrics) GetVMID() string {
+	if m != nil {
+		return m.VMID
+	}
+	return ""
+}
+
+func (m *VMBootMetrics) GetBootTimeMs() int64 {
+	if m != nil {
+		return m.BootTimeMs
+	}
+	return 0
+}
+
+func (m *VMBootMetrics) GetAgentDialAttempts() uint32 {
+	if m != nil {
+		return m.AgentDialAttempts
+	}
+	return 0
+}
+
+// Stats of a container combined with resource usage of the VMM running it, returned by Stats.
+// Fields 1 to 6 match io.containerd.cgroups.v1.Metrics and hold the container's cgroup stats in the guest,
+// so the stats are sent as cgroup metrics and tools unaware of VMM stats (like ctr) can still read them.
+type ContainerStats struct {
+	Hugetlb              []*cgroups.HugetlbStat `protobuf:"bytes,1,rep,name=Hugetlb" json:"Hugetlb,omitempty"`
+	Pids                 *cgroups.PidsStat      `protobuf:"bytes,2,opt,name=Pids" json:"Pids,omitempty"`
+	CPU                  *cgroups.CPUStat       `protobuf:"bytes,3,opt,name=CPU" json:"CPU,omitempty"`
+	Memory               *cgroups.MemoryStat    `protobuf:"bytes,4,opt,name=Memory" json:"Memory,omitempty"`
+	Blkio                *cgroups.BlkIOStat     `protobuf:"bytes,5,opt,name=Blkio" json:"Blkio,omitempty"`
+	Rdma                 *cgroups.RdmaStat      `protobuf:"bytes,6,opt,name=Rdma" json:"Rdma,omitempty"`
+	VMM                  *VMMStats              `protobuf:"bytes,100,opt,name=VMM" json:"VMM,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}               `json:"-"`
+	XXX_unrecognized     []byte                 `json:"-"`
+	XXX_sizecache        int32                  `json:"-"`
+}
+
+func (m *ContainerStats) Reset()         { *m = ContainerStats{} }
+func (m *ContainerStats) String() string { return proto.CompactTextString(m) }
+func (*ContainerStats) ProtoMessage()    {}
+func (*ContainerStats) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_bab87210d157cec3, []int{4}
+}
+func (m *ContainerStats) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ContainerStats.Unmarshal(m, b)
+}
+func (m *ContainerStats) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ContainerStats.Marshal(b, m, deterministic)
+}
+func (dst *ContainerStats) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ContainerStats.Merge(dst, src)
+}
+func (m *ContainerStats) XXX_Size() int {
+	return xxx_messageInfo_ContainerStats.Size(m)
+}
+func (m *ContainerStats) XXX_DiscardUnknown() {
+	xxx_messageInfo_ContainerStats.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ContainerStats proto.InternalMessageInfo
+
+func (m *ContainerStats) GetHugetlb() []*cgroups.HugetlbStat {
+	if m != nil {
+		return m.Hugetlb
+	}
+	return nil
+}
+
+func (m *ContainerStats) GetPids() *cgroups.PidsStat {
+	if m != nil {
+		return m.Pids
+	}
+	return nil
+}
+
+func (m *ContainerStats) GetCPU() *cgroups.CPUStat {
+	if m != nil {
+		return m.CPU
+	}
+	return nil
+}
+
+func (m *ContainerStats) GetMemory() *cgroups.MemoryStat {
+	if m != nil {
+		return m.Memory
+	}
+	return nil
+}
+
+func (m *ContainerStats) GetBlkio() *cgroups.BlkIOStat {
+	if m != nil {
+		return m.Blkio
+	}
+	return nil
+}
+
+func (m *ContainerStats) GetRdma() *cgroups.RdmaStat {
+	if m != nil {
+		return m.Rdma
+	}
+	return nil
+}
+
+func (m *ContainerStats) GetVMM() *VMMStats {
+	if m != nil {
+		return m.VMM
+	}
+	return nil
+}
+
+// Resource usage of the Firecracker process on the host
+type VMMStats struct {
+	Pid uint32 `protobuf:"varint,1,opt,name=Pid,proto3" json:"Pid,omitempty"`
+	// Resident memory of the process, including guest memory touched by the guest
+	RSSBytes uint64 `protobuf:"varint,2,opt,name=RSSBytes,proto3" json:"RSSBytes,omitempty"`
+	// CPU time spent by vCPU threads, in nanoseconds
+	VcpuTimeNs uint64 `protobuf:"varint,3,opt,name=VcpuTimeNs,proto3" json:"VcpuTimeNs,omitempty"`
+	// CPU time spent by all threads of the process (vCPUs, API and I/O), in nanoseconds
+	CPUTimeNs            uint64   `protobuf:"varint,4,opt,name=CPUTimeNs,proto3" json:"CPUTimeNs,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *VMMStats) Reset()         { *m = VMMStats{} }
+func (m *VMMStats) String() string { return proto.CompactTextString(m) }
+func (*VMMStats) ProtoMessage()    {}
+func (*VMMStats) Descriptor() ([]byte, []int) {
+	return fileDescriptor_types_bab87210d157cec3, []int{5}
+}
+func (m *VMMStats) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_VMMStats.Unmarshal(m, b)
+}
+func (m *VMMStats) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_VMMStats.Marshal(b, m, deterministic)
+}
+func (dst *VMMStats) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_VMMStats.Merge(dst, src)
+}
+func (m *VMMStats) XXX_Size() int {
+	return xxx_messageInfo_VMMStats.Size(m)
+}
+func (m *VMMStats) XXX_DiscardUnknown() {
+	xxx_messageInfo_VMMStats.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_VMMStats proto.InternalMessageInfo
+
+func (m *VMMStats) GetPid() uint32 {
+	if m != nil {
+		return m.Pid
+	}
+	return 0
+}
+
+func (m *VMMStats) GetRSSBytes() uint64 {
+	if m != nil {
+		return m.RSSBytes
+	}
+	return 0
+}
+
+func (m *VMMStats) GetVcpuTimeNs() uint64 {
+	if m != nil {
+		return m.VcpuTimeNs
+	}
+	return 0
+}
+
+func (m *VMMStats) GetCPUTimeNs() uint64 {
+	if m != nil {
+		return m.CPUTimeNs
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*ExtraData)(nil), "firecracker.containerd.ExtraData")
+	proto.RegisterType((*InjectedFile)(nil), "firecracker.containerd.InjectedFile")
+	proto.RegisterType((*VMMetrics)(nil), "firecracker.containerd.VMMetrics")
+	proto.RegisterType((*VMBootMetrics)(nil), "firecracker.containerd.VMBootMetrics")
+	proto.RegisterType((*ContainerStats)(nil), "firecracker.containerd.ContainerStats")
+	proto.RegisterType((*VMMStats)(nil), "firecracker.containerd.VMMStats")
 }
 
-func init() { proto.RegisterFile("proto/types.proto", fileDescriptor_types_fd1a0f9dde9f57da) }
-
-var fileDescriptor_types_fd1a0f9dde9f57da = []byte{
-	// 188 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x2c, 0x28, 0xca, 0x2f,
-	0xc9, 0xd7, 0x2f, 0xa9, 0x2c, 0x48, 0x2d, 0xd6, 0x03, 0xb3, 0x85, 0xc4, 0xd2, 0x32, 0x8b, 0x52,
-	0x93, 0x8b, 0x12, 0x93, 0xb3, 0x53, 0x8b, 0xf4, 0x92, 0xf3, 0xf3, 0x4a, 0x12, 0x33, 0xf3, 0x52,
-	0x8b, 0x52, 0xa4, 0x24, 0xd3, 0xf3, 0xf3, 0xd3, 0x73, 0x52, 0xf5, 0xc1, 0xaa, 0x92, 0x4a, 0xd3,
-	0xf4, 0x13, 0xf3, 0x2a, 0x21, 0x5a, 0x94, 0xe2, 0xb9, 0x38, 0x5d, 0x2b, 0x4a, 0x8a, 0x12, 0x5d,
-	0x12, 0x4b, 0x12, 0x85, 0xa4, 0xb8, 0x38, 0xbc, 0x8a, 0xf3, 0xf3, 0x82, 0x0b, 0x52, 0x93, 0x25,
-	0x18, 0x15, 0x18, 0x35, 0x78, 0x82, 0xe0, 0x7c, 0x21, 0x33, 0x2e, 0xee, 0xa0, 0xd2, 0xbc, 0x64,
-	0xff, 0x82, 0x92, 0xcc, 0xfc, 0xbc, 0x62, 0x09, 0x26, 0x05, 0x46, 0x0d, 0x6e, 0x23, 0x11, 0x3d,
-	0x88, 0xc9, 0x7a, 0x30, 0x93, 0xf5, 0x1c, 0xf3, 0x2a, 0x83, 0x90, 0x15, 0x3a, 0xd9, 0x46, 0x59,
-	0xa7, 0x67, 0x96, 0x64, 0x94, 0x26, 0xe9, 0x25, 0xe7, 0xe7, 0xea, 0x23, 0x39, 0x50, 0x37, 0x37,
-	0x33, 0xb9, 0x28, 0xbf, 0x0c, 0x55, 0x0c, 0xe1, 0x68, 0xa8, 0x63, 0xd9, 0xc0, 0x94, 0x31, 0x20,
-	0x00, 0x00, 0xff, 0xff, 0xad, 0x88, 0x4e, 0x21, 0xee, 0x00, 0x00, 0x00,
+func init() { proto.RegisterFile("proto/types.proto", fileDescriptor_types_bab87210d157cec3) }
+
+var fileDescriptor_types_bab87210d157cec3 = []byte{
+	// 815 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x55, 0x6d, 0x6f, 0xea, 0x36,
+	0x14, 0x16, 0x85, 0xf2, 0x72, 0x80, 0xee, 0x5e, 0x6b, 0x9a, 0xbc, 0x6a, 0xaa, 0xb2, 0xec, 0x6e,
+	0x42, 0x7b, 0x09, 0x1a, 0x57, 0xba, 0xd2, 0xde, 0x34, 0x01, 0xed, 0x54, 0xb6, 0xa6, 0x20, 0xd3,
+	0x52, 0x69, 0xdf, 0xd2, 0xc4, 0x0d, 0x1e, 0x49, 0x9c, 0x25, 0x0e, 0x2a, 0x3f, 0x63, 0xbf, 0x61,
+	0x3f, 0x6e, 0x7f, 0x63, 0xb2, 0x9d, 0x40, 0xa0, 0x63, 0xf7, 0x13, 0xf6, 0x73, 0x9e, 0xe7, 0xe0,
+	0x9c, 0xf3, 0xf8, 0x18, 0x5e, 0xc7, 0x09, 0x17, 0xbc, 0x2f, 0x36, 0x31, 0x4d, 0x2d, 0xb5, 0x46,
+	0x1f, 0x3d, 0xb1, 0x84, 0xba, 0x89, 0xe3, 0xae, 0x68, 0x62, 0xb9, 0x3c, 0x12, 0x0e, 0x8b, 0x68,
+	0xe2, 0x9d, 0x7f, 0xec, 0x73, 0xee, 0x07, 0xb4, 0xaf, 0x58, 0x8f, 0xd9, 0x53, 0xdf, 0x89, 0x36,
+	0x5a, 0x72, 0xfe, 0x95, 0xcf, 0xc4, 0x32, 0x7b, 0xb4, 0x5c, 0x1e, 0xf6, 0x77, 0x8a, 0xbe, 0xeb,
+	0x27, 0x3c, 0x8b, 0xd3, 0x7e, 0x48, 0x45, 0xc2, 0xdc, 0x3c, 0xbf, 0xf9, 0xcf, 0x09, 0xb4, 0xae,
+	0x9e, 0x45, 0xe2, 0x5c, 0x3a, 0xc2, 0x41, 0xe7, 0xd0, 0xfc, 0x35, 0xe5, 0xd1, 0x3c, 0xa6, 0x2e,
+	0xae, 0x18, 0x95, 0x5e, 0x87, 0x6c, 0xf7, 0xe8, 0x1d, 0xb4, 0x49, 0x16, 0xb9, 0xd3, 0x58, 0x30,
+	0x1e, 0xa5, 0xf8, 0xc4, 0xa8, 0xf4, 0xda, 0x83, 0x0f, 0x2d, 0x7d, 0x0e, 0xab, 0x38, 0x87, 0x35,
+	0x8c, 0x36, 0xa4, 0x4c, 0x44, 0x9f, 0x40, 0x6b, 0xe1, 0xc6, 0xd9, 0x98, 0x67, 0x91, 0xc0, 0x55,
+	0xa3, 0xd2, 0xeb, 0x92, 0x1d, 0x80, 0xbe, 0x80, 0x33, 0x42, 0x1d, 0x6f, 0x1a, 0x05, 0x1b, 0xc2,
+	0xb9, 0x78, 0x4a, 0x71, 0xcd, 0xa8, 0xf4, 0x9a, 0xe4, 0x00, 0x45, 0x17, 0x00, 0xbf, 0xd1, 0x24,
+	0xa2, 0xc1, 0x30, 0xf1, 0x53, 0x7c, 0x6a, 0x54, 0x7a, 0x2d, 0x52, 0x42, 0xe4, 0xc9, 0x6f, 0xb8,
+	0x7f, 0x43, 0xd7, 0x34, 0xc0, 0x75, 0x15, 0xdd, 0xee, 0x91, 0x09, 0x9d, 0x31, 0x8f, 0x52, 0x1e,
+	0xd0, 0x07, 0xe6, 0x89, 0x25, 0x6e, 0xa8, 0x43, 0xec, 0x61, 0xe8, 0x0d, 0x74, 0xf3, 0xfd, 0x35,
+	0x65, 0xfe, 0x52, 0xe0, 0xa6, 0x22, 0xed, 0x83, 0xe8, 0x7b, 0x38, 0xfd, 0x85, 0x05, 0x34, 0xc5,
+	0x60, 0x54, 0x7b, 0xed, 0xc1, 0x1b, 0xeb, 0xbf, 0xbb, 0x63, 0x4d, 0xa2, 0x3f, 0xa8, 0x2b, 0xa8,
+	0x27, 0xc9, 0x44, 0x4b, 0xcc, 0x19, 0x74, 0xca, 0x30, 0x42, 0x50, 0x9b, 0x39, 0x62, 0xa9, 0xea,
+	0xdc, 0x22, 0x6a, 0x2d, 0x31, 0x9b, 0x7b, 0x54, 0x15, 0xb7, 0x4b, 0xd4, 0x1a, 0x61, 0x68, 0x8c,
+	0x79, 0x24, 0x68, 0x5e, 0xbd, 0x0e, 0x29, 0xb6, 0xe6, 0x5f, 0x35, 0x68, 0x2d, 0x6c, 0x5b, 0xf7,
+	0x53, 0x6a, 0x17, 0xf6, 0xe4, 0xb2, 0xc8, 0x27, 0xd7, 0xc8, 0x80, 0xf6, 0x1d, 0x0b, 0x69, 0x2a,
+	0x9c, 0x30, 0xb6, 0x75, 0xcf, 0xaa, 0xa4, 0x0c, 0xc9, 0xfa, 0x8f, 0x02, 0xee, 0xae, 0x64, 0xb9,
+	0x77, 0x2d, 0xaa, 0x91, 0x03, 0x14, 0xf5, 0xe0, 0x03, 0x85, 0x3c, 0x24, 0x4c, 0x50, 0x4d, 0xac,
+	0x29, 0xe2, 0x21, 0xbc, 0x97, 0x71, 0xb4, 0x11, 0x54, 0x77, 0xab, 0x46, 0x0e, 0xd0, 0xfd, 0x8c,
+	0x9a, 0x58, 0x3f, 0xcc, 0xa8, 0x99, 0x17, 0x00, 0xb7, 0x54, 0x90, 0x67, 0x4d, 0x6a, 0x28, 0x52,
+	0x09, 0xc9, 0xe3, 0x77, 0x79, 0xbc, 0xb9, 0x8d, 0xe7, 0x88, 0xec, 0xff, 0x22, 0x95, 0xff, 0x9d,
+	0x33, 0x5a, 0x8a, 0xb1, 0x87, 0x6d, 0x39, 0x45, 0x16, 0x28, 0x71, 0xca, 0x79, 0xdc, 0x38, 0xbb,
+	0x7a, 0x66, 0x62, 0xc2, 0x27, 0x11, 0x6e, 0xe7, 0x9c, 0x12, 0x26, 0x7d, 0xb4, 0xdb, 0x4f, 0x33,
+	0x81, 0x3b, 0x8a, 0xb4, 0x0f, 0xa2, 0x2f, 0xe1, 0x55, 0x01, 0xd8, 0x21, 0xe3, 0xb2, 0x28, 0xb8,
+	0xab, 0x88, 0x2f, 0x70, 0xf4, 0x35, 0xbc, 0x2e, 0x63, 0xaa, 0x2e, 0xf8, 0x4c, 0x91, 0x5f, 0x06,
+	0xcc, 0x3f, 0xa1, 0xbb, 0xb0, 0x47, 0x9c, 0x8b, 0xff, 0xb3, 0xc5, 0x05, 0x80, 0xa4, 0x48, 0x1f,
+	0x6c, 0x5d, 0x51, 0x42, 0xe4, 0x5f, 0x0e, 0x7d, 0x1a, 0x89, 0x4b, 0xe6, 0x04, 0x43, 0x21, 0x68,
+	0x18, 0x8b, 0x34, 0xbf, 0xba, 0x2f, 0x03, 0xe6, 0xdf, 0x55, 0x38, 0x1b, 0x17, 0xde, 0x9f, 0x0b,
+	0x47, 0xa4, 0xe8, 0x67, 0x68, 0x5c, 0x67, 0x3e, 0x15, 0xc1, 0x23, 0xae, 0xa8, 0x9b, 0xf2, 0xb9,
+	0xc5, 0x78, 0xf9, 0x82, 0xe4, 0xc3, 0xc8, 0x5a, 0x7f, 0x6b, 0xe5, 0x44, 0x29, 0x24, 0x85, 0x0a,
+	0xbd, 0x83, 0xda, 0x8c, 0x79, 0xc5, 0x94, 0x31, 0x8f, 0xab, 0x25, 0x4b, 0x49, 0x15, 0x1f, 0xbd,
+	0x85, 0xea, 0x78, 0x76, 0xaf, 0xce, 0xda, 0x1e, 0x7c, 0x7a, 0x5c, 0x36, 0x9e, 0xdd, 0x2b, 0x95,
+	0x64, 0xa3, 0x1f, 0xa1, 0x6e, 0xd3, 0x90, 0x27, 0x1b, 0x65, 0x69, 0x79, 0xad, 0x8f, 0xea, 0x34,
+	0x4f, 0x49, 0x73, 0x0d, 0xfa, 0x0e, 0x4e, 0x47, 0xc1, 0x8a, 0x71, 0x65, 0xf3, 0xf6, 0xe0, 0xb3,
+	0xe3, 0xe2, 0x51, 0xb0, 0x9a, 0x4c, 0x95, 0x56, 0x2b, 0xe4, 0x57, 0x12, 0x2f, 0x74, 0x70, 0xfd,
+	0x7d, 0x5f, 0x29, 0x59, 0xfa, 0x2b, 0xe5, 0x0a, 0x0d, 0xa0, 0xba, 0xb0, 0x6d, 0xec, 0x29, 0x99,
+	0x71, 0x6c, 0x08, 0x2d, 0x6c, 0x5b, 0x75, 0x83, 0x48, 0xb2, 0xb9, 0x86, 0x66, 0x01, 0xa0, 0x57,
+	0x50, 0x9d, 0x31, 0x4f, 0x59, 0xa2, 0x4b, 0xe4, 0x52, 0x8e, 0x4f, 0x32, 0x9f, 0x6b, 0xeb, 0x9f,
+	0x28, 0x6f, 0x6d, 0xf7, 0xd2, 0x2d, 0xd2, 0x67, 0xd2, 0x1b, 0xb7, 0x69, 0x3e, 0x1e, 0x4a, 0x88,
+	0x1c, 0xf0, 0xe3, 0xd9, 0x7d, 0x1e, 0xd6, 0x43, 0x61, 0x07, 0x8c, 0x7e, 0xfa, 0xfd, 0x87, 0xd2,
+	0x7b, 0x54, 0x3a, 0xea, 0x37, 0x21, 0x73, 0x13, 0xbe, 0xde, 0xc7, 0x4a, 0xef, 0x95, 0x7e, 0x51,
+	0xea, 0xea, 0xe7, 0xed, 0xbf, 0x03, 0x00, 0xb7, 0xc6, 0xaa, 0xe2, 0x1b, 0x07, 0x00, 0x00,
 }
@@ -0,0 +1,218 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/pkg/errors"
+)
+
+// agentLimiter bounds the number of concurrent in-flight RPCs to the agent of a VM.
+// Requests beyond the limit are queued for up to queueTimeout, then rejected.
+type agentLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+func newAgentLimiter(maxInFlight int, queueTimeout time.Duration) *agentLimiter {
+	return &agentLimiter{
+		slots:        make(chan struct{}, maxInFlight),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// acquire takes a slot, the returned function gives it back
+func (l *agentLimiter) acquire(ctx context.Context) (func(), error) {
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	if l.queueTimeout > 0 {
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+
+		select {
+		case l.slots <- struct{}{}:
+			return l.release, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	// Unavailable is mapped to a retryable gRPC status code
+	err := errors.Wrapf(errdefs.ErrUnavailable, "agent is busy with %d in-flight requests, try again later", cap(l.slots))
+	return nil, errdefs.ToGRPC(err)
+}
+
+func (l *agentLimiter) release() {
+	<-l.slots
+}
+
+// limitedTaskService applies admission control to the agent's task service.
+// Wait blocks until a process exits, so it's not limited, and neither are Kill and Shutdown,
+// as stopping containers must remain possible while the agent is overloaded.
+type limitedTaskService struct {
+	taskAPI.TaskService
+	limiter *agentLimiter
+}
+
+var _ = (taskAPI.TaskService)(&limitedTaskService{})
+
+func (s *limitedTaskService) State(ctx context.Context, req *taskAPI.StateRequest) (*taskAPI.StateResponse, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.State(ctx, req)
+}
+
+func (s *limitedTaskService) Create(ctx context.Context, req *taskAPI.CreateTaskRequest) (*taskAPI.CreateTaskResponse, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.Create(ctx, req)
+}
+
+func (s *limitedTaskService) Start(ctx context.Context, req *taskAPI.StartRequest) (*taskAPI.StartResponse, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.Start(ctx, req)
+}
+
+func (s *limitedTaskService) Delete(ctx context.Context, req *taskAPI.DeleteRequest) (*taskAPI.DeleteResponse, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.Delete(ctx, req)
+}
+
+func (s *limitedTaskService) Pids(ctx context.Context, req *taskAPI.PidsRequest) (*taskAPI.PidsResponse, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.Pids(ctx, req)
+}
+
+func (s *limitedTaskService) Pause(ctx context.Context, req *taskAPI.PauseRequest) (*ptypes.Empty, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.Pause(ctx, req)
+}
+
+func (s *limitedTaskService) Resume(ctx context.Context, req *taskAPI.ResumeRequest) (*ptypes.Empty, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.Resume(ctx, req)
+}
+
+func (s *limitedTaskService) Checkpoint(ctx context.Context, req *taskAPI.CheckpointTaskRequest) (*ptypes.Empty, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.Checkpoint(ctx, req)
+}
+
+func (s *limitedTaskService) Exec(ctx context.Context, req *taskAPI.ExecProcessRequest) (*ptypes.Empty, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.Exec(ctx, req)
+}
+
+func (s *limitedTaskService) ResizePty(ctx context.Context, req *taskAPI.ResizePtyRequest) (*ptypes.Empty, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.ResizePty(ctx, req)
+}
+
+func (s *limitedTaskService) CloseIO(ctx context.Context, req *taskAPI.CloseIORequest) (*ptypes.Empty, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.CloseIO(ctx, req)
+}
+
+func (s *limitedTaskService) Update(ctx context.Context, req *taskAPI.UpdateTaskRequest) (*ptypes.Empty, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.Update(ctx, req)
+}
+
+func (s *limitedTaskService) Stats(ctx context.Context, req *taskAPI.StatsRequest) (*taskAPI.StatsResponse, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.Stats(ctx, req)
+}
+
+func (s *limitedTaskService) Connect(ctx context.Context, req *taskAPI.ConnectRequest) (*taskAPI.ConnectResponse, error) {
+	release, err := s.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return s.TaskService.Connect(ctx, req)
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingTaskService blocks Exec and Wait calls until unblocked
+type blockingTaskService struct {
+	taskAPI.TaskService
+	unblock chan struct{}
+}
+
+func (s *blockingTaskService) Exec(ctx context.Context, req *taskAPI.ExecProcessRequest) (*ptypes.Empty, error) {
+	<-s.unblock
+	return &ptypes.Empty{}, nil
+}
+
+func (s *blockingTaskService) Wait(ctx context.Context, req *taskAPI.WaitRequest) (*taskAPI.WaitResponse, error) {
+	<-s.unblock
+	return &taskAPI.WaitResponse{}, nil
+}
+
+func TestAgentLimiter(t *testing.T) {
+	ctx := context.Background()
+	limiter := newAgentLimiter(1, 0)
+
+	release, err := limiter.acquire(ctx)
+	require.NoError(t, err)
+
+	_, err = limiter.acquire(ctx)
+	require.Error(t, err)
+	assert.True(t, errdefs.IsUnavailable(errdefs.FromGRPC(err)))
+
+	release()
+	release, err = limiter.acquire(ctx)
+	require.NoError(t, err)
+
+	// Queued requests get the slot once it's released
+	limiter.queueTimeout = time.Minute
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+
+	release, err = limiter.acquire(ctx)
+	require.NoError(t, err)
+
+	limiter.queueTimeout = 10 * time.Millisecond
+	_, err = limiter.acquire(ctx)
+	assert.True(t, errdefs.IsUnavailable(errdefs.FromGRPC(err)))
+
+	release()
+}
+
+func TestLimitedTaskService(t *testing.T) {
+	ctx := context.Background()
+	agent := &blockingTaskService{unblock: make(chan struct{})}
+	client := &limitedTaskService{TaskService: agent, limiter: newAgentLimiter(1, 0)}
+
+	execErr := make(chan error)
+	go func() {
+		_, err := client.Exec(ctx, &taskAPI.ExecProcessRequest{})
+		execErr <- err
+	}()
+
+	// Wait until the exec takes the only slot
+	for len(client.limiter.slots) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err := client.Exec(ctx, &taskAPI.ExecProcessRequest{})
+	assert.Error(t, err)
+
+	// Waits are not limited
+	waitErr := make(chan error)
+	go func() {
+		_, err := client.Wait(ctx, &taskAPI.WaitRequest{})
+		waitErr <- err
+	}()
+
+	close(agent.unblock)
+	assert.NoError(t, <-execErr)
+	assert.NoError(t, <-waitErr)
+	assert.Len(t, client.limiter.slots, 0)
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// How long to wait for Firecracker to spawn its vCPU threads once the instance is started
+	vcpuThreadsTimeout = time.Second
+
+	// Number of CPUs a CPU set can hold (CPU_SETSIZE)
+	maxCPUs = 1024
+)
+
+var (
+	// Names Firecracker gives its vCPU threads, like "fc_vcpu 0" ("fc_vcpu0" in older versions)
+	vcpuThreadName = regexp.MustCompile(`^fc_vcpu ?([0-9]+)$`)
+
+	// Sets CPU affinity of a thread, replaceable in tests
+	schedSetaffinity = unix.SchedSetaffinity
+)
+
+// parseCPUList parses a list of CPUs in cpuset format (like "0-3,8"), returning sorted unique CPUs
+func parseCPUList(list string) ([]int, error) {
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, errors.Errorf("invalid CPU %q", bounds[0])
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, errors.Errorf("invalid CPU range %q", part)
+			}
+		}
+
+		if last >= maxCPUs {
+			return nil, errors.Errorf("CPUs can't exceed %d", maxCPUs-1)
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			seen[cpu] = true
+		}
+	}
+
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// isCPUSubset returns true if all cpus are in the set
+func isCPUSubset(cpus, set []int) bool {
+	allowed := make(map[int]bool, len(set))
+	for _, cpu := range set {
+		allowed[cpu] = true
+	}
+
+	for _, cpu := range cpus {
+		if !allowed[cpu] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func formatCPUList(cpus []int) string {
+	list := make([]string, len(cpus))
+	for i, cpu := range cpus {
+		list[i] = strconv.Itoa(cpu)
+	}
+
+	return strings.Join(list, ",")
+}
+
+// vcpuThreads returns thread IDs of vCPUs of the given Firecracker process, by vCPU index
+func vcpuThreads(pid int) (map[int]int, error) {
+	taskDir := filepath.Join(procDir, strconv.Itoa(pid), "task")
+	entries, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		return nil, err
+	}
+
+	threads := make(map[int]int)
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// Threads may exit while being inspected, they are skipped then
+		comm, err := ioutil.ReadFile(filepath.Join(taskDir, entry.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+
+		if match := vcpuThreadName.FindStringSubmatch(strings.TrimSpace(string(comm))); match != nil {
+			index, _ := strconv.Atoi(match[1])
+			threads[index] = tid
+		}
+	}
+
+	return threads, nil
+}
+
+// pinVcpus sets CPU affinity of vCPU threads of the given Firecracker process. With at least as many CPUs as
+// vCPUs, each vCPU gets a CPU of its own (in order), otherwise all vCPUs share all the CPUs.
+func pinVcpus(ctx context.Context, pid, vcpuCount int, cpus []int) error {
+	deadline := time.Now().Add(vcpuThreadsTimeout)
+	threads, err := vcpuThreads(pid)
+	for err == nil && len(threads) < vcpuCount && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		threads, err = vcpuThreads(pid)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "failed to find vCPU threads")
+	}
+
+	if len(threads) < vcpuCount {
+		return errors.Errorf("found %d vCPU threads out of %d", len(threads), vcpuCount)
+	}
+
+	shared := len(cpus) < vcpuCount
+	if shared {
+		log.G(ctx).WithFields(logrus.Fields{"cpus": formatCPUList(cpus), "vcpus": vcpuCount}).
+			Warn("fewer CPUs than vCPUs to pin to, vCPUs share the CPUs")
+	}
+
+	for index, tid := range threads {
+		var set unix.CPUSet
+		if shared {
+			for _, cpu := range cpus {
+				set.Set(cpu)
+			}
+		} else {
+			set.Set(cpus[index])
+		}
+
+		if err := schedSetaffinity(tid, &set); err != nil {
+			return errors.Wrapf(err, "failed to set affinity of vCPU %d (thread %d)", index, tid)
+		}
+	}
+
+	log.G(ctx).WithFields(logrus.Fields{"cpus": formatCPUList(cpus), "shared": shared}).Info("pinned vCPUs")
+	return nil
+}
+
+// cpusetCgroup returns the cgroup the VMM of the VM is moved into, or "" if none is configured
+func (s *service) cpusetCgroup() string {
+	if s.config.CpusetCgroup == "" {
+		return ""
+	}
+
+	return filepath.Join(s.config.CpusetCgroup, jailID(s.namespace, s.id))
+}
+
+// joinCpusetCgroup creates a cpuset cgroup restricted to the given CPUs and moves the process into it.
+// Memory nodes are inherited from the parent, which cgroup v1 doesn't do on its own.
+func joinCpusetCgroup(dir string, cpus []int, pid int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "cpuset.cpus"), []byte(formatCPUList(cpus)), 0644); err != nil {
+		return errors.Wrap(err, "failed to set cpuset.cpus")
+	}
+
+	mems, err := ioutil.ReadFile(filepath.Join(dir, "cpuset.mems"))
+	if err == nil && strings.TrimSpace(string(mems)) == "" {
+		parentMems, err := ioutil.ReadFile(filepath.Join(filepath.Dir(dir), "cpuset.mems"))
+		if err != nil {
+			return errors.Wrap(err, "failed to read cpuset.mems of parent cgroup")
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "cpuset.mems"), parentMems, 0644); err != nil {
+			return errors.Wrap(err, "failed to set cpuset.mems")
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return errors.Wrap(err, "failed to move VMM into cgroup")
+	}
+
+	return nil
+}
+
+// applyCPUAffinity moves the VMM into its cpuset cgroup (if configured) and pins its vCPUs.
+// The cgroup comes first, as joining a cpuset resets CPU affinity of the process's threads.
+func (s *service) applyCPUAffinity(ctx context.Context, pid, vcpuCount int, cpus []int) error {
+	if dir := s.cpusetCgroup(); dir != "" {
+		if err := joinCpusetCgroup(dir, cpus, pid); err != nil {
+			return errors.Wrapf(err, "failed to set up cpuset cgroup %s", dir)
+		}
+	}
+
+	return pinVcpus(ctx, pid, vcpuCount, cpus)
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := parseCPUList("4-6, 0,5")
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 4, 5, 6}, cpus)
+	assert.Equal(t, "0,4,5,6", formatCPUList(cpus))
+
+	assert.True(t, isCPUSubset([]int{4, 6}, cpus))
+	assert.False(t, isCPUSubset([]int{1}, cpus))
+
+	for _, list := range []string{"", "a", "-1", "3-1", "0-", "1,,2", "1024", "0-4096"} {
+		_, err := parseCPUList(list)
+		assert.Errorf(t, err, "list %q", list)
+	}
+}
+
+func TestPinVcpus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prevProcDir := procDir
+	procDir = dir
+	defer func() { procDir = prevProcDir }()
+
+	for tid, comm := range map[int]string{100: "firecracker", 101: "fc_api", 102: "fc_vcpu 0", 103: "fc_vcpu 1"} {
+		taskDir := filepath.Join(dir, "100", "task", strconv.Itoa(tid))
+		require.NoError(t, os.MkdirAll(taskDir, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir, "comm"), []byte(comm+"\n"), 0644))
+	}
+
+	threads, err := vcpuThreads(100)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 102, 1: 103}, threads)
+
+	affinity := make(map[int]*unix.CPUSet)
+	prevSchedSetaffinity := schedSetaffinity
+	schedSetaffinity = func(tid int, set *unix.CPUSet) error {
+		copied := *set
+		affinity[tid] = &copied
+		return nil
+	}
+	defer func() { schedSetaffinity = prevSchedSetaffinity }()
+
+	// Each vCPU gets a CPU of its own
+	require.NoError(t, pinVcpus(context.Background(), 100, 2, []int{2, 3, 4}))
+	require.Len(t, affinity, 2)
+	assert.Equal(t, 1, affinity[102].Count())
+	assert.True(t, affinity[102].IsSet(2))
+	assert.Equal(t, 1, affinity[103].Count())
+	assert.True(t, affinity[103].IsSet(3))
+
+	// vCPUs share the only CPU
+	require.NoError(t, pinVcpus(context.Background(), 100, 2, []int{5}))
+	assert.True(t, affinity[102].IsSet(5))
+	assert.True(t, affinity[103].IsSet(5))
+
+	// Missing vCPU threads
+	assert.Error(t, pinVcpus(context.Background(), 100, 3, []int{2, 3, 4}))
+}
+
+func TestJoinCpusetCgroup(t *testing.T) {
+	parent, err := ioutil.TempDir("", "cpuset")
+	require.NoError(t, err)
+	defer os.RemoveAll(parent)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(parent, "cpuset.mems"), []byte("0-1\n"), 0644))
+
+	// cgroup v1 creates cpuset.mems empty
+	dir := filepath.Join(parent, "vm")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cpuset.mems"), nil, 0644))
+
+	require.NoError(t, joinCpusetCgroup(dir, []int{2, 3}, 42))
+
+	for name, expected := range map[string]string{"cpuset.cpus": "2,3", "cpuset.mems": "0-1\n", "cgroup.procs": "42"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(data), name)
+	}
+}
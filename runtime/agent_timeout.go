@@ -0,0 +1,260 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Timeout of agent RPCs unless configured otherwise
+const defaultAgentTimeoutMs = 60000
+
+// agentMethods lists RPCs of the agent's task service, which timeouts can be configured for.
+// The ones mapped to true block until something happens in the guest (like a process exiting),
+// so the default timeout doesn't apply to them, only a timeout configured for them explicitly.
+var agentMethods = map[string]bool{
+	"State":      false,
+	"Create":     false,
+	"Start":      false,
+	"Delete":     false,
+	"Pids":       false,
+	"Pause":      false,
+	"Resume":     false,
+	"Checkpoint": true,
+	"Kill":       false,
+	"Exec":       false,
+	"ResizePty":  false,
+	"CloseIO":    false,
+	"Update":     false,
+	"Wait":       true,
+	"Stats":      false,
+	"Connect":    false,
+	"Shutdown":   false,
+}
+
+// validateAgentTimeouts checks per-RPC timeouts name RPCs of the agent and aren't negative
+func validateAgentTimeouts(timeouts map[string]int) error {
+	for method, timeout := range timeouts {
+		if _, ok := agentMethods[method]; !ok {
+			return errors.Errorf("unknown agent RPC %q", method)
+		}
+
+		if timeout < 0 {
+			return errors.Errorf("timeout of %s can't be negative", method)
+		}
+	}
+
+	return nil
+}
+
+// agentTimeout returns the timeout of the agent RPC, 0 if it isn't bounded
+func (c *Config) agentTimeout(method string) time.Duration {
+	if timeout, ok := c.AgentRPCTimeoutsMs[method]; ok {
+		return time.Duration(timeout) * time.Millisecond
+	}
+
+	if agentMethods[method] {
+		return 0
+	}
+
+	return time.Duration(c.AgentTimeoutMs) * time.Millisecond
+}
+
+// timeoutTaskService bounds RPCs to the agent's task service, so a wedged agent fails requests
+// instead of hanging the shim
+type timeoutTaskService struct {
+	taskAPI.TaskService
+	config *Config
+}
+
+var _ = (taskAPI.TaskService)(&timeoutTaskService{})
+
+// call runs the RPC with the timeout of the method. Running out of time is reported as DeadlineExceeded
+// naming the RPC, while the caller's own deadline or cancellation is passed on as is.
+func (s *timeoutTaskService) call(ctx context.Context, method string, rpc func(context.Context) error) error {
+	timeout := s.config.agentTimeout(method)
+	if timeout == 0 {
+		return rpc(ctx)
+	}
+
+	rpcCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := rpc(rpcCtx)
+	if err != nil && rpcCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return status.Errorf(codes.DeadlineExceeded, "agent didn't answer %s within %s", method, timeout)
+	}
+
+	return err
+}
+
+func (s *timeoutTaskService) State(ctx context.Context, req *taskAPI.StateRequest) (resp *taskAPI.StateResponse, err error) {
+	err = s.call(ctx, "State", func(ctx context.Context) error {
+		resp, err = s.TaskService.State(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Create(ctx context.Context, req *taskAPI.CreateTaskRequest) (resp *taskAPI.CreateTaskResponse, err error) {
+	err = s.call(ctx, "Create", func(ctx context.Context) error {
+		resp, err = s.TaskService.Create(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Start(ctx context.Context, req *taskAPI.StartRequest) (resp *taskAPI.StartResponse, err error) {
+	err = s.call(ctx, "Start", func(ctx context.Context) error {
+		resp, err = s.TaskService.Start(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Delete(ctx context.Context, req *taskAPI.DeleteRequest) (resp *taskAPI.DeleteResponse, err error) {
+	err = s.call(ctx, "Delete", func(ctx context.Context) error {
+		resp, err = s.TaskService.Delete(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Pids(ctx context.Context, req *taskAPI.PidsRequest) (resp *taskAPI.PidsResponse, err error) {
+	err = s.call(ctx, "Pids", func(ctx context.Context) error {
+		resp, err = s.TaskService.Pids(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Pause(ctx context.Context, req *taskAPI.PauseRequest) (resp *ptypes.Empty, err error) {
+	err = s.call(ctx, "Pause", func(ctx context.Context) error {
+		resp, err = s.TaskService.Pause(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Resume(ctx context.Context, req *taskAPI.ResumeRequest) (resp *ptypes.Empty, err error) {
+	err = s.call(ctx, "Resume", func(ctx context.Context) error {
+		resp, err = s.TaskService.Resume(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Checkpoint(ctx context.Context, req *taskAPI.CheckpointTaskRequest) (resp *ptypes.Empty, err error) {
+	err = s.call(ctx, "Checkpoint", func(ctx context.Context) error {
+		resp, err = s.TaskService.Checkpoint(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Kill(ctx context.Context, req *taskAPI.KillRequest) (resp *ptypes.Empty, err error) {
+	err = s.call(ctx, "Kill", func(ctx context.Context) error {
+		resp, err = s.TaskService.Kill(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Exec(ctx context.Context, req *taskAPI.ExecProcessRequest) (resp *ptypes.Empty, err error) {
+	err = s.call(ctx, "Exec", func(ctx context.Context) error {
+		resp, err = s.TaskService.Exec(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) ResizePty(ctx context.Context, req *taskAPI.ResizePtyRequest) (resp *ptypes.Empty, err error) {
+	err = s.call(ctx, "ResizePty", func(ctx context.Context) error {
+		resp, err = s.TaskService.ResizePty(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) CloseIO(ctx context.Context, req *taskAPI.CloseIORequest) (resp *ptypes.Empty, err error) {
+	err = s.call(ctx, "CloseIO", func(ctx context.Context) error {
+		resp, err = s.TaskService.CloseIO(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Update(ctx context.Context, req *taskAPI.UpdateTaskRequest) (resp *ptypes.Empty, err error) {
+	err = s.call(ctx, "Update", func(ctx context.Context) error {
+		resp, err = s.TaskService.Update(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Wait(ctx context.Context, req *taskAPI.WaitRequest) (resp *taskAPI.WaitResponse, err error) {
+	err = s.call(ctx, "Wait", func(ctx context.Context) error {
+		resp, err = s.TaskService.Wait(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Stats(ctx context.Context, req *taskAPI.StatsRequest) (resp *taskAPI.StatsResponse, err error) {
+	err = s.call(ctx, "Stats", func(ctx context.Context) error {
+		resp, err = s.TaskService.Stats(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Connect(ctx context.Context, req *taskAPI.ConnectRequest) (resp *taskAPI.ConnectResponse, err error) {
+	err = s.call(ctx, "Connect", func(ctx context.Context) error {
+		resp, err = s.TaskService.Connect(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
+
+func (s *timeoutTaskService) Shutdown(ctx context.Context, req *taskAPI.ShutdownRequest) (resp *ptypes.Empty, err error) {
+	err = s.call(ctx, "Shutdown", func(ctx context.Context) error {
+		resp, err = s.TaskService.Shutdown(ctx, req)
+		return err
+	})
+
+	return resp, err
+}
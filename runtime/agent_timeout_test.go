@@ -0,0 +1,96 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// stuckTaskService never answers Exec and Wait calls, like a wedged agent
+type stuckTaskService struct {
+	taskAPI.TaskService
+}
+
+func (s *stuckTaskService) Exec(ctx context.Context, req *taskAPI.ExecProcessRequest) (*ptypes.Empty, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *stuckTaskService) Wait(ctx context.Context, req *taskAPI.WaitRequest) (*taskAPI.WaitResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestAgentTimeout(t *testing.T) {
+	config := &Config{AgentTimeoutMs: 1000}
+	assert.Equal(t, time.Second, config.agentTimeout("Exec"))
+	assert.EqualValues(t, 0, config.agentTimeout("Wait"), "long-running RPCs aren't bounded by default")
+	assert.EqualValues(t, 0, config.agentTimeout("Checkpoint"))
+
+	config.AgentRPCTimeoutsMs = map[string]int{"Exec": 0, "Wait": 5000}
+	assert.EqualValues(t, 0, config.agentTimeout("Exec"))
+	assert.Equal(t, 5*time.Second, config.agentTimeout("Wait"))
+	assert.Equal(t, time.Second, config.agentTimeout("State"))
+
+	assert.NoError(t, validateAgentTimeouts(config.AgentRPCTimeoutsMs))
+	assert.Error(t, validateAgentTimeouts(map[string]int{"exec": 1000}))
+	assert.Error(t, validateAgentTimeouts(map[string]int{"Exec": -1}))
+}
+
+func TestTimeoutTaskService(t *testing.T) {
+	config := &Config{AgentTimeoutMs: 10}
+	client := &timeoutTaskService{TaskService: &stuckTaskService{}, config: config}
+
+	_, err := client.Exec(context.Background(), &taskAPI.ExecProcessRequest{})
+	require.Error(t, err)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Contains(t, err.Error(), "Exec")
+
+	// Caller's cancellation isn't reported as a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.Exec(ctx, &taskAPI.ExecProcessRequest{})
+	assert.Equal(t, context.Canceled, err)
+
+	// Wait isn't bounded unless configured
+	done := make(chan struct{})
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		defer close(done)
+		_, err := client.Wait(ctx, &taskAPI.WaitRequest{})
+		assert.Equal(t, context.Canceled, err)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("wait shouldn't time out")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	<-done
+
+	config.AgentRPCTimeoutsMs = map[string]int{"Wait": 10}
+	_, err = client.Wait(context.Background(), &taskAPI.WaitRequest{})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
@@ -0,0 +1,329 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Audit log formats
+	auditFormatJSON = "json"
+	auditFormatText = "text"
+
+	// Audit events
+	auditEventVMStart  = "vm_start"
+	auditEventVMStop   = "vm_stop"
+	auditEventVMMExit  = "vmm_exit"
+	auditEventCreate   = "create"
+	auditEventStart    = "start"
+	auditEventExec     = "exec"
+	auditEventPause    = "pause"
+	auditEventResume   = "resume"
+	auditEventKill     = "kill"
+	auditEventDelete   = "delete"
+	auditEventShutdown = "shutdown"
+
+	auditHashField     = " hash="
+	auditPrevHashField = " prev_hash="
+)
+
+// auditRecord is a single entry of the audit log.
+// Records are chained: each one holds the hash of the previous record, and its own hash covers
+// the rest of the record, so modified or removed records break the chain.
+type auditRecord struct {
+	Time      time.Time         `json:"time"`
+	Namespace string            `json:"namespace"`
+	VMID      string            `json:"vm_id"`
+	Event     string            `json:"event"`
+	TaskID    string            `json:"task_id,omitempty"`
+	ExecID    string            `json:"exec_id,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash,omitempty"`
+}
+
+// auditLog appends lifecycle events of the VM to a file dedicated to the VM.
+// The file is opened on first use, so shim invocations not serving the VM don't touch it.
+type auditLog struct {
+	mu        sync.Mutex
+	path      string
+	format    string
+	namespace string
+	vmID      string
+	file      *os.File
+	lastHash  string
+}
+
+func newAuditLog(dir, format, namespace, vmID string) *auditLog {
+	if format == "" {
+		format = auditFormatJSON
+	}
+
+	return &auditLog{
+		path:      auditLogPath(dir, namespace, vmID),
+		format:    format,
+		namespace: namespace,
+		vmID:      vmID,
+	}
+}
+
+func auditLogPath(dir, namespace, vmID string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.log", namespace, vmID))
+}
+
+// record appends an event to the log. Failures are logged, as they must not fail the operation itself.
+// Nil audit log (auditing disabled) ignores events.
+func (a *auditLog) record(ctx context.Context, event, taskID, execID string, fields map[string]string) {
+	if a == nil {
+		return
+	}
+
+	if err := a.write(event, taskID, execID, fields); err != nil {
+		log.G(ctx).WithError(err).WithField("event", event).Error("failed to write audit record")
+	}
+}
+
+func (a *auditLog) write(event, taskID, execID string, fields map[string]string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+
+	line, hash, err := formatAuditRecord(a.format, auditRecord{
+		Time:      time.Now().UTC(),
+		Namespace: a.namespace,
+		VMID:      a.vmID,
+		Event:     event,
+		TaskID:    taskID,
+		ExecID:    execID,
+		Fields:    fields,
+		PrevHash:  a.lastHash,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.file.WriteString(line + "\n"); err != nil {
+		return err
+	}
+
+	// Flushed right away, so a crash of the shim or the host doesn't lose the trail
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+
+	a.lastHash = hash
+	return nil
+}
+
+func (a *auditLog) open() error {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+
+	// Continue the chain of an existing log, like the one of a restarted shim
+	lastHash, err := lastAuditHash(a.path, a.format)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read audit log %s", a.path)
+	}
+
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	a.file = file
+	a.lastHash = lastHash
+	return nil
+}
+
+func lastAuditHash(path, format string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var last string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			last = line
+		}
+	}
+
+	if err := scanner.Err(); err != nil || last == "" {
+		return "", err
+	}
+
+	_, _, hash, err := parseAuditRecord(format, last)
+	return hash, err
+}
+
+// formatAuditRecord serializes the record in the given format, returning the line and hash of the record
+func formatAuditRecord(format string, rec auditRecord) (string, string, error) {
+	rec.Hash = ""
+	payload, err := auditPayload(format, rec)
+	if err != nil {
+		return "", "", err
+	}
+
+	hash := auditHash(rec.PrevHash, payload)
+	if format == auditFormatText {
+		return payload + auditHashField + hash, hash, nil
+	}
+
+	rec.Hash = hash
+	data, err := json.Marshal(rec)
+	return string(data), hash, err
+}
+
+// auditPayload serializes the hashed part of the record, everything but the hash itself
+func auditPayload(format string, rec auditRecord) (string, error) {
+	if format != auditFormatText {
+		data, err := json.Marshal(rec)
+		return string(data), err
+	}
+
+	fields := []string{
+		rec.Time.Format(time.RFC3339Nano),
+		"event=" + auditValue(rec.Event),
+		"namespace=" + auditValue(rec.Namespace),
+		"vm_id=" + auditValue(rec.VMID),
+	}
+
+	if rec.TaskID != "" {
+		fields = append(fields, "task_id="+auditValue(rec.TaskID))
+	}
+
+	if rec.ExecID != "" {
+		fields = append(fields, "exec_id="+auditValue(rec.ExecID))
+	}
+
+	keys := make([]string, 0, len(rec.Fields))
+	for key := range rec.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fields = append(fields, key+"="+auditValue(rec.Fields[key]))
+	}
+
+	return strings.Join(fields, " ") + auditPrevHashField + rec.PrevHash, nil
+}
+
+// auditValue quotes values which would be ambiguous in text format
+func auditValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
+func auditHash(prevHash, payload string) string {
+	sum := sha256.Sum256([]byte(prevHash + payload))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseAuditRecord splits a line of the audit log into the previous hash, the hashed payload and the hash
+func parseAuditRecord(format, line string) (string, string, string, error) {
+	if format != auditFormatText {
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return "", "", "", err
+		}
+
+		hash := rec.Hash
+		rec.Hash = ""
+		payload, err := auditPayload(format, rec)
+		return rec.PrevHash, payload, hash, err
+	}
+
+	i := strings.LastIndex(line, auditHashField)
+	if i < 0 {
+		return "", "", "", errors.New("record has no hash")
+	}
+
+	payload, hash := line[:i], line[i+len(auditHashField):]
+	j := strings.LastIndex(payload, auditPrevHashField)
+	if j < 0 {
+		return "", "", "", errors.New("record has no previous hash")
+	}
+
+	return payload[j+len(auditPrevHashField):], payload, hash, nil
+}
+
+// verifyAuditLog checks the hash chain of an audit log and returns the number of records in it
+func verifyAuditLog(path, format string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var (
+		count    int
+		lastHash string
+	)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+
+		count++
+		prevHash, payload, hash, err := parseAuditRecord(format, scanner.Text())
+		if err != nil {
+			return count, errors.Wrapf(err, "invalid record %d", count)
+		}
+
+		if prevHash != lastHash {
+			return count, errors.Errorf("record %d doesn't follow the previous record", count)
+		}
+
+		if auditHash(prevHash, payload) != hash {
+			return count, errors.Errorf("record %d has been modified", count)
+		}
+
+		lastHash = hash
+	}
+
+	return count, scanner.Err()
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	for _, format := range []string{auditFormatJSON, auditFormatText} {
+		format := format
+		t.Run(format, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "audit-")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			ctx := context.Background()
+			audit := newAuditLog(dir, format, "default", "vm1")
+			audit.record(ctx, auditEventVMStart, "", "", map[string]string{"cid": "3"})
+			audit.record(ctx, auditEventCreate, "c1", "", map[string]string{"bundle": "/run/bundle with spaces"})
+			audit.file.Close()
+
+			// A restarted shim continues the chain
+			audit = newAuditLog(dir, format, "default", "vm1")
+			audit.record(ctx, auditEventKill, "c1", "", map[string]string{"signal": "9"})
+			audit.file.Close()
+
+			path := auditLogPath(dir, "default", "vm1")
+			count, err := verifyAuditLog(path, format)
+			require.NoError(t, err)
+			assert.Equal(t, 3, count)
+
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			require.Len(t, lines, 3)
+			assert.Contains(t, lines[0], auditEventVMStart)
+
+			// Modified record
+			tampered := strings.Replace(string(data), "signal", "sigma", 1)
+			require.NoError(t, ioutil.WriteFile(path, []byte(tampered), 0600))
+			_, err = verifyAuditLog(path, format)
+			assert.Error(t, err)
+
+			// Removed record
+			tampered = lines[0] + "\n" + lines[2] + "\n"
+			require.NoError(t, ioutil.WriteFile(path, []byte(tampered), 0600))
+			_, err = verifyAuditLog(path, format)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	var audit *auditLog
+	audit.record(context.Background(), auditEventShutdown, "", "", nil)
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/sirupsen/logrus"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// Topic of events carrying the boot time of a VM
+const vmBootEventTopic = "/firecracker/vm/boot"
+
+// reportBoot logs how long the VM took to get its agent ready, and publishes it as an event if configured to.
+// Attempts are the vsock dials made to reach the agent.
+func (s *service) reportBoot(ctx context.Context, bootTime time.Duration, dialAttempts int) {
+	log.G(ctx).WithFields(logrus.Fields{
+		"boot_time_ms":        milliseconds(bootTime),
+		"agent_dial_attempts": dialAttempts,
+	}).Info("VM ready")
+
+	if !s.config.PublishBootMetrics {
+		return
+	}
+
+	s.publishEvent(ctx, vmBootEventTopic, &proto.VMBootMetrics{
+		VMID:              s.id,
+		BootTimeMs:        int64(bootTime / time.Millisecond),
+		AgentDialAttempts: uint32(dialAttempts),
+	})
+}
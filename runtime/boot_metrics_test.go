@@ -0,0 +1,39 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+func TestReportBoot(t *testing.T) {
+	publisher := &fakePublisher{}
+	s := &service{id: "app", config: &Config{}, publish: publisher}
+
+	s.reportBoot(context.Background(), 1500*time.Millisecond, 3)
+	assert.Empty(t, publisher.events, "published without publish_boot_metrics")
+
+	s.config.PublishBootMetrics = true
+	s.reportBoot(context.Background(), 1500*time.Millisecond, 3)
+	require.Len(t, publisher.events, 1)
+	assert.Equal(t, []string{vmBootEventTopic}, publisher.topics)
+	assert.Equal(t, &proto.VMBootMetrics{VMID: "app", BootTimeMs: 1500, AgentDialAttempts: 3}, publisher.events[0])
+}
@@ -0,0 +1,243 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Corresponds to VHOST_VSOCK_SET_GUEST_CID in vhost.h
+	ioctlVsockSetGuestCID = uintptr(0x4008AF60)
+	// 0, 1 and 2 are reserved CIDs, see http://man7.org/linux/man-pages/man7/vsock.7.html
+	startCID = 3
+	maxCID   = math.MaxUint32
+
+	// Number of CIDs checked by cid-usage by default
+	defaultCIDUsageRange = 1 << 16
+
+	cidLockRetryInterval = 10 * time.Millisecond
+)
+
+var (
+	vsockDevicePath = "/dev/vhost-vsock"
+
+	// Host-wide lock serializing CID allocation between shims
+	cidLockPath = "/run/firecracker-containerd/vsock-cid.lock"
+)
+
+// setGuestCID tries to assign the CID to the vhost-vsock device opened as fd, returns false if the CID is taken.
+// CIDs are host-wide, so this accounts for VMs started by any process on the host.
+func setGuestCID(fd uintptr, contextID uint64) (bool, error) {
+	cid := contextID
+	_, _, err := sysCall(
+		unix.SYS_IOCTL,
+		fd,
+		ioctlVsockSetGuestCID,
+		uintptr(unsafe.Pointer(&cid)))
+
+	switch err {
+	case unix.Errno(0):
+		return true, nil
+	case unix.EADDRINUSE:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// findNextAvailableVsockCID finds first available vsock context ID.
+// It uses VHOST_VSOCK_SET_GUEST_CID ioctl which allows some CID ranges to be statically reserved in advance.
+// The ioctl fails with EADDRINUSE if cid is already taken and with EINVAL if the CID is invalid.
+// Taken from https://bugzilla.redhat.com/show_bug.cgi?id=1291851
+// CIDs registered to running shims are skipped without probing.
+func findNextAvailableVsockCID(ctx context.Context) (uint32, error) {
+	file, err := os.OpenFile(vsockDevicePath, syscall.O_RDWR, 0666)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open vsock device")
+	}
+
+	defer file.Close()
+
+	for contextID := startCID; contextID < maxCID; contextID++ {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		default:
+			if isCIDRegistered(uint32(contextID)) {
+				continue
+			}
+
+			available, err := setGuestCID(file.Fd(), uint64(contextID))
+			if err != nil {
+				// Fail if we get an error we don't expect
+				return 0, err
+			}
+
+			if available {
+				return uint32(contextID), nil
+			}
+		}
+	}
+
+	return 0, errors.New("couldn't find any available vsock context id")
+}
+
+// cidReservation keeps other shims from allocating the reserved CID until it's released
+type cidReservation struct {
+	CID  uint32
+	lock *os.File
+}
+
+// reserveVsockCID finds an available vsock CID while holding the host-wide CID lock and registers it to the VM.
+// As every running VM has a CID registered, the capacity of the host is checked under the same lock.
+// A probed CID is free again as soon as the probe is done, so the lock has to be held (by calling release later)
+// until the VMM has claimed the CID, otherwise a concurrent shim would find the same CID.
+// The registration stays until the CID is unregistered when the VM is gone.
+func reserveVsockCID(ctx context.Context, namespace, id string, capacity vmCapacity) (*cidReservation, error) {
+	lock, err := lockCIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var cid uint32
+	err = capacity.check()
+	if err == nil {
+		cid, err = findNextAvailableVsockCID(ctx)
+	}
+
+	if err == nil {
+		err = registerCID(cid, namespace, id, capacity.MemSizeMib)
+	}
+
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return &cidReservation{CID: cid, lock: lock}, nil
+}
+
+// registerVMCID registers the CID of a running VM to this shim, taking over the record of the shim that started it
+func registerVMCID(ctx context.Context, cid uint32, namespace, id string) error {
+	lock, err := lockCIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer lock.Close()
+	return registerCID(cid, namespace, id, vmMemSizeMib)
+}
+
+// release lets other shims allocate CIDs again, it can be called more than once
+func (r *cidReservation) release() error {
+	if r.lock == nil {
+		return nil
+	}
+
+	err := r.lock.Close()
+	r.lock = nil
+	return err
+}
+
+// lockCIDs takes the exclusive flock on the CID lock file. The lock belongs to the open file, so it's released when
+// the file is closed, including when the shim dies.
+func lockCIDs(ctx context.Context) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(cidLockPath), 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create CID lock directory")
+	}
+
+	file, err := os.OpenFile(cidLockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open CID lock")
+	}
+
+	for {
+		err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return file, nil
+		}
+
+		if err != unix.EWOULDBLOCK {
+			file.Close()
+			return nil, errors.Wrap(err, "failed to lock CIDs")
+		}
+
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		case <-time.After(cidLockRetryInterval):
+		}
+	}
+}
+
+// cidUsage reports how many CIDs of a range are taken by VMs running on the host
+type cidUsage struct {
+	First     uint32 `json:"first"`
+	Last      uint32 `json:"last"`
+	InUse     uint32 `json:"in_use"`
+	Available uint32 `json:"available"`
+
+	// VMs CIDs are registered to, which only covers VMs started by the runtime
+	Registered []cidRecord `json:"registered,omitempty"`
+}
+
+// vsockCIDUsage checks count CIDs starting with the first one handed out by findNextAvailableVsockCID.
+// Each check is a single ioctl. A free CID is held by the device file only until the next check or until it's closed.
+func vsockCIDUsage(ctx context.Context, count uint32) (*cidUsage, error) {
+	file, err := os.OpenFile(vsockDevicePath, syscall.O_RDWR, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open vsock device")
+	}
+
+	defer file.Close()
+
+	return countCIDs(ctx, file.Fd(), startCID, count)
+}
+
+func countCIDs(ctx context.Context, fd uintptr, first, count uint32) (*cidUsage, error) {
+	if count == 0 || uint64(first)+uint64(count) > maxCID {
+		return nil, errors.Errorf("invalid CID range of %d from %d", count, first)
+	}
+
+	usage := &cidUsage{First: first, Last: first + count - 1}
+	for contextID := first; contextID <= usage.Last; contextID++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		available, err := setGuestCID(fd, uint64(contextID))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to check CID %d", contextID)
+		}
+
+		if available {
+			usage.Available++
+		} else {
+			usage.InUse++
+		}
+	}
+
+	return usage, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Directory with a file per CID allocated by a shim on this host
+var cidRegistryDir = "/run/firecracker-containerd/cids"
+
+// cidRecord describes the VM a CID is allocated to
+type cidRecord struct {
+	CID       uint32 `json:"cid"`
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+	Pid       int    `json:"pid"`
+	// Memory given to the VM, counted against max_vm_memory_percent
+	MemSizeMib int64 `json:"mem_size_mib,omitempty"`
+}
+
+func cidRecordPath(cid uint32) string {
+	return filepath.Join(cidRegistryDir, strconv.FormatUint(uint64(cid), 10)+".json")
+}
+
+// registerCID records the CID as allocated by this shim. Must be called with the CID lock held.
+func registerCID(cid uint32, namespace, id string, memSizeMib int64) error {
+	if err := os.MkdirAll(cidRegistryDir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create CID registry")
+	}
+
+	data, err := json.Marshal(&cidRecord{CID: cid, Namespace: namespace, ID: id, Pid: os.Getpid(), MemSizeMib: memSizeMib})
+	if err != nil {
+		return err
+	}
+
+	// Written to a temporary file first, so readers never see a partial record
+	tmp := cidRecordPath(cid) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "failed to register CID %d", cid)
+	}
+
+	if err := os.Rename(tmp, cidRecordPath(cid)); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to register CID %d", cid)
+	}
+
+	return nil
+}
+
+// unregisterCID frees the CID in the registry, it's a no-op if the CID isn't registered
+func unregisterCID(cid uint32) error {
+	if err := os.Remove(cidRecordPath(cid)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to unregister CID %d", cid)
+	}
+
+	return nil
+}
+
+func readCIDRecord(path string) (*cidRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var record cidRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, errors.Wrapf(err, "invalid CID record %s", path)
+	}
+
+	return &record, nil
+}
+
+// isCIDRegistered returns true if the CID is allocated by a shim that's still running.
+// Records left behind by shims that died without cleaning up are ignored.
+func isCIDRegistered(cid uint32) bool {
+	record, err := readCIDRecord(cidRecordPath(cid))
+	if err != nil {
+		return false
+	}
+
+	return processExists(record.Pid)
+}
+
+// registeredCIDs returns records of CIDs allocated by running shims, ordered by CID
+func registeredCIDs() ([]cidRecord, error) {
+	files, err := ioutil.ReadDir(cidRegistryDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var records []cidRecord
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		record, err := readCIDRecord(filepath.Join(cidRegistryDir, file.Name()))
+		if err != nil {
+			// Removed concurrently or garbage, either way it doesn't describe a running VM
+			continue
+		}
+
+		if processExists(record.Pid) {
+			records = append(records, *record)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].CID < records[j].CID })
+	return records, nil
+}
+
+// findCIDRecord returns the record of the CID allocated to the given VM, including records left behind
+// by shims that are gone. Returns nil if there is no such record.
+func findCIDRecord(namespace, id string) (*cidRecord, error) {
+	files, err := ioutil.ReadDir(cidRegistryDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		record, err := readCIDRecord(filepath.Join(cidRegistryDir, file.Name()))
+		if err != nil {
+			continue
+		}
+
+		if record.Namespace == namespace && record.ID == id {
+			return record, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	// EPERM means the process exists, but belongs to someone else
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
@@ -0,0 +1,209 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCountCIDs(t *testing.T) {
+	// CIDs are checked in order, 3, 4 and 7 are taken by other VMs
+	var (
+		next  uint64 = startCID
+		taken        = map[uint64]bool{3: true, 4: true, 7: true}
+	)
+
+	sysCall = func(trap, a1, a2, a3 uintptr) (r1, r2 uintptr, err syscall.Errno) {
+		cid := next
+		next++
+		if taken[cid] {
+			return 0, 0, unix.EADDRINUSE
+		}
+
+		return 0, 0, 0
+	}
+
+	defer func() {
+		sysCall = syscall.Syscall
+	}()
+
+	usage, err := countCIDs(context.Background(), 0, startCID, 8)
+	require.NoError(t, err)
+	assert.Equal(t, &cidUsage{First: 3, Last: 10, InUse: 3, Available: 5}, usage)
+
+	_, err = countCIDs(context.Background(), 0, startCID, 0)
+	assert.Error(t, err)
+
+	_, err = countCIDs(context.Background(), 0, maxCID-1, 2)
+	assert.Error(t, err)
+}
+
+func TestCountCIDsUnexpectedError(t *testing.T) {
+	sysCall = func(trap, a1, a2, a3 uintptr) (r1, r2 uintptr, err syscall.Errno) {
+		return 0, 0, unix.EINVAL
+	}
+
+	defer func() {
+		sysCall = syscall.Syscall
+	}()
+
+	_, err := countCIDs(context.Background(), 0, startCID, 8)
+	assert.Error(t, err)
+}
+
+func TestReserveVsockCIDConcurrent(t *testing.T) {
+	restore := mockCIDAllocation(t)
+	defer restore()
+
+	const count = 32
+
+	var (
+		group sync.WaitGroup
+		cids  = make(chan uint32, count)
+		errs  = make(chan error, count)
+	)
+
+	for i := 0; i < count; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+
+			reservation, err := reserveVsockCID(context.Background(), "default", "vm", vmCapacity{})
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			// Starting the VM takes a while
+			time.Sleep(time.Millisecond)
+
+			errs <- reservation.release()
+			cids <- reservation.CID
+		}()
+	}
+
+	group.Wait()
+	close(cids)
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	seen := make(map[uint32]bool)
+	for cid := range cids {
+		assert.False(t, seen[cid], "CID %d allocated more than once", cid)
+		seen[cid] = true
+	}
+
+	assert.Len(t, seen, count)
+}
+
+func TestReserveVsockCIDCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cid")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prevLockPath := cidLockPath
+	cidLockPath = filepath.Join(dir, "vsock-cid.lock")
+	defer func() { cidLockPath = prevLockPath }()
+
+	held, err := lockCIDs(context.Background())
+	require.NoError(t, err)
+	defer held.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = reserveVsockCID(ctx, "default", "vm", vmCapacity{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+// mockCIDAllocation points the CID lock and registry to a temporary directory.
+// The ioctl always succeeds, as if no VM was running on the host, so registered CIDs are the only taken ones.
+func mockCIDAllocation(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "cid")
+	require.NoError(t, err)
+
+	sysCall = func(trap, a1, a2, a3 uintptr) (r1, r2 uintptr, err syscall.Errno) {
+		return 0, 0, 0
+	}
+
+	prevDevicePath, prevLockPath, prevRegistryDir := vsockDevicePath, cidLockPath, cidRegistryDir
+	vsockDevicePath = os.DevNull
+	cidLockPath = filepath.Join(dir, "locks", "vsock-cid.lock")
+	cidRegistryDir = filepath.Join(dir, "cids")
+
+	return func() {
+		sysCall = syscall.Syscall
+		vsockDevicePath, cidLockPath, cidRegistryDir = prevDevicePath, prevLockPath, prevRegistryDir
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCIDReusableAfterTeardown(t *testing.T) {
+	restore := mockCIDAllocation(t)
+	defer restore()
+
+	ctx := context.Background()
+
+	first, err := reserveVsockCID(ctx, "default", "vm1", vmCapacity{})
+	require.NoError(t, err)
+	require.NoError(t, first.release())
+	assert.EqualValues(t, 3, first.CID)
+
+	second, err := reserveVsockCID(ctx, "default", "vm2", vmCapacity{})
+	require.NoError(t, err)
+	require.NoError(t, second.release())
+	assert.EqualValues(t, 4, second.CID)
+
+	records, err := registeredCIDs()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, cidRecord{CID: 3, Namespace: "default", ID: "vm1", Pid: os.Getpid()}, records[0])
+
+	// Shutting down the first VM frees its CID
+	exited := make(chan struct{})
+	close(exited)
+	s := &service{
+		config:     &Config{CleanupTimeoutMs: 100},
+		vmmExited:  exited,
+		machineCID: first.CID,
+	}
+	require.NoError(t, s.teardownVM(ctx))
+
+	third, err := reserveVsockCID(ctx, "default", "vm3", vmCapacity{})
+	require.NoError(t, err)
+	require.NoError(t, third.release())
+	assert.EqualValues(t, 3, third.CID)
+
+	// Records of shims which are gone don't hold CIDs
+	require.NoError(t, ioutil.WriteFile(cidRecordPath(5), []byte(`{"cid":5,"namespace":"default","id":"vm4","pid":-1}`), 0600))
+	assert.False(t, isCIDRegistered(5))
+
+	records, err = registeredCIDs()
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+}
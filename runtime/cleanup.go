@@ -0,0 +1,369 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+const (
+	defaultCleanupTimeoutMs = 5000
+
+	cleanupInitialBackoff = 10 * time.Millisecond
+	cleanupMaxBackoff     = 500 * time.Millisecond
+)
+
+// vmArtifacts returns the files created on the host for the VM, which have to be removed once the VMM is gone
+func (s *service) vmArtifacts() []string {
+	if j := s.vmJail(); j != nil {
+		return j.artifacts()
+	}
+
+	if s.pooledVM != nil {
+		return s.pooledVM.artifacts()
+	}
+
+	var paths []string
+	// The FIFO directory goes after the FIFOs, as only empty directories are removed
+	for _, path := range []string{s.config.SocketPath, s.logFifo(), s.metricsFifo(), s.vmFifoDir(), s.cpusetCgroup()} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	for _, cgroup := range s.vmmCgroups() {
+		paths = append(paths, cgroup)
+	}
+
+	return paths
+}
+
+// teardownVM stops the VMM and removes its artifacts from the host.
+// Only the first call does the work, later (or concurrent) calls wait for it and return its result,
+// so the shutdown and exit paths can both call it.
+func (s *service) teardownVM(ctx context.Context) error {
+	s.teardownOnce.Do(func() {
+		s.teardownErr = s.doTeardownVM(ctx)
+	})
+
+	return s.teardownErr
+}
+
+// doTeardownVM does the work of teardownVM on every call. Failed starts call it directly,
+// as the next Create retries the start and the VM it starts has to be torn down too.
+func (s *service) doTeardownVM(ctx context.Context) error {
+	select {
+	case <-s.vmmExited:
+		// VMM is gone already, its files might be still around
+	default:
+		if err := s.haltVM(ctx); err != nil {
+			return err
+		}
+
+		s.audit.record(ctx, auditEventVMStop, "", "", nil)
+	}
+
+	timeout := time.Duration(s.config.CleanupTimeoutMs) * time.Millisecond
+	if remaining := cleanupArtifacts(ctx, s.vmmExited, s.vmArtifacts(), timeout); len(remaining) > 0 {
+		log.G(ctx).WithField("artifacts", remaining).Warn("failed to cleanup VM artifacts")
+	}
+
+	// The tap device can only be released once the VMM doesn't use it anymore
+	if s.network != nil {
+		if err := s.network.teardown(); err != nil {
+			return errors.Wrap(err, "failed to release CNI network")
+		}
+	}
+
+	if s.bundle != "" {
+		if err := removeVMState(s.bundle); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to remove VM state")
+		}
+	}
+
+	// CID is free once the VMM is stopped, the ioctl keeps reporting it as taken while the process is exiting.
+	// The record is removed last, as Cleanup relies on it to find the tap device of a VM left behind.
+	if s.machineCID != 0 {
+		if err := unregisterCID(s.machineCID); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to unregister CID")
+		}
+	}
+
+	return nil
+}
+
+func (s *service) shutdownGracePeriod() time.Duration {
+	return time.Duration(s.config.ShutdownGracePeriodMs) * time.Millisecond
+}
+
+// haltVM asks the guest to shut down, so it flushes its filesystems before the VMM exits, and waits for
+// the VMM to exit for up to shutdown_grace_period_ms. If the guest doesn't make it in time (or can't be
+// asked, like with older agents), the VMM is stopped forcibly.
+func (s *service) haltVM(ctx context.Context) error {
+	gracePeriod := s.shutdownGracePeriod()
+	if gracePeriod == 0 || s.guest == nil {
+		log.G(ctx).Info("stopping VMM")
+		return s.stopVM()
+	}
+
+	// The VMM exiting is expected from now on
+	atomic.StoreInt32(&s.vmStopping, 1)
+
+	haltCtx, cancel := context.WithTimeout(ctx, gracePeriod)
+	defer cancel()
+
+	_, err := s.guest.Halt(haltCtx, &proto.HaltRequest{})
+	if err == nil {
+		select {
+		case <-s.vmmExited:
+			log.G(ctx).Info("VM shut down gracefully")
+			return nil
+		case <-haltCtx.Done():
+			err = errors.Errorf("VMM didn't exit within %s", gracePeriod)
+		}
+	}
+
+	log.G(ctx).WithError(err).Warn("VM didn't shut down gracefully, stopping VMM forcibly")
+	return s.stopVM()
+}
+
+// cleanupVM destroys whatever is left of the VM of a shim that is gone: the VMM process serving the
+// configured API socket (or chrooted to the jail), the socket and FIFOs (or the jail), the CNI network,
+// the saved VM state and the CID record.
+// It's safe to call when nothing is left, so it can be retried.
+func (s *service) cleanupVM(ctx context.Context) error {
+	timeout := time.Duration(s.config.CleanupTimeoutMs) * time.Millisecond
+
+	pids, err := s.findVMMProcesses()
+	if err != nil {
+		return errors.Wrap(err, "failed to look up VMM process")
+	}
+
+	for _, pid := range pids {
+		log.G(ctx).WithField("pid", pid).Info("killing VMM left behind")
+		if err := unix.Kill(pid, unix.SIGKILL); err != nil && err != unix.ESRCH {
+			return errors.Wrapf(err, "failed to kill VMM process %d", pid)
+		}
+	}
+
+	if remaining := cleanupArtifacts(ctx, waitProcesses(pids), s.vmArtifacts(), timeout); len(remaining) > 0 {
+		return errors.Errorf("failed to cleanup VM artifacts %v", remaining)
+	}
+
+	record, err := findCIDRecord(s.namespace, s.id)
+	if err != nil {
+		return errors.Wrap(err, "failed to look up CID record")
+	}
+
+	if s.config.CNINetworkName != "" && record != nil {
+		network, err := s.newVMNetwork(newCNI(s.config), s.tapName(record.CID))
+		if err != nil {
+			return err
+		}
+
+		if err := network.teardown(); err != nil {
+			return errors.Wrap(err, "failed to release CNI network")
+		}
+	}
+
+	if s.bundle != "" {
+		if err := removeVMState(s.bundle); err != nil {
+			return err
+		}
+	}
+
+	if record != nil {
+		return unregisterCID(record.CID)
+	}
+
+	return nil
+}
+
+// Where processes are looked up, can be replaced by tests
+var procDir = "/proc"
+
+// findVMMProcesses returns pids of Firecracker processes serving their API on the given socket path.
+// Relative paths (on the command line and the given one) are resolved against the working directory
+// of their process, as the shim and its VMM share the bundle directory.
+func findVMMProcesses(socketPath string) ([]int, error) {
+	if socketPath == "" {
+		return nil, nil
+	}
+
+	socketPath, err := filepath.Abs(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+
+		// Processes may exit while being inspected, they are skipped then
+		cmdline, err := ioutil.ReadFile(filepath.Join(procDir, entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+
+		path := apiSocketArg(strings.Split(string(cmdline), "\x00"))
+		if path == "" {
+			continue
+		}
+
+		if !filepath.IsAbs(path) {
+			cwd, err := os.Readlink(filepath.Join(procDir, entry.Name(), "cwd"))
+			if err != nil {
+				continue
+			}
+
+			path = filepath.Join(cwd, path)
+		}
+
+		if filepath.Clean(path) == socketPath {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
+
+// apiSocketArg returns the value of Firecracker's --api-sock argument
+func apiSocketArg(args []string) string {
+	for i, arg := range args {
+		if arg == "--api-sock" && i+1 < len(args) {
+			return args[i+1]
+		}
+
+		if strings.HasPrefix(arg, "--api-sock=") {
+			return strings.TrimPrefix(arg, "--api-sock=")
+		}
+	}
+
+	return ""
+}
+
+// waitProcesses returns a channel closed once all the given processes are gone.
+// Zombies count as gone, as they don't hold any resources besides their pid.
+func waitProcesses(pids []int) <-chan struct{} {
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+
+		backoff := cleanupInitialBackoff
+		for _, pid := range pids {
+			for isProcessRunning(pid) {
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > cleanupMaxBackoff {
+					backoff = cleanupMaxBackoff
+				}
+			}
+		}
+	}()
+
+	return exited
+}
+
+// isProcessRunning returns true if the process exists and isn't a zombie
+func isProcessRunning(pid int) bool {
+	stat, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+
+	// State follows the command name, which is in parentheses and may contain spaces itself
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
+
+// How artifacts are removed, can be replaced by tests
+var removeArtifact = os.Remove
+
+// cleanupArtifacts waits for the VMM process to exit (exited is closed) and removes the given paths.
+// Removal is retried with backoff, as the files might be still busy while the VMM is exiting.
+// Returns the paths that couldn't be removed within the timeout.
+func cleanupArtifacts(ctx context.Context, exited <-chan struct{}, paths []string, timeout time.Duration) []string {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	var (
+		remaining = paths
+		backoff   = cleanupInitialBackoff
+		gone      bool
+	)
+
+	for {
+		if !gone {
+			select {
+			case <-exited:
+				gone = true
+				// A closed channel is always ready, only the backoff and the deadline wake the loop from now on
+				exited = nil
+			default:
+			}
+		}
+
+		// Don't touch the files until the VMM is confirmed gone
+		if gone {
+			var failed []string
+			for _, path := range remaining {
+				if err := removeArtifact(path); err != nil && !os.IsNotExist(err) {
+					log.G(ctx).WithError(err).Debugf("failed to remove %s, will retry", path)
+					failed = append(failed, path)
+				}
+			}
+
+			remaining = failed
+			if len(remaining) == 0 {
+				return nil
+			}
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-exited:
+		case <-deadline.C:
+			if !gone {
+				log.G(ctx).Warn("VMM process didn't exit in time, skipping cleanup")
+			}
+
+			return remaining
+		}
+
+		if backoff *= 2; backoff > cleanupMaxBackoff {
+			backoff = cleanupMaxBackoff
+		}
+	}
+}
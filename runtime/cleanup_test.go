@@ -0,0 +1,304 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+func TestCleanupArtifacts(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "cleanup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "firecracker.sock")
+	fifo := filepath.Join(dir, "metrics.fifo")
+	busy := filepath.Join(dir, "busy")
+	missing := filepath.Join(dir, "missing")
+
+	require.NoError(t, ioutil.WriteFile(socket, nil, 0600))
+	require.NoError(t, ioutil.WriteFile(fifo, nil, 0600))
+	require.NoError(t, os.MkdirAll(filepath.Join(busy, "content"), 0700))
+
+	// Nothing is removed while the VMM is running
+	exited := make(chan struct{})
+	remaining := cleanupArtifacts(ctx, exited, []string{socket, fifo}, 50*time.Millisecond)
+	assert.Equal(t, []string{socket, fifo}, remaining)
+	assert.FileExists(t, socket)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(exited)
+	}()
+
+	remaining = cleanupArtifacts(ctx, exited, []string{socket, fifo, missing}, time.Second)
+	assert.Empty(t, remaining)
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(fifo)
+	assert.True(t, os.IsNotExist(err))
+
+	// Non-empty directory can't be removed, so it's reported after the timeout
+	remaining = cleanupArtifacts(ctx, exited, []string{busy}, 100*time.Millisecond)
+	assert.Equal(t, []string{busy}, remaining)
+}
+
+func TestCleanupArtifactsBackoff(t *testing.T) {
+	var attempts []time.Time
+	prevRemove := removeArtifact
+	removeArtifact = func(path string) error {
+		attempts = append(attempts, time.Now())
+		return errors.New("busy")
+	}
+	defer func() { removeArtifact = prevRemove }()
+
+	// VMM is gone, but the path stays busy until the timeout
+	exited := make(chan struct{})
+	close(exited)
+
+	remaining := cleanupArtifacts(context.Background(), exited, []string{"busy"}, 300*time.Millisecond)
+	assert.Equal(t, []string{"busy"}, remaining)
+
+	// 10ms, 20ms, 40ms, 80ms and 160ms apart, rather than retried back to back
+	require.True(t, len(attempts) > 1)
+	assert.True(t, len(attempts) <= 7, "%d attempts within the timeout", len(attempts))
+	backoff := cleanupInitialBackoff
+	for i := 1; i < len(attempts); i++ {
+		assert.True(t, attempts[i].Sub(attempts[i-1]) >= backoff, "attempt %d came too early", i)
+		if backoff *= 2; backoff > cleanupMaxBackoff {
+			backoff = cleanupMaxBackoff
+		}
+	}
+}
+
+func TestTeardownVMExitedVMM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "teardown")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "firecracker.sock")
+	require.NoError(t, ioutil.WriteFile(socket, nil, 0600))
+
+	// VMM is gone already, so no machine is needed to stop it
+	exited := make(chan struct{})
+	close(exited)
+
+	s := &service{
+		config:    &Config{SocketPath: socket, CleanupTimeoutMs: 100},
+		vmmExited: exited,
+	}
+
+	require.NoError(t, s.teardownVM(context.Background()))
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+
+	// Tearing down again (like on shim exit after Shutdown) is a no-op
+	require.NoError(t, ioutil.WriteFile(socket, nil, 0600))
+	require.NoError(t, s.teardownVM(context.Background()))
+	_, err = os.Stat(socket)
+	assert.NoError(t, err)
+}
+
+func TestTeardownVMAfterFailedStart(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "teardown")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "firecracker.sock")
+	exited := make(chan struct{})
+	close(exited)
+
+	s := &service{
+		config:    &Config{SocketPath: socket, CleanupTimeoutMs: 100},
+		vmmExited: exited,
+	}
+
+	// First boot fails after the VMM is started, which stops the VMM and cleans up after it
+	_, err = s.ensureVM(ctx, func() (taskAPI.TaskService, error) {
+		require.NoError(t, ioutil.WriteFile(socket, nil, 0600))
+		atomic.StoreInt32(&s.vmStopping, 1)
+		require.NoError(t, s.doTeardownVM(ctx))
+		return nil, errors.New("boot failed")
+	})
+	require.Error(t, err)
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+
+	// Retry starts another VM, whose exit isn't expected
+	client := taskAPI.NewTaskClient(nil)
+	_, err = s.ensureVM(ctx, func() (taskAPI.TaskService, error) {
+		require.NoError(t, ioutil.WriteFile(socket, nil, 0600))
+		return client, nil
+	})
+	require.NoError(t, err)
+	assert.False(t, s.isVMStopping())
+
+	// Shutdown tears down the VM of the retry
+	require.NoError(t, s.teardownVM(ctx))
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// fakeProcess adds a process to a fake proc directory
+func fakeProcess(t *testing.T, dir string, pid int, cwd, state string, args ...string) {
+	path := filepath.Join(dir, strconv.Itoa(pid))
+	require.NoError(t, os.MkdirAll(path, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(path, "cmdline"), []byte(strings.Join(args, "\x00")+"\x00"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(path, "stat"), []byte(strconv.Itoa(pid)+" (fire cracker) "+state+" 1 2 3"), 0600))
+	require.NoError(t, os.Symlink(cwd, filepath.Join(path, "cwd")))
+}
+
+func TestFindVMMProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prevProcDir := procDir
+	procDir = dir
+	defer func() { procDir = prevProcDir }()
+
+	fakeProcess(t, dir, 100, "/run/containerd/default/a", "S", "firecracker", "--api-sock", "./firecracker.sock")
+	fakeProcess(t, dir, 101, "/run/containerd/default/b", "S", "firecracker", "--api-sock", "./firecracker.sock")
+	fakeProcess(t, dir, 102, "/", "Z", "firecracker", "--api-sock=/run/containerd/default/a/firecracker.sock")
+	fakeProcess(t, dir, 103, "/run/containerd/default/a", "S", "sleep", "10")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "self"), 0700))
+
+	pids, err := findVMMProcesses("/run/containerd/default/a/firecracker.sock")
+	require.NoError(t, err)
+	assert.Equal(t, []int{100, 102}, pids)
+
+	pids, err = findVMMProcesses("/run/containerd/default/c/firecracker.sock")
+	require.NoError(t, err)
+	assert.Empty(t, pids)
+
+	assert.True(t, isProcessRunning(100))
+	assert.False(t, isProcessRunning(102))
+	assert.False(t, isProcessRunning(104))
+
+	select {
+	case <-waitProcesses([]int{102, 104}):
+	case <-time.After(time.Second):
+		assert.Fail(t, "zombie and missing processes should count as gone")
+	}
+}
+
+func TestCleanupVM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cleanup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prevProcDir, prevRegistryDir := procDir, cidRegistryDir
+	procDir = filepath.Join(dir, "proc")
+	cidRegistryDir = filepath.Join(dir, "cids")
+	defer func() { procDir, cidRegistryDir = prevProcDir, prevRegistryDir }()
+
+	require.NoError(t, os.MkdirAll(procDir, 0700))
+
+	socket := filepath.Join(dir, "firecracker.sock")
+	fifo := filepath.Join(dir, "fc-logs.fifo")
+	require.NoError(t, ioutil.WriteFile(socket, nil, 0600))
+	require.NoError(t, ioutil.WriteFile(fifo, nil, 0600))
+	require.NoError(t, registerCID(42, "default", "task", vmMemSizeMib))
+	require.NoError(t, registerCID(43, "default", "other", vmMemSizeMib))
+
+	s := &service{
+		namespace: "default",
+		id:        "task",
+		config:    &Config{SocketPath: socket, LogFifo: fifo, CleanupTimeoutMs: 100},
+	}
+
+	// Nothing is left after the first call, so the second one is a no-op
+	for i := 0; i < 2; i++ {
+		require.NoError(t, s.cleanupVM(context.Background()))
+
+		for _, path := range []string{socket, fifo, cidRecordPath(42)} {
+			_, err = os.Stat(path)
+			assert.True(t, os.IsNotExist(err), path)
+		}
+
+		assert.FileExists(t, cidRecordPath(43))
+	}
+}
+
+type fakeGuest struct {
+	proto.AgentService
+
+	halt func() error
+}
+
+func (g *fakeGuest) Halt(ctx context.Context, req *proto.HaltRequest) (*proto.HaltResponse, error) {
+	if err := g.halt(); err != nil {
+		return nil, err
+	}
+
+	return &proto.HaltResponse{}, nil
+}
+
+func TestHaltVMGracefully(t *testing.T) {
+	s := &service{
+		config:    &Config{ShutdownGracePeriodMs: 1000},
+		vmmExited: make(chan struct{}),
+	}
+
+	// Guest reboots and VMM exits on its own
+	s.guest = &fakeGuest{halt: func() error {
+		close(s.vmmExited)
+		return nil
+	}}
+
+	require.NoError(t, s.haltVM(context.Background()))
+	assert.True(t, s.isVMStopping())
+}
+
+func TestHaltVMForcibly(t *testing.T) {
+	for _, halt := range []func() error{
+		// Older agents don't know the call
+		func() error { return errors.New("not implemented") },
+		// Guest never goes down
+		func() error { return nil },
+	} {
+		cmd := exec.Command("sleep", "10")
+		require.NoError(t, cmd.Start())
+
+		s := &service{
+			config:    &Config{ShutdownGracePeriodMs: 50},
+			guest:     &fakeGuest{halt: halt},
+			vmmExited: make(chan struct{}),
+			vmmPid:    cmd.Process.Pid,
+		}
+
+		require.NoError(t, s.haltVM(context.Background()))
+		assert.Error(t, cmd.Wait(), "VMM should be killed")
+	}
+}
@@ -16,28 +16,145 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
+	"math"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
 )
 
 const (
 	configPathEnvName = "FIRECRACKER_CONTAINERD_RUNTIME_CONFIG_PATH"
 	defaultConfigPath = "/etc/containerd/firecracker-runtime.json"
+
+	defaultAgentLogLevel = "info"
+
+	// Upper bound of vCPU count requested for a task, matching the limit of Firecracker
+	defaultMaxCPUCount = 32
+
+	// Upper bound of VM startup, until the agent is connected
+	defaultBootTimeoutMs = 30000
+
+	// Time the guest is given to shut down on its own before the VMM is stopped
+	defaultShutdownGracePeriodMs = 2000
+
+	// GOMAXPROCS of the long running shim process
+	defaultShimMaxProcs = 2
+
+	// Lowest soft memory limit of the shim process, below it the shim would do little but garbage collection
+	minShimMemoryLimit = 16 << 20
+
+	// Limits of the bundle spec packed into create requests.
+	// The maximum leaves room for the rest of the request within ttrpc message size limit.
+	defaultMaxBundleSize = 1 << 20
+	maxBundleSize        = 3 << 20
 )
 
 type Config struct {
-	FirecrackerBinaryPath string            `json:"firecracker_binary_path"`
-	SocketPath            string            `json:"socket_path"`
-	KernelImagePath       string            `json:"kernel_image_path"`
-	KernelArgs            string            `json:"kernel_args"`
-	RootDrive             string            `json:"root_drive"`
-	CPUCount              int               `json:"cpu_count"`
-	CPUTemplate           string            `json:"cpu_template"`
-	AdditionalDrives      map[string]string `json:"additional_drives"`
-	LogFifo               string            `json:"log_fifo"`
-	LogLevel              string            `json:"log_level"`
-	MetricsFifo           string            `json:"metrics_fifo"`
-	HtEnabled             bool              `json:"ht_enabled"`
-	Debug                 bool              `json:"debug"`
+	FirecrackerBinaryPath string                 `json:"firecracker_binary_path"`
+	SocketPath            string                 `json:"socket_path"`
+	KernelImagePath       string                 `json:"kernel_image_path"`
+	KernelArgs            string                 `json:"kernel_args"`
+	RootDrive             string                 `json:"root_drive"`
+	CPUCount              int                    `json:"cpu_count"`
+	MaxCPUCount           int                    `json:"max_cpu_count"`
+	CPUTemplate           string                 `json:"cpu_template"`
+	VsockPort             uint32                 `json:"vsock_port"`
+	BootTimeoutMs         int                    `json:"boot_timeout_ms"`
+	StdioPortBase         uint32                 `json:"stdio_port_base"`
+	VsockPorts            *VsockPortsConfig      `json:"vsock_ports"`
+	AdditionalDrives      map[string]string      `json:"additional_drives"`
+	LogFifo               string                 `json:"log_fifo"`
+	LogLevel              string                 `json:"log_level"`
+	MetricsFifo           string                 `json:"metrics_fifo"`
+	LogDir                string                 `json:"log_dir"`
+	FifoDir               string                 `json:"fifo_dir"`
+	HtEnabled             bool                   `json:"ht_enabled"`
+	Debug                 bool                   `json:"debug"`
+	AgentLogLevel         string                 `json:"agent_log_level"`
+	ExportedLabels        []string               `json:"exported_labels"`
+	StdioBufferSize       int                    `json:"stdio_buffer_size"`
+	VsockBufferSize       int                    `json:"vsock_buffer_size"`
+	APITimeoutMs          int                    `json:"api_timeout_ms"`
+	MetricsSnapshotDir    string                 `json:"metrics_snapshot_dir"`
+	PublishMetrics        bool                   `json:"publish_metrics"`
+	PublishBootMetrics    bool                   `json:"publish_boot_metrics"`
+	CleanupTimeoutMs      int                    `json:"cleanup_timeout_ms"`
+	Volumes               []VolumeConfig         `json:"volumes"`
+	TaskVolumeDirs        []string               `json:"task_volume_dirs"`
+	FSTypes               []string               `json:"fs_types"`
+	MaxBundleSize         int                    `json:"max_bundle_size"`
+	MaxInjectedFilesSize  int                    `json:"max_injected_files_size"`
+	DNSVsockPort          uint32                 `json:"dns_vsock_port"`
+	DNSUpstream           string                 `json:"dns_upstream"`
+	BootProfile           string                 `json:"boot_profile"`
+	PrefaultMemory        bool                   `json:"prefault_memory"`
+	SeccompProfile        string                 `json:"seccomp_profile"`
+	InitMode              string                 `json:"init_mode"`
+	Drives                []DriveConfig          `json:"drives"`
+	ShimMaxProcs          int                    `json:"shim_max_procs"`
+	ShimMemoryLimit       int64                  `json:"shim_memory_limit"`
+	AgentMaxInFlight      int                    `json:"agent_max_inflight"`
+	AgentQueueTimeoutMs   int                    `json:"agent_queue_timeout_ms"`
+	AgentTimeoutMs        int                    `json:"agent_timeout_ms"`
+	AgentRPCTimeoutsMs    map[string]int         `json:"agent_rpc_timeouts_ms"`
+	AuditLogDir           string                 `json:"audit_log_dir"`
+	AuditLogFormat        string                 `json:"audit_log_format"`
+	CNINetworkName        string                 `json:"cni_network_name"`
+	CNIConfDir            string                 `json:"cni_conf_dir"`
+	CNIBinDirs            []string               `json:"cni_bin_dirs"`
+	CNIIfName             string                 `json:"cni_if_name"`
+	DriveRateLimiter      *RateLimiterConfig     `json:"drive_rate_limiter"`
+	NetworkRxRateLimiter  *RateLimiterConfig     `json:"network_rx_rate_limiter"`
+	NetworkTxRateLimiter  *RateLimiterConfig     `json:"network_tx_rate_limiter"`
+	Metadata              map[string]interface{} `json:"metadata"`
+	ShutdownGracePeriodMs int                    `json:"shutdown_grace_period_ms"`
+	Jailer                *JailerConfig          `json:"jailer"`
+	VcpuAffinity          string                 `json:"vcpu_affinity"`
+	CpusetCgroup          string                 `json:"cpuset_cgroup"`
+	WarmPool              *WarmPoolConfig        `json:"warm_pool"`
+	LivenessProbe         *LivenessProbeConfig   `json:"liveness_probe"`
+	MaxVMs                int                    `json:"max_vms"`
+	MaxVMMemoryPercent    int                    `json:"max_vm_memory_percent"`
+	DriveIOEngine         string                 `json:"drive_io_engine"`
+	VMMCgroupParent       string                 `json:"vmm_cgroup_parent"`
+	VMMMemoryOverheadMiB  int                    `json:"vmm_memory_overhead_mib"`
+
+	// Loaded from SeccompProfile
+	seccompBaseline *specs.LinuxSeccomp
+}
+
+// DriveConfig describes a drive attached to every VM, which can be selected as its root device
+type DriveConfig struct {
+	ID       string `json:"id"`
+	HostPath string `json:"host_path"`
+	ReadOnly bool   `json:"read_only"`
+	IsRoot   bool   `json:"is_root"`
+	IOEngine string `json:"io_engine"`
+}
+
+// VsockPortsConfig sets the vsock ports of the agent one by one, taking over vsock_port and stdio_port_base
+// for the ports that are set
+type VsockPortsConfig struct {
+	Agent  uint32 `json:"agent"`
+	Stdin  uint32 `json:"stdin"`
+	Stdout uint32 `json:"stdout"`
+	Stderr uint32 `json:"stderr"`
+}
+
+// VolumeConfig describes a drive with a filesystem to be attached to the VM and mounted in the guest
+type VolumeConfig struct {
+	HostPath  string `json:"host_path"`
+	GuestPath string `json:"guest_path"`
+	ReadOnly  bool   `json:"read_only"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -54,10 +171,462 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
-	var cfg Config
+	cfg := Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		BootTimeoutMs:    defaultBootTimeoutMs,
+		AgentTimeoutMs:   defaultAgentTimeoutMs,
+
+		ShutdownGracePeriodMs: defaultShutdownGracePeriodMs,
+		MaxInjectedFilesSize:  defaultMaxInjectedFilesSize,
+	}
+
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
 
+	if err := cfg.validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid config at '%s'", path)
+	}
+
+	if cfg.SeccompProfile != "" {
+		if cfg.seccompBaseline, err = loadSeccompProfile(cfg.SeccompProfile); err != nil {
+			return nil, errors.Wrap(err, "failed to load seccomp_profile")
+		}
+	}
+
 	return &cfg, nil
 }
+
+// hasFifos returns true if Firecracker is given both the log and metrics FIFOs, which it requires for either
+func (c *Config) hasFifos() bool {
+	return (c.LogFifo != "" || c.FifoDir != "") && (c.MetricsFifo != "" || c.FifoDir != "")
+}
+
+// checkPaths makes sure files referenced by config exist and can be used by Firecracker, so a misconfigured
+// path fails with an error naming the setting rather than an opaque failure halfway through VM start.
+// This isn't part of validate as config is also loaded by shim commands (like delete) that don't start VMs.
+func (c *Config) checkPaths() error {
+	if c.FirecrackerBinaryPath != "" {
+		if err := checkFile(c.FirecrackerBinaryPath, unix.X_OK); err != nil {
+			return errors.Wrap(err, "invalid firecracker_binary_path")
+		}
+	}
+
+	if c.Jailer != nil {
+		if _, err := exec.LookPath(c.Jailer.binaryPath()); err != nil {
+			return errors.Wrap(err, "invalid binary_path of jailer")
+		}
+	}
+
+	if c.KernelImagePath == "" {
+		return errors.New("kernel_image_path can't be empty")
+	}
+
+	if err := checkFile(c.KernelImagePath, unix.R_OK); err != nil {
+		return errors.Wrap(err, "invalid kernel_image_path")
+	}
+
+	for _, drive := range configuredDrives(c) {
+		if err := unix.Access(drive.HostPath, unix.R_OK); err != nil {
+			err = &os.PathError{Op: "access", Path: drive.HostPath, Err: err}
+			if drive.ID == rootDriveID {
+				return errors.Wrap(err, "invalid root_drive")
+			}
+
+			return errors.Wrapf(err, "invalid host_path of drive %q", drive.ID)
+		}
+	}
+
+	return nil
+}
+
+// checkFile checks path is a regular file accessible in the given mode
+func checkFile(path string, mode uint32) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return errors.Errorf("%s is not a regular file", path)
+	}
+
+	if err := unix.Access(path, mode); err != nil {
+		return &os.PathError{Op: "access", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+func (c *Config) validate() error {
+	if _, err := logrus.ParseLevel(c.AgentLogLevel); err != nil {
+		return errors.Wrap(err, "invalid agent_log_level")
+	}
+
+	if c.StdioBufferSize < internal.MinBufferSize || c.StdioBufferSize > internal.MaxBufferSize {
+		return errors.Errorf("stdio_buffer_size should be between %d and %d", internal.MinBufferSize, internal.MaxBufferSize)
+	}
+
+	if c.VsockBufferSize != 0 && (c.VsockBufferSize < internal.MinVsockBufferSize || c.VsockBufferSize > internal.MaxVsockBufferSize) {
+		return errors.Errorf("vsock_buffer_size should be between %d and %d", internal.MinVsockBufferSize, internal.MaxVsockBufferSize)
+	}
+
+	if c.APITimeoutMs <= 0 {
+		return errors.New("api_timeout_ms should be positive")
+	}
+
+	if c.BootTimeoutMs < 0 {
+		return errors.New("boot_timeout_ms can't be negative")
+	}
+
+	if c.ShutdownGracePeriodMs < 0 {
+		return errors.New("shutdown_grace_period_ms can't be negative")
+	}
+
+	if c.MaxBundleSize <= 0 || c.MaxBundleSize > maxBundleSize {
+		return errors.Errorf("max_bundle_size should be between 1 and %d", maxBundleSize)
+	}
+
+	if c.MaxInjectedFilesSize < 0 || c.MaxInjectedFilesSize > maxInjectedFilesSize {
+		return errors.Errorf("max_injected_files_size should be between 0 and %d", maxInjectedFilesSize)
+	}
+
+	if c.MaxCPUCount <= 0 {
+		return errors.New("max_cpu_count should be positive")
+	}
+
+	if c.CPUCount > c.MaxCPUCount {
+		return errors.Errorf("cpu_count can't exceed max_cpu_count (%d)", c.MaxCPUCount)
+	}
+
+	if err := validateCPUTemplate(c.CPUTemplate); err != nil {
+		return err
+	}
+
+	if err := validateIOEngine(c.DriveIOEngine); err != nil {
+		return errors.Wrap(err, "invalid drive_io_engine")
+	}
+
+	if c.MaxVMs < 0 {
+		return errors.New("max_vms can't be negative")
+	}
+
+	if c.MaxVMMemoryPercent < 0 {
+		return errors.New("max_vm_memory_percent can't be negative")
+	}
+
+	if c.ShimMaxProcs <= 0 {
+		return errors.New("shim_max_procs should be positive")
+	}
+
+	if c.ShimMemoryLimit != 0 && c.ShimMemoryLimit < minShimMemoryLimit {
+		return errors.Errorf("shim_memory_limit should be either 0 (no limit) or at least %d", minShimMemoryLimit)
+	}
+
+	if c.AgentMaxInFlight < 0 || c.AgentQueueTimeoutMs < 0 {
+		return errors.New("agent_max_inflight and agent_queue_timeout_ms can't be negative")
+	}
+
+	if c.AgentTimeoutMs < 0 {
+		return errors.New("agent_timeout_ms can't be negative")
+	}
+
+	if err := validateAgentTimeouts(c.AgentRPCTimeoutsMs); err != nil {
+		return errors.Wrap(err, "invalid agent_rpc_timeouts_ms")
+	}
+
+	if c.CleanupTimeoutMs <= 0 {
+		return errors.New("cleanup_timeout_ms should be positive")
+	}
+
+	if c.MetricsSnapshotDir != "" && !c.hasFifos() {
+		return errors.New("metrics_snapshot_dir requires both log_fifo and metrics_fifo (or fifo_dir) to be set")
+	}
+
+	if c.PublishMetrics && !c.hasFifos() {
+		return errors.New("publish_metrics requires both log_fifo and metrics_fifo (or fifo_dir) to be set")
+	}
+
+	if c.LogDir != "" && !c.hasFifos() {
+		return errors.New("log_dir requires both log_fifo and metrics_fifo (or fifo_dir) to be set")
+	}
+
+	if c.StdioPortBase > math.MaxUint32-2 {
+		return errors.Errorf("stdio_port_base can't exceed %d", uint32(math.MaxUint32-2))
+	}
+
+	if err := c.validatePorts(); err != nil {
+		return err
+	}
+
+	if c.DNSVsockPort != 0 {
+		if _, _, err := net.SplitHostPort(c.DNSUpstream); err != nil {
+			return errors.Wrap(err, "dns_upstream should be an address in host:port form")
+		}
+	}
+
+	if c.BootProfile != "" && c.BootProfile != bootProfileLog && !filepath.IsAbs(c.BootProfile) {
+		return errors.Errorf("boot_profile should be either %q or an absolute directory path", bootProfileLog)
+	}
+
+	if c.AuditLogDir != "" && !filepath.IsAbs(c.AuditLogDir) {
+		return errors.New("audit_log_dir should be an absolute path")
+	}
+
+	switch c.AuditLogFormat {
+	case "", auditFormatJSON, auditFormatText:
+	default:
+		return errors.Errorf("audit_log_format should be either %q or %q", auditFormatJSON, auditFormatText)
+	}
+
+	if len(c.CNIIfName) > maxIfNameLength {
+		return errors.Errorf("cni_if_name can't be longer than %d characters", maxIfNameLength)
+	}
+
+	if c.CNINetworkName == "" && (c.CNIConfDir != "" || len(c.CNIBinDirs) > 0 || c.CNIIfName != "") {
+		return errors.New("cni_conf_dir, cni_bin_dirs and cni_if_name require cni_network_name to be set")
+	}
+
+	if c.InitMode != "" {
+		if err := checkInitMode(c.InitMode, c.KernelArgs); err != nil {
+			return errors.Wrap(err, "invalid init_mode")
+		}
+	}
+
+	if err := validateDrives(c); err != nil {
+		return err
+	}
+
+	for _, fsType := range c.FSTypes {
+		if fsType == "" {
+			return errors.New("fs_types can't contain empty type")
+		}
+	}
+
+	if err := validateVolumes(c.Volumes); err != nil {
+		return err
+	}
+
+	for name, limiter := range map[string]*RateLimiterConfig{
+		"drive_rate_limiter":      c.DriveRateLimiter,
+		"network_rx_rate_limiter": c.NetworkRxRateLimiter,
+		"network_tx_rate_limiter": c.NetworkTxRateLimiter,
+	} {
+		if err := limiter.validate(); err != nil {
+			return errors.Wrapf(err, "invalid %s", name)
+		}
+	}
+
+	if c.Metadata != nil && c.CNINetworkName == "" {
+		return errMetadataWithoutNetwork
+	}
+
+	for _, dir := range c.TaskVolumeDirs {
+		if !filepath.IsAbs(dir) {
+			return errors.Errorf("task_volume_dirs entry %q should be an absolute path", dir)
+		}
+	}
+
+	if c.Jailer != nil {
+		if err := c.Jailer.validate(); err != nil {
+			return errors.Wrap(err, "invalid jailer")
+		}
+
+		// The jailer is given the binary to exec and names the chroot after it
+		if !filepath.IsAbs(c.FirecrackerBinaryPath) {
+			return errors.New("jailer requires firecracker_binary_path to be an absolute path")
+		}
+
+		// FIFOs are placed in the chroot root under their file names, FIFOs in fifo_dir have distinct ones
+		if c.LogFifo != "" && filepath.Base(c.LogFifo) == filepath.Base(c.MetricsFifo) {
+			return errors.New("log_fifo and metrics_fifo need different file names with jailer")
+		}
+	}
+
+	if c.VcpuAffinity != "" {
+		if _, err := parseCPUList(c.VcpuAffinity); err != nil {
+			return errors.Wrap(err, "invalid vcpu_affinity")
+		}
+	}
+
+	if c.CpusetCgroup != "" {
+		if !filepath.IsAbs(c.CpusetCgroup) {
+			return errors.New("cpuset_cgroup should be an absolute path")
+		}
+
+		if c.VcpuAffinity == "" {
+			return errors.New("cpuset_cgroup requires vcpu_affinity to be set")
+		}
+
+		// The jailer puts Firecracker into cgroups of its own
+		if c.Jailer != nil {
+			return errors.New("cpuset_cgroup can't be used with jailer")
+		}
+	}
+
+	if c.VMMCgroupParent != "" {
+		if filepath.IsAbs(c.VMMCgroupParent) || filepath.Clean(c.VMMCgroupParent) != c.VMMCgroupParent || strings.HasPrefix(c.VMMCgroupParent, "..") {
+			return errors.New("vmm_cgroup_parent should be a relative cgroup path, like \"firecracker-containerd\"")
+		}
+
+		// The jailer puts Firecracker into cgroups of its own, host limits are applied there
+		if c.Jailer != nil {
+			return errors.New("vmm_cgroup_parent can't be used with jailer")
+		}
+	}
+
+	if c.VMMMemoryOverheadMiB < 0 {
+		return errors.New("vmm_memory_overhead_mib can't be negative")
+	}
+
+	if c.WarmPool != nil {
+		if err := c.WarmPool.validate(); err != nil {
+			return errors.Wrap(err, "invalid warm_pool")
+		}
+
+		// Pooled VMs are booted before any task is known, so they can't have settings tied to one
+		if c.Jailer != nil || c.CNINetworkName != "" || len(c.Volumes) > 0 {
+			return errors.New("warm_pool can't be used with jailer, cni_network_name or volumes")
+		}
+	}
+
+	if err := c.LivenessProbe.validate(); err != nil {
+		return errors.Wrap(err, "invalid liveness_probe")
+	}
+
+	for _, name := range c.ExportedLabels {
+		if _, ok := vmLabels[name]; !ok {
+			return errors.Errorf("invalid exported_labels entry %q", name)
+		}
+	}
+
+	return nil
+}
+
+// checkInitMode verifies the guest init mode is supported and consistent with the kernel command line
+func checkInitMode(mode, kernelArgs string) error {
+	if !internal.IsValidInitMode(mode) {
+		return errors.Errorf("unsupported init mode %q", mode)
+	}
+
+	// The kernel has to be told to run the agent instead of the image's init
+	if _, found := internal.FindBootArg(kernelArgs, "init"); mode == internal.InitModeAgent && !found {
+		return errors.Errorf("init mode %q requires init= kernel argument pointing to the agent", mode)
+	}
+
+	return nil
+}
+
+// validatePorts checks the vsock ports used to talk to the agent are valid and distinct
+func (c *Config) validatePorts() error {
+	stdio := c.stdioPorts()
+	ports := []struct {
+		name string
+		port uint32
+	}{
+		{"agent", c.agentPort()},
+		{"stdin", stdio.Stdin},
+		{"stdout", stdio.Stdout},
+		{"stderr", stdio.Stderr},
+		{"dns", c.DNSVsockPort},
+	}
+
+	seen := make(map[uint32]string, len(ports))
+	for _, p := range ports {
+		if p.port == 0 {
+			continue
+		}
+
+		// VMADDR_PORT_ANY
+		if p.port == math.MaxUint32 {
+			return errors.Errorf("%s vsock port can't be %d", p.name, p.port)
+		}
+
+		if other, ok := seen[p.port]; ok {
+			return errors.Errorf("%s vsock port %d collides with %s port", p.name, p.port, other)
+		}
+
+		seen[p.port] = p.name
+	}
+
+	return nil
+}
+
+// agentPort returns vsock port of the agent API
+func (c *Config) agentPort() uint32 {
+	if c.VsockPorts != nil && c.VsockPorts.Agent != 0 {
+		return c.VsockPorts.Agent
+	}
+
+	if c.VsockPort == 0 {
+		return internal.DefaultVsockPort
+	}
+
+	return c.VsockPort
+}
+
+// vmmMemoryOverhead returns the memory in bytes the VMM is given on top of the limits of its containers
+func (c *Config) vmmMemoryOverhead() int64 {
+	if c.VMMMemoryOverheadMiB == 0 {
+		return defaultVMMMemoryOverheadMiB << 20
+	}
+
+	return int64(c.VMMMemoryOverheadMiB) << 20
+}
+
+// stdioPortBase returns the first of the three vsock ports used for stdin, stdout and stderr
+func (c *Config) stdioPortBase() uint32 {
+	if c.StdioPortBase == 0 {
+		return internal.DefaultStdioPortBase
+	}
+
+	return c.StdioPortBase
+}
+
+// stdioPorts returns vsock ports used for stdin, stdout and stderr: consecutive from stdio_port_base, unless
+// set in vsock_ports
+func (c *Config) stdioPorts() internal.StdioPorts {
+	ports := internal.StdioPortsFromBase(c.stdioPortBase())
+	if c.VsockPorts == nil {
+		return ports
+	}
+
+	if c.VsockPorts.Stdin != 0 {
+		ports.Stdin = c.VsockPorts.Stdin
+	}
+
+	if c.VsockPorts.Stdout != 0 {
+		ports.Stdout = c.VsockPorts.Stdout
+	}
+
+	if c.VsockPorts.Stderr != 0 {
+		ports.Stderr = c.VsockPorts.Stderr
+	}
+
+	return ports
+}
+
+// allowedFSTypes returns filesystem types allowed for rootfs mounts and volumes, ext4 unless configured
+func allowedFSTypes(fsTypes []string) []string {
+	if len(fsTypes) == 0 {
+		return []string{internal.FSTypeExt4}
+	}
+
+	return fsTypes
+}
+
+func isAllowedFSType(fsTypes []string, fsType string) bool {
+	for _, allowed := range allowedFSTypes(fsTypes) {
+		if allowed == fsType {
+			return true
+		}
+	}
+
+	return false
+}
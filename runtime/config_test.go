@@ -0,0 +1,462 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+func TestCPUTemplateConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+	}
+
+	for _, template := range []string{"", "C3", "T2", "None"} {
+		config.CPUTemplate = template
+		assert.NoError(t, config.validate(), template)
+	}
+
+	for _, template := range []string{"c3", "M5", "-avx512f", "none"} {
+		config.CPUTemplate = template
+		assert.Error(t, config.validate(), template)
+	}
+}
+
+func TestMaxVMsConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+	}
+
+	config.MaxVMs = 16
+	config.MaxVMMemoryPercent = 150
+	assert.NoError(t, config.validate())
+
+	config.MaxVMs = -1
+	assert.Error(t, config.validate())
+
+	config.MaxVMs = 0
+	config.MaxVMMemoryPercent = -1
+	assert.Error(t, config.validate())
+}
+
+func TestVsockPortConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+	}
+
+	assert.NoError(t, config.validate())
+	assert.EqualValues(t, internal.DefaultVsockPort, config.agentPort())
+	assert.EqualValues(t, internal.DefaultStdioPortBase, config.stdioPortBase())
+
+	// Default ports aren't passed to the agent
+	s := &service{config: config}
+	assert.False(t, strings.Contains(s.kernelArgs(vmOptions{}), internal.VsockPortBootArg))
+
+	config.VsockPort = 20789
+	config.StdioPortBase = 21000
+	assert.NoError(t, config.validate())
+	args := s.kernelArgs(vmOptions{})
+	assert.Contains(t, args, "fc_agent.vsock_port=20789")
+	assert.Contains(t, args, "fc_agent.stdio_port_base=21000")
+
+	config.VsockPort = 21002
+	assert.Error(t, config.validate())
+
+	config.VsockPort = 0
+	config.StdioPortBase = 10788
+	assert.Error(t, config.validate())
+
+	config.StdioPortBase = 21000
+	config.DNSVsockPort = 21001
+	config.DNSUpstream = "10.0.0.2:53"
+	assert.Error(t, config.validate())
+
+	config.DNSVsockPort = internal.DefaultVsockPort
+	assert.Error(t, config.validate())
+
+	config.DNSVsockPort = 11000
+	assert.NoError(t, config.validate())
+}
+
+func TestVsockPortsConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+		StdioPortBase:    21000,
+		VsockPorts:       &VsockPortsConfig{Agent: 5000, Stderr: 6000},
+	}
+
+	// Ports not set one by one follow vsock_port and stdio_port_base
+	assert.NoError(t, config.validate())
+	assert.EqualValues(t, 5000, config.agentPort())
+	assert.Equal(t, internal.StdioPorts{Stdin: 21000, Stdout: 21001, Stderr: 6000}, config.stdioPorts())
+
+	s := &service{config: config}
+	args := s.kernelArgs(vmOptions{})
+	assert.Contains(t, args, "fc_agent.vsock_port=5000")
+	assert.Contains(t, args, "fc_agent.stdio_port_base=21000")
+	assert.Contains(t, args, "fc_agent.stderr_port=6000")
+	assert.NotContains(t, args, "fc_agent.stdin_port")
+
+	config.VsockPorts.Stdout = 5000
+	assert.Error(t, config.validate())
+
+	config.VsockPorts.Stdout = math.MaxUint32
+	assert.Error(t, config.validate())
+
+	config.VsockPorts.Stdout = 0
+	config.DNSVsockPort = 6000
+	config.DNSUpstream = "10.0.0.2:53"
+	assert.Error(t, config.validate())
+}
+
+func TestMetadataConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+		Metadata:         map[string]interface{}{"env": "prod"},
+	}
+
+	assert.Equal(t, errMetadataWithoutNetwork, config.validate())
+
+	config.CNINetworkName = "fcnet"
+	assert.NoError(t, config.validate())
+}
+
+func TestCheckConfigPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fc-config-paths-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kernel := filepath.Join(dir, "vmlinux")
+	rootfs := filepath.Join(dir, "rootfs.img")
+	binary := filepath.Join(dir, "firecracker")
+	require.NoError(t, ioutil.WriteFile(kernel, nil, 0644))
+	require.NoError(t, ioutil.WriteFile(rootfs, nil, 0644))
+	require.NoError(t, ioutil.WriteFile(binary, nil, 0755))
+
+	config := &Config{
+		FirecrackerBinaryPath: binary,
+		KernelImagePath:       kernel,
+		RootDrive:             rootfs,
+	}
+
+	require.NoError(t, config.checkPaths())
+
+	config.KernelImagePath = filepath.Join(dir, "missing")
+	err = config.checkPaths()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid kernel_image_path")
+
+	config.KernelImagePath = dir
+	err = config.checkPaths()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not a regular file")
+
+	config.KernelImagePath = kernel
+	config.RootDrive = filepath.Join(dir, "missing")
+	err = config.checkPaths()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid root_drive")
+
+	config.RootDrive = rootfs
+	config.Drives = []DriveConfig{{ID: "data", HostPath: filepath.Join(dir, "missing")}}
+	err = config.checkPaths()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid host_path of drive "data"`)
+
+	config.Drives = nil
+	config.FirecrackerBinaryPath = kernel
+	err = config.checkPaths()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid firecracker_binary_path")
+}
+
+func TestStdioBufferSizeConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.MinBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+	}
+
+	assert.NoError(t, config.validate())
+
+	config.StdioBufferSize = internal.MinBufferSize - 1
+	assert.Error(t, config.validate())
+
+	config.StdioBufferSize = internal.MaxBufferSize + 1
+	assert.Error(t, config.validate())
+}
+
+func TestVsockBufferSizeConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		VsockBufferSize:  internal.MinVsockBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+	}
+
+	assert.NoError(t, config.validate())
+
+	s := &service{config: config}
+	assert.Contains(t, strings.Fields(s.kernelArgs(vmOptions{})), "fc_agent.vsock_buffer_size=4096")
+
+	config.VsockBufferSize = internal.MinVsockBufferSize - 1
+	assert.Error(t, config.validate())
+
+	config.VsockBufferSize = internal.MaxVsockBufferSize + 1
+	assert.Error(t, config.validate())
+
+	// The kernel default is kept
+	config.VsockBufferSize = 0
+	assert.NoError(t, config.validate())
+	assert.NotContains(t, s.kernelArgs(vmOptions{}), internal.VsockBufferSizeBootArg)
+}
+
+func TestJailerConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:         defaultAgentLogLevel,
+		StdioBufferSize:       internal.DefaultBufferSize,
+		APITimeoutMs:          defaultAPITimeoutMs,
+		CleanupTimeoutMs:      defaultCleanupTimeoutMs,
+		MaxBundleSize:         defaultMaxBundleSize,
+		ShimMaxProcs:          defaultShimMaxProcs,
+		MaxCPUCount:           defaultMaxCPUCount,
+		RootDrive:             "/var/lib/firecracker/root.img",
+		FirecrackerBinaryPath: "/usr/bin/firecracker",
+		LogFifo:               "/run/fc/logs.fifo",
+		MetricsFifo:           "/run/fc/metrics.fifo",
+		Jailer:                &JailerConfig{UID: 123, GID: 100},
+	}
+
+	assert.NoError(t, config.validate())
+
+	config.Jailer.UID = 0
+	assert.Error(t, config.validate())
+
+	config.Jailer.UID = 123
+	config.FirecrackerBinaryPath = "firecracker"
+	assert.Error(t, config.validate())
+
+	// FIFOs end up next to each other in the chroot
+	config.FirecrackerBinaryPath = "/usr/bin/firecracker"
+	config.MetricsFifo = "/run/fc/metrics/logs.fifo"
+	assert.Error(t, config.validate())
+}
+
+func TestVcpuAffinityConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+		VcpuAffinity:     "0-3",
+		CpusetCgroup:     "/sys/fs/cgroup/cpuset/firecracker",
+	}
+
+	assert.NoError(t, config.validate())
+
+	config.VcpuAffinity = "3-0"
+	assert.Error(t, config.validate())
+
+	// Cgroup alone doesn't say which CPUs to use
+	config.VcpuAffinity = ""
+	assert.Error(t, config.validate())
+
+	config.VcpuAffinity = "0-3"
+	config.CpusetCgroup = "firecracker"
+	assert.Error(t, config.validate())
+}
+
+func TestVMMCgroupParentConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+		VMMCgroupParent:  "firecracker-containerd",
+	}
+
+	assert.NoError(t, config.validate())
+	assert.Equal(t, int64(defaultVMMMemoryOverheadMiB<<20), config.vmmMemoryOverhead())
+
+	for _, parent := range []string{"/sys/fs/cgroup/memory/firecracker", "../firecracker", "firecracker/"} {
+		config.VMMCgroupParent = parent
+		assert.Error(t, config.validate(), parent)
+	}
+
+	config.VMMCgroupParent = ""
+	config.VMMMemoryOverheadMiB = -1
+	assert.Error(t, config.validate())
+}
+
+func TestShimLimitsConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+	}
+
+	assert.NoError(t, config.validate())
+
+	config.ShimMemoryLimit = 256 << 20
+	assert.NoError(t, config.validate())
+
+	config.ShimMemoryLimit = 1 << 20
+	assert.Error(t, config.validate())
+
+	config.ShimMemoryLimit = 0
+	config.ShimMaxProcs = 0
+	assert.Error(t, config.validate())
+}
+
+func TestLogDirConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+		LogDir:           "/var/log/firecracker",
+	}
+
+	assert.Error(t, config.validate(), "log_dir requires FIFOs")
+
+	config.FifoDir = "/run/firecracker"
+	assert.NoError(t, config.validate())
+
+	config.FifoDir = ""
+	config.LogFifo = "fc-logs.fifo"
+	config.MetricsFifo = "fc-metrics.fifo"
+	assert.NoError(t, config.validate())
+}
+
+func TestWarmPoolConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+		WarmPool:         &WarmPoolConfig{MinSize: 2, MaxSize: 8},
+	}
+
+	assert.NoError(t, config.validate())
+
+	config.WarmPool.MaxSize = 1
+	assert.Error(t, config.validate())
+
+	// Pooled VMs can't be set up for a task before it's known
+	config.WarmPool.MaxSize = 8
+	config.Volumes = []VolumeConfig{{HostPath: "/var/lib/volumes/data.img", GuestPath: "/data"}}
+	assert.Error(t, config.validate())
+}
+
+func TestAgentTimeoutsConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+		AgentTimeoutMs:   defaultAgentTimeoutMs,
+	}
+
+	assert.NoError(t, config.validate())
+
+	config.AgentRPCTimeoutsMs = map[string]int{"Create": 120000, "Wait": 0}
+	assert.NoError(t, config.validate())
+
+	config.AgentRPCTimeoutsMs = map[string]int{"Spawn": 1000}
+	assert.Error(t, config.validate())
+
+	config.AgentRPCTimeoutsMs = nil
+	config.AgentTimeoutMs = -1
+	assert.Error(t, config.validate())
+}
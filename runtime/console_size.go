@@ -0,0 +1,164 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	ptypes "github.com/gogo/protobuf/types"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// taskConsoleSize returns the initial terminal size of a task, taken from its task options or else from
+// process.consoleSize of its bundle spec. Returns nil if neither sets it.
+func taskConsoleSize(specPath string, options *proto.ExtraData) (*specs.Box, error) {
+	if size := consoleSize(options.GetConsoleWidth(), options.GetConsoleHeight()); size != nil {
+		return size, nil
+	}
+
+	data, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec struct {
+		Process *struct {
+			ConsoleSize *specs.Box `json:"consoleSize"`
+		} `json:"process"`
+	}
+
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+
+	if spec.Process == nil || spec.Process.ConsoleSize == nil {
+		return nil, nil
+	}
+
+	return consoleSize(uint32(spec.Process.ConsoleSize.Width), uint32(spec.Process.ConsoleSize.Height)), nil
+}
+
+// execConsoleSize returns consoleSize of the process spec of an exec request, nil if it isn't set
+func execConsoleSize(spec *ptypes.Any) (*specs.Box, error) {
+	if spec == nil {
+		return nil, nil
+	}
+
+	var process struct {
+		ConsoleSize *specs.Box `json:"consoleSize"`
+	}
+
+	if err := json.Unmarshal(spec.Value, &process); err != nil {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid process spec: %v", err)
+	}
+
+	if process.ConsoleSize == nil {
+		return nil, nil
+	}
+
+	return consoleSize(uint32(process.ConsoleSize.Width), uint32(process.ConsoleSize.Height)), nil
+}
+
+// consoleSize returns nil unless both dimensions are set
+func consoleSize(width, height uint32) *specs.Box {
+	if width == 0 || height == 0 {
+		return nil
+	}
+
+	return &specs.Box{Width: uint(width), Height: uint(height)}
+}
+
+// pendingConsoles keeps terminal sizes of exec'd processes which aren't started yet. runc creates the PTY of an
+// exec'd process only when starting it, so the process is resized to the latest size once it's started.
+type pendingConsoles struct {
+	mu    sync.Mutex
+	sizes map[processKey]*specs.Box
+}
+
+// add registers the exec'd process as not started, with its initial size (which can be nil)
+func (p *pendingConsoles) add(id, execID string, size *specs.Box) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sizes == nil {
+		p.sizes = make(map[processKey]*specs.Box)
+	}
+
+	p.sizes[processKey{id: id, execID: execID}] = size
+}
+
+// resize replaces the size of a process which isn't started yet, returns false if there is no such process
+func (p *pendingConsoles) resize(id, execID string, size *specs.Box) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := processKey{id: id, execID: execID}
+	if _, ok := p.sizes[key]; !ok {
+		return false
+	}
+
+	p.sizes[key] = size
+	return true
+}
+
+// remove returns the size the process should be given and forgets it
+func (p *pendingConsoles) remove(id, execID string) *specs.Box {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := processKey{id: id, execID: execID}
+	size := p.sizes[key]
+	delete(p.sizes, key)
+	return size
+}
+
+// removeExecs forgets all processes exec'd in the given container
+func (p *pendingConsoles) removeExecs(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key := range p.sizes {
+		if key.id == id {
+			delete(p.sizes, key)
+		}
+	}
+}
+
+// resizeConsole sets the size of the process' PTY in the guest. Failures are only logged, the process works with
+// the wrong size until it's resized again.
+func (s *service) resizeConsole(ctx context.Context, id, execID string, size *specs.Box) {
+	if size == nil {
+		return
+	}
+
+	_, err := s.agentClient.ResizePty(ctx, &taskAPI.ResizePtyRequest{
+		ID:     id,
+		ExecID: execID,
+		Width:  uint32(size.Width),
+		Height: uint32(size.Height),
+	})
+
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("exec_id", execID).Warn("failed to set initial terminal size")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	ptypes "github.com/gogo/protobuf/types"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+func TestTaskConsoleSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	specPath := filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(specPath, []byte(`{"process":{"terminal":true,"consoleSize":{"height":24,"width":80}}}`), 0600))
+
+	size, err := taskConsoleSize(specPath, nil)
+	require.NoError(t, err)
+	assert.Equal(t, &specs.Box{Width: 80, Height: 24}, size)
+
+	// Task options take precedence, unless they only set one dimension
+	size, err = taskConsoleSize(specPath, &proto.ExtraData{ConsoleWidth: 132, ConsoleHeight: 43})
+	require.NoError(t, err)
+	assert.Equal(t, &specs.Box{Width: 132, Height: 43}, size)
+
+	size, err = taskConsoleSize(specPath, &proto.ExtraData{ConsoleWidth: 132})
+	require.NoError(t, err)
+	assert.Equal(t, &specs.Box{Width: 80, Height: 24}, size)
+
+	require.NoError(t, ioutil.WriteFile(specPath, []byte(`{"process":{"terminal":true}}`), 0600))
+	size, err = taskConsoleSize(specPath, nil)
+	require.NoError(t, err)
+	assert.Nil(t, size)
+}
+
+func TestExecConsoleSize(t *testing.T) {
+	size, err := execConsoleSize(&ptypes.Any{Value: []byte(`{"terminal":true,"consoleSize":{"height":50,"width":200}}`)})
+	require.NoError(t, err)
+	assert.Equal(t, &specs.Box{Width: 200, Height: 50}, size)
+
+	size, err = execConsoleSize(&ptypes.Any{Value: []byte(`{"terminal":true}`)})
+	require.NoError(t, err)
+	assert.Nil(t, size)
+
+	_, err = execConsoleSize(&ptypes.Any{Value: []byte(`{`)})
+	assert.Error(t, err)
+}
+
+func TestExecConsoleResizedOnStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// Stops state monitoring right away
+	cancel()
+
+	agent := &fakeAgent{}
+	s := &service{ctx: ctx, agentClient: agent, publish: &fakePublisher{}}
+
+	spec := &ptypes.Any{Value: []byte(`{"terminal":true,"consoleSize":{"height":24,"width":80}}`)}
+	for _, execID := range []string{"shell1", "shell2"} {
+		_, err := s.Exec(context.Background(), &taskAPI.ExecProcessRequest{ID: "1", ExecID: execID, Terminal: true, Spec: spec})
+		require.NoError(t, err)
+	}
+
+	// Neither PTY exists yet, so nothing reaches the guest
+	_, err := s.ResizePty(context.Background(), &taskAPI.ResizePtyRequest{ID: "1", ExecID: "shell2", Width: 100, Height: 30})
+	require.NoError(t, err)
+	assert.Empty(t, agent.resizes)
+
+	_, err = s.Start(context.Background(), &taskAPI.StartRequest{ID: "1", ExecID: "shell1"})
+	require.NoError(t, err)
+	_, err = s.Start(context.Background(), &taskAPI.StartRequest{ID: "1", ExecID: "shell2"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1/shell1:80x24", "1/shell2:100x30"}, agent.resizes)
+
+	// Started processes are resized right away
+	_, err = s.ResizePty(context.Background(), &taskAPI.ResizePtyRequest{ID: "1", ExecID: "shell1", Width: 120, Height: 40})
+	require.NoError(t, err)
+	_, err = s.ResizePty(context.Background(), &taskAPI.ResizePtyRequest{ID: "1", Width: 90, Height: 20})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1/shell1:80x24", "1/shell2:100x30", "1/shell1:120x40", "1/:90x20"}, agent.resizes)
+}
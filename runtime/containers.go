@@ -0,0 +1,284 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+type containerInfo struct {
+	id        string
+	dependsOn []string
+	sandbox   bool
+	exited    bool
+
+	// Resources the container is limited to in the guest, 0 if unlimited
+	memoryLimit int64
+	cpuShares   uint64
+}
+
+// containerSet keeps track of containers running inside of the VM and
+// decides in which order they have to be stopped.
+type containerSet struct {
+	mu sync.Mutex
+	// containers in creation order
+	list []*containerInfo
+}
+
+// readAnnotations reads annotations from OCI spec at the given path
+func readAnnotations(specPath string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+
+	return spec.Annotations, nil
+}
+
+// newContainerInfo reads ordering information of a container from its annotations
+func newContainerInfo(id string, annotations map[string]string) (*containerInfo, error) {
+	info := &containerInfo{id: id}
+
+	if value := annotations[internal.DependsOnAnnotation]; value != "" {
+		for _, dep := range strings.Split(value, ",") {
+			if dep = strings.TrimSpace(dep); dep != "" {
+				info.dependsOn = append(info.dependsOn, dep)
+			}
+		}
+	}
+
+	if value, ok := annotations[internal.SandboxAnnotation]; ok {
+		sandbox, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+
+		info.sandbox = sandbox
+	}
+
+	return info, nil
+}
+
+// add registers a new container
+func (c *containerSet) add(info *containerInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.list = append(c.list, info)
+}
+
+// remove forgets the container
+func (c *containerSet) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, info := range c.list {
+		if info.id == id {
+			c.list = append(c.list[:i], c.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// setResources records limits of the container, set in its spec or updated later. Like runc, only the
+// limits given are changed.
+func (c *containerSet) setResources(id string, resources *specs.LinuxResources) {
+	if resources == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, info := range c.list {
+		if info.id != id {
+			continue
+		}
+
+		if resources.Memory != nil && resources.Memory.Limit != nil {
+			info.memoryLimit = *resources.Memory.Limit
+		}
+
+		if resources.CPU != nil && resources.CPU.Shares != nil {
+			info.cpuShares = *resources.CPU.Shares
+		}
+	}
+}
+
+// hostLimits sums up limits of the running containers. Memory is unlimited (-1) unless every container
+// has a memory limit, and CPU shares are 0 if no container has them set.
+func (c *containerSet) hostLimits() hostLimits {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		limits    hostLimits
+		unlimited bool
+	)
+
+	running := c.runningLocked()
+	for _, info := range running {
+		limits.memory += info.memoryLimit
+		limits.cpuShares += info.cpuShares
+		unlimited = unlimited || info.memoryLimit <= 0
+	}
+
+	if unlimited || len(running) == 0 {
+		limits.memory = -1
+	}
+
+	return limits
+}
+
+// running returns the number of containers that haven't exited yet
+func (c *containerSet) running() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+	for _, info := range c.list {
+		if !info.exited {
+			count++
+		}
+	}
+
+	return count
+}
+
+// markExited records exit of the container and returns the list of containers (in stop order)
+// that have to be stopped before the VM can be torn down.
+// teardown is true when the VM is no longer needed, either because the sandbox container
+// exited or because there are no running containers left.
+func (c *containerSet) markExited(id string) (remaining []string, teardown bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var sandbox bool
+	for _, info := range c.list {
+		if info.id == id {
+			info.exited = true
+			sandbox = info.sandbox
+		}
+	}
+
+	remaining = c.stopOrder(c.runningLocked())
+	return remaining, sandbox || len(remaining) == 0
+}
+
+// dependents returns the running containers that (directly or transitively) depend on the given one,
+// in the order they have to be stopped
+func (c *containerSet) dependents(id string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		set   []*containerInfo
+		queue = []string{id}
+		seen  = map[string]bool{id: true}
+	)
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, info := range c.runningLocked() {
+			if !seen[info.id] && info.dependsOnID(current) {
+				seen[info.id] = true
+				set = append(set, info)
+				queue = append(queue, info.id)
+			}
+		}
+	}
+
+	return c.stopOrder(set)
+}
+
+func (c *containerSet) runningLocked() []*containerInfo {
+	var list []*containerInfo
+	for _, info := range c.list {
+		if !info.exited {
+			list = append(list, info)
+		}
+	}
+
+	return list
+}
+
+// stopOrder sorts the given containers so that dependent containers go before their dependencies.
+// Otherwise containers are stopped in reverse creation order, sandbox container always goes last.
+func (c *containerSet) stopOrder(set []*containerInfo) []string {
+	var (
+		order   []string
+		visited = make(map[string]bool, len(set))
+		visit   func(info *containerInfo)
+	)
+
+	visit = func(info *containerInfo) {
+		if visited[info.id] {
+			return
+		}
+
+		visited[info.id] = true
+
+		for i := len(set) - 1; i >= 0; i-- {
+			if set[i].dependsOnID(info.id) {
+				visit(set[i])
+			}
+		}
+
+		order = append(order, info.id)
+	}
+
+	var sandboxes []*containerInfo
+	for i := len(set) - 1; i >= 0; i-- {
+		if set[i].sandbox {
+			sandboxes = append(sandboxes, set[i])
+			continue
+		}
+
+		visit(set[i])
+	}
+
+	for _, info := range sandboxes {
+		visit(info)
+	}
+
+	return order
+}
+
+func (info *containerInfo) dependsOnID(id string) bool {
+	for _, dep := range info.dependsOn {
+		if dep == id {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+func addContainer(t *testing.T, c *containerSet, id string, annotations map[string]string) {
+	info, err := newContainerInfo(id, annotations)
+	require.NoError(t, err)
+	c.add(info)
+}
+
+func TestContainerStopOrder(t *testing.T) {
+	var c containerSet
+
+	addContainer(t, &c, "pause", map[string]string{internal.SandboxAnnotation: "true"})
+	addContainer(t, &c, "db", nil)
+	addContainer(t, &c, "app", map[string]string{internal.DependsOnAnnotation: "db"})
+	addContainer(t, &c, "proxy", map[string]string{internal.DependsOnAnnotation: "app, db"})
+	_, err := newContainerInfo("bad", map[string]string{internal.SandboxAnnotation: "maybe"})
+	require.Error(t, err)
+
+	assert.Equal(t, []string{"proxy", "app"}, c.dependents("db"))
+	assert.Equal(t, []string{"proxy"}, c.dependents("app"))
+	assert.Empty(t, c.dependents("proxy"))
+
+	// Exit of a regular container doesn't tear down the VM
+	remaining, teardown := c.markExited("proxy")
+	assert.False(t, teardown)
+	assert.Equal(t, []string{"app", "db", "pause"}, remaining)
+	assert.Equal(t, 3, c.running())
+
+	// Sandbox exit stops the rest in dependency order
+	remaining, teardown = c.markExited("pause")
+	assert.True(t, teardown)
+	assert.Equal(t, []string{"app", "db"}, remaining)
+}
+
+func TestContainerDrain(t *testing.T) {
+	var c containerSet
+
+	addContainer(t, &c, "first", nil)
+	addContainer(t, &c, "second", nil)
+
+	_, teardown := c.markExited("second")
+	assert.False(t, teardown)
+
+	// VM is torn down only after the last container exits
+	remaining, teardown := c.markExited("first")
+	assert.True(t, teardown)
+	assert.Empty(t, remaining)
+	assert.Equal(t, 0, c.running())
+
+	c.remove("first")
+	c.remove("second")
+	assert.Empty(t, c.list)
+}
+
+func TestContainerHostLimits(t *testing.T) {
+	var c containerSet
+	limit := func(v int64) *int64 { return &v }
+	shares := func(v uint64) *uint64 { return &v }
+
+	assert.Equal(t, hostLimits{memory: -1}, c.hostLimits())
+
+	addContainer(t, &c, "app", nil)
+	addContainer(t, &c, "sidecar", nil)
+	c.setResources("app", &specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: limit(256 << 20)}})
+
+	// A container without a memory limit leaves the VM unlimited
+	assert.Equal(t, hostLimits{memory: -1}, c.hostLimits())
+
+	c.setResources("sidecar", &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: limit(64 << 20)},
+		CPU:    &specs.LinuxCPU{Shares: shares(512)},
+	})
+	assert.Equal(t, hostLimits{memory: 320 << 20, cpuShares: 512}, c.hostLimits())
+
+	// Updates change only the limits given
+	c.setResources("sidecar", &specs.LinuxResources{CPU: &specs.LinuxCPU{Shares: shares(256)}})
+	assert.Equal(t, hostLimits{memory: 320 << 20, cpuShares: 256}, c.hostLimits())
+
+	c.markExited("sidecar")
+	assert.Equal(t, hostLimits{memory: 256 << 20}, c.hostLimits())
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/pkg/errors"
+)
+
+// cpuTemplateNone explicitly starts VMs without a CPU template, exposing the host CPU's features as they are
+const cpuTemplateNone = "None"
+
+const (
+	cpuVendorIntel = "GenuineIntel"
+	cpuVendorAMD   = "AuthenticAMD"
+)
+
+// cpuTemplateVendors lists the host CPU vendors Firecracker supports each CPU template on.
+// Both templates mask Intel CPUID leaves (C3 like a C3 instance, T2 like a T2 instance).
+var cpuTemplateVendors = map[models.CPUTemplate][]string{
+	models.CPUTemplateC3: {cpuVendorIntel},
+	models.CPUTemplateT2: {cpuVendorIntel},
+}
+
+// validateCPUTemplate checks the template is either supported by Firecracker or explicitly none.
+// Firecracker only supports predefined CPU templates, arbitrary CPUID masks can't be applied.
+func validateCPUTemplate(template string) error {
+	if template == "" || template == cpuTemplateNone {
+		return nil
+	}
+
+	if _, ok := cpuTemplateVendors[models.CPUTemplate(template)]; !ok {
+		return errors.Errorf("unsupported cpu_template %q, should be %q, %q or %q",
+			template, models.CPUTemplateC3, models.CPUTemplateT2, cpuTemplateNone)
+	}
+
+	return nil
+}
+
+// cpuTemplate returns the CPU template VMs are started with, empty if none
+func (c *Config) cpuTemplate() models.CPUTemplate {
+	if c.CPUTemplate == cpuTemplateNone {
+		return ""
+	}
+
+	return models.CPUTemplate(c.CPUTemplate)
+}
+
+// checkCPUTemplate checks the host CPU supports the configured CPU template, which Firecracker would
+// otherwise fail to apply with an error that doesn't tell why. Hosts whose CPU vendor can't be told
+// are left to Firecracker to check.
+func (c *Config) checkCPUTemplate() error {
+	template := c.cpuTemplate()
+	if template == "" {
+		return nil
+	}
+
+	vendor, err := hostCPUVendor()
+	if err != nil || vendor == "" {
+		return nil
+	}
+
+	vendors := cpuTemplateVendors[template]
+	for _, supported := range vendors {
+		if vendor == supported {
+			return nil
+		}
+	}
+
+	return errors.Wrapf(errdefs.ErrFailedPrecondition,
+		"cpu_template %q is only supported on %s CPUs, but the host CPU is %s (set cpu_template to %q to start VMs without a template)",
+		template, strings.Join(vendors, ", "), vendor, cpuTemplateNone)
+}
+
+// hostCPUVendor returns the vendor ID of the host CPU, empty if it isn't reported (like on ARM hosts)
+func hostCPUVendor() (string, error) {
+	file, err := os.Open(filepath.Join(procDir, "cpuinfo"))
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "vendor_id" {
+			return strings.TrimSpace(parts[1]), nil
+		}
+	}
+
+	return "", scanner.Err()
+}
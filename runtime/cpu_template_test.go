@@ -0,0 +1,67 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCPUTemplate(t *testing.T) {
+	config := &Config{CPUTemplate: "C3"}
+	assert.Equal(t, models.CPUTemplateC3, config.cpuTemplate())
+
+	config.CPUTemplate = cpuTemplateNone
+	assert.Empty(t, config.cpuTemplate())
+}
+
+func TestCheckCPUTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prevProcDir := procDir
+	procDir = dir
+	defer func() { procDir = prevProcDir }()
+
+	writeCPUInfo := func(vendor string) {
+		cpuinfo := "processor\t: 0\nvendor_id\t: " + vendor + "\ncpu family\t: 6\n"
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cpuinfo"), []byte(cpuinfo), 0600))
+	}
+
+	// Vendor isn't known, Firecracker is left to check
+	config := &Config{CPUTemplate: "T2"}
+	assert.NoError(t, config.checkCPUTemplate())
+
+	writeCPUInfo(cpuVendorIntel)
+	assert.NoError(t, config.checkCPUTemplate())
+
+	writeCPUInfo(cpuVendorAMD)
+	err = config.checkCPUTemplate()
+	require.Error(t, err)
+	assert.True(t, errdefs.IsFailedPrecondition(err))
+	assert.Contains(t, err.Error(), cpuVendorAMD)
+
+	for _, template := range []string{"", cpuTemplateNone} {
+		config.CPUTemplate = template
+		assert.NoError(t, config.checkCPUTemplate(), template)
+	}
+}
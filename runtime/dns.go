@@ -0,0 +1,117 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+const (
+	dnsQueryTimeout = 5 * time.Second
+	maxDNSInflight  = 128
+)
+
+// proxyDNS connects to the DNS port of the agent and resolves queries sent by the guest using the upstream resolver.
+// The connection is initiated by the host, so the port is only used within the VM and can't collide with other VMs.
+func (s *service) proxyDNS(ctx context.Context, cid uint32) {
+	defer recoverGoroutine(ctx, "dns_proxy", nil)
+
+	conn, err := dialVsock(ctx, cid, s.config.DNSVsockPort)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to connect to agent DNS port")
+		return
+	}
+
+	defer conn.Close()
+
+	log.G(ctx).Infof("resolving guest DNS queries with %s", s.config.DNSUpstream)
+	if err := serveDNS(ctx, conn, s.config.DNSUpstream, dnsQueryTimeout); err != nil && err != io.EOF {
+		log.G(ctx).WithError(err).Warn("DNS proxy stopped")
+	}
+}
+
+// serveDNS reads queries from the guest connection and writes back responses of the upstream resolver.
+// Queries are resolved concurrently, the guest matches responses by query ID.
+func serveDNS(ctx context.Context, conn io.ReadWriter, upstream string, timeout time.Duration) error {
+	var (
+		writeLock sync.Mutex
+		inflight  = make(chan struct{}, maxDNSInflight)
+	)
+
+	for {
+		query, err := internal.ReadDNSMessage(conn)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case inflight <- struct{}{}:
+		default:
+			log.G(ctx).Warn("too many DNS queries in flight, dropping query")
+			continue
+		}
+
+		go func() {
+			defer func() { <-inflight }()
+
+			resp, err := resolveDNS(upstream, query, timeout)
+			if err != nil {
+				// The guest resolver retries or times out on its own
+				log.G(ctx).WithError(err).Debug("DNS query failed")
+				return
+			}
+
+			writeLock.Lock()
+			defer writeLock.Unlock()
+
+			if err := internal.WriteDNSMessage(conn, resp); err != nil {
+				log.G(ctx).WithError(err).Debug("failed to send DNS response to guest")
+			}
+		}()
+	}
+}
+
+// resolveDNS sends the query to the upstream resolver over UDP and waits for the response
+func resolveDNS(upstream string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", upstream, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, internal.MaxDNSMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
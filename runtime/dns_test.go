@@ -0,0 +1,64 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+// fakeResolver answers every query with the query itself with QR (response) bit set
+func fakeResolver(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		buf := make([]byte, internal.MaxDNSMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			buf[2] |= 0x80
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return conn
+}
+
+func TestServeDNS(t *testing.T) {
+	resolver := fakeResolver(t)
+	defer resolver.Close()
+
+	guest, host := net.Pipe()
+	defer guest.Close()
+
+	go serveDNS(context.Background(), host, resolver.LocalAddr().String(), time.Second)
+
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	require.NoError(t, internal.WriteDNSMessage(guest, query))
+
+	resp, err := internal.ReadDNSMessage(guest)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x12, 0x34, 0x81, 0x00}, resp[:4])
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+
+	"github.com/containerd/containerd/api/types"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+)
+
+// Firecracker doesn't allow to configure host caching for drives,
+// guest flushes are not propagated to disk, which matches the "Unsafe" cache type.
+const defaultDriveCacheType = "Unsafe"
+
+// driveRole describes why a drive was attached to the VM
+type driveRole string
+
+const (
+	driveRoleRoot   driveRole = "root"
+	driveRoleExtra  driveRole = "extra"
+	driveRoleRootfs driveRole = "rootfs"
+	driveRoleVolume driveRole = "volume"
+)
+
+// rootDriveID is the ID of the drive configured with root_drive
+const rootDriveID = "root"
+
+// I/O engines of Firecracker block devices
+const (
+	ioEngineSync  = "Sync"
+	ioEngineAsync = "Async"
+)
+
+// IDs of configured drives start with a letter, so they never collide with the numeric IDs of other drives
+var driveIDPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+// driveInfo represents a single entry of the VM drive inventory
+type driveInfo struct {
+	ID           string              `json:"id"`
+	Role         driveRole           `json:"role"`
+	PathOnHost   string              `json:"path_on_host"`
+	IsRootDevice bool                `json:"is_root_device"`
+	IsReadOnly   bool                `json:"is_read_only"`
+	CacheType    string              `json:"cache_type"`
+	RateLimiter  *models.RateLimiter `json:"rate_limiter,omitempty"`
+}
+
+// driveAllocator assigns sequential drive IDs (starting from 1) and keeps track
+// of the role of each drive, so the effective layout can be reported later.
+type driveAllocator struct {
+	drives []models.Drive
+	roles  []driveRole
+}
+
+// add allocates the next drive ID and records the drive
+func (a *driveAllocator) add(role driveRole, pathOnHost string, isRoot, isReadOnly bool) {
+	a.addWithID(strconv.Itoa(len(a.drives)+1), role, pathOnHost, isRoot, isReadOnly)
+}
+
+// addWithID records the drive with the given ID
+func (a *driveAllocator) addWithID(id string, role driveRole, pathOnHost string, isRoot, isReadOnly bool) {
+	a.drives = append(a.drives, models.Drive{
+		DriveID:      firecracker.String(id),
+		PathOnHost:   firecracker.String(pathOnHost),
+		IsRootDevice: firecracker.Bool(isRoot),
+		IsReadOnly:   firecracker.Bool(isReadOnly),
+	})
+	a.roles = append(a.roles, role)
+}
+
+// inventory returns the drive layout in attachment order
+func (a *driveAllocator) inventory() []driveInfo {
+	list := make([]driveInfo, len(a.drives))
+	for i, drive := range a.drives {
+		list[i] = driveInfo{
+			ID:           firecracker.StringValue(drive.DriveID),
+			Role:         a.roles[i],
+			PathOnHost:   firecracker.StringValue(drive.PathOnHost),
+			IsRootDevice: firecracker.BoolValue(drive.IsRootDevice),
+			IsReadOnly:   firecracker.BoolValue(drive.IsReadOnly),
+			CacheType:    defaultDriveCacheType,
+			RateLimiter:  drive.RateLimiter,
+		}
+	}
+
+	return list
+}
+
+// withDrivePath returns a copy of the inventory with the host path of the drive of the given ID replaced,
+// like the placeholder of a pooled VM's rootfs once the rootfs is hot-plugged
+func withDrivePath(drives []driveInfo, id, pathOnHost string) []driveInfo {
+	list := make([]driveInfo, len(drives))
+	copy(list, drives)
+	for i := range list {
+		if list[i].ID == id {
+			list[i].PathOnHost = pathOnHost
+		}
+	}
+
+	return list
+}
+
+// configuredDrives returns root_drive and drives from config, in attachment order
+func configuredDrives(config *Config) []DriveConfig {
+	var drives []DriveConfig
+	if config.RootDrive != "" {
+		drives = append(drives, DriveConfig{ID: rootDriveID, HostPath: config.RootDrive, IsRoot: true})
+	}
+
+	return append(drives, config.Drives...)
+}
+
+// validateDrives checks IDs of configured drives are valid and unique, and exactly one of the drives is root
+func validateDrives(config *Config) error {
+	var (
+		ids   = make(map[string]bool)
+		roots []string
+	)
+
+	for _, drive := range config.Drives {
+		if drive.ID == rootDriveID || !driveIDPattern.MatchString(drive.ID) {
+			return errors.Errorf("invalid drive id %q, ids start with a letter followed by letters, digits or _, %q is reserved for root_drive", drive.ID, rootDriveID)
+		}
+
+		if ids[drive.ID] {
+			return errors.Errorf("drive id %q is used more than once", drive.ID)
+		}
+
+		if drive.HostPath == "" {
+			return errors.Errorf("drive %q host_path can't be empty", drive.ID)
+		}
+
+		if err := validateIOEngine(drive.IOEngine); err != nil {
+			return errors.Wrapf(err, "invalid io_engine of drive %q", drive.ID)
+		}
+
+		ids[drive.ID] = true
+	}
+
+	for _, drive := range configuredDrives(config) {
+		if drive.IsRoot {
+			roots = append(roots, drive.ID)
+		}
+	}
+
+	if len(roots) != 1 {
+		return errors.Errorf("exactly one drive should be the root device (either root_drive or a drive with is_root), got %v", roots)
+	}
+
+	return nil
+}
+
+// validateIOEngine accepts only the Sync engine, which Firecracker uses when no engine is given.
+// The drive API used by the runtime predates engine selection, so the io_uring based Async engine isn't available.
+func validateIOEngine(engine string) error {
+	switch engine {
+	case "", ioEngineSync:
+		return nil
+	case ioEngineAsync:
+		return errors.Errorf("%q requires a newer Firecracker than the runtime supports", engine)
+	default:
+		return errors.Errorf("unknown I/O engine %q, should be %q", engine, ioEngineSync)
+	}
+}
+
+// defaultRootDrive returns the ID of the drive configured as root device
+func defaultRootDrive(config *Config) string {
+	for _, drive := range configuredDrives(config) {
+		if drive.IsRoot {
+			return drive.ID
+		}
+	}
+
+	return ""
+}
+
+// isConfiguredDrive returns true if the ID belongs to root_drive or one of drives
+func isConfiguredDrive(config *Config, id string) bool {
+	for _, drive := range configuredDrives(config) {
+		if drive.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// attachConfiguredDrives attaches configured drives in order, with the drive of the given ID as root device
+func attachConfiguredDrives(config *Config, rootID string, drives *driveAllocator) error {
+	var found bool
+	for _, drive := range configuredDrives(config) {
+		isRoot := drive.ID == rootID
+		role := driveRoleExtra
+		if isRoot {
+			role = driveRoleRoot
+			found = true
+		}
+
+		drives.addWithID(drive.ID, role, drive.HostPath, isRoot, drive.ReadOnly)
+	}
+
+	if !found {
+		return errors.Errorf("root drive %q isn't configured", rootID)
+	}
+
+	return nil
+}
+
+// hasReadOnlyRootfsMount returns true if any of the rootfs mounts is read-only, like the ones of snapshots
+// the snapshotter was asked to keep read-only
+func hasReadOnlyRootfsMount(mounts []*types.Mount) bool {
+	for _, mnt := range mounts {
+		for _, option := range mnt.Options {
+			if option == "ro" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// writeDriveInventory writes the drives attached to the VM of the bundle as JSON, as saved in its VM state
+func writeDriveInventory(w io.Writer, bundle string) error {
+	state, err := loadVMState(bundle)
+	if err != nil {
+		return err
+	}
+
+	if state == nil {
+		return errors.Errorf("no VM is running for bundle %s", bundle)
+	}
+
+	return json.NewEncoder(w).Encode(state.Drives)
+}
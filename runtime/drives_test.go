@@ -0,0 +1,189 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/api/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDriveInventory(t *testing.T) {
+	drives := &driveAllocator{}
+	drives.add(driveRoleRoot, "/var/lib/firecracker/root.img", true, false)
+	drives.add(driveRoleRootfs, "/dev/mapper/pool-snap-1", false, false)
+
+	list := drives.inventory()
+	require.Len(t, list, 2)
+
+	assert.Equal(t, "1", list[0].ID)
+	assert.Equal(t, driveRoleRoot, list[0].Role)
+	assert.Equal(t, "/var/lib/firecracker/root.img", list[0].PathOnHost)
+	assert.True(t, list[0].IsRootDevice)
+	assert.False(t, list[0].IsReadOnly)
+	assert.Equal(t, defaultDriveCacheType, list[0].CacheType)
+
+	assert.Equal(t, "2", list[1].ID)
+	assert.Equal(t, driveRoleRootfs, list[1].Role)
+	assert.Equal(t, "/dev/mapper/pool-snap-1", list[1].PathOnHost)
+	assert.False(t, list[1].IsRootDevice)
+	assert.Nil(t, list[1].RateLimiter)
+}
+
+func TestDriveInventoryState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	drives := &driveAllocator{}
+	drives.add(driveRoleRoot, "/var/lib/firecracker/root.img", true, true)
+	drives.add(driveRoleRootfs, "/var/lib/firecracker/placeholder.img", false, false)
+
+	s := &service{drives: drives.inventory()}
+	require.NoError(t, saveVMState(dir, &vmState{CID: 42, Drives: s.driveInventory()}))
+
+	// Operators read the inventory from the state file
+	data, err := ioutil.ReadFile(filepath.Join(dir, vmStateFileName))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"path_on_host":"/var/lib/firecracker/root.img"`)
+	assert.Contains(t, string(data), `"is_read_only":true`)
+	assert.Contains(t, string(data), `"cache_type":"Unsafe"`)
+
+	state, err := loadVMState(dir)
+	require.NoError(t, err)
+	assert.Equal(t, s.driveInventory(), state.Drives)
+
+	// The rootfs of a pooled VM replaces its placeholder
+	list := withDrivePath(state.Drives, "2", "/dev/mapper/pool-snap-1")
+	assert.Equal(t, "/dev/mapper/pool-snap-1", list[1].PathOnHost)
+	assert.Equal(t, "/var/lib/firecracker/placeholder.img", state.Drives[1].PathOnHost, "inventory is copied")
+	assert.Equal(t, state.Drives[0], list[0])
+}
+
+func TestWriteDriveInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// No VM was started from the bundle
+	var out bytes.Buffer
+	assert.Error(t, writeDriveInventory(&out, dir))
+
+	drives := &driveAllocator{}
+	drives.addWithID(rootDriveID, driveRoleRoot, "/var/lib/firecracker/root.img", true, true)
+	drives.add(driveRoleRootfs, "/dev/mapper/pool-snap-1", false, false)
+
+	limiter := &RateLimiterConfig{Bandwidth: &TokenBucketConfig{Size: 1 << 20, RefillTimeMs: 100}}
+	drives.setRateLimiter(limiter.model())
+	require.NoError(t, saveVMState(dir, &vmState{CID: 42, Drives: drives.inventory()}))
+
+	require.NoError(t, writeDriveInventory(&out, dir))
+	assert.Contains(t, out.String(), `"path_on_host":"/var/lib/firecracker/root.img"`)
+	assert.Contains(t, out.String(), `"is_read_only":true`)
+	assert.Contains(t, out.String(), `"cache_type":"Unsafe"`)
+	assert.Contains(t, out.String(), `"rate_limiter":{"bandwidth":{"one_time_burst":0,"refill_time":100,"size":1048576}}`)
+
+	var list []driveInfo
+	require.NoError(t, json.Unmarshal(out.Bytes(), &list))
+	assert.Equal(t, drives.inventory(), list)
+}
+
+func TestValidateDrives(t *testing.T) {
+	config := &Config{RootDrive: "/var/lib/firecracker/root.img"}
+	require.NoError(t, validateDrives(config))
+	assert.Equal(t, rootDriveID, defaultRootDrive(config))
+
+	config.Drives = []DriveConfig{
+		{ID: "alpine", HostPath: "/var/lib/firecracker/alpine.img"},
+		{ID: "debian", HostPath: "/var/lib/firecracker/debian.img", ReadOnly: true},
+	}
+	require.NoError(t, validateDrives(config))
+
+	// Two root devices
+	config.Drives[1].IsRoot = true
+	assert.Error(t, validateDrives(config))
+
+	config.RootDrive = ""
+	require.NoError(t, validateDrives(config))
+	assert.Equal(t, "debian", defaultRootDrive(config))
+
+	// No root device
+	config.Drives[1].IsRoot = false
+	assert.Error(t, validateDrives(config))
+
+	// Only the engine Firecracker uses without being asked for one is available
+	config.Drives = []DriveConfig{{ID: "data", HostPath: "/root.img", IsRoot: true, IOEngine: "Sync"}}
+	require.NoError(t, validateDrives(config))
+
+	config.Drives[0].IOEngine = "Async"
+	err := validateDrives(config)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "requires a newer Firecracker")
+
+	for _, drives := range [][]DriveConfig{
+		{{ID: "root", HostPath: "/root.img", IsRoot: true}},
+		{{ID: "2", HostPath: "/root.img", IsRoot: true}},
+		{{ID: "data-1", HostPath: "/root.img", IsRoot: true}},
+		{{ID: "data", HostPath: "", IsRoot: true}},
+		{{ID: "data", HostPath: "/root.img", IsRoot: true}, {ID: "data", HostPath: "/data.img"}},
+		{{ID: "data", HostPath: "/root.img", IsRoot: true, IOEngine: "sync"}},
+	} {
+		config.Drives = drives
+		assert.Error(t, validateDrives(config), drives)
+	}
+}
+
+func TestAttachConfiguredDrives(t *testing.T) {
+	config := &Config{
+		RootDrive: "/var/lib/firecracker/root.img",
+		Drives: []DriveConfig{
+			{ID: "debian", HostPath: "/var/lib/firecracker/debian.img", ReadOnly: true},
+		},
+	}
+
+	drives := &driveAllocator{}
+	require.NoError(t, attachConfiguredDrives(config, "debian", drives))
+	drives.add(driveRoleRootfs, "/dev/mapper/pool-snap-1", false, false)
+
+	list := drives.inventory()
+	require.Len(t, list, 3)
+
+	assert.Equal(t, rootDriveID, list[0].ID)
+	assert.Equal(t, driveRoleExtra, list[0].Role)
+	assert.False(t, list[0].IsRootDevice)
+
+	assert.Equal(t, "debian", list[1].ID)
+	assert.Equal(t, driveRoleRoot, list[1].Role)
+	assert.True(t, list[1].IsRootDevice)
+	assert.True(t, list[1].IsReadOnly)
+
+	assert.Equal(t, "3", list[2].ID)
+	assert.Equal(t, driveRoleRootfs, list[2].Role)
+
+	assert.Error(t, attachConfiguredDrives(config, "ubuntu", &driveAllocator{}))
+}
+
+func TestHasReadOnlyRootfsMount(t *testing.T) {
+	assert.False(t, hasReadOnlyRootfsMount(nil))
+	assert.False(t, hasReadOnlyRootfsMount([]*types.Mount{{Type: "ext4", Source: "/dev/mapper/pool-snap-1"}}))
+	assert.False(t, hasReadOnlyRootfsMount([]*types.Mount{{Type: "ext4", Options: []string{"rw", "noatime"}}}))
+	assert.True(t, hasReadOnlyRootfsMount([]*types.Mount{{Type: "ext4", Options: []string{"noatime", "ro"}}}))
+}
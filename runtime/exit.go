@@ -0,0 +1,119 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// exitHooks holds the cleanup functions to run when the shim process exits
+var exitHooks exitHookList
+
+// exitHookList runs registered functions once, in reverse registration order.
+// The shim can exit from several places (Shutdown, a panic, a signal), the list makes sure cleanup happens only once.
+type exitHookList struct {
+	mu    sync.Mutex
+	hooks []func()
+	once  sync.Once
+}
+
+func (l *exitHookList) register(hook func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.hooks = append(l.hooks, hook)
+}
+
+func (l *exitHookList) run() {
+	l.once.Do(func() {
+		l.mu.Lock()
+		hooks := l.hooks
+		l.mu.Unlock()
+
+		for i := len(hooks) - 1; i >= 0; i-- {
+			hooks[i]()
+		}
+	})
+}
+
+// exitShim runs exit hooks and terminates the shim process with the given code
+func exitShim(code int) {
+	exitHooks.run()
+	os.Exit(code)
+}
+
+// exitOnPanic runs exit hooks if the calling goroutine is panicking, then lets the panic continue.
+// Must be deferred directly by the function to guard.
+func exitOnPanic() {
+	if r := recover(); r != nil {
+		log.L.WithField("panic", fmt.Sprint(r)).Error("shim panicked, cleaning up")
+		exitHooks.run()
+		panic(r)
+	}
+}
+
+// recoverGoroutine keeps a panic in a background goroutine from crashing the shim, which would take down the VM
+// with all of its containers. The panic is logged with its stack, then onPanic (if not nil) cleans up after the
+// goroutine. Must be deferred directly by the goroutine's function.
+func recoverGoroutine(ctx context.Context, name string, onPanic func()) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	log.G(ctx).WithFields(logrus.Fields{
+		"goroutine": name,
+		"panic":     fmt.Sprint(r),
+		"stack":     string(debug.Stack()),
+	}).Error("background goroutine panicked")
+
+	if onPanic == nil {
+		return
+	}
+
+	// Cleanup works with whatever state the goroutine left behind, it must not crash the shim either
+	defer func() {
+		if r := recover(); r != nil {
+			log.G(ctx).WithFields(logrus.Fields{"goroutine": name, "panic": fmt.Sprint(r)}).Error("cleanup after panic failed")
+		}
+	}()
+
+	onPanic()
+}
+
+// handleExitSignals cleans up and exits when the shim receives a signal which would otherwise terminate it.
+// SIGTERM and SIGINT are handled by the shim library, SIGKILL can't be caught.
+// SIGUSR2 makes the shim exit without stopping the VM, so a restarted shim can reattach to it.
+func handleExitSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGHUP, unix.SIGUSR2)
+
+	sig := <-signals
+	if sig == unix.SIGUSR2 {
+		log.L.Info("shim received SIGUSR2, exiting and leaving the VM running")
+		os.Exit(0)
+	}
+
+	log.L.WithField("signal", sig).Warn("shim received signal, cleaning up")
+	exitShim(128 + int(sig.(unix.Signal)))
+}
@@ -0,0 +1,35 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitHookList(t *testing.T) {
+	var (
+		hooks exitHookList
+		calls []int
+	)
+
+	hooks.register(func() { calls = append(calls, 1) })
+	hooks.register(func() { calls = append(calls, 2) })
+
+	hooks.run()
+	hooks.run()
+
+	assert.Equal(t, []int{2, 1}, calls)
+}
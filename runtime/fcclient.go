@@ -0,0 +1,167 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+	httptransport "github.com/go-openapi/runtime/client"
+	"github.com/go-openapi/strfmt"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultAPITimeoutMs = 1000
+
+// firecrackerClient talks to Firecracker API over unix socket.
+// Unlike the SDK's default client, every call (including instance start) is bounded by the same configurable timeout.
+type firecrackerClient struct {
+	client  *client.Firecracker
+	timeout time.Duration
+}
+
+var _ firecracker.Firecracker = &firecrackerClient{}
+
+func newFirecrackerClient(socketPath string, timeout time.Duration, logger *logrus.Entry, debug bool) *firecrackerClient {
+	httpClient := client.NewHTTPClient(strfmt.NewFormats())
+
+	socketTransport := &http.Transport{
+		DialContext: func(ctx context.Context, network, path string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+
+	transport := httptransport.New(client.DefaultHost, client.DefaultBasePath, client.DefaultSchemes)
+	transport.Transport = socketTransport
+	transport.SetDebug(debug)
+
+	if logger != nil {
+		transport.SetLogger(logger)
+	}
+
+	httpClient.SetTransport(transport)
+
+	return &firecrackerClient{
+		client:  httpClient,
+		timeout: timeout,
+	}
+}
+
+func (f *firecrackerClient) PutLogger(ctx context.Context, logger *models.Logger) (*ops.PutLoggerNoContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	params := ops.NewPutLoggerParamsWithContext(ctx)
+	params.SetBody(logger)
+
+	return f.client.Operations.PutLogger(params)
+}
+
+func (f *firecrackerClient) PutMachineConfiguration(ctx context.Context, cfg *models.MachineConfiguration) (*ops.PutMachineConfigurationNoContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	params := ops.NewPutMachineConfigurationParamsWithContext(ctx)
+	params.SetBody(cfg)
+
+	return f.client.Operations.PutMachineConfiguration(params)
+}
+
+func (f *firecrackerClient) PutGuestBootSource(ctx context.Context, source *models.BootSource) (*ops.PutGuestBootSourceNoContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	params := ops.NewPutGuestBootSourceParamsWithContext(ctx)
+	params.SetBody(source)
+
+	return f.client.Operations.PutGuestBootSource(params)
+}
+
+func (f *firecrackerClient) PutGuestNetworkInterfaceByID(ctx context.Context, ifaceID string, ifaceCfg *models.NetworkInterface) (*ops.PutGuestNetworkInterfaceByIDNoContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	params := ops.NewPutGuestNetworkInterfaceByIDParamsWithContext(ctx)
+	params.SetIfaceID(ifaceID)
+	params.SetBody(ifaceCfg)
+
+	return f.client.Operations.PutGuestNetworkInterfaceByID(params)
+}
+
+func (f *firecrackerClient) PutGuestDriveByID(ctx context.Context, driveID string, drive *models.Drive) (*ops.PutGuestDriveByIDNoContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	params := ops.NewPutGuestDriveByIDParamsWithContext(ctx)
+	params.SetDriveID(driveID)
+	params.SetBody(drive)
+
+	return f.client.Operations.PutGuestDriveByID(params)
+}
+
+func (f *firecrackerClient) PatchGuestDriveByID(ctx context.Context, driveID, pathOnHost string) (*ops.PatchGuestDriveByIDNoContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	params := ops.NewPatchGuestDriveByIDParamsWithContext(ctx)
+	params.SetDriveID(driveID)
+	params.SetBody(&models.PartialDrive{DriveID: &driveID, PathOnHost: &pathOnHost})
+
+	return f.client.Operations.PatchGuestDriveByID(params)
+}
+
+func (f *firecrackerClient) PutGuestVsockByID(ctx context.Context, vsockID string, vsock *models.Vsock) (*ops.PutGuestVsockByIDCreated, *ops.PutGuestVsockByIDNoContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	params := ops.NewPutGuestVsockByIDParamsWithContext(ctx)
+	params.SetID(vsockID)
+	params.SetBody(vsock)
+
+	return f.client.Operations.PutGuestVsockByID(params)
+}
+
+func (f *firecrackerClient) CreateSyncAction(ctx context.Context, info *models.InstanceActionInfo) (*ops.CreateSyncActionNoContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	params := ops.NewCreateSyncActionParamsWithContext(ctx)
+	params.SetInfo(info)
+
+	return f.client.Operations.CreateSyncAction(params)
+}
+
+func (f *firecrackerClient) PutMmds(ctx context.Context, metadata interface{}) (*ops.PutMmdsNoContent, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	params := ops.NewPutMmdsParamsWithContext(ctx)
+	params.SetBody(metadata)
+
+	return f.client.Operations.PutMmds(params)
+}
+
+func (f *firecrackerClient) GetMachineConfig() (*ops.GetMachineConfigOK, error) {
+	params := ops.NewGetMachineConfigParams()
+	params.SetTimeout(f.timeout)
+
+	return f.client.Operations.GetMachineConfig(params)
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirecrackerClientTimeout(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "fcclient-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	socketPath := filepath.Join(tempDir, "firecracker.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	// Wedged VMM never responds
+	release := make(chan struct{})
+	defer close(release)
+
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	client := newFirecrackerClient(socketPath, 100*time.Millisecond, nil, false)
+
+	start := time.Now()
+	_, err = client.CreateSyncAction(context.Background(), &models.InstanceActionInfo{ActionType: models.InstanceActionInfoActionTypeInstanceStart})
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "API call must be bounded by timeout")
+
+	_, err = client.GetMachineConfig()
+	assert.Error(t, err)
+}
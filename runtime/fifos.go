@@ -0,0 +1,77 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	vmLogFifoName     = "log.fifo"
+	vmMetricsFifoName = "metrics.fifo"
+)
+
+// vmFifoDir returns the directory FIFOs of the VM are created in, unique to the task the VM is started for.
+// It's empty unless fifo_dir is set and at least one of the FIFOs isn't configured explicitly.
+func (s *service) vmFifoDir() string {
+	if s.config.FifoDir == "" || (s.config.LogFifo != "" && s.config.MetricsFifo != "") {
+		return ""
+	}
+
+	return filepath.Join(s.config.FifoDir, s.namespace, s.id)
+}
+
+// logFifo returns the path of the log FIFO of the VM, log_fifo takes precedence over fifo_dir
+func (s *service) logFifo() string {
+	if s.config.LogFifo != "" {
+		return s.config.LogFifo
+	}
+
+	if dir := s.vmFifoDir(); dir != "" {
+		return filepath.Join(dir, vmLogFifoName)
+	}
+
+	return ""
+}
+
+// metricsFifo returns the path of the metrics FIFO of the VM, metrics_fifo takes precedence over fifo_dir
+func (s *service) metricsFifo() string {
+	if s.config.MetricsFifo != "" {
+		return s.config.MetricsFifo
+	}
+
+	if dir := s.vmFifoDir(); dir != "" {
+		return filepath.Join(dir, vmMetricsFifoName)
+	}
+
+	return ""
+}
+
+// createVMFifoDir creates the directory of FIFOs of the VM, the FIFOs themselves are made by the logging handler.
+// Jailed FIFOs are placed in the chroot instead.
+func (s *service) createVMFifoDir() error {
+	dir := s.vmFifoDir()
+	if dir == "" || s.vmJail() != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create fifo directory %q", dir)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVMFifos(t *testing.T) {
+	s := &service{config: &Config{}, namespace: "default", id: "task"}
+
+	assert.Empty(t, s.logFifo())
+	assert.Empty(t, s.metricsFifo())
+	assert.Empty(t, s.vmFifoDir())
+
+	s.config.FifoDir = "/run/firecracker"
+	assert.Equal(t, "/run/firecracker/default/task/log.fifo", s.logFifo())
+	assert.Equal(t, "/run/firecracker/default/task/metrics.fifo", s.metricsFifo())
+
+	other := &service{config: s.config, namespace: "default", id: "other"}
+	assert.NotEqual(t, s.logFifo(), other.logFifo(), "VMs of different tasks should have different FIFOs")
+
+	// Explicit paths take precedence
+	s.config.LogFifo = "/tmp/fc-logs.fifo"
+	assert.Equal(t, "/tmp/fc-logs.fifo", s.logFifo())
+	assert.Equal(t, "/run/firecracker/default/task/metrics.fifo", s.metricsFifo())
+	assert.Equal(t, []string{"/run/firecracker/default/task/metrics.fifo", "/run/firecracker/default/task"}, s.vmArtifacts()[1:3])
+
+	s.config.MetricsFifo = "/tmp/fc-metrics.fifo"
+	assert.Equal(t, "/tmp/fc-metrics.fifo", s.metricsFifo())
+	assert.Empty(t, s.vmFifoDir(), "no FIFOs are placed in fifo_dir")
+}
+
+func TestCreateVMFifoDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fc-fifos-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &service{config: &Config{FifoDir: dir}, namespace: "default", id: "task"}
+	require.NoError(t, s.createVMFifoDir())
+
+	info, err := os.Stat(filepath.Join(dir, "default", "task"))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+}
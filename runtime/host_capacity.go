@@ -0,0 +1,117 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+)
+
+// Memory given to each VM
+const vmMemSizeMib = 256
+
+// vmCapacity describes the resources a VM takes from the host and the limits it has to fit in
+type vmCapacity struct {
+	MemSizeMib int64
+	// MaxVMs is the number of VMs that may run on the host at once, 0 if unlimited
+	MaxVMs int
+	// MaxMemoryMib is the memory all VMs on the host may be given together, 0 if unlimited
+	MaxMemoryMib int64
+}
+
+// vmCapacity returns the limits a VM of the given memory size is started with
+func (c *Config) vmCapacity(memSizeMib int64) (vmCapacity, error) {
+	capacity := vmCapacity{MemSizeMib: memSizeMib, MaxVMs: c.MaxVMs}
+	if c.MaxVMMemoryPercent == 0 {
+		return capacity, nil
+	}
+
+	totalMib, err := hostMemoryMib()
+	if err != nil {
+		return capacity, err
+	}
+
+	capacity.MaxMemoryMib = totalMib * int64(c.MaxVMMemoryPercent) / 100
+	return capacity, nil
+}
+
+// check fails with ErrUnavailable if the VM doesn't fit next to the VMs running on the host.
+// Must be called with the CID lock held, so concurrent shims don't take the last slot twice.
+func (v vmCapacity) check() error {
+	if v.MaxVMs == 0 && v.MaxMemoryMib == 0 {
+		return nil
+	}
+
+	records, err := registeredCIDs()
+	if err != nil {
+		return errors.Wrap(err, "failed to list running VMs")
+	}
+
+	if v.MaxVMs > 0 && len(records) >= v.MaxVMs {
+		return errors.Wrapf(errdefs.ErrUnavailable, "host at capacity: %d VMs are running, max_vms is %d", len(records), v.MaxVMs)
+	}
+
+	if v.MaxMemoryMib > 0 {
+		var usedMib int64
+		for _, record := range records {
+			usedMib += record.MemSizeMib
+		}
+
+		if usedMib+v.MemSizeMib > v.MaxMemoryMib {
+			return errors.Wrapf(errdefs.ErrUnavailable,
+				"host at capacity: running VMs use %d MiB, another %d MiB would exceed the VM memory limit of %d MiB",
+				usedMib, v.MemSizeMib, v.MaxMemoryMib)
+		}
+	}
+
+	return nil
+}
+
+// hostMemoryMib returns MemTotal from /proc/meminfo in MiB
+func hostMemoryMib() (int64, error) {
+	file, err := os.Open(filepath.Join(procDir, "meminfo"))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read host memory size")
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// MemTotal:       16316412 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "MemTotal:" || fields[2] != "kB" {
+			continue
+		}
+
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid MemTotal %q", fields[1])
+		}
+
+		return kb / 1024, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, errors.Wrap(err, "failed to read host memory size")
+	}
+
+	return 0, errors.New("MemTotal not found in meminfo")
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostCapacityMaxVMs(t *testing.T) {
+	restore := mockCIDAllocation(t)
+	defer restore()
+
+	ctx := context.Background()
+	capacity := vmCapacity{MemSizeMib: vmMemSizeMib, MaxVMs: 2}
+
+	for _, id := range []string{"vm1", "vm2"} {
+		reservation, err := reserveVsockCID(ctx, "default", id, capacity)
+		require.NoError(t, err)
+		require.NoError(t, reservation.release())
+	}
+
+	_, err := reserveVsockCID(ctx, "default", "vm3", capacity)
+	require.Error(t, err)
+	assert.True(t, errdefs.IsUnavailable(err))
+	assert.Contains(t, err.Error(), "host at capacity")
+
+	// A VM that's gone frees its slot
+	require.NoError(t, unregisterCID(3))
+	reservation, err := reserveVsockCID(ctx, "default", "vm3", capacity)
+	require.NoError(t, err)
+	require.NoError(t, reservation.release())
+
+	// Records of shims which are gone don't take slots either
+	require.NoError(t, unregisterCID(4))
+	require.NoError(t, ioutil.WriteFile(cidRecordPath(4), []byte(`{"cid":4,"namespace":"default","id":"vm2","pid":-1}`), 0600))
+	reservation, err = reserveVsockCID(ctx, "default", "vm4", capacity)
+	require.NoError(t, err)
+	require.NoError(t, reservation.release())
+}
+
+func TestHostCapacityMemory(t *testing.T) {
+	restore := mockCIDAllocation(t)
+	defer restore()
+
+	ctx := context.Background()
+	capacity := vmCapacity{MemSizeMib: 256, MaxMemoryMib: 600}
+
+	first, err := reserveVsockCID(ctx, "default", "vm1", capacity)
+	require.NoError(t, err)
+	require.NoError(t, first.release())
+
+	second, err := reserveVsockCID(ctx, "default", "vm2", capacity)
+	require.NoError(t, err)
+	require.NoError(t, second.release())
+
+	_, err = reserveVsockCID(ctx, "default", "vm3", capacity)
+	require.Error(t, err)
+	assert.True(t, errdefs.IsUnavailable(err))
+	assert.Contains(t, err.Error(), "running VMs use 512 MiB")
+
+	// A smaller VM still fits
+	capacity.MemSizeMib = 64
+	third, err := reserveVsockCID(ctx, "default", "vm3", capacity)
+	require.NoError(t, err)
+	require.NoError(t, third.release())
+}
+
+func TestVMCapacityConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prevProcDir := procDir
+	procDir = dir
+	defer func() { procDir = prevProcDir }()
+
+	meminfo := "MemTotal:        4194304 kB\nMemFree:         1048576 kB\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "meminfo"), []byte(meminfo), 0600))
+
+	config := &Config{MaxVMs: 10}
+	capacity, err := config.vmCapacity(vmMemSizeMib)
+	require.NoError(t, err)
+	assert.Equal(t, vmCapacity{MemSizeMib: vmMemSizeMib, MaxVMs: 10}, capacity)
+
+	config.MaxVMMemoryPercent = 75
+	capacity, err = config.vmCapacity(vmMemSizeMib)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3072, capacity.MaxMemoryMib)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "meminfo"), []byte("MemFree: 1 kB\n"), 0600))
+	_, err = config.vmCapacity(vmMemSizeMib)
+	assert.Error(t, err)
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd/log"
+	ptypes "github.com/gogo/protobuf/types"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Memory the VMM is given on top of the limits of its containers, for the guest kernel, the agent and the VMM itself
+const defaultVMMMemoryOverheadMiB = 128
+
+// Controllers of the host cgroups the limits of the VMM are applied through
+var hostCgroupControllers = []string{"memory", "cpu"}
+
+// hostLimits are the limits of the VMM process on the host, following the limits of containers in its VM
+type hostLimits struct {
+	// Bytes, -1 for no limit
+	memory int64
+	// 0 leaves CPU shares as they are
+	cpuShares uint64
+}
+
+// vmmCgroups returns host cgroups of the VMM by controller: those the jailer created for a jailed VMM, those
+// under vmm_cgroup_parent otherwise. Returns nil if the VMM has no cgroups of its own.
+func (s *service) vmmCgroups() map[string]string {
+	var cgroup func(controller string) string
+	if j := s.vmJail(); j != nil {
+		cgroup = j.cgroup
+	} else if s.config.VMMCgroupParent != "" && s.pooledVM == nil {
+		cgroup = func(controller string) string {
+			return filepath.Join(cgroupRoot, controller, s.config.VMMCgroupParent, jailID(s.namespace, s.id))
+		}
+	} else {
+		return nil
+	}
+
+	cgroups := make(map[string]string, len(hostCgroupControllers))
+	for _, controller := range hostCgroupControllers {
+		cgroups[controller] = cgroup(controller)
+	}
+
+	return cgroups
+}
+
+// joinVMMCgroups creates the cgroups of a VMM started without the jailer and moves the VMM into them
+func joinVMMCgroups(cgroups map[string]string, pid int) error {
+	for _, dir := range cgroups {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return errors.Wrapf(err, "failed to move VMM into cgroup %s", dir)
+		}
+	}
+
+	return nil
+}
+
+// writeHostLimits sets the limits in the cgroups of the VMM. Memory limit can't go below what the VMM uses
+// already, the kernel refuses it then.
+func writeHostLimits(cgroups map[string]string, limits hostLimits, overhead int64) error {
+	memory := limits.memory
+	if memory > 0 {
+		memory += overhead
+	}
+
+	path := filepath.Join(cgroups["memory"], "memory.limit_in_bytes")
+	if err := ioutil.WriteFile(path, []byte(strconv.FormatInt(memory, 10)), 0644); err != nil {
+		return errors.Wrap(err, "failed to set VMM memory limit")
+	}
+
+	if limits.cpuShares > 0 {
+		path := filepath.Join(cgroups["cpu"], "cpu.shares")
+		if err := ioutil.WriteFile(path, []byte(strconv.FormatUint(limits.cpuShares, 10)), 0644); err != nil {
+			return errors.Wrap(err, "failed to set VMM CPU shares")
+		}
+	}
+
+	return nil
+}
+
+// updateHostLimits records resources of a task update and applies the resulting limits to the host cgroups
+// of the VMM, so the VM as a whole can't take more from the host than its containers are given
+func (s *service) updateHostLimits(ctx context.Context, id string, resources *ptypes.Any) error {
+	cgroups := s.vmmCgroups()
+	if cgroups == nil || resources == nil {
+		return nil
+	}
+
+	var update specs.LinuxResources
+	if err := json.Unmarshal(resources.Value, &update); err != nil {
+		return errors.Wrap(err, "failed to unmarshal resources")
+	}
+
+	s.containers.setResources(id, &update)
+	limits := s.containers.hostLimits()
+	if err := writeHostLimits(cgroups, limits, s.config.vmmMemoryOverhead()); err != nil {
+		return err
+	}
+
+	log.G(ctx).WithFields(logrus.Fields{"memory": limits.memory, "cpu_shares": limits.cpuShares}).Info("updated VMM host limits")
+	return nil
+}
+
+// readResources reads resources of the container from OCI spec at the given path
+func readResources(specPath string) (*specs.LinuxResources, error) {
+	data, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec struct {
+		Linux *struct {
+			Resources *specs.LinuxResources `json:"resources"`
+		} `json:"linux"`
+	}
+
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+
+	if spec.Linux == nil {
+		return nil, nil
+	}
+
+	return spec.Linux.Resources, nil
+}
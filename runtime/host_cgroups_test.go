@@ -0,0 +1,98 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ptypes "github.com/gogo/protobuf/types"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVMMCgroups(t *testing.T) {
+	s := &service{config: &Config{}, namespace: "default", id: "task"}
+	assert.Nil(t, s.vmmCgroups())
+
+	s.config.VMMCgroupParent = "firecracker-containerd"
+	assert.Equal(t, map[string]string{
+		"memory": "/sys/fs/cgroup/memory/firecracker-containerd/default-task",
+		"cpu":    "/sys/fs/cgroup/cpu/firecracker-containerd/default-task",
+	}, s.vmmCgroups())
+
+	// Cgroups of a jailed VMM are created by the jailer
+	s.config = &Config{FirecrackerBinaryPath: "/usr/bin/firecracker", Jailer: &JailerConfig{}}
+	assert.Equal(t, "/sys/fs/cgroup/memory/firecracker/default-task", s.vmmCgroups()["memory"])
+}
+
+func TestUpdateHostLimits(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroups")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	defer func(orig string) { cgroupRoot = orig }(cgroupRoot)
+	cgroupRoot = root
+
+	s := &service{
+		config:    &Config{VMMCgroupParent: "fc", VMMMemoryOverheadMiB: 64},
+		namespace: "default",
+		id:        "task",
+	}
+
+	cgroups := s.vmmCgroups()
+	require.NoError(t, joinVMMCgroups(cgroups, os.Getpid()))
+	addContainer(t, &s.containers, "task", nil)
+
+	limit := int64(256 << 20)
+	shares := uint64(512)
+	value, err := json.Marshal(&specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: &limit},
+		CPU:    &specs.LinuxCPU{Shares: &shares},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.updateHostLimits(context.Background(), "task", &ptypes.Any{Value: value}))
+
+	memory, err := ioutil.ReadFile(filepath.Join(cgroups["memory"], "memory.limit_in_bytes"))
+	require.NoError(t, err)
+	assert.Equal(t, "335544320", string(memory))
+
+	cpuShares, err := ioutil.ReadFile(filepath.Join(cgroups["cpu"], "cpu.shares"))
+	require.NoError(t, err)
+	assert.Equal(t, "512", string(cpuShares))
+}
+
+func TestReadResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spec")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"linux": {"resources": {"memory": {"limit": 1048576}}}}`), 0644))
+
+	resources, err := readResources(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<20), *resources.Memory.Limit)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{}`), 0644))
+	resources, err = readResources(path)
+	require.NoError(t, err)
+	assert.Nil(t, resources)
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+const (
+	// Limits of the total size of files injected into a container. The maximum leaves room for the bundle spec
+	// within ttrpc message size limit.
+	defaultMaxInjectedFilesSize = 64 << 10
+	maxInjectedFilesSize        = 1 << 20
+)
+
+// validateInjectedFiles checks files a task asks to have written into its container rootfs. Errors name the
+// files, never their content.
+func validateInjectedFiles(files []*proto.InjectedFile, maxSize int, readOnlyRootfs bool) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	if maxSize == 0 {
+		return errors.Wrap(errdefs.ErrInvalidArgument, "injecting files is disabled (max_injected_files_size is 0)")
+	}
+
+	if readOnlyRootfs {
+		return errors.Wrap(errdefs.ErrInvalidArgument, "files can't be injected into a read-only rootfs")
+	}
+
+	size := 0
+	seen := make(map[string]bool, len(files))
+	for _, file := range files {
+		if err := internal.ValidateInjectedFile(file.Path, file.Mode); err != nil {
+			return errors.Wrap(errdefs.ErrInvalidArgument, err.Error())
+		}
+
+		if seen[file.Path] {
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "file %s is injected more than once", file.Path)
+		}
+
+		seen[file.Path] = true
+		size += len(file.Content)
+	}
+
+	if size > maxSize {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "injected files take %d bytes, exceeding the limit of %d bytes (see max_injected_files_size)", size, maxSize)
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+func TestValidateInjectedFiles(t *testing.T) {
+	files := []*proto.InjectedFile{
+		{Path: "/etc/ssl/certs/ca.pem", Mode: 0644, Content: []byte("cert")},
+		{Path: "/run/secrets/token", Content: []byte("t0ken")},
+	}
+
+	assert.NoError(t, validateInjectedFiles(nil, 0, true))
+	assert.NoError(t, validateInjectedFiles(files, 9, false))
+
+	for _, err := range []error{
+		validateInjectedFiles(files, 8, false),
+		validateInjectedFiles(files, 0, false),
+		validateInjectedFiles(files, defaultMaxInjectedFilesSize, true),
+		validateInjectedFiles(append(files, &proto.InjectedFile{Path: "/run/secrets/token"}), defaultMaxInjectedFilesSize, false),
+		validateInjectedFiles([]*proto.InjectedFile{{Path: "run/secrets/token"}}, defaultMaxInjectedFilesSize, false),
+	} {
+		assert.True(t, errdefs.IsInvalidArgument(err), "%v", err)
+		assert.False(t, strings.Contains(err.Error(), "t0ken"), "content must not be in errors")
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultJailerBinary  = "jailer"
+	defaultChrootBaseDir = "/srv/jailer"
+
+	// Where a jailed Firecracker serves its API, relative to its chroot
+	jailedSocketPath = "/api.socket"
+	jailedKernelPath = "/vmlinux"
+
+	// Longest jail ID accepted by the jailer
+	maxJailIDLength = 64
+)
+
+var (
+	// Characters the jailer accepts in jail IDs
+	jailIDPattern = regexp.MustCompile(`[^a-zA-Z0-9-]`)
+
+	// Device used by Firecracker for vsock, which the jailer doesn't create in the chroot
+	vhostVsockPath = "/dev/vhost-vsock"
+
+	// Root of cgroup v1 hierarchies, the jailer creates cgroups under each controller mounted there
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+// JailerConfig enables launching Firecracker through the jailer, which chroots it, drops its privileges
+// and puts it into its own cgroups
+type JailerConfig struct {
+	BinaryPath    string `json:"binary_path"`
+	UID           int    `json:"uid"`
+	GID           int    `json:"gid"`
+	ChrootBaseDir string `json:"chroot_base_dir"`
+	NumaNode      int    `json:"numa_node"`
+}
+
+func (c *JailerConfig) binaryPath() string {
+	if c.BinaryPath == "" {
+		return defaultJailerBinary
+	}
+
+	return c.BinaryPath
+}
+
+func (c *JailerConfig) chrootBaseDir() string {
+	if c.ChrootBaseDir == "" {
+		return defaultChrootBaseDir
+	}
+
+	return c.ChrootBaseDir
+}
+
+func (c *JailerConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if c.UID <= 0 || c.GID <= 0 {
+		return errors.New("uid and gid should be set to an unprivileged user and group")
+	}
+
+	if c.ChrootBaseDir != "" && !filepath.IsAbs(c.ChrootBaseDir) {
+		return errors.New("chroot_base_dir should be an absolute path")
+	}
+
+	if c.NumaNode < 0 {
+		return errors.New("numa_node can't be negative")
+	}
+
+	return nil
+}
+
+// jail describes the chroot of a jailed Firecracker, files used by Firecracker are placed there and
+// referenced by their paths within the chroot
+type jail struct {
+	config   *JailerConfig
+	execFile string
+	id       string
+}
+
+// jail returns the jail of the VM of the given task, or nil if Firecracker isn't jailed.
+// The jail only depends on config and the task, so shims cleaning up after others find the same one.
+func (c *Config) jail(namespace, id string) *jail {
+	if c.Jailer == nil {
+		return nil
+	}
+
+	return &jail{config: c.Jailer, execFile: c.FirecrackerBinaryPath, id: jailID(namespace, id)}
+}
+
+// jailID derives a jail ID from the task. IDs that have to be changed to be accepted by the jailer get
+// a hash suffix, so different tasks don't end up in the same jail.
+func jailID(namespace, id string) string {
+	name := namespace + "-" + id
+	sanitized := jailIDPattern.ReplaceAllString(name, "-")
+	if sanitized == name && len(name) <= maxJailIDLength {
+		return name
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(namespace+"/"+id)))[:16]
+	if prefix := maxJailIDLength - len(hash) - 1; len(sanitized) > prefix {
+		sanitized = sanitized[:prefix]
+	}
+
+	return sanitized + "-" + hash
+}
+
+// dir returns the directory the jailer creates for the VM, which holds the chroot
+func (j *jail) dir() string {
+	return filepath.Join(j.config.chrootBaseDir(), filepath.Base(j.execFile), j.id)
+}
+
+func (j *jail) rootDir() string {
+	return filepath.Join(j.dir(), "root")
+}
+
+// hostPath returns the host path of a path within the chroot
+func (j *jail) hostPath(path string) string {
+	return filepath.Join(j.rootDir(), path)
+}
+
+func (j *jail) socketPath() string {
+	return j.hostPath(jailedSocketPath)
+}
+
+// fifo returns host and chroot paths a configured FIFO gets in the chroot
+func (j *jail) fifo(path string) (string, string) {
+	jailed := "/" + filepath.Base(path)
+	return j.hostPath(jailed), jailed
+}
+
+func (j *jail) chown(path string) error {
+	return os.Lchown(path, j.config.UID, j.config.GID)
+}
+
+// command returns the jailer command starting Firecracker
+func (j *jail) command(ctx context.Context) *exec.Cmd {
+	return exec.CommandContext(ctx, j.config.binaryPath(),
+		"--id", j.id,
+		"--node", strconv.Itoa(j.config.NumaNode),
+		"--exec-file", j.execFile,
+		"--uid", strconv.Itoa(j.config.UID),
+		"--gid", strconv.Itoa(j.config.GID),
+		"--chroot-base-dir", j.config.chrootBaseDir(),
+	)
+}
+
+// prepare sets up the chroot with the kernel, drives and the vsock device, and makes cfg refer to them
+// by their paths within the chroot
+func (j *jail) prepare(cfg *firecracker.Config) error {
+	// Firecracker creates its API socket in the chroot root after dropping privileges
+	if err := os.MkdirAll(j.rootDir(), 0700); err != nil {
+		return err
+	}
+
+	if err := j.chown(j.rootDir()); err != nil {
+		return err
+	}
+
+	if err := j.link(vhostVsockPath, vhostVsockPath); err != nil {
+		return err
+	}
+
+	if err := j.link(cfg.KernelImagePath, jailedKernelPath); err != nil {
+		return errors.Wrap(err, "failed to place kernel image")
+	}
+	cfg.KernelImagePath = jailedKernelPath
+
+	// Drives are copied, the runtime keeps referring to them by their host paths
+	drives := make([]models.Drive, len(cfg.Drives))
+	for i, drive := range cfg.Drives {
+		jailed := "/" + firecracker.StringValue(drive.DriveID)
+		if err := j.link(firecracker.StringValue(drive.PathOnHost), jailed); err != nil {
+			return errors.Wrapf(err, "failed to place drive %s", firecracker.StringValue(drive.DriveID))
+		}
+
+		drive.PathOnHost = firecracker.String(jailed)
+		drives[i] = drive
+	}
+	cfg.Drives = drives
+
+	cfg.SocketPath = j.socketPath()
+	// FIFOs are set up by the runtime, as the SDK would create them at their chroot paths on the host
+	cfg.LogFifo, cfg.MetricsFifo = "", ""
+	// Jailed paths don't exist on the host
+	cfg.DisableValidation = true
+	return nil
+}
+
+// link makes a host file available in the chroot. Device nodes are created anew and owned by the
+// jail's user, other files are hard linked, so they have to be on the same filesystem as the chroot
+// and accessible to the jail's user and group.
+func (j *jail) link(src, jailed string) error {
+	dst := j.hostPath(jailed)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(src, &stat); err != nil {
+		return &os.PathError{Op: "stat", Path: src, Err: err}
+	}
+
+	switch stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK, syscall.S_IFCHR:
+		if err := unix.Mknod(dst, stat.Mode&(syscall.S_IFMT)|0600, int(stat.Rdev)); err != nil {
+			return &os.PathError{Op: "mknod", Path: dst, Err: err}
+		}
+
+		return j.chown(dst)
+	default:
+		if err := os.Link(src, dst); err != nil {
+			if linkErr, ok := err.(*os.LinkError); ok && linkErr.Err == syscall.EXDEV {
+				return errors.Errorf("%s has to be on the same filesystem as chroot_base_dir", src)
+			}
+
+			return err
+		}
+
+		return nil
+	}
+}
+
+// cgroup returns the cgroup the jailer puts Firecracker into for the given controller
+func (j *jail) cgroup(controller string) string {
+	return filepath.Join(cgroupRoot, controller, filepath.Base(j.execFile), j.id)
+}
+
+// artifacts returns what's left on the host for a jailed VM: the jail directory with its content
+// (listed before the directories holding it, so they can be removed in order) and cgroups created by
+// the jailer
+func (j *jail) artifacts() []string {
+	var paths []string
+	filepath.Walk(j.dir(), func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			paths = append([]string{path}, paths...)
+		}
+
+		return nil
+	})
+
+	controllers, _ := filepath.Glob(filepath.Join(cgroupRoot, "*"))
+	for _, controller := range controllers {
+		cgroup := j.cgroup(filepath.Base(controller))
+		if _, err := os.Stat(cgroup); err == nil {
+			paths = append(paths, cgroup)
+		}
+	}
+
+	return paths
+}
+
+// findJailedProcesses returns pids of processes chrooted to the given directory
+func findJailedProcesses(rootDir string) ([]int, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+
+		// Processes may exit while being inspected, they are skipped then
+		root, err := os.Readlink(filepath.Join(procDir, entry.Name(), "root"))
+		if err == nil && filepath.Clean(root) == filepath.Clean(rootDir) {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
+
+// vmJail returns the jail of the VM, or nil if Firecracker isn't jailed
+func (s *service) vmJail() *jail {
+	return s.config.jail(s.namespace, s.id)
+}
+
+// socketPath returns the host path of the VM's API socket
+func (s *service) socketPath() string {
+	if j := s.vmJail(); j != nil {
+		return j.socketPath()
+	}
+
+	return s.config.SocketPath
+}
+
+// findVMMProcesses returns pids of the VMM processes of the VM
+func (s *service) findVMMProcesses() ([]int, error) {
+	if j := s.vmJail(); j != nil {
+		return findJailedProcesses(j.rootDir())
+	}
+
+	return findVMMProcesses(s.config.SocketPath)
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJailID(t *testing.T) {
+	assert.Equal(t, "default-app-1", jailID("default", "app-1"))
+
+	// Invalid characters are replaced, a hash keeps IDs of different tasks apart
+	id := jailID("k8s.io", "app_1")
+	assert.True(t, strings.HasPrefix(id, "k8s-io-app-1-"), id)
+	assert.NotEqual(t, id, jailID("k8s-io", "app-1"))
+	assert.Regexp(t, "^[a-zA-Z0-9-]+$", id)
+
+	long := jailID("default", strings.Repeat("a", 100))
+	assert.Len(t, long, maxJailIDLength)
+	assert.NotEqual(t, long, jailID("default", strings.Repeat("a", 101)))
+}
+
+func TestJailerConfigValidation(t *testing.T) {
+	var unset *JailerConfig
+	assert.NoError(t, unset.validate())
+
+	config := &JailerConfig{UID: 123, GID: 100}
+	assert.NoError(t, config.validate())
+	assert.Equal(t, defaultJailerBinary, config.binaryPath())
+	assert.Equal(t, defaultChrootBaseDir, config.chrootBaseDir())
+
+	assert.Error(t, (&JailerConfig{GID: 100}).validate())
+	assert.Error(t, (&JailerConfig{UID: 123, GID: 100, ChrootBaseDir: "jails"}).validate())
+	assert.Error(t, (&JailerConfig{UID: 123, GID: 100, NumaNode: -1}).validate())
+}
+
+func TestJailCommand(t *testing.T) {
+	config := &Config{
+		FirecrackerBinaryPath: "/usr/bin/firecracker",
+		Jailer:                &JailerConfig{BinaryPath: "/usr/bin/jailer", UID: 123, GID: 100, NumaNode: 1},
+	}
+
+	assert.Nil(t, (&Config{}).jail("default", "app"))
+
+	j := config.jail("default", "app")
+	assert.Equal(t, "/srv/jailer/firecracker/default-app/root", j.rootDir())
+	assert.Equal(t, "/srv/jailer/firecracker/default-app/root/api.socket", j.socketPath())
+
+	cmd := j.command(context.Background())
+	assert.Equal(t, []string{
+		"/usr/bin/jailer",
+		"--id", "default-app",
+		"--node", "1",
+		"--exec-file", "/usr/bin/firecracker",
+		"--uid", "123",
+		"--gid", "100",
+		"--chroot-base-dir", "/srv/jailer",
+	}, cmd.Args)
+}
+
+func TestJailPrepare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jailer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kernel := filepath.Join(dir, "vmlinux")
+	rootfs := filepath.Join(dir, "rootfs.img")
+	for _, path := range []string{kernel, rootfs} {
+		require.NoError(t, ioutil.WriteFile(path, []byte(path), 0600))
+	}
+
+	// Stands in for the vsock device, regular files are linked
+	prevVsockPath := vhostVsockPath
+	vhostVsockPath = filepath.Join(dir, "vhost-vsock")
+	defer func() { vhostVsockPath = prevVsockPath }()
+	require.NoError(t, ioutil.WriteFile(vhostVsockPath, nil, 0600))
+
+	config := &Config{
+		FirecrackerBinaryPath: "/usr/bin/firecracker",
+		Jailer:                &JailerConfig{UID: os.Getuid(), GID: os.Getgid(), ChrootBaseDir: filepath.Join(dir, "jails")},
+	}
+
+	drives := []models.Drive{{DriveID: firecracker.String("root_drive"), PathOnHost: firecracker.String(rootfs)}}
+	cfg := firecracker.Config{
+		SocketPath:      "./firecracker.sock",
+		KernelImagePath: kernel,
+		Drives:          drives,
+		LogFifo:         "fc-logs.fifo",
+		MetricsFifo:     "fc-metrics.fifo",
+	}
+
+	j := config.jail("default", "app")
+	require.NoError(t, j.prepare(&cfg))
+
+	assert.Equal(t, j.socketPath(), cfg.SocketPath)
+	assert.Equal(t, "/vmlinux", cfg.KernelImagePath)
+	assert.Equal(t, "/root_drive", firecracker.StringValue(cfg.Drives[0].PathOnHost))
+	assert.Empty(t, cfg.LogFifo)
+	assert.True(t, cfg.DisableValidation)
+
+	// The runtime keeps host paths of drives
+	assert.Equal(t, rootfs, firecracker.StringValue(drives[0].PathOnHost))
+
+	data, err := ioutil.ReadFile(j.hostPath("/root_drive"))
+	require.NoError(t, err)
+	assert.Equal(t, rootfs, string(data))
+	assert.FileExists(t, j.hostPath("/vmlinux"))
+	assert.FileExists(t, j.hostPath(vhostVsockPath))
+
+	host, jailed := j.fifo("/run/fc/metrics.fifo")
+	assert.Equal(t, "/metrics.fifo", jailed)
+	assert.Equal(t, filepath.Join(j.rootDir(), "metrics.fifo"), host)
+
+	// The jail is removed in one pass
+	remaining := cleanupArtifacts(context.Background(), closedChannel(), j.artifacts(), time.Second)
+	assert.Empty(t, remaining)
+	_, err = os.Stat(j.dir())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func closedChannel() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+func TestFindJailedProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jailer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prevProcDir := procDir
+	procDir = dir
+	defer func() { procDir = prevProcDir }()
+
+	for pid, root := range map[string]string{"100": "/srv/jailer/firecracker/default-app/root", "101": "/"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, pid), 0700))
+		require.NoError(t, os.Symlink(root, filepath.Join(dir, pid, "root")))
+	}
+
+	pids, err := findJailedProcesses("/srv/jailer/firecracker/default-app/root")
+	require.NoError(t, err)
+	assert.Equal(t, []int{100}, pids)
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import "strings"
+
+// mergeKernelArgs appends task kernel args to the configured ones. A task arg replaces all configured
+// args with the same name (the part before "="), so for instance a task's "console=ttyS1" replaces every
+// configured console, while repeated args of the task itself are kept. Init args of the configured
+// command line (after "--") stay at the end.
+func mergeKernelArgs(configured, task string) string {
+	taskArgs := strings.Fields(task)
+	if len(taskArgs) == 0 {
+		return configured
+	}
+
+	overridden := make(map[string]bool, len(taskArgs))
+	for _, arg := range taskArgs {
+		overridden[kernelArgName(arg)] = true
+	}
+
+	var merged, initArgs []string
+	for i, arg := range strings.Fields(configured) {
+		if arg == "--" {
+			initArgs = strings.Fields(configured)[i:]
+			break
+		}
+
+		if !overridden[kernelArgName(arg)] {
+			merged = append(merged, arg)
+		}
+	}
+
+	merged = append(merged, taskArgs...)
+	return strings.Join(append(merged, initArgs...), " ")
+}
+
+func kernelArgName(arg string) string {
+	return strings.SplitN(arg, "=", 2)[0]
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeKernelArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		configured string
+		task       string
+		expected   string
+	}{
+		{"no task args", "console=ttyS0 reboot=k", "", "console=ttyS0 reboot=k"},
+		{"appended", "console=ttyS0", "quiet loglevel=3", "console=ttyS0 quiet loglevel=3"},
+		{"task wins", "console=ttyS0 reboot=k panic=1", "console=ttyS1 panic=0", "reboot=k console=ttyS1 panic=0"},
+		{"all configured values replaced", "console=tty0 console=ttyS0 quiet", "console=ttyS1", "quiet console=ttyS1"},
+		{"task repeats kept", "console=ttyS0", "console=tty0 console=ttyS1", "console=tty0 console=ttyS1"},
+		{"flag replaced", "quiet ro", "ro", "quiet ro"},
+		{"init args last", "console=ttyS0 init=/sbin/init -- single", "init=/bin/sh", "console=ttyS0 init=/bin/sh -- single"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, mergeKernelArgs(tc.configured, tc.task))
+		})
+	}
+}
+
+func TestTaskKernelArgs(t *testing.T) {
+	s := &service{config: &Config{KernelArgs: "console=ttyS0 reboot=k", AgentLogLevel: "info"}}
+
+	opts := vmOptions{}
+	require.NoError(t, opts.setKernelArgs("console=ttyS1"))
+
+	args := strings.Fields(s.kernelArgs(opts))
+	assert.Equal(t, []string{"reboot=k", "console=ttyS1"}, args[:2])
+	assert.NotContains(t, args, "console=ttyS0")
+
+	// Agent parameters are set by the runtime
+	assert.Error(t, opts.setKernelArgs("fc_agent.log_level=debug"))
+	assert.Error(t, opts.setKernelArgs("quiet -- single"))
+	assert.Equal(t, "console=ttyS1", opts.extraKernelArgs)
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	containersAPI "github.com/containerd/containerd/api/services/containers/v1"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/pkg/dialer"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+const (
+	vmLabelPrefix      = "firecracker-containerd.vm."
+	exportLabelTimeout = 10 * time.Second
+)
+
+// vmLabels lists VM metadata that can be exported as container labels.
+// Kernel arguments and host paths of drives are intentionally not exposed, as they may contain sensitive values.
+var vmLabels = map[string]func(s *service) string{
+	"cid": func(s *service) string {
+		return strconv.FormatUint(uint64(s.machineCID), 10)
+	},
+	"socket_path": func(s *service) string {
+		return s.socketPath()
+	},
+	"kernel_image_path": func(s *service) string {
+		return s.config.KernelImagePath
+	},
+	"vcpu_count": func(s *service) string {
+		return strconv.Itoa(s.vcpuCount)
+	},
+	"pause_supported": func(s *service) string {
+		if s.capabilities == nil {
+			return "unknown"
+		}
+
+		return strconv.FormatBool(s.capabilities.Pause)
+	},
+	"cgroup_version": func(s *service) string {
+		if s.capabilities == nil || s.capabilities.CgroupVersion == 0 {
+			return "unknown"
+		}
+
+		return strconv.FormatUint(uint64(s.capabilities.CgroupVersion), 10)
+	},
+	"drives": func(s *service) string {
+		var list []string
+		for _, drive := range s.driveInventory() {
+			list = append(list, fmt.Sprintf("%s:%s", drive.ID, drive.Role))
+		}
+
+		return strings.Join(list, ",")
+	},
+}
+
+// exportedLabels returns the VM metadata labels enabled in config
+func (s *service) exportedLabels() map[string]string {
+	labels := make(map[string]string, len(s.config.ExportedLabels))
+	for _, name := range s.config.ExportedLabels {
+		labels[vmLabelPrefix+name] = vmLabels[name](s)
+	}
+
+	return labels
+}
+
+// exportLabels records VM metadata as labels of the given container, so external tools can
+// find out which VM backs the container via containerd API
+func (s *service) exportLabels(ctx context.Context, containerID string) error {
+	labels := s.exportedLabels()
+	if len(labels) == 0 {
+		return nil
+	}
+
+	address := s.containerdAddress
+	if address == "" {
+		return errors.New("containerd address is unknown")
+	}
+
+	ctx, cancel := context.WithTimeout(namespaces.WithNamespace(ctx, s.namespace), exportLabelTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, dialer.DialAddress(address),
+		grpc.WithBlock(),
+		grpc.WithInsecure(),
+		grpc.WithDialer(dialer.Dialer),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to containerd at %q", address)
+	}
+
+	defer conn.Close()
+
+	var paths []string
+	for key := range labels {
+		paths = append(paths, "labels."+key)
+	}
+
+	req := &containersAPI.UpdateContainerRequest{
+		Container: containersAPI.Container{
+			ID:     containerID,
+			Labels: labels,
+		},
+		UpdateMask: &ptypes.FieldMask{Paths: paths},
+	}
+
+	if _, err := containersAPI.NewContainersClient(conn).Update(ctx, req); err != nil {
+		return errors.Wrap(err, "failed to update container labels")
+	}
+
+	log.G(ctx).WithField("labels", labels).Debugf("exported VM labels to container %q", containerID)
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+func TestExportedLabels(t *testing.T) {
+	drives := &driveAllocator{}
+	drives.add(driveRoleRoot, "/var/lib/firecracker/root.img", true, false)
+	drives.add(driveRoleRootfs, "/dev/mapper/pool-snap-1", false, false)
+
+	s := &service{
+		config: &Config{
+			AgentLogLevel:    defaultAgentLogLevel,
+			StdioBufferSize:  internal.DefaultBufferSize,
+			APITimeoutMs:     defaultAPITimeoutMs,
+			CleanupTimeoutMs: defaultCleanupTimeoutMs,
+			MaxBundleSize:    defaultMaxBundleSize,
+			ShimMaxProcs:     defaultShimMaxProcs,
+			MaxCPUCount:      defaultMaxCPUCount,
+			RootDrive:        "/var/lib/firecracker/root.img",
+			SocketPath:       "./firecracker.sock",
+			CPUCount:         2,
+			ExportedLabels:   []string{"cid", "vcpu_count", "drives"},
+		},
+		machineCID: 3,
+		vcpuCount:  2,
+		drives:     drives.inventory(),
+	}
+
+	require.NoError(t, s.config.validate())
+
+	assert.Equal(t, map[string]string{
+		"firecracker-containerd.vm.cid":        "3",
+		"firecracker-containerd.vm.vcpu_count": "2",
+		"firecracker-containerd.vm.drives":     "1:root,2:rootfs",
+	}, s.exportedLabels())
+
+	s.config.ExportedLabels = []string{"kernel_args"}
+	assert.Error(t, s.config.validate())
+}
+
+func TestExportLabelsWithoutAddress(t *testing.T) {
+	assert.Empty(t, flagValue("no-such-flag"))
+
+	s := &service{config: &Config{ExportedLabels: []string{"cid"}}, machineCID: 3}
+	assert.EqualError(t, s.exportLabels(context.Background(), "container"), "containerd address is unknown")
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+const (
+	defaultLivenessIntervalMs       = 10000
+	defaultLivenessTimeoutMs        = 2000
+	defaultLivenessFailureThreshold = 3
+)
+
+// LivenessProbeConfig makes the shim ping the agent periodically, and tear the VM down once the agent
+// misses failure_threshold pings in a row
+type LivenessProbeConfig struct {
+	IntervalMs       int `json:"interval_ms"`
+	TimeoutMs        int `json:"timeout_ms"`
+	FailureThreshold int `json:"failure_threshold"`
+}
+
+func (c *LivenessProbeConfig) interval() time.Duration {
+	if c.IntervalMs == 0 {
+		return defaultLivenessIntervalMs * time.Millisecond
+	}
+
+	return time.Duration(c.IntervalMs) * time.Millisecond
+}
+
+func (c *LivenessProbeConfig) failureThreshold() int {
+	if c.FailureThreshold == 0 {
+		return defaultLivenessFailureThreshold
+	}
+
+	return c.FailureThreshold
+}
+
+func (c *LivenessProbeConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if c.IntervalMs < 0 || c.TimeoutMs < 0 || c.FailureThreshold < 0 {
+		return errors.New("interval_ms, timeout_ms and failure_threshold can't be negative")
+	}
+
+	return nil
+}
+
+// livenessTimeout bounds a single ping, both of the probe and of Connect
+func (c *Config) livenessTimeout() time.Duration {
+	if c.LivenessProbe == nil || c.LivenessProbe.TimeoutMs == 0 {
+		return defaultLivenessTimeoutMs * time.Millisecond
+	}
+
+	return time.Duration(c.LivenessProbe.TimeoutMs) * time.Millisecond
+}
+
+// pingAgent checks the agent responds within the liveness timeout. Older agents don't know the call,
+// but answering it at all tells they're alive.
+func (s *service) pingAgent(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.config.livenessTimeout())
+	defer cancel()
+
+	_, err := s.guest.Ping(ctx, &proto.PingRequest{})
+	if err != nil && status.Code(errors.Cause(err)) == codes.NotFound {
+		return nil
+	}
+
+	return err
+}
+
+// checkLiveness fails with ErrUnavailable if there's no agent to talk to or it doesn't respond
+func (s *service) checkLiveness(ctx context.Context) error {
+	if s.guest == nil {
+		return errors.Wrap(errdefs.ErrUnavailable, "VM isn't running")
+	}
+
+	if err := s.pingAgent(ctx); err != nil {
+		return errors.Wrapf(errdefs.ErrUnavailable, "agent isn't responding: %v", err)
+	}
+
+	return nil
+}
+
+// monitorLiveness pings the agent until ctx is canceled. Once the agent misses enough pings in a row,
+// the VM is considered lost: its processes are reported as exited and it's torn down along with the shim,
+// rather than being left running with nothing able to reach it.
+func (s *service) monitorLiveness(ctx context.Context) {
+	defer recoverGoroutine(ctx, "monitor_liveness", nil)
+
+	err := s.probeLiveness(ctx)
+	if err == nil {
+		return
+	}
+
+	// Claims the teardown, so the VMM exit that follows isn't handled once more
+	if !atomic.CompareAndSwapInt32(&s.vmStopping, 0, 1) {
+		return
+	}
+
+	log.G(ctx).WithError(err).Error("VM is unresponsive, tearing it down")
+	s.audit.record(ctx, auditEventVMMExit, "", "", map[string]string{"error": err.Error()})
+	s.handleVMMExit(ctx, err)
+}
+
+// probeLiveness pings the agent every interval, and returns an error once failure_threshold pings in a row
+// fail. Returns nil when ctx is canceled or the VM is being stopped.
+func (s *service) probeLiveness(ctx context.Context) error {
+	probe := s.config.LivenessProbe
+	ticker := time.NewTicker(probe.interval())
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		err := s.pingAgent(ctx)
+		if ctx.Err() != nil || s.isVMStopping() {
+			return nil
+		}
+
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		log.G(ctx).WithError(err).WithFields(logrus.Fields{
+			"failures":  failures,
+			"threshold": probe.failureThreshold(),
+		}).Warn("agent missed liveness probe")
+
+		if failures >= probe.failureThreshold() {
+			return errors.Wrapf(err, "agent missed %d liveness probes in a row", failures)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// pingGuest fails Ping calls with the given errors in order, nil standing for a response
+type pingGuest struct {
+	proto.AgentService
+
+	errs  []error
+	pings int
+}
+
+func (g *pingGuest) Ping(ctx context.Context, req *proto.PingRequest) (*proto.PingResponse, error) {
+	g.pings++
+	if len(g.errs) == 0 {
+		return &proto.PingResponse{}, nil
+	}
+
+	err := g.errs[0]
+	g.errs = g.errs[1:]
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.PingResponse{}, nil
+}
+
+func TestCheckLiveness(t *testing.T) {
+	s := &service{config: &Config{}}
+	assert.True(t, errdefs.IsUnavailable(s.checkLiveness(context.Background())), "no VM")
+
+	s.guest = &pingGuest{errs: []error{errors.New("timeout")}}
+	assert.True(t, errdefs.IsUnavailable(s.checkLiveness(context.Background())))
+
+	s.guest = &pingGuest{}
+	assert.NoError(t, s.checkLiveness(context.Background()))
+
+	// Older agents don't know the call
+	s.guest = &pingGuest{errs: []error{status.Errorf(codes.NotFound, "method Ping")}}
+	assert.NoError(t, s.checkLiveness(context.Background()))
+}
+
+func TestProbeLiveness(t *testing.T) {
+	failure := errors.New("timeout")
+	guest := &pingGuest{errs: []error{failure, nil, failure, failure, nil, failure, failure, failure}}
+	s := &service{
+		guest:  guest,
+		config: &Config{LivenessProbe: &LivenessProbeConfig{IntervalMs: 1, FailureThreshold: 3}},
+	}
+
+	// Failures are counted in a row only
+	err := s.probeLiveness(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missed 3 liveness probes")
+	assert.Equal(t, 8, guest.pings)
+}
+
+func TestProbeLivenessCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	s := &service{
+		guest:  &pingGuest{errs: []error{errors.New("timeout")}},
+		config: &Config{LivenessProbe: &LivenessProbeConfig{IntervalMs: 1, FailureThreshold: 1}},
+	}
+
+	assert.NoError(t, s.probeLiveness(ctx))
+}
+
+func TestLivenessProbeConfigValidate(t *testing.T) {
+	var probe *LivenessProbeConfig
+	assert.NoError(t, probe.validate())
+	assert.NoError(t, (&LivenessProbeConfig{}).validate())
+	assert.Error(t, (&LivenessProbeConfig{FailureThreshold: -1}).validate())
+	assert.Equal(t, defaultLivenessFailureThreshold, (&LivenessProbeConfig{}).failureThreshold())
+}
@@ -14,11 +14,156 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/runtime/v2/shim"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 const ShimID = "aws.firecracker"
 
+const (
+	// cidUsageAction reports vsock CID usage of the host instead of running the shim
+	cidUsageAction = "cid-usage"
+	// auditVerifyAction checks the hash chain of an audit log instead of running the shim
+	auditVerifyAction = "audit-verify"
+	// warmPoolAction keeps a pool of pre-booted VMs for shims to take instead of running the shim
+	warmPoolAction = "warm-pool"
+	// drivesAction reports the drives attached to the VM of a bundle instead of running the shim
+	drivesAction = "drives"
+)
+
 func main() {
+	// Shutdown exits the process directly, this covers other ways out (a panic in main goroutine, signals)
+	defer exitHooks.run()
+
+	// Shim flags are registered and parsed by shim.Run, so the action is looked up before
+	if len(os.Args) > 1 {
+		var action func([]string) error
+		switch os.Args[1] {
+		case cidUsageAction:
+			action = printCIDUsage
+		case auditVerifyAction:
+			action = verifyAudit
+		case warmPoolAction:
+			action = runWarmPool
+		case drivesAction:
+			action = printDrives
+		}
+
+		if action != nil {
+			if err := action(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", ShimID, err)
+				os.Exit(1)
+			}
+
+			return
+		}
+	}
+
+	go handleExitSignals()
+
 	shim.Run(ShimID, NewService)
 }
+
+func printCIDUsage(args []string) error {
+	flags := flag.NewFlagSet(cidUsageAction, flag.ContinueOnError)
+	count := flags.Uint("range", defaultCIDUsageRange, "number of CIDs to check")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	usage, err := vsockCIDUsage(context.Background(), uint32(*count))
+	if err != nil {
+		return err
+	}
+
+	if usage.Registered, err = registeredCIDs(); err != nil {
+		return err
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(usage)
+}
+
+func verifyAudit(args []string) error {
+	flags := flag.NewFlagSet(auditVerifyAction, flag.ContinueOnError)
+	format := flags.String("format", auditFormatJSON, "format of the audit log, json or text")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.Errorf("usage: %s [-format FORMAT] FILE", auditVerifyAction)
+	}
+
+	count, err := verifyAuditLog(flags.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d records verified\n", count)
+	return nil
+}
+
+func printDrives(args []string) error {
+	flags := flag.NewFlagSet(drivesAction, flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.Errorf("usage: %s BUNDLE", drivesAction)
+	}
+
+	return writeDriveInventory(os.Stdout, flags.Arg(0))
+}
+
+func runWarmPool(args []string) error {
+	flags := flag.NewFlagSet(warmPoolAction, flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := LoadConfig("")
+	if err != nil {
+		return err
+	}
+
+	if config.WarmPool == nil {
+		return errors.New("warm_pool isn't configured")
+	}
+
+	if err := config.checkPaths(); err != nil {
+		return errors.Wrap(err, "invalid runtime config")
+	}
+
+	if err := config.checkCPUTemplate(); err != nil {
+		return err
+	}
+
+	// Unclaimed VMs are stopped once the process is asked to exit
+	ctx, cancel := context.WithCancel(log.WithLogger(context.Background(), log.L.WithField("action", warmPoolAction)))
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGINT, unix.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	pool := newWarmPool(config.WarmPool, func(ctx context.Context, name string) (*pooledVM, error) {
+		return bootPooledVM(ctx, config, name)
+	}, func(ctx context.Context, vm *pooledVM) error {
+		return stopPooledVM(ctx, config, vm)
+	})
+
+	return pool.run(ctx)
+}
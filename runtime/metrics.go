@@ -0,0 +1,330 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/fifo"
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// Upper bound for a single metrics record kept in memory and written to disk
+const maxMetricsSize = 1024 * 1024
+
+// Topic of events carrying VM metrics
+const vmMetricsEventTopic = "/firecracker/vm/metrics"
+
+// metricsRecorder keeps the last metrics record flushed by Firecracker to the metrics FIFO.
+// If publish is set, it's called with the counters accumulated so far after each record.
+type metricsRecorder struct {
+	mu      sync.Mutex
+	last    []byte
+	totals  proto.VMMetrics
+	publish func(*proto.VMMetrics)
+}
+
+// firecrackerMetrics are the parts of a Firecracker metrics record exported by the runtime.
+// Firecracker reports counts since the previous record.
+type firecrackerMetrics struct {
+	UTCTimestampMs int64 `json:"utc_timestamp_ms"`
+	Block          struct {
+		ReadCount  uint64 `json:"read_count"`
+		WriteCount uint64 `json:"write_count"`
+		ReadBytes  uint64 `json:"read_bytes"`
+		WriteBytes uint64 `json:"write_bytes"`
+	} `json:"block"`
+	Net struct {
+		RxBytesCount uint64 `json:"rx_bytes_count"`
+		TxBytesCount uint64 `json:"tx_bytes_count"`
+	} `json:"net"`
+	Vsock struct {
+		RxBytesCount uint64 `json:"rx_bytes_count"`
+		TxBytesCount uint64 `json:"tx_bytes_count"`
+	} `json:"vsock"`
+	Vcpu struct {
+		ExitIoIn      uint64 `json:"exit_io_in"`
+		ExitIoOut     uint64 `json:"exit_io_out"`
+		ExitMmioRead  uint64 `json:"exit_mmio_read"`
+		ExitMmioWrite uint64 `json:"exit_mmio_write"`
+	} `json:"vcpu"`
+}
+
+// metricsSnapshot is the content of the file written when a VM exits abnormally
+type metricsSnapshot struct {
+	Namespace  string          `json:"namespace"`
+	ID         string          `json:"id"`
+	CID        uint32          `json:"vm_cid"`
+	ExitError  string          `json:"exit_error"`
+	CapturedAt time.Time       `json:"captured_at"`
+	Metrics    json.RawMessage `json:"metrics"`
+}
+
+// run reads metrics records (one JSON document per line) until reader is closed or ctx is canceled
+func (r *metricsRecorder) run(ctx context.Context, reader io.ReadCloser) {
+	defer recoverGoroutine(ctx, "metrics", nil)
+	defer reader.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Closing the reader unblocks the pending read
+	go func() {
+		select {
+		case <-ctx.Done():
+			reader.Close()
+		case <-done:
+		}
+	}()
+
+	buf := bufio.NewReaderSize(reader, maxMetricsSize)
+	for {
+		line, err := buf.ReadSlice('\n')
+		switch err {
+		case nil:
+			r.record(line)
+			if r.publish != nil {
+				if totals, err := r.accumulate(line); err != nil {
+					log.G(ctx).WithError(err).Debug("failed to parse metrics")
+				} else {
+					r.publish(totals)
+				}
+			}
+		case bufio.ErrBufferFull:
+			log.G(ctx).Warnf("skipping metrics record larger than %d bytes", maxMetricsSize)
+			// Drop the rest of the oversized record
+			for err == bufio.ErrBufferFull {
+				_, err = buf.ReadSlice('\n')
+			}
+		default:
+			if err != io.EOF && ctx.Err() == nil {
+				log.G(ctx).WithError(err).Debug("failed to read metrics")
+			}
+			return
+		}
+	}
+}
+
+func (r *metricsRecorder) record(line []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.last = append(r.last[:0], line...)
+}
+
+// accumulate adds the counts of the record to the totals and returns a copy of them
+func (r *metricsRecorder) accumulate(line []byte) (*proto.VMMetrics, error) {
+	var record firecrackerMetrics
+	if err := json.Unmarshal(line, &record); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := &r.totals
+	t.TimestampMs = record.UTCTimestampMs
+	t.BlockReadCount += record.Block.ReadCount
+	t.BlockWriteCount += record.Block.WriteCount
+	t.BlockReadBytes += record.Block.ReadBytes
+	t.BlockWriteBytes += record.Block.WriteBytes
+	t.NetRxBytes += record.Net.RxBytesCount
+	t.NetTxBytes += record.Net.TxBytesCount
+	t.VsockRxBytes += record.Vsock.RxBytesCount
+	t.VsockTxBytes += record.Vsock.TxBytesCount
+	t.VcpuExitIoIn += record.Vcpu.ExitIoIn
+	t.VcpuExitIoOut += record.Vcpu.ExitIoOut
+	t.VcpuExitMmioRead += record.Vcpu.ExitMmioRead
+	t.VcpuExitMmioWrite += record.Vcpu.ExitMmioWrite
+
+	totals := r.totals
+	return &totals, nil
+}
+
+// snapshot returns a copy of the last valid metrics record, or nil if nothing has been recorded yet
+func (r *metricsRecorder) snapshot() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.last) == 0 || !json.Valid(r.last) {
+		return nil
+	}
+
+	return append([]byte(nil), r.last...)
+}
+
+// writeSnapshot saves the last metrics record to the given directory
+func (r *metricsRecorder) writeSnapshot(dir string, snap metricsSnapshot) (string, error) {
+	snap.Metrics = r.snapshot()
+	if snap.Metrics == nil {
+		return "", errors.New("no metrics have been recorded")
+	}
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s-%s-%d-%d.json", snap.Namespace, snap.ID, snap.CID, snap.CapturedAt.Unix())
+	path := filepath.Join(dir, name)
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// bootstrapLoggingHandler replaces SDK's logging setup in order to read the metrics FIFO, to copy logs to
+// the log file of the VM (see vmLogPath), and to place FIFOs of a jailed VMM in its chroot.
+// A reader has to be attached to the FIFO before Firecracker opens it for writing.
+func (s *service) bootstrapLoggingHandler(client firecracker.Firecracker, logLevel string) firecracker.Handler {
+	return firecracker.Handler{
+		Name: firecracker.BootstrapLoggingHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			logFifo, metricsFifo := s.logFifo(), s.metricsFifo()
+			hostLogFifo, hostMetricsFifo := logFifo, metricsFifo
+			jail := s.vmJail()
+			if jail != nil {
+				hostLogFifo, logFifo = jail.fifo(logFifo)
+				hostMetricsFifo, metricsFifo = jail.fifo(metricsFifo)
+			}
+
+			for _, path := range []string{hostLogFifo, hostMetricsFifo} {
+				if err := syscall.Mkfifo(path, 0700); err != nil {
+					return errors.Wrapf(err, "failed to create fifo %q", path)
+				}
+
+				if jail != nil {
+					if err := jail.chown(path); err != nil {
+						return errors.Wrapf(err, "failed to hand fifo %q over to jail", path)
+					}
+				}
+			}
+
+			// Open is completed in background once Firecracker opens the FIFO for writing
+			reader, err := fifo.OpenFifo(context.Background(), hostMetricsFifo, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+			if err != nil {
+				return errors.Wrap(err, "failed to open metrics fifo")
+			}
+
+			// The VMM outlives the handler's context, the reader stops once the service does
+			go s.metrics.run(s.ctx, reader)
+
+			if logPath := s.vmLogPath(); logPath != "" {
+				if err := captureLog(s.ctx, hostLogFifo, logPath); err != nil {
+					return err
+				}
+			}
+
+			_, err = client.PutLogger(ctx, &models.Logger{
+				LogFifo:     logFifo,
+				Level:       logLevel,
+				MetricsFifo: metricsFifo,
+				ShowLevel:   true,
+			})
+
+			return err
+		},
+	}
+}
+
+// vmLogPath returns the file Firecracker logs of the VM are copied to, so logs of VMs started by
+// different shims aren't intermingled, or an empty string if log_dir isn't set
+func (s *service) vmLogPath() string {
+	if s.config.LogDir == "" {
+		return ""
+	}
+
+	return filepath.Join(s.config.LogDir, s.namespace, s.id+".log")
+}
+
+// captureLog appends everything written to the log FIFO to a file, until Firecracker closes the FIFO
+func captureLog(ctx context.Context, fifoPath, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create log directory %q", filepath.Dir(path))
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open VM log file")
+	}
+
+	// Opened in background, like the metrics FIFO
+	reader, err := fifo.OpenFifo(context.Background(), fifoPath, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to open log fifo")
+	}
+
+	go func() {
+		defer file.Close()
+		defer reader.Close()
+
+		if _, err := io.Copy(file, reader); err != nil && ctx.Err() == nil {
+			log.G(ctx).WithError(err).Warn("failed to copy VM logs")
+		}
+	}()
+
+	return nil
+}
+
+// publishMetrics publishes the metrics of the VM as an event
+func (s *service) publishMetrics(metrics *proto.VMMetrics) {
+	metrics.VMID = s.id
+	if err := s.publish.Publish(s.ctx, vmMetricsEventTopic, metrics); err != nil {
+		log.G(s.ctx).WithError(err).Warn("failed to publish VM metrics")
+	}
+}
+
+// captureMetricsSnapshot writes the last metrics of a VMM that exited unexpectedly, if configured to
+func (s *service) captureMetricsSnapshot(ctx context.Context, exitErr error) {
+	if s.metrics == nil || s.config.MetricsSnapshotDir == "" {
+		return
+	}
+
+	path, err := s.metrics.writeSnapshot(s.config.MetricsSnapshotDir, metricsSnapshot{
+		Namespace:  s.namespace,
+		ID:         s.id,
+		CID:        s.machineCID,
+		ExitError:  exitErr.Error(),
+		CapturedAt: time.Now(),
+	})
+
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to capture metrics snapshot")
+		return
+	}
+
+	log.G(ctx).Infof("captured metrics snapshot to %s", path)
+}
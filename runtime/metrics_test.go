@@ -0,0 +1,169 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+func TestMetricsRecorder(t *testing.T) {
+	var recorder metricsRecorder
+
+	input := strings.Join([]string{
+		`{"utc_timestamp_ms":1,"vcpu":{"exit_io_in":1}}`,
+		`{"utc_timestamp_ms":2,"vcpu":{"exit_io_in":2}}`,
+		`{"big":"` + strings.Repeat("x", maxMetricsSize) + `"}`,
+	}, "\n") + "\n"
+
+	recorder.run(context.Background(), ioutil.NopCloser(strings.NewReader(input)))
+
+	// Oversized record is skipped, the last one which fits is kept
+	assert.JSONEq(t, `{"utc_timestamp_ms":2,"vcpu":{"exit_io_in":2}}`, string(recorder.snapshot()))
+}
+
+func TestMetricsSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var recorder metricsRecorder
+
+	snap := metricsSnapshot{
+		Namespace:  "default",
+		ID:         "container-1",
+		CID:        3,
+		ExitError:  "signal: killed",
+		CapturedAt: time.Unix(1545000000, 0),
+	}
+
+	_, err = recorder.writeSnapshot(dir, snap)
+	assert.Error(t, err, "nothing to capture before metrics are flushed")
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.Write([]byte(`{"utc_timestamp_ms":1}` + "\n"))
+		writer.Close()
+	}()
+
+	recorder.run(context.Background(), reader)
+
+	path, err := recorder.writeSnapshot(dir, snap)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(path, "default-container-1-3-1545000000.json"))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	var saved metricsSnapshot
+	require.NoError(t, json.Unmarshal(data, &saved))
+	assert.Equal(t, "container-1", saved.ID)
+	assert.Equal(t, "signal: killed", saved.ExitError)
+	assert.JSONEq(t, `{"utc_timestamp_ms":1}`, string(saved.Metrics))
+}
+
+func TestMetricsPublish(t *testing.T) {
+	var published []*proto.VMMetrics
+	recorder := metricsRecorder{publish: func(metrics *proto.VMMetrics) {
+		published = append(published, metrics)
+	}}
+
+	input := strings.Join([]string{
+		`{"utc_timestamp_ms":1,"block":{"read_count":2,"read_bytes":4096},"vcpu":{"exit_io_in":1,"exit_mmio_write":3}}`,
+		`not json`,
+		`{"utc_timestamp_ms":2,"block":{"read_count":1,"write_bytes":512},"vsock":{"rx_bytes_count":10,"tx_bytes_count":20},"vcpu":{"exit_io_in":2}}`,
+	}, "\n") + "\n"
+
+	recorder.run(context.Background(), ioutil.NopCloser(strings.NewReader(input)))
+
+	// Firecracker reports counts since the previous record, so they add up
+	require.Len(t, published, 2)
+	assert.Equal(t, &proto.VMMetrics{
+		TimestampMs:       2,
+		BlockReadCount:    3,
+		BlockReadBytes:    4096,
+		BlockWriteBytes:   512,
+		VsockRxBytes:      10,
+		VsockTxBytes:      20,
+		VcpuExitIoIn:      3,
+		VcpuExitMmioWrite: 3,
+	}, published[1])
+	assert.EqualValues(t, 2, published[0].BlockReadCount)
+}
+
+func TestMetricsRecorderCanceled(t *testing.T) {
+	var recorder metricsRecorder
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	defer writer.Close()
+
+	done := make(chan struct{})
+	go func() {
+		recorder.run(ctx, reader)
+		close(done)
+	}()
+
+	writer.Write([]byte(`{"utc_timestamp_ms":1}` + "\n"))
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "metrics reader didn't stop after the context was canceled")
+	}
+
+	assert.NotNil(t, recorder.snapshot())
+}
+
+func TestCaptureLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fc-log-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fifoPath := filepath.Join(dir, "fc-logs.fifo")
+	require.NoError(t, syscall.Mkfifo(fifoPath, 0700))
+
+	logPath := filepath.Join(dir, "default", "task.log")
+	require.NoError(t, captureLog(context.Background(), fifoPath, logPath))
+
+	writer, err := os.OpenFile(fifoPath, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = writer.WriteString("2019-01-01T00:00:00.000000000 [anonymous-instance:INFO] Running Firecracker\n")
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	// The file is written in background until the writer closes the FIFO
+	var data []byte
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, err = ioutil.ReadFile(logPath); err == nil && len(data) > 0 {
+			break
+		}
+	}
+
+	assert.Contains(t, string(data), "Running Firecracker")
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pkg/errors"
+)
+
+var errMetadataWithoutNetwork = errors.New("metadata requires cni_network_name, as MMDS is served over the network interface")
+
+// parseMetadata parses MMDS contents, which must be a JSON object
+func parseMetadata(value string) (map[string]interface{}, error) {
+	var metadata map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+		return nil, err
+	}
+
+	if metadata == nil {
+		return nil, errors.New("metadata should be a JSON object")
+	}
+
+	return metadata, nil
+}
+
+// setMetadataHandler puts the metadata into MMDS before the instance starts, so it's available from boot.
+// SDK's handler ignores its argument and sends Machine.Metadata, which we don't set.
+func setMetadataHandler(client firecracker.Firecracker, metadata map[string]interface{}) firecracker.Handler {
+	return firecracker.Handler{
+		Name: firecracker.SetMetadataHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			_, err := client.PutMmds(ctx, metadata)
+			return errors.Wrap(err, "failed to set MMDS metadata")
+		},
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+func TestParseMetadata(t *testing.T) {
+	metadata, err := parseMetadata(`{"instance": {"id": "i-1", "tags": ["a", "b"]}}`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"instance": map[string]interface{}{"id": "i-1", "tags": []interface{}{"a", "b"}},
+	}, metadata)
+
+	for _, value := range []string{"", "null", `"text"`, `[1, 2]`, `{"id":`} {
+		_, err := parseMetadata(value)
+		assert.Errorf(t, err, "metadata %q", value)
+	}
+}
+
+func TestVMOptionsMetadata(t *testing.T) {
+	s := &service{config: &Config{
+		CNINetworkName: "fcnet",
+		Metadata:       map[string]interface{}{"env": "prod"},
+	}}
+
+	opts, err := s.vmOptions(nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"env": "prod"}, opts.metadata)
+
+	opts, err = s.vmOptions(map[string]string{internal.MetadataAnnotation: `{"env": "test"}`})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"env": "test"}, opts.metadata)
+
+	_, err = s.vmOptions(map[string]string{internal.MetadataAnnotation: `["env"]`})
+	assert.Error(t, err)
+
+	// MMDS can't be reached without a network interface
+	s.config = &Config{}
+	_, err = s.vmOptions(map[string]string{internal.MetadataAnnotation: `{"env": "test"}`})
+	assert.Error(t, err)
+}
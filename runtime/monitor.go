@@ -0,0 +1,119 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+type processKey struct {
+	id     string
+	execID string
+}
+
+type processMonitor struct {
+	pid    uint32
+	cancel context.CancelFunc
+}
+
+// monitoredProcess identifies a process whose monitoring was stopped
+type monitoredProcess struct {
+	id     string
+	execID string
+	pid    uint32
+}
+
+// processMonitors keeps track of state monitoring of processes running inside of the VM, so that every process
+// (a container's init process or an exec'd one) is monitored at most once and its monitoring can be stopped
+// independently of other processes.
+type processMonitors struct {
+	mu       sync.Mutex
+	monitors map[processKey]*processMonitor
+}
+
+// start registers monitoring of the given process (with the given pid), returning the context to monitor it with and a function to
+// call once monitoring is over. Returns false if the process is monitored already.
+func (m *processMonitors) start(ctx context.Context, id, execID string, pid uint32) (context.Context, func(), bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := processKey{id: id, execID: execID}
+	if _, ok := m.monitors[key]; ok {
+		return nil, nil, false
+	}
+
+	if m.monitors == nil {
+		m.monitors = make(map[processKey]*processMonitor)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	monitor := &processMonitor{pid: pid, cancel: cancel}
+	m.monitors[key] = monitor
+
+	release := func() {
+		cancel()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		// The process may have been monitored again in the meantime
+		if m.monitors[key] == monitor {
+			delete(m.monitors, key)
+		}
+	}
+
+	return ctx, release, true
+}
+
+// stop stops monitoring of the given process
+func (m *processMonitors) stop(id, execID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := processKey{id: id, execID: execID}
+	if monitor, ok := m.monitors[key]; ok {
+		monitor.cancel()
+		delete(m.monitors, key)
+	}
+}
+
+// stopExecs stops monitoring of processes exec'd in the given container. Monitoring of the init process is left
+// alone, as it may be tearing down the VM after the process exited.
+func (m *processMonitors) stopExecs(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, monitor := range m.monitors {
+		if key.id == id && key.execID != "" {
+			monitor.cancel()
+			delete(m.monitors, key)
+		}
+	}
+}
+
+// stopAll stops monitoring of all processes and returns them, so their exit can be reported otherwise
+func (m *processMonitors) stopAll() []monitoredProcess {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var processes []monitoredProcess
+	for key, monitor := range m.monitors {
+		monitor.cancel()
+		processes = append(processes, monitoredProcess{id: key.id, execID: key.execID, pid: monitor.pid})
+		delete(m.monitors, key)
+	}
+
+	return processes
+}
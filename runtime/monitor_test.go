@@ -0,0 +1,64 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessMonitors(t *testing.T) {
+	var monitors processMonitors
+
+	initCtx, releaseInit, ok := monitors.start(context.Background(), "app", "", 1)
+	require.True(t, ok)
+	execCtx, _, ok := monitors.start(context.Background(), "app", "shell", 2)
+	require.True(t, ok)
+
+	_, _, ok = monitors.start(context.Background(), "app", "shell", 2)
+	assert.False(t, ok, "a process must be monitored once")
+
+	// Exec'd processes are monitored independently of the init process
+	monitors.stopExecs("app")
+	assert.Error(t, execCtx.Err())
+	assert.NoError(t, initCtx.Err())
+
+	execCtx, releaseExec, ok := monitors.start(context.Background(), "app", "shell", 2)
+	require.True(t, ok)
+	monitors.stop("app", "shell")
+	assert.Error(t, execCtx.Err())
+
+	// A stale release doesn't affect monitoring started later on
+	execCtx, _, ok = monitors.start(context.Background(), "app", "shell", 2)
+	require.True(t, ok)
+	releaseExec()
+	assert.NoError(t, execCtx.Err())
+	_, _, ok = monitors.start(context.Background(), "app", "shell", 2)
+	assert.False(t, ok)
+
+	releaseInit()
+	assert.Error(t, initCtx.Err())
+	initCtx, _, ok = monitors.start(context.Background(), "app", "", 1)
+	assert.True(t, ok)
+
+	// Processes stopped all at once are returned with their pids
+	processes := monitors.stopAll()
+	assert.Error(t, initCtx.Err())
+	assert.Error(t, execCtx.Err())
+	assert.ElementsMatch(t, []monitoredProcess{{id: "app", pid: 1}, {id: "app", execID: "shell", pid: 2}}, processes)
+	assert.Empty(t, monitors.stopAll())
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultCNIConfDir = "/etc/cni/conf.d"
+	defaultCNIBinDir  = "/opt/cni/bin"
+
+	// Tap devices are named after the vsock CID of their VM, which is unique on the host
+	tapNamePrefix = "fctap"
+	// Longest network interface name accepted by the kernel (IFNAMSIZ without the terminating null)
+	maxIfNameLength = 15
+)
+
+// vmNetwork is the network attachment of a VM, set up by the configured CNI plugin chain
+type vmNetwork struct {
+	cni     libcni.CNI
+	list    *libcni.NetworkConfigList
+	runtime *libcni.RuntimeConf
+
+	delOnce sync.Once
+	delErr  error
+}
+
+func newCNI(config *Config) libcni.CNI {
+	binDirs := config.CNIBinDirs
+	if len(binDirs) == 0 {
+		binDirs = []string{defaultCNIBinDir}
+	}
+
+	return &libcni.CNIConfig{Path: binDirs}
+}
+
+// newVMNetwork loads the configured CNI network for the VM attached with the given tap device.
+// The plugins are run in the network namespace of the shim, which is where the VMM runs.
+func (s *service) newVMNetwork(cni libcni.CNI, ifName string) (*vmNetwork, error) {
+	confDir := s.config.CNIConfDir
+	if confDir == "" {
+		confDir = defaultCNIConfDir
+	}
+
+	list, err := libcni.LoadConfList(confDir, s.config.CNINetworkName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load CNI network %q", s.config.CNINetworkName)
+	}
+
+	return &vmNetwork{
+		cni:  cni,
+		list: list,
+		runtime: &libcni.RuntimeConf{
+			ContainerID: fmt.Sprintf("%s-%s", s.namespace, s.id),
+			NetNS:       fmt.Sprintf("/proc/%d/ns/net", os.Getpid()),
+			IfName:      ifName,
+		},
+	}, nil
+}
+
+// tapName returns the name of the tap device of the VM with the given CID
+func (s *service) tapName(cid uint32) string {
+	if s.config.CNIIfName != "" {
+		return s.config.CNIIfName
+	}
+
+	return fmt.Sprintf("%s%d", tapNamePrefix, cid)
+}
+
+// setupNetwork runs CNI ADD for the configured network and returns the tap device to attach to the VM
+func (s *service) setupNetwork(ctx context.Context, cni libcni.CNI, cid uint32) (*vmNetwork, firecracker.NetworkInterface, error) {
+	var iface firecracker.NetworkInterface
+
+	network, err := s.newVMNetwork(cni, s.tapName(cid))
+	if err != nil {
+		return nil, iface, err
+	}
+
+	result, err := cni.AddNetworkList(network.list, network.runtime)
+	if err != nil {
+		return nil, iface, errors.Wrapf(err, "failed to add VM to CNI network %q", network.list.Name)
+	}
+
+	iface, err = network.vmInterface(ctx, result)
+	if err != nil {
+		if delErr := network.teardown(); delErr != nil {
+			log.G(ctx).WithError(delErr).Error("failed to release CNI network")
+		}
+
+		return nil, iface, err
+	}
+
+	return network, iface, nil
+}
+
+// vmInterface finds the tap device in the CNI result (the interface named IfName) and the guest MAC address,
+// which is taken from the interface plugins report as being in the VM (sandbox set to the container ID).
+func (n *vmNetwork) vmInterface(ctx context.Context, cniResult types.Result) (firecracker.NetworkInterface, error) {
+	var iface firecracker.NetworkInterface
+
+	converted, err := current.NewResultFromResult(cniResult)
+	if err != nil {
+		return iface, errors.Wrap(err, "failed to parse CNI result")
+	}
+
+	for _, cniIface := range converted.Interfaces {
+		switch {
+		case cniIface.Name == n.runtime.IfName:
+			iface.HostDevName = cniIface.Name
+		case cniIface.Sandbox == n.runtime.ContainerID:
+			iface.MacAddress = cniIface.Mac
+		}
+	}
+
+	if iface.HostDevName == "" {
+		return iface, errors.Errorf("CNI network %q didn't create interface %q", n.list.Name, n.runtime.IfName)
+	}
+
+	for _, ip := range converted.IPs {
+		log.G(ctx).Infof("assigned IP %s (gateway %s) to VM on CNI network %q", ip.Address.String(), ip.Gateway, n.list.Name)
+	}
+
+	return iface, nil
+}
+
+// teardown runs CNI DEL to release the tap device and the IP address, only once
+func (n *vmNetwork) teardown() error {
+	n.delOnce.Do(func() {
+		n.delErr = n.cni.DelNetworkList(n.list, n.runtime)
+	})
+
+	return n.delErr
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+const testConfList = `{
+	"cniVersion": "0.3.1",
+	"name": "fcnet",
+	"plugins": [{"type": "ptp"}, {"type": "tc-redirect-tap"}]
+}`
+
+type mockCNI struct {
+	libcni.CNI
+
+	result  *current.Result
+	addConf *libcni.RuntimeConf
+	delCnt  int
+}
+
+func (m *mockCNI) AddNetworkList(list *libcni.NetworkConfigList, rt *libcni.RuntimeConf) (types.Result, error) {
+	m.addConf = rt
+	return m.result, nil
+}
+
+func (m *mockCNI) DelNetworkList(list *libcni.NetworkConfigList, rt *libcni.RuntimeConf) error {
+	m.delCnt++
+	return nil
+}
+
+func TestSetupNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cni")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "fcnet.conflist"), []byte(testConfList), 0600))
+
+	s := &service{
+		id:        "task",
+		namespace: "default",
+		config:    &Config{CNINetworkName: "fcnet", CNIConfDir: dir},
+	}
+
+	index := 1
+	cni := &mockCNI{result: &current.Result{
+		CNIVersion: "0.3.1",
+		Interfaces: []*current.Interface{
+			{Name: "veth0", Mac: "aa:aa:aa:aa:aa:aa"},
+			{Name: "fctap3", Mac: "bb:bb:bb:bb:bb:bb"},
+			{Name: "eth0", Mac: "cc:cc:cc:cc:cc:cc", Sandbox: "default-task"},
+		},
+		IPs: []*current.IPConfig{{
+			Version:   "4",
+			Interface: &index,
+			Address:   net.IPNet{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32)},
+			Gateway:   net.IPv4(10, 0, 0, 1),
+		}},
+	}}
+
+	network, iface, err := s.setupNetwork(context.Background(), cni, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "fctap3", iface.HostDevName)
+	assert.Equal(t, "cc:cc:cc:cc:cc:cc", iface.MacAddress)
+	assert.Equal(t, "default-task", cni.addConf.ContainerID)
+	assert.Equal(t, "fctap3", cni.addConf.IfName)
+
+	// Teardown is called on both shutdown and shim exit, CNI DEL must run once
+	require.NoError(t, network.teardown())
+	require.NoError(t, network.teardown())
+	assert.Equal(t, 1, cni.delCnt)
+
+	// Network is released if the plugins didn't create the tap device
+	s.config.CNIIfName = "tap0"
+	cni.delCnt = 0
+	_, _, err = s.setupNetwork(context.Background(), cni, 4)
+	assert.Error(t, err)
+	assert.Equal(t, 1, cni.delCnt)
+
+	s.config.CNINetworkName = "missing"
+	_, _, err = s.setupNetwork(context.Background(), cni, 5)
+	assert.Error(t, err)
+}
+
+func TestCNIConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+		CNIIfName:        "tap0",
+	}
+
+	assert.Error(t, config.validate(), "cni_if_name without cni_network_name")
+
+	config.CNINetworkName = "fcnet"
+	assert.NoError(t, config.validate())
+
+	config.CNIIfName = "firecracker-tap0"
+	assert.Error(t, config.validate())
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/runtime"
+	"github.com/sirupsen/logrus"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// How long to wait before asking the agent for OOM events again after a failure
+const oomRetryInterval = time.Second
+
+// monitorOOM relays OOM kills reported by the agent as TaskOOM events until ctx is canceled
+func (s *service) monitorOOM(ctx context.Context) {
+	defer recoverGoroutine(ctx, "monitor_oom", nil)
+
+	var after uint64
+	for {
+		resp, err := s.guest.WaitOOM(ctx, &proto.WaitOOMRequest{After: after})
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to wait for OOM events")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(oomRetryInterval):
+			}
+
+			continue
+		}
+
+		for _, event := range resp.Events {
+			after = event.Seq
+			s.handleOOM(ctx, event)
+		}
+	}
+}
+
+// handleOOM publishes an OOM event of a container. Kills outside of containers are only logged,
+// as there's no task to report them for.
+func (s *service) handleOOM(ctx context.Context, event *proto.OOMEvent) {
+	logger := log.G(ctx).WithFields(logrus.Fields{"id": event.ContainerID, "guest": event.Guest})
+	if event.Guest {
+		logger.Warn("guest ran out of memory, processes were killed")
+	} else {
+		logger.Info("container reached its memory limit, processes were killed")
+	}
+
+	if event.ContainerID == "" {
+		return
+	}
+
+	s.publishEvent(ctx, runtime.TaskOOMEventTopic, &eventstypes.TaskOOM{ContainerID: event.ContainerID})
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/runtime"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// oomGuest returns the given responses of WaitOOM in order, and cancels ctx once they are all returned
+type oomGuest struct {
+	proto.AgentService
+
+	responses []*proto.WaitOOMResponse
+	afters    []uint64
+	cancel    context.CancelFunc
+}
+
+func (g *oomGuest) WaitOOM(ctx context.Context, req *proto.WaitOOMRequest) (*proto.WaitOOMResponse, error) {
+	g.afters = append(g.afters, req.After)
+	if len(g.responses) == 0 {
+		g.cancel()
+		return nil, ctx.Err()
+	}
+
+	resp := g.responses[0]
+	g.responses = g.responses[1:]
+	if resp == nil {
+		return nil, errors.New("agent is busy")
+	}
+
+	return resp, nil
+}
+
+func TestMonitorOOM(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	guest := &oomGuest{
+		cancel: cancel,
+		responses: []*proto.WaitOOMResponse{
+			{},
+			{Events: []*proto.OOMEvent{
+				{Seq: 1, ContainerID: "app"},
+				{Seq: 2, ContainerID: "app", Guest: true},
+			}},
+			nil,
+			{Events: []*proto.OOMEvent{{Seq: 3, Guest: true}}},
+		},
+	}
+
+	publisher := &fakePublisher{}
+	s := &service{guest: guest, publish: publisher}
+	s.monitorOOM(ctx)
+
+	// Kills outside of containers are not published, failed calls are retried
+	assert.Equal(t, []string{runtime.TaskOOMEventTopic, runtime.TaskOOMEventTopic}, publisher.topics)
+	assert.Equal(t, []uint64{0, 0, 2, 2, 3}, guest.afters)
+}
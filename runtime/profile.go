@@ -0,0 +1,191 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// bootProfileLog is the boot_profile value which writes profiles to the runtime log instead of files
+const bootProfileLog = "log"
+
+// bootPhase is a single measured step of VM startup, times are relative to the start of the boot
+type bootPhase struct {
+	Name       string  `json:"name"`
+	StartMs    float64 `json:"start_ms"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// bootProfile is the machine readable breakdown of VM startup
+type bootProfile struct {
+	Namespace string      `json:"namespace"`
+	ID        string      `json:"id"`
+	CID       uint32      `json:"vm_cid"`
+	StartedAt time.Time   `json:"started_at"`
+	TotalMs   float64     `json:"total_ms"`
+	Error     string      `json:"error,omitempty"`
+	Phases    []bootPhase `json:"phases"`
+}
+
+// bootProfiler records phases of VM startup. A nil profiler records nothing,
+// so profiling costs no more than a nil check when disabled.
+type bootProfiler struct {
+	mu      sync.Mutex
+	start   time.Time
+	lastEnd time.Time
+	phases  []bootPhase
+}
+
+func newBootProfiler() *bootProfiler {
+	now := time.Now()
+	return &bootProfiler{start: now, lastEnd: now}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (p *bootProfiler) record(name string, start, end time.Time, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	phase := bootPhase{
+		Name:       name,
+		StartMs:    milliseconds(start.Sub(p.start)),
+		DurationMs: milliseconds(end.Sub(start)),
+	}
+
+	if err != nil {
+		phase.Error = err.Error()
+	}
+
+	p.phases = append(p.phases, phase)
+	p.lastEnd = end
+}
+
+// measure runs fn and records how long it took
+func (p *bootProfiler) measure(name string, fn func() error) error {
+	if p == nil {
+		return fn()
+	}
+
+	start := time.Now()
+	err := fn()
+	p.record(name, start, time.Now(), err)
+
+	return err
+}
+
+// sinceLast records a phase that lasted from the end of the previous phase until now,
+// for steps that can't be wrapped (like instance start done by the SDK after running handlers)
+func (p *bootProfiler) sinceLast(name string, err error) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	start := p.lastEnd
+	p.mu.Unlock()
+
+	p.record(name, start, time.Now(), err)
+}
+
+// wrap returns the SDK handler which records its own run time under the handler name
+func (p *bootProfiler) wrap(handler firecracker.Handler) firecracker.Handler {
+	if p == nil {
+		return handler
+	}
+
+	return firecracker.Handler{
+		Name: handler.Name,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			return p.measure(handler.Name, func() error { return handler.Fn(ctx, m) })
+		},
+	}
+}
+
+// profile returns the recorded phases
+func (p *bootProfiler) profile(err error) bootProfile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	profile := bootProfile{
+		StartedAt: p.start,
+		TotalMs:   milliseconds(time.Since(p.start)),
+		Phases:    append([]bootPhase(nil), p.phases...),
+	}
+
+	if err != nil {
+		profile.Error = err.Error()
+	}
+
+	return profile
+}
+
+// writeBootProfile emits the profile of VM startup, either to the log or to a file in the configured directory
+func (s *service) writeBootProfile(ctx context.Context, p *bootProfiler, bootErr error) {
+	if p == nil {
+		return
+	}
+
+	profile := p.profile(bootErr)
+	profile.Namespace = s.namespace
+	profile.ID = s.id
+	profile.CID = s.machineCID
+
+	data, err := json.Marshal(profile)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to encode boot profile")
+		return
+	}
+
+	if s.config.BootProfile == bootProfileLog {
+		log.G(ctx).WithField("boot_profile", string(data)).Info("VM boot profile")
+		return
+	}
+
+	path, err := writeBootProfileFile(s.config.BootProfile, profile, data)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to write boot profile")
+		return
+	}
+
+	log.G(ctx).Infof("wrote boot profile to %s", path)
+}
+
+func writeBootProfileFile(dir string, profile bootProfile, data []byte) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s-%s-%d-%d.json", profile.Namespace, profile.ID, profile.CID, profile.StartedAt.UnixNano())
+	path := filepath.Join(dir, name)
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootProfiler(t *testing.T) {
+	ctx := context.Background()
+
+	// Disabled profiler just runs the steps
+	var disabled *bootProfiler
+	calls := 0
+	assert.NoError(t, disabled.measure("step", func() error { calls++; return nil }))
+	disabled.sinceLast("step", nil)
+	handler := firecracker.Handler{Name: "fcinit.Step", Fn: func(context.Context, *firecracker.Machine) error { calls++; return nil }}
+	assert.NoError(t, disabled.wrap(handler).Fn(ctx, nil))
+	assert.Equal(t, 2, calls)
+
+	profiler := newBootProfiler()
+
+	handler.Fn = func(context.Context, *firecracker.Machine) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+
+	require.NoError(t, profiler.wrap(handler).Fn(ctx, nil))
+	time.Sleep(5 * time.Millisecond)
+	profiler.sinceLast("start_instance", nil)
+
+	failure := errors.New("no vsock")
+	assert.Equal(t, failure, profiler.measure("vsock_connect", func() error { return failure }))
+
+	profile := profiler.profile(failure)
+	require.Len(t, profile.Phases, 3)
+
+	assert.Equal(t, "fcinit.Step", profile.Phases[0].Name)
+	assert.True(t, profile.Phases[0].DurationMs >= 10)
+
+	// Phases are contiguous when measured back to back
+	assert.Equal(t, "start_instance", profile.Phases[1].Name)
+	assert.InDelta(t, profile.Phases[0].StartMs+profile.Phases[0].DurationMs, profile.Phases[1].StartMs, 0.001)
+	assert.True(t, profile.Phases[1].DurationMs >= 5)
+
+	assert.Equal(t, "no vsock", profile.Phases[2].Error)
+	assert.Equal(t, "no vsock", profile.Error)
+	assert.True(t, profile.TotalMs >= profile.Phases[2].StartMs)
+}
+
+func TestWriteBootProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &service{
+		namespace:  "default",
+		id:         "task",
+		machineCID: 3,
+		config:     &Config{BootProfile: dir},
+	}
+
+	profiler := newBootProfiler()
+	profiler.measure("agent_ready", func() error { return nil })
+	s.writeBootProfile(context.Background(), profiler, nil)
+
+	files, err := filepath.Glob(filepath.Join(dir, "default-task-3-*.json"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	data, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+
+	var profile bootProfile
+	require.NoError(t, json.Unmarshal(data, &profile))
+	assert.Equal(t, "task", profile.ID)
+	assert.Equal(t, uint32(3), profile.CID)
+	require.Len(t, profile.Phases, 1)
+	assert.Equal(t, "agent_ready", profile.Phases[0].Name)
+}
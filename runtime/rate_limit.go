@@ -0,0 +1,178 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/pkg/errors"
+)
+
+// TokenBucketConfig describes a Firecracker token bucket: size tokens are refilled every refill_time_ms,
+// and one_time_burst extra tokens can be used once. A bucket with size 0 doesn't limit anything.
+type TokenBucketConfig struct {
+	Size         int64 `json:"size"`
+	RefillTimeMs int64 `json:"refill_time_ms"`
+	OneTimeBurst int64 `json:"one_time_burst"`
+}
+
+// RateLimiterConfig limits bytes (bandwidth) and operations (ops) of a drive or a network interface
+type RateLimiterConfig struct {
+	Bandwidth *TokenBucketConfig `json:"bandwidth"`
+	Ops       *TokenBucketConfig `json:"ops"`
+}
+
+func (b *TokenBucketConfig) unlimited() bool {
+	return b == nil || b.Size == 0
+}
+
+func (b *TokenBucketConfig) validate() error {
+	if b.unlimited() {
+		return nil
+	}
+
+	if b.Size < 0 || b.OneTimeBurst < 0 {
+		return errors.New("size and one_time_burst can't be negative")
+	}
+
+	if b.RefillTimeMs <= 0 {
+		return errors.Errorf("refill_time_ms should be positive, got %d", b.RefillTimeMs)
+	}
+
+	return nil
+}
+
+// within returns true if the bucket doesn't allow more than the limit bucket
+func (b *TokenBucketConfig) within(limit *TokenBucketConfig) bool {
+	if limit.unlimited() {
+		return true
+	}
+
+	if b.unlimited() {
+		return false
+	}
+
+	// Compare refill rates (size / refill_time_ms) without dividing
+	return b.Size*limit.RefillTimeMs <= limit.Size*b.RefillTimeMs && b.OneTimeBurst <= limit.OneTimeBurst
+}
+
+func (b *TokenBucketConfig) model() *models.TokenBucket {
+	if b.unlimited() {
+		return nil
+	}
+
+	size, refillTime, oneTimeBurst := b.Size, b.RefillTimeMs, b.OneTimeBurst
+	return &models.TokenBucket{
+		Size:         &size,
+		RefillTime:   &refillTime,
+		OneTimeBurst: &oneTimeBurst,
+	}
+}
+
+func (c *RateLimiterConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if err := c.Bandwidth.validate(); err != nil {
+		return errors.Wrap(err, "invalid bandwidth bucket")
+	}
+
+	if err := c.Ops.validate(); err != nil {
+		return errors.Wrap(err, "invalid ops bucket")
+	}
+
+	return nil
+}
+
+// within returns true if none of the buckets allows more than the corresponding bucket of limit
+func (c *RateLimiterConfig) within(limit *RateLimiterConfig) bool {
+	if limit == nil {
+		return true
+	}
+
+	if c == nil {
+		return limit.Bandwidth.unlimited() && limit.Ops.unlimited()
+	}
+
+	return c.Bandwidth.within(limit.Bandwidth) && c.Ops.within(limit.Ops)
+}
+
+// model converts the config to Firecracker's rate limiter, nil means unlimited
+func (c *RateLimiterConfig) model() *models.RateLimiter {
+	if c == nil || (c.Bandwidth.unlimited() && c.Ops.unlimited()) {
+		return nil
+	}
+
+	return &models.RateLimiter{
+		Bandwidth: c.Bandwidth.model(),
+		Ops:       c.Ops.model(),
+	}
+}
+
+// parseRateLimiter parses a rate limiter requested by a task, which can only tighten the configured one
+func parseRateLimiter(value string, limit *RateLimiterConfig) (*RateLimiterConfig, error) {
+	var limiter RateLimiterConfig
+	if err := json.Unmarshal([]byte(value), &limiter); err != nil {
+		return nil, err
+	}
+
+	if err := limiter.validate(); err != nil {
+		return nil, err
+	}
+
+	if !limiter.within(limit) {
+		return nil, errors.New("rate limiter can't allow more than the configured one")
+	}
+
+	return &limiter, nil
+}
+
+// setRateLimiter applies the rate limiter to all allocated drives
+func (a *driveAllocator) setRateLimiter(limiter *models.RateLimiter) {
+	for i := range a.drives {
+		a.drives[i].RateLimiter = limiter
+	}
+}
+
+// createNetworkInterfacesHandler replaces SDK's network setup, which doesn't support rate limiters.
+// Interfaces are numbered the same way SDK does.
+func createNetworkInterfacesHandler(client firecracker.Firecracker, ifaces []firecracker.NetworkInterface, rx, tx *models.RateLimiter) firecracker.Handler {
+	return firecracker.Handler{
+		Name: firecracker.CreateNetworkInterfacesHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			for i, iface := range ifaces {
+				id := strconv.Itoa(i + 1)
+				_, err := client.PutGuestNetworkInterfaceByID(ctx, id, &models.NetworkInterface{
+					IfaceID:           firecracker.String(id),
+					GuestMac:          iface.MacAddress,
+					HostDevName:       iface.HostDevName,
+					AllowMmdsRequests: iface.AllowMDDS,
+					RxRateLimiter:     rx,
+					TxRateLimiter:     tx,
+				})
+
+				if err != nil {
+					return errors.Wrapf(err, "failed to create network interface %q", iface.HostDevName)
+				}
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+func TestRateLimiterValidate(t *testing.T) {
+	for _, limiter := range []*RateLimiterConfig{
+		nil,
+		{},
+		{Bandwidth: &TokenBucketConfig{}},
+		{Bandwidth: &TokenBucketConfig{Size: 1 << 20, RefillTimeMs: 100}},
+		{Ops: &TokenBucketConfig{Size: 100, RefillTimeMs: 1000, OneTimeBurst: 1000}},
+	} {
+		assert.NoError(t, limiter.validate(), limiter)
+	}
+
+	for _, limiter := range []*RateLimiterConfig{
+		{Bandwidth: &TokenBucketConfig{Size: 1 << 20}},
+		{Bandwidth: &TokenBucketConfig{Size: -1, RefillTimeMs: 100}},
+		{Ops: &TokenBucketConfig{Size: 100, RefillTimeMs: -1000}},
+		{Ops: &TokenBucketConfig{Size: 100, RefillTimeMs: 1000, OneTimeBurst: -1}},
+	} {
+		assert.Error(t, limiter.validate(), limiter)
+	}
+}
+
+func TestRateLimiterModel(t *testing.T) {
+	var limiter *RateLimiterConfig
+	assert.Nil(t, limiter.model())
+
+	// Buckets of size 0 are unlimited, so they are left out
+	limiter = &RateLimiterConfig{Bandwidth: &TokenBucketConfig{}, Ops: &TokenBucketConfig{}}
+	assert.Nil(t, limiter.model())
+
+	limiter.Ops = &TokenBucketConfig{Size: 100, RefillTimeMs: 1000, OneTimeBurst: 50}
+	model := limiter.model()
+	require.NotNil(t, model)
+	assert.Nil(t, model.Bandwidth)
+	require.NotNil(t, model.Ops)
+	assert.EqualValues(t, 100, *model.Ops.Size)
+	assert.EqualValues(t, 1000, *model.Ops.RefillTime)
+	assert.EqualValues(t, 50, *model.Ops.OneTimeBurst)
+}
+
+func TestDriveRateLimiter(t *testing.T) {
+	drives := &driveAllocator{}
+	drives.addWithID(rootDriveID, driveRoleRoot, "/var/lib/firecracker/root.img", true, false)
+	drives.add(driveRoleRootfs, "/dev/mapper/pool-snap-1", false, false)
+
+	limiter := &RateLimiterConfig{Bandwidth: &TokenBucketConfig{Size: 1 << 20, RefillTimeMs: 100}}
+	drives.setRateLimiter(limiter.model())
+
+	for _, drive := range drives.inventory() {
+		require.NotNil(t, drive.RateLimiter, drive.ID)
+		assert.EqualValues(t, 1<<20, *drive.RateLimiter.Bandwidth.Size)
+	}
+}
+
+func TestVMOptionsRateLimiters(t *testing.T) {
+	s := &service{config: &Config{
+		DriveRateLimiter: &RateLimiterConfig{
+			Bandwidth: &TokenBucketConfig{Size: 10 << 20, RefillTimeMs: 1000},
+		},
+	}}
+
+	opts, err := s.vmOptions(nil)
+	require.NoError(t, err)
+	assert.Equal(t, s.config.DriveRateLimiter, opts.driveRateLimiter)
+	assert.Nil(t, opts.networkRxRateLimiter)
+
+	opts, err = s.vmOptions(map[string]string{
+		// Half of the configured bandwidth, with an ops limit on top
+		internal.DriveRateLimiterAnnotation:     `{"bandwidth": {"size": 512000, "refill_time_ms": 100}, "ops": {"size": 100, "refill_time_ms": 1000}}`,
+		internal.NetworkRxRateLimiterAnnotation: `{"bandwidth": {"size": 1048576, "refill_time_ms": 1000}}`,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &RateLimiterConfig{
+		Bandwidth: &TokenBucketConfig{Size: 512000, RefillTimeMs: 100},
+		Ops:       &TokenBucketConfig{Size: 100, RefillTimeMs: 1000},
+	}, opts.driveRateLimiter)
+	require.NotNil(t, opts.networkRxRateLimiter)
+	assert.EqualValues(t, 1048576, opts.networkRxRateLimiter.Bandwidth.Size)
+
+	for _, value := range []string{
+		`{"bandwidth": {"size": 20971520, "refill_time_ms": 1000}}`,
+		`{"bandwidth": {"size": 0}}`,
+		`{"ops": {"size": 100, "refill_time_ms": 1000}}`,
+		`{"bandwidth": {"size": 1024}}`,
+		`[]`,
+	} {
+		_, err = s.vmOptions(map[string]string{internal.DriveRateLimiterAnnotation: value})
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/containerd/typeurl"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+const (
+	defaultReadinessTimeout  = 30 * time.Second
+	maxReadinessTimeout      = 10 * time.Minute
+	defaultReadinessInterval = time.Second
+)
+
+// readinessProbe is a command run inside of the container to find out whether the workload is ready
+type readinessProbe struct {
+	process  *specs.Process
+	exitCode uint32
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// newReadinessProbe builds the readiness probe from the container annotations, nil is returned if
+// the container doesn't define one. The probe process inherits environment, user and working
+// directory of the container process.
+func newReadinessProbe(specPath string, annotations map[string]string) (*readinessProbe, error) {
+	value, ok := annotations[internal.ReadinessProbeAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	var args []string
+	if err := json.Unmarshal([]byte(value), &args); err != nil {
+		return nil, errors.Wrapf(err, "%s should be a JSON array of strings", internal.ReadinessProbeAnnotation)
+	}
+
+	if len(args) == 0 {
+		return nil, errors.Errorf("%s can't be empty", internal.ReadinessProbeAnnotation)
+	}
+
+	probe := &readinessProbe{
+		timeout:  defaultReadinessTimeout,
+		interval: defaultReadinessInterval,
+	}
+
+	if value, ok := annotations[internal.ReadinessProbeExitCodeAnnotation]; ok {
+		code, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", internal.ReadinessProbeExitCodeAnnotation)
+		}
+
+		probe.exitCode = uint32(code)
+	}
+
+	if value, ok := annotations[internal.ReadinessProbeTimeoutAnnotation]; ok {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", internal.ReadinessProbeTimeoutAnnotation)
+		}
+
+		if timeout <= 0 || timeout > maxReadinessTimeout {
+			return nil, errors.Errorf("%s should be positive and at most %s", internal.ReadinessProbeTimeoutAnnotation, maxReadinessTimeout)
+		}
+
+		probe.timeout = timeout
+	}
+
+	data, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec specs.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+
+	process := specs.Process{Cwd: "/"}
+	if spec.Process != nil {
+		process = *spec.Process
+	}
+
+	process.Args = args
+	process.Terminal = false
+	probe.process = &process
+
+	return probe, nil
+}
+
+// waitReady runs the readiness probe of the container until it passes or the probe timeout expires
+func (s *service) waitReady(ctx context.Context, id string, probe *readinessProbe) error {
+	ctx, cancel := context.WithTimeout(ctx, probe.timeout)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		execID := fmt.Sprintf("readiness-probe-%d", attempt)
+
+		passed, err := s.runProbe(ctx, id, execID, probe)
+		if passed {
+			log.G(ctx).Infof("container %q is ready after %d probe(s)", id, attempt)
+			return nil
+		}
+
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("readiness probe %q failed", execID)
+		}
+
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+
+			return errors.Wrapf(err, "container %q didn't become ready within %s", id, probe.timeout)
+		case <-time.After(probe.interval):
+		}
+	}
+}
+
+// runProbe runs a single probe as an exec process of the container and checks its exit code
+func (s *service) runProbe(ctx context.Context, id, execID string, probe *readinessProbe) (bool, error) {
+	spec, err := typeurl.MarshalAny(probe.process)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := s.agentClient.Exec(ctx, &taskAPI.ExecProcessRequest{ID: id, ExecID: execID, Spec: spec}); err != nil {
+		return false, errors.Wrap(err, "exec failed")
+	}
+
+	var started, exited bool
+	defer func() {
+		// The probe context might be expired already, cleanup with a separate one
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), containerStopTimeout)
+		defer cancel()
+
+		if started && !exited {
+			s.agentClient.Kill(cleanupCtx, &taskAPI.KillRequest{ID: id, ExecID: execID, Signal: uint32(syscall.SIGKILL)})
+			s.agentClient.Wait(cleanupCtx, &taskAPI.WaitRequest{ID: id, ExecID: execID})
+		}
+
+		if _, err := s.agentClient.Delete(cleanupCtx, &taskAPI.DeleteRequest{ID: id, ExecID: execID}); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to delete readiness probe %q", execID)
+		}
+	}()
+
+	if _, err := s.agentClient.Start(ctx, &taskAPI.StartRequest{ID: id, ExecID: execID}); err != nil {
+		return false, errors.Wrap(err, "start failed")
+	}
+
+	started = true
+
+	resp, err := s.agentClient.Wait(ctx, &taskAPI.WaitRequest{ID: id, ExecID: execID})
+	if err != nil {
+		return false, errors.Wrap(err, "wait failed")
+	}
+
+	exited = true
+	if resp.ExitStatus != probe.exitCode {
+		return false, errors.Errorf("probe exited with %d, expected %d", resp.ExitStatus, probe.exitCode)
+	}
+
+	return true, nil
+}
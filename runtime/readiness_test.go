@@ -0,0 +1,136 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	ptypes "github.com/gogo/protobuf/types"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+func TestNewReadinessProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "readiness")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	specPath := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(specPath, []byte(`{"process": {"terminal": true, "args": ["/app"], "env": ["A=1"], "cwd": "/srv"}}`), 0600)
+	require.NoError(t, err)
+
+	probe, err := newReadinessProbe(specPath, nil)
+	require.NoError(t, err)
+	assert.Nil(t, probe, "probe is opt-in")
+
+	probe, err = newReadinessProbe(specPath, map[string]string{
+		internal.ReadinessProbeAnnotation:         `["test", "-f", "/ready"]`,
+		internal.ReadinessProbeExitCodeAnnotation: "1",
+		internal.ReadinessProbeTimeoutAnnotation:  "5s",
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test", "-f", "/ready"}, probe.process.Args)
+	assert.Equal(t, []string{"A=1"}, probe.process.Env)
+	assert.Equal(t, "/srv", probe.process.Cwd)
+	assert.False(t, probe.process.Terminal)
+	assert.EqualValues(t, 1, probe.exitCode)
+	assert.Equal(t, 5*time.Second, probe.timeout)
+
+	for _, annotations := range []map[string]string{
+		{internal.ReadinessProbeAnnotation: "test -f /ready"},
+		{internal.ReadinessProbeAnnotation: "[]"},
+		{internal.ReadinessProbeAnnotation: `["true"]`, internal.ReadinessProbeExitCodeAnnotation: "-1"},
+		{internal.ReadinessProbeAnnotation: `["true"]`, internal.ReadinessProbeTimeoutAnnotation: "0s"},
+		{internal.ReadinessProbeAnnotation: `["true"]`, internal.ReadinessProbeTimeoutAnnotation: "1h"},
+	} {
+		_, err := newReadinessProbe(specPath, annotations)
+		assert.Error(t, err, annotations)
+	}
+}
+
+// probeAgent fails the first failures probes, then lets them pass
+type probeAgent struct {
+	taskAPI.TaskService
+
+	mu       sync.Mutex
+	failures int
+	probes   int
+	running  map[string]bool
+}
+
+func (a *probeAgent) Exec(ctx context.Context, req *taskAPI.ExecProcessRequest) (*ptypes.Empty, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.running[req.ExecID] = true
+	return &ptypes.Empty{}, nil
+}
+
+func (a *probeAgent) Start(ctx context.Context, req *taskAPI.StartRequest) (*taskAPI.StartResponse, error) {
+	return &taskAPI.StartResponse{}, nil
+}
+
+func (a *probeAgent) Wait(ctx context.Context, req *taskAPI.WaitRequest) (*taskAPI.WaitResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.probes++
+	if a.probes <= a.failures {
+		return &taskAPI.WaitResponse{ExitStatus: 1}, nil
+	}
+
+	return &taskAPI.WaitResponse{}, nil
+}
+
+func (a *probeAgent) Delete(ctx context.Context, req *taskAPI.DeleteRequest) (*taskAPI.DeleteResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.running, req.ExecID)
+	return &taskAPI.DeleteResponse{}, nil
+}
+
+func TestWaitReady(t *testing.T) {
+	ctx := context.Background()
+	probe := &readinessProbe{
+		process:  &specs.Process{Args: []string{"true"}},
+		timeout:  time.Second,
+		interval: time.Millisecond,
+	}
+
+	agent := &probeAgent{failures: 2, running: make(map[string]bool)}
+	s := &service{agentClient: agent}
+
+	require.NoError(t, s.waitReady(ctx, "1", probe))
+	assert.Equal(t, 3, agent.probes)
+	assert.Empty(t, agent.running, "probe processes must be deleted")
+
+	agent = &probeAgent{failures: 1000, running: make(map[string]bool)}
+	s = &service{agentClient: agent}
+	probe.timeout = 50 * time.Millisecond
+
+	assert.Error(t, s.waitReady(ctx, "1", probe))
+	assert.Empty(t, agent.running)
+}
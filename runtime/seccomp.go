@@ -0,0 +1,291 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/containerd/containerd/errdefs"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// seccompActionRank orders seccomp actions from the least to the most restrictive
+var seccompActionRank = map[specs.LinuxSeccompAction]int{
+	specs.ActAllow: 0,
+	specs.ActTrace: 1,
+	specs.ActErrno: 2,
+	specs.ActTrap:  3,
+	specs.ActKill:  4,
+}
+
+// stricterAction returns the more restrictive of the two actions
+func stricterAction(a, b specs.LinuxSeccompAction) specs.LinuxSeccompAction {
+	if seccompActionRank[b] > seccompActionRank[a] {
+		return b
+	}
+
+	return a
+}
+
+// loadSeccompProfile reads the host baseline profile, in the format of the linux.seccomp section of OCI spec
+func loadSeccompProfile(path string) (*specs.LinuxSeccomp, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile specs.LinuxSeccomp
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse seccomp profile %s", path)
+	}
+
+	if err := validateSeccompProfile(&profile); err != nil {
+		return nil, errors.Wrapf(err, "invalid seccomp profile %s", path)
+	}
+
+	return &profile, nil
+}
+
+func validateSeccompProfile(profile *specs.LinuxSeccomp) error {
+	if _, ok := seccompActionRank[profile.DefaultAction]; !ok {
+		return errors.Errorf("unsupported default action %q", profile.DefaultAction)
+	}
+
+	for _, rule := range profile.Syscalls {
+		if len(rule.Names) == 0 {
+			return errors.New("syscall rule without names")
+		}
+
+		if _, ok := seccompActionRank[rule.Action]; !ok {
+			return errors.Errorf("unsupported action %q for syscalls %v", rule.Action, rule.Names)
+		}
+	}
+
+	return nil
+}
+
+// syscallRules returns the rules of the profile by syscall name, each rule naming a single syscall.
+// Names are returned in the order they first appear in the profile.
+func syscallRules(profile *specs.LinuxSeccomp) (map[string][]specs.LinuxSyscall, []string) {
+	var (
+		rules = make(map[string][]specs.LinuxSyscall)
+		names []string
+	)
+
+	for _, rule := range profile.Syscalls {
+		for _, name := range rule.Names {
+			if _, ok := rules[name]; !ok {
+				names = append(names, name)
+			}
+
+			rules[name] = append(rules[name], specs.LinuxSyscall{
+				Names:  []string{name},
+				Action: rule.Action,
+				Args:   rule.Args,
+			})
+		}
+	}
+
+	return rules, names
+}
+
+// mergeSeccomp combines the container's profile with the host baseline, so the result is at least as restrictive
+// as each of them:
+//   - the default action is the more restrictive of the two default actions,
+//   - each syscall gets the more restrictive of the actions the two profiles take for it (either by a rule or by default),
+//   - conditional rules (matching syscall arguments) are kept, with the action raised to the other profile's default action,
+//   - architectures of the baseline replace the container's ones if set.
+//
+// Profiles which both have rules for a syscall, with either of them matching its arguments, can't be merged, as
+// the result would depend on argument values, which can't be expressed in a single profile.
+func mergeSeccomp(container, baseline *specs.LinuxSeccomp) (*specs.LinuxSeccomp, error) {
+	if err := validateSeccompProfile(baseline); err != nil {
+		return nil, errors.Wrap(err, "invalid seccomp baseline")
+	}
+
+	if container == nil {
+		merged := *baseline
+		return &merged, nil
+	}
+
+	if err := validateSeccompProfile(container); err != nil {
+		return nil, err
+	}
+
+	merged := &specs.LinuxSeccomp{
+		DefaultAction: stricterAction(container.DefaultAction, baseline.DefaultAction),
+		Architectures: container.Architectures,
+	}
+
+	if len(baseline.Architectures) > 0 {
+		merged.Architectures = baseline.Architectures
+	}
+
+	baselineRules, baselineNames := syscallRules(baseline)
+	containerRules, containerNames := syscallRules(container)
+
+	var (
+		unconditional = make(map[specs.LinuxSeccompAction][]string)
+		conditional   []specs.LinuxSyscall
+		seen          = make(map[string]bool)
+	)
+
+	for _, name := range append(baselineNames, containerNames...) {
+		if seen[name] {
+			continue
+		}
+
+		seen[name] = true
+
+		var rules []specs.LinuxSyscall
+		switch fromBaseline, fromContainer := baselineRules[name], containerRules[name]; {
+		case fromBaseline != nil && fromContainer != nil:
+			if hasConditionalRules(fromBaseline) || hasConditionalRules(fromContainer) {
+				return nil, errors.Errorf("rules for syscall %s can't be merged with the baseline, as one of them matches arguments", name)
+			}
+
+			rules = []specs.LinuxSyscall{{
+				Names:  []string{name},
+				Action: stricterAction(strictestAction(fromBaseline), strictestAction(fromContainer)),
+			}}
+		case fromBaseline != nil:
+			rules = raiseActions(fromBaseline, container.DefaultAction)
+		default:
+			rules = raiseActions(fromContainer, baseline.DefaultAction)
+		}
+
+		// Rules taking the default action are redundant, unless dropping them would let a call matching a
+		// conditional rule fall through to an unconditional rule with another action
+		var kept, dropped []specs.LinuxSyscall
+		for _, rule := range rules {
+			if rule.Action != merged.DefaultAction {
+				kept = append(kept, rule)
+			} else {
+				dropped = append(dropped, rule)
+			}
+		}
+
+		if hasConditionalRules(dropped) && hasUnconditionalRules(kept) {
+			return nil, errors.Errorf("rules for syscall %s can't be merged with the baseline, as they'd become ambiguous", name)
+		}
+
+		for _, rule := range kept {
+			if len(rule.Args) == 0 {
+				unconditional[rule.Action] = append(unconditional[rule.Action], name)
+			} else {
+				conditional = append(conditional, rule)
+			}
+		}
+	}
+
+	var actions []specs.LinuxSeccompAction
+	for action := range unconditional {
+		actions = append(actions, action)
+	}
+
+	sort.Slice(actions, func(i, j int) bool { return seccompActionRank[actions[i]] < seccompActionRank[actions[j]] })
+	for _, action := range actions {
+		merged.Syscalls = append(merged.Syscalls, specs.LinuxSyscall{Names: unconditional[action], Action: action})
+	}
+
+	merged.Syscalls = append(merged.Syscalls, conditional...)
+	return merged, nil
+}
+
+func hasConditionalRules(rules []specs.LinuxSyscall) bool {
+	for _, rule := range rules {
+		if len(rule.Args) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasUnconditionalRules(rules []specs.LinuxSyscall) bool {
+	for _, rule := range rules {
+		if len(rule.Args) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func strictestAction(rules []specs.LinuxSyscall) specs.LinuxSeccompAction {
+	action := specs.ActAllow
+	for _, rule := range rules {
+		action = stricterAction(action, rule.Action)
+	}
+
+	return action
+}
+
+func raiseActions(rules []specs.LinuxSyscall, min specs.LinuxSeccompAction) []specs.LinuxSyscall {
+	raised := make([]specs.LinuxSyscall, 0, len(rules))
+	for _, rule := range rules {
+		rule.Action = stricterAction(rule.Action, min)
+		raised = append(raised, rule)
+	}
+
+	return raised
+}
+
+// applySeccompBaseline merges the baseline into the seccomp profile of the given OCI spec.
+// Only the linux.seccomp section is rewritten, other fields are passed through as they are.
+func applySeccompBaseline(spec []byte, baseline *specs.LinuxSeccomp) ([]byte, error) {
+	var (
+		root  map[string]json.RawMessage
+		linux map[string]json.RawMessage
+	)
+
+	if err := json.Unmarshal(spec, &root); err != nil {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "failed to parse bundle spec: %v", err)
+	}
+
+	if raw, ok := root["linux"]; ok {
+		if err := json.Unmarshal(raw, &linux); err != nil {
+			return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "failed to parse linux section of bundle spec: %v", err)
+		}
+	}
+
+	if linux == nil {
+		linux = make(map[string]json.RawMessage)
+	}
+
+	var container *specs.LinuxSeccomp
+	if raw, ok := linux["seccomp"]; ok {
+		if err := json.Unmarshal(raw, &container); err != nil {
+			return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "failed to parse seccomp profile of bundle spec: %v", err)
+		}
+	}
+
+	merged, err := mergeSeccomp(container, baseline)
+	if err != nil {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "failed to apply seccomp baseline: %v", err)
+	}
+
+	if linux["seccomp"], err = json.Marshal(merged); err != nil {
+		return nil, err
+	}
+
+	if root["linux"], err = json.Marshal(linux); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(root)
+}
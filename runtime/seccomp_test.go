@@ -0,0 +1,161 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeSeccomp(t *testing.T) {
+	denylist := &specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Architectures: []specs.Arch{specs.ArchX86_64},
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"ptrace"}, Action: specs.ActKill},
+			{Names: []string{"mount"}, Action: specs.ActErrno},
+		},
+	}
+
+	allowlist := &specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Architectures: []specs.Arch{specs.ArchX86_64, specs.ArchX86},
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"read", "write", "ptrace"}, Action: specs.ActAllow},
+		},
+	}
+
+	// Allowed by the container, the baseline forbids ptrace
+	merged, err := mergeSeccomp(allowlist, denylist)
+	require.NoError(t, err)
+	assert.Equal(t, &specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Architectures: []specs.Arch{specs.ArchX86_64},
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"read", "write"}, Action: specs.ActAllow},
+			{Names: []string{"ptrace"}, Action: specs.ActKill},
+		},
+	}, merged)
+
+	// Container can't widen the baseline allowlist
+	merged, err = mergeSeccomp(denylist, allowlist)
+	require.NoError(t, err)
+	assert.Equal(t, &specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Architectures: []specs.Arch{specs.ArchX86_64, specs.ArchX86},
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"read", "write"}, Action: specs.ActAllow},
+			{Names: []string{"ptrace"}, Action: specs.ActKill},
+		},
+	}, merged)
+
+	// No container profile
+	merged, err = mergeSeccomp(nil, denylist)
+	require.NoError(t, err)
+	assert.Equal(t, denylist, merged)
+}
+
+func TestMergeSeccompConditionalRules(t *testing.T) {
+	personality := specs.LinuxSyscall{
+		Names:  []string{"personality"},
+		Action: specs.ActAllow,
+		Args:   []specs.LinuxSeccompArg{{Index: 0, Value: 0, Op: specs.OpEqualTo}},
+	}
+
+	container := &specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Syscalls:      []specs.LinuxSyscall{personality},
+	}
+
+	// Baseline doesn't restrict personality, the conditional rule is kept
+	merged, err := mergeSeccomp(container, &specs.LinuxSeccomp{DefaultAction: specs.ActAllow})
+	require.NoError(t, err)
+	assert.Equal(t, []specs.LinuxSyscall{personality}, merged.Syscalls)
+
+	// Baseline forbids everything, so does the conditional rule
+	merged, err = mergeSeccomp(container, &specs.LinuxSeccomp{DefaultAction: specs.ActTrap})
+	require.NoError(t, err)
+	assert.Equal(t, specs.ActTrap, merged.DefaultAction)
+	assert.Empty(t, merged.Syscalls)
+
+	// Both profiles have rules for personality, result would depend on the arguments
+	_, err = mergeSeccomp(container, &specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls:      []specs.LinuxSyscall{{Names: []string{"personality"}, Action: specs.ActErrno}},
+	})
+	assert.Error(t, err)
+
+	// Container rule matching the default, while an unconditional rule takes another action
+	_, err = mergeSeccomp(&specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"personality"}, Action: specs.ActErrno, Args: personality.Args},
+			{Names: []string{"personality"}, Action: specs.ActTrap},
+		},
+	}, &specs.LinuxSeccomp{DefaultAction: specs.ActErrno})
+	assert.Error(t, err)
+}
+
+func TestMergeSeccompInvalidProfile(t *testing.T) {
+	baseline := &specs.LinuxSeccomp{DefaultAction: specs.ActAllow}
+
+	_, err := mergeSeccomp(&specs.LinuxSeccomp{DefaultAction: "SCMP_ACT_UNKNOWN"}, baseline)
+	assert.Error(t, err)
+
+	_, err = mergeSeccomp(&specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls:      []specs.LinuxSyscall{{Action: specs.ActErrno}},
+	}, baseline)
+	assert.Error(t, err)
+}
+
+func TestApplySeccompBaseline(t *testing.T) {
+	spec := []byte(`{"ociVersion":"1.0.1","custom":{"x":1},"linux":{"namespaces":[{"type":"pid"}],` +
+		`"seccomp":{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"names":["mount"],"action":"SCMP_ACT_ERRNO"}]}}}`)
+	baseline := &specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls:      []specs.LinuxSyscall{{Names: []string{"ptrace"}, Action: specs.ActErrno}},
+	}
+
+	data, err := applySeccompBaseline(spec, baseline)
+	require.NoError(t, err)
+
+	var merged struct {
+		Custom map[string]int `json:"custom"`
+		specs.Spec
+	}
+
+	require.NoError(t, json.Unmarshal(data, &merged))
+	assert.Equal(t, map[string]int{"x": 1}, merged.Custom)
+	assert.Equal(t, "1.0.1", merged.Version)
+	require.Len(t, merged.Linux.Namespaces, 1)
+	assert.Equal(t, []specs.LinuxSyscall{
+		{Names: []string{"ptrace", "mount"}, Action: specs.ActErrno},
+	}, merged.Linux.Seccomp.Syscalls)
+
+	// Spec without seccomp profile gets the baseline
+	data, err = applySeccompBaseline([]byte(`{"ociVersion":"1.0.1"}`), baseline)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &merged.Spec))
+	assert.Equal(t, baseline, merged.Linux.Seccomp)
+
+	_, err = applySeccompBaseline([]byte(`{"linux":{"seccomp":{"defaultAction":"SCMP_ACT_ALLOW",`+
+		`"syscalls":[{"names":["ptrace"],"action":"SCMP_ACT_ALLOW","args":[{"index":0,"value":1,"op":"SCMP_CMP_EQ"}]}]}}}`), baseline)
+	assert.True(t, errdefs.IsInvalidArgument(err))
+}
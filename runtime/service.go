@@ -15,20 +15,25 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"io"
 	"io/ioutil"
-	"math"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	goruntime "runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-	"unsafe"
 
 	eventstypes "github.com/containerd/containerd/api/events"
 	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/events"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/namespaces"
@@ -37,10 +42,13 @@ import (
 	taskAPI "github.com/containerd/containerd/runtime/v2/task"
 	"github.com/containerd/fifo"
 	"github.com/containerd/ttrpc"
+	"github.com/containerd/typeurl"
 	"github.com/firecracker-microvm/firecracker-go-sdk"
 	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	gogoproto "github.com/gogo/protobuf/proto"
 	ptypes "github.com/gogo/protobuf/types"
 	"github.com/mdlayher/vsock"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
@@ -49,22 +57,55 @@ import (
 	"github.com/firecracker-microvm/firecracker-containerd/proto"
 )
 
+var errPauseUnsupported = errors.Wrap(errdefs.ErrNotImplemented, "pause is not supported by the guest")
+
 const (
-	defaultVsockPort     = 10789
-	supportedMountFSType = "ext4"
+	containerStopTimeout = 10 * time.Second
+
+	// Maximum message size accepted by ttrpc
+	ttrpcMessageLengthMax = 4 << 20
+
+	// Delays between attempts to reconnect a dropped stdio connection
+	stdioRedialBackoff    = 100 * time.Millisecond
+	stdioRedialMaxBackoff = 5 * time.Second
 )
 
 // implements shimapi
 type service struct {
-	server  *ttrpc.Server
-	id      string
-	publish events.Publisher
-
+	server    *ttrpc.Server
+	id        string
+	namespace string
+	publish   events.Publisher
+	// Address of containerd's API, empty if the shim wasn't given one
+	containerdAddress string
+
+	// vmLock guards VM startup, so concurrent Create calls don't race to start two VMs
+	vmLock       sync.Mutex
 	agentStarted bool
 	agentClient  taskAPI.TaskService
+	guest        proto.AgentService
+	capabilities *proto.CapabilitiesResponse
+	metrics      *metricsRecorder
+	vmStopping   int32
+	vmmExited    chan struct{}
+	teardownOnce sync.Once
+	teardownErr  error
 	config       *Config
+	audit        *auditLog
 	machine      *firecracker.Machine
+	pooledVM     *pooledVM
 	machineCID   uint32
+	vmmPid       int
+	bundle       string
+	stateLock    sync.Mutex // serializes updates of the VM state saved in the bundle
+	vcpuCount    int
+	drives       []driveInfo // drive layout of the VM, see driveInventory
+	network      *vmNetwork
+	containers   containerSet
+	monitors     processMonitors
+	consoles     pendingConsoles
+	stdins       stdinClosers
+	probes       sync.Map
 	ctx          context.Context
 	cancel       context.CancelFunc
 }
@@ -72,6 +113,9 @@ type service struct {
 var (
 	_       = (taskAPI.TaskService)(&service{})
 	sysCall = syscall.Syscall
+
+	// Connects stdio streams to the agent, replaceable in tests
+	dialStdio = internal.DialVsock
 )
 
 // Matches type Init func(..).. defined https://github.com/containerd/containerd/blob/master/runtime/v2/shim/shim.go#L47
@@ -92,16 +136,57 @@ func NewService(ctx context.Context, id string, publisher events.Publisher) (shi
 		config.Debug = opts.Debug
 	}
 
+	namespace, _ := namespaces.Namespace(ctx)
+
 	s := &service{
-		server:  server,
-		id:      id,
-		publish: publisher,
-		config:  config,
+		server:            server,
+		id:                id,
+		namespace:         namespace,
+		publish:           publisher,
+		containerdAddress: flagValue("address"),
+		config:            config,
+	}
+
+	// Shims run in the bundle directory. Only the one serving the task (run without an action)
+	// reattaches to the VM of its predecessor.
+	if bundle, err := os.Getwd(); err == nil {
+		s.bundle = bundle
+		if flag.Arg(0) == "" {
+			logShimLimits(ctx, config)
+			if err := s.recoverVM(ctx, bundle); err != nil {
+				log.G(ctx).WithError(err).Error("failed to reattach to running VM")
+			}
+		}
+	}
+
+	if config.AuditLogDir != "" {
+		s.audit = newAuditLog(config.AuditLogDir, config.AuditLogFormat, namespace, id)
 	}
 
 	return s, nil
 }
 
+// flagValue returns the value of the command line flag with the given name, empty if there's no such flag
+func flagValue(name string) string {
+	f := flag.Lookup(name)
+	if f == nil {
+		return ""
+	}
+
+	return f.Value.String()
+}
+
+// logShimLimits logs the resource limits the shim's Go runtime is running with.
+// The memory limit is the configured one, which the shim was started with in GOMEMLIMIT.
+func logShimLimits(ctx context.Context, config *Config) {
+	fields := logrus.Fields{"gomaxprocs": goruntime.GOMAXPROCS(0)}
+	if config.ShimMemoryLimit > 0 {
+		fields["memory_limit"] = config.ShimMemoryLimit
+	}
+
+	log.G(ctx).WithFields(fields).Info("shim started")
+}
+
 func (s *service) StartShim(ctx context.Context, id, containerdBinary, containerdAddress string) (string, error) {
 	cmd, err := s.newCommand(ctx, containerdBinary, containerdAddress)
 	if err != nil {
@@ -157,6 +242,7 @@ func (s *service) StartShim(ctx context.Context, id, containerdBinary, container
 }
 
 func (s *service) Create(ctx context.Context, request *taskAPI.CreateTaskRequest) (*taskAPI.CreateTaskResponse, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithFields(logrus.Fields{
 		"id":         request.ID,
 		"bundle":     request.Bundle,
@@ -167,150 +253,531 @@ func (s *service) Create(ctx context.Context, request *taskAPI.CreateTaskRequest
 		"checkpoint": request.Checkpoint,
 	}).Debug("creating task")
 
-	// TODO: should there be a lock here
-	if !s.agentStarted {
-		client, err := s.startVM(ctx, request)
-		if err != nil {
-			log.G(ctx).WithError(err).Error("failed to start VM")
-			return nil, err
+	bundleSpecPath := filepath.Join(request.Bundle, "config.json")
+
+	runcOptions, taskOptions, err := unpackTaskOptions(request.Options)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to unpack task options")
+		return nil, errdefs.ToGRPC(err)
+	}
+
+	// Generate new anyData with bundle/config.json packed inside.
+	// Done first, so oversized specs are rejected before they are read anywhere else or a VM is started.
+	readOnlyRootfs := taskOptions.GetReadOnlyRootfs() || hasReadOnlyRootfsMount(request.Rootfs)
+	files := taskOptions.GetFiles()
+	if err := validateInjectedFiles(files, s.config.MaxInjectedFilesSize, readOnlyRootfs); err != nil {
+		log.G(ctx).WithError(err).Error("invalid injected files")
+		return nil, errdefs.ToGRPC(err)
+	}
+
+	anyData, err := packBundle(bundleSpecPath, runcOptions, readOnlyRootfs, files, s.config.MaxBundleSize, s.config.seccompBaseline)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to pack bundle")
+		return nil, errdefs.ToGRPC(err)
+	}
+
+	annotations, err := readAnnotations(bundleSpecPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read container annotations")
+	}
+
+	// Validated before anything is created in the guest, adding the container once it's created can't fail
+	container, err := newContainerInfo(request.ID, annotations)
+	if err != nil {
+		err = errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s annotation: %v", internal.SandboxAnnotation, err)
+		return nil, errdefs.ToGRPC(err)
+	}
+
+	resources, err := readResources(bundleSpecPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read container resources")
+	}
+
+	probe, err := newReadinessProbe(bundleSpecPath, annotations)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid readiness probe")
+	}
+
+	var consoleSize *specs.Box
+	if request.Terminal {
+		if consoleSize, err = taskConsoleSize(bundleSpecPath, taskOptions); err != nil {
+			return nil, errors.Wrap(err, "failed to read console size")
 		}
+	}
 
-		s.agentClient = client
-		s.agentStarted = true
+	vmOpts, err := s.vmOptions(annotations)
+	if err != nil {
+		return nil, err
 	}
 
-	log.G(ctx).Infof("creating task '%s'", request.ID)
+	if err := vmOpts.setVcpuCount(taskOptions.GetVcpuCount(), s.config.MaxCPUCount); err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+
+	if err := vmOpts.setKernelArgs(taskOptions.GetKernelArgs()); err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+
+	if err := vmOpts.setLogLevel(taskOptions.GetLogLevel()); err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+
+	vmOpts.readOnlyRootfs = readOnlyRootfs
+
+	_, err = s.ensureVM(ctx, func() (taskAPI.TaskService, error) {
+		if s.canUsePooledVM(request, vmOpts) {
+			client, err := s.startPooledVM(ctx, request, vmOpts)
+			if err != nil {
+				log.G(ctx).WithError(err).Warn("failed to use pooled VM, booting one")
+			} else if client != nil {
+				return client, nil
+			}
+		}
+
+		return s.startVM(ctx, request, vmOpts)
+	})
 
-	// Generate new anyData with bundle/config.json packed inside
-	anyData, err := packBundle(filepath.Join(request.Bundle, "config.json"), request.Options)
 	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to start VM")
 		return nil, err
 	}
 
+	log.G(ctx).Infof("creating task '%s'", request.ID)
+
 	request.Options = anyData
+	if size := request.Size(); size > ttrpcMessageLengthMax {
+		err := errors.Wrapf(errdefs.ErrInvalidArgument, "create request is %d bytes, exceeding the limit of %d bytes", size, ttrpcMessageLengthMax)
+		log.G(ctx).WithError(err).Error("create failed")
+		return nil, errdefs.ToGRPC(err)
+	}
 
 	resp, err := s.agentClient.Create(ctx, request)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("create failed")
 		return nil, err
 	}
-	s.ctx, s.cancel = context.WithCancel(ctx)
-	go s.proxyStdio(s.ctx, request.Stdin, request.Stdout, request.Stderr, s.machineCID)
+
+	s.containers.add(container)
+	s.saveTask(ctx, request)
+
+	// Limits of the spec are counted in host limits of the VMM once a task update sets them
+	s.containers.setResources(request.ID, resources)
+
+	if probe != nil {
+		s.probes.Store(request.ID, probe)
+	}
+
+	// runc sets up the PTY on create, so the process sees the size as soon as it starts
+	s.resizeConsole(ctx, request.ID, "", consoleSize)
+
+	s.proxyStdio(s.ctx, request.ID, request.Stdin, request.Stdout, request.Stderr, request.Terminal, s.machineCID)
+	go func() {
+		defer recoverGoroutine(ctx, "export_labels", nil)
+		if err := s.exportLabels(context.Background(), request.ID); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to export VM labels")
+		}
+	}()
+
+	s.audit.record(ctx, auditEventCreate, request.ID, "", map[string]string{
+		"bundle": request.Bundle,
+		"pid":    strconv.FormatUint(uint64(resp.Pid), 10),
+	})
+
+	s.publishEvent(ctx, runtime.TaskCreateEventTopic, &eventstypes.TaskCreate{
+		ContainerID: request.ID,
+		Bundle:      request.Bundle,
+		Rootfs:      request.Rootfs,
+		IO: &eventstypes.TaskIO{
+			Stdin:    request.Stdin,
+			Stdout:   request.Stdout,
+			Stderr:   request.Stderr,
+			Terminal: request.Terminal,
+		},
+		Checkpoint: request.Checkpoint,
+		Pid:        resp.Pid,
+	})
+
 	log.G(ctx).Infof("successfully created task with pid %d", resp.Pid)
 	return resp, nil
 }
 
+// ensureVM makes sure the VM is started exactly once per service instance.
+// Concurrent callers wait for the VM started by the first caller and reuse its agent client.
+// If the VM fails to start, the error is returned and the next caller retries.
+func (s *service) ensureVM(ctx context.Context, startVM func() (taskAPI.TaskService, error)) (taskAPI.TaskService, error) {
+	s.vmLock.Lock()
+	defer s.vmLock.Unlock()
+
+	if s.agentStarted {
+		log.G(ctx).Debug("attaching to running VM")
+		return s.agentClient, nil
+	}
+
+	// A failed start stops its VMM, the exit of the VMM started now isn't expected
+	atomic.StoreInt32(&s.vmStopping, 0)
+
+	client, err := startVM()
+	if err != nil {
+		return nil, err
+	}
+
+	s.agentClient = client
+	s.agentStarted = true
+
+	return client, nil
+}
+
 func (s *service) Start(ctx context.Context, req *taskAPI.StartRequest) (*taskAPI.StartResponse, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("start")
 	resp, err := s.agentClient.Start(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-	// TODO: Do we need to cancel this at some point?
-	go s.monitorState(s.ctx, req.ID, req.ExecID, resp.Pid)
+
+	if req.ExecID != "" {
+		s.resizeConsole(ctx, req.ID, req.ExecID, s.consoles.remove(req.ID, req.ExecID))
+	}
+	s.audit.record(ctx, auditEventStart, req.ID, req.ExecID, map[string]string{"pid": strconv.FormatUint(uint64(resp.Pid), 10)})
+
+	if monitorCtx, release, ok := s.monitors.start(s.ctx, req.ID, req.ExecID, resp.Pid); ok {
+		go func() {
+			defer release()
+			s.monitorState(monitorCtx, req.ID, req.ExecID, resp.Pid)
+		}()
+	}
+
+	// Report the task as started only once the workload is ready
+	if probe, ok := s.probes.Load(req.ID); ok && req.ExecID == "" {
+		if err := s.waitReady(ctx, req.ID, probe.(*readinessProbe)); err != nil {
+			log.G(ctx).WithError(err).Error("readiness probe didn't pass")
+			return nil, err
+		}
+	}
+
+	if req.ExecID == "" {
+		s.publishEvent(ctx, runtime.TaskStartEventTopic, &eventstypes.TaskStart{
+			ContainerID: req.ID,
+			Pid:         resp.Pid,
+		})
+	} else {
+		s.publishEvent(ctx, runtime.TaskExecStartedEventTopic, &eventstypes.TaskExecStarted{
+			ContainerID: req.ID,
+			ExecID:      req.ExecID,
+			Pid:         resp.Pid,
+		})
+	}
 
 	return resp, nil
 }
 
+// publishEvent publishes a task lifecycle event, failures are logged but don't fail the request
+func (s *service) publishEvent(ctx context.Context, topic string, event events.Event) {
+	if err := s.publish.Publish(ctx, topic, event); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to publish %s event", topic)
+	}
+}
+
+// monitorState waits for a process to stop and reports its exit. Only exit of a container's init process can
+// tear the VM down (once no containers are left running), exec'd processes never do.
 func (s *service) monitorState(ctx context.Context, id, execID string, pid uint32) {
+	defer recoverGoroutine(ctx, "monitor_state", func() { s.abortTask(ctx, id, execID, pid) })
+
+	var (
+		exitStatus uint32
+		exited     bool
+	)
+
+	// Older agents can't notify about exits, their process states are polled
+	if caps := s.capabilities; caps != nil && caps.ExitNotifications {
+		exitStatus, exited = s.waitExit(ctx, id, execID)
+	} else {
+		exitStatus, exited = s.pollExit(ctx, id, execID)
+	}
+
+	if !exited {
+		return
+	}
+
+	s.publishEvent(ctx, runtime.TaskExitEventTopic, exitEvent(id, execID, pid, exitStatus))
+
+	if execID != "" {
+		return
+	}
+
+	remaining, teardown := s.containers.markExited(id)
+	if !teardown {
+		return
+	}
+
+	// Sandbox has exited, stop the rest of the containers before tearing down the VM
+	for _, containerID := range remaining {
+		s.drainContainer(ctx, containerID)
+	}
+
+	s.shutdown(ctx)
+	s.server.Close()
+}
+
+// waitExit waits for the agent to report exit of a process. Returns false if the process is gone
+// without exiting (it was deleted) or ctx is done.
+func (s *service) waitExit(ctx context.Context, id, execID string) (uint32, bool) {
+	for {
+		resp, err := s.guest.WaitExit(ctx, &proto.WaitExitRequest{ID: id, ExecID: execID})
+		if ctx.Err() != nil {
+			return 0, false
+		}
+
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to wait for exit, falling back to polling")
+			return s.pollExit(ctx, id, execID)
+		}
+
+		if resp.Exited {
+			return resp.ExitStatus, true
+		}
+
+		// Nothing happened for a while, the process may have been deleted in the meantime
+		_, err = s.agentClient.State(ctx, &taskAPI.StateRequest{ID: id, ExecID: execID})
+		if errdefs.IsNotFound(errdefs.FromGRPC(err)) {
+			log.G(ctx).WithFields(logrus.Fields{"id": id, "exec_id": execID}).Debug("process is gone")
+			return 0, false
+		}
+	}
+}
+
+// pollExit polls the state of a process until it stops. Returns false if the process is gone
+// without exiting (it was deleted) or ctx is done.
+func (s *service) pollExit(ctx context.Context, id, execID string) (uint32, bool) {
 	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return 0, false
 		case <-ticker.C:
-			//make a state request
-			req := &taskAPI.StateRequest{
-				ID:     id,
-				ExecID: execID,
+			resp, err := s.agentClient.State(ctx, &taskAPI.StateRequest{ID: id, ExecID: execID})
+			if errdefs.IsNotFound(errdefs.FromGRPC(err)) {
+				// Deleted before its exit was noticed, there's nothing left to monitor
+				log.G(ctx).WithFields(logrus.Fields{"id": id, "exec_id": execID}).Debug("process is gone")
+				return 0, false
 			}
-			resp, err := s.agentClient.State(ctx, req)
+
 			if err != nil {
 				log.G(ctx).WithError(err).Error("error monitoring state")
 				continue
 			}
-			// if ending state, stop vm and break
+
 			if resp.Status == task.StatusStopped {
-				s.publish.Publish(ctx, runtime.TaskExitEventTopic, &eventstypes.TaskExit{
-					ContainerID: s.id,
-					ID:          s.id,
-					Pid:         pid,
-					ExitStatus:  resp.ExitStatus,
-					ExitedAt:    time.Now(),
-				})
-				s.Shutdown(ctx, &taskAPI.ShutdownRequest{ID: id})
-				s.server.Close()
-				return
+				return resp.ExitStatus, true
 			}
 		}
+	}
+}
+
+// abortTask kills a process whose state can't be monitored anymore, and reports its exit which otherwise
+// would never be reported
+func (s *service) abortTask(ctx context.Context, id, execID string, pid uint32) {
+	log.G(ctx).WithFields(logrus.Fields{"id": id, "exec_id": execID}).Warn("killing task after its monitoring failed")
+	if _, err := s.agentClient.Kill(ctx, &taskAPI.KillRequest{ID: id, ExecID: execID, Signal: uint32(unix.SIGKILL)}); err != nil {
+		log.G(ctx).WithError(err).Error("failed to kill task")
+	}
+
+	s.publishEvent(ctx, runtime.TaskExitEventTopic, exitEvent(id, execID, pid, 128+uint32(unix.SIGKILL)))
+}
 
+// exitEvent makes the exit event of a container's init process or of a process exec'd in the container,
+// which is identified by its exec ID like in the events of other shims
+func exitEvent(id, execID string, pid, status uint32) *eventstypes.TaskExit {
+	processID := id
+	if execID != "" {
+		processID = execID
+	}
+
+	return &eventstypes.TaskExit{
+		ContainerID: id,
+		ID:          processID,
+		Pid:         pid,
+		ExitStatus:  status,
+		ExitedAt:    time.Now(),
 	}
 }
 
-func (s *service) proxyStdio(ctx context.Context, stdin, stdout, stderr string, CID uint32) {
-	go proxyIO(ctx, stdin, CID, internal.StdinPort, true)
-	go proxyIO(ctx, stdout, CID, internal.StdoutPort, false)
-	go proxyIO(ctx, stderr, CID, internal.StderrPort, false)
+// proxyStdio proxies the stdio of the container's init process. Its stdin stream is registered before returning,
+// so CloseIO can end it right after Create.
+func (s *service) proxyStdio(ctx context.Context, id, stdin, stdout, stderr string, terminal bool, CID uint32) {
+	for _, stream := range internal.StdioStreams(s.config.stdioPorts(), stdin, stdout, stderr, terminal) {
+		var stdinClosed <-chan struct{}
+		if stream.Stdin {
+			stdinClosed = s.stdins.add(id, "")
+		}
+
+		stream.VsockBufferSize = s.config.VsockBufferSize
+		go proxyIO(ctx, stream, CID, s.config.StdioBufferSize, stdinClosed)
+	}
 }
 
-func proxyIO(ctx context.Context, path string, CID, port uint32, in bool) {
-	if path == "" {
-		return
+// proxyIO copies a stdio stream between its FIFO and the agent. A stdin stream ends when the FIFO reaches EOF
+// or stdinClosed is closed, whichever comes first.
+func proxyIO(ctx context.Context, stream internal.StdioStream, CID uint32, bufferSize int, stdinClosed <-chan struct{}) {
+	log.G(ctx).Debug("setting up IO for " + stream.Path)
+
+	// Stdin is opened read-only, so the FIFO reaches EOF once the client closes it
+	flag := syscall.O_RDWR | syscall.O_NONBLOCK
+	if stream.Stdin {
+		flag = syscall.O_RDONLY | syscall.O_NONBLOCK
 	}
-	log.G(ctx).Debug("setting up IO for " + path)
-	f, err := fifo.OpenFifo(ctx, path, syscall.O_RDWR|syscall.O_NONBLOCK, 0700)
+
+	f, err := fifo.OpenFifo(ctx, stream.Path, flag, 0700)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("error opening fifo")
 		return
 	}
-	conn, err := vsock.Dial(CID, port)
+	conn, err := dialStdio(CID, stream.Port, stream.VsockBufferSize)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("unable to dial agent vsock")
 		f.Close()
 		return
 	}
+
+	stdioConn := internal.NewStdioConn(conn, func() (io.ReadWriteCloser, error) {
+		return redialStdio(ctx, CID, stream.Port, stream.VsockBufferSize)
+	})
+
+	// The stream is lost, but the container and the rest of its IO keep going
+	defer recoverGoroutine(ctx, "proxy_io", func() {
+		stdioConn.Close()
+		f.Close()
+	})
+
+	if err := copyStdio(ctx, f, stdioConn, stream.Stdin, stdinClosed, bufferSize); err != nil {
+		log.G(ctx).WithError(err).Error("error with stdio")
+	}
+}
+
+// redialStdio dials the agent again after a stdio connection dropped, backing off between attempts until
+// it succeeds or ctx is canceled
+func redialStdio(ctx context.Context, CID, port uint32, vsockBufferSize int) (io.ReadWriteCloser, error) {
+	backoff := stdioRedialBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		conn, err := dialStdio(CID, port, vsockBufferSize)
+		if err == nil {
+			log.G(ctx).WithField("port", port).Info("reconnected stdio")
+			return conn, nil
+		}
+
+		log.G(ctx).WithError(err).WithField("port", port).Debug("failed to reconnect stdio")
+		if backoff *= 2; backoff > stdioRedialMaxBackoff {
+			backoff = stdioRedialMaxBackoff
+		}
+	}
+}
+
+// copyStdio copies between the FIFO and the agent connection until either side is done or ctx is canceled.
+// Stdin EOF (or stdinClosed being closed) is passed to the agent by closing the connection. A dropped connection
+// is reconnected, while output streams never end before ctx is canceled, as the agent only closes them when it's
+// done with the process.
+func copyStdio(ctx context.Context, f io.ReadWriteCloser, conn *internal.StdioConn, stdin bool, stdinClosed <-chan struct{}, bufferSize int) error {
 	go func() {
 		<-ctx.Done()
 		conn.Close()
 		f.Close()
 	}()
+
 	log.G(ctx).Debug("begin copying io")
-	buf := make([]byte, internal.DefaultBufferSize)
-	if in {
-		_, err = io.CopyBuffer(conn, f, buf)
-	} else {
-		_, err = io.CopyBuffer(f, conn, buf)
+	buf := make([]byte, bufferSize)
+	if !stdin {
+		return conn.CopyFrom(f, buf, false)
 	}
-	if err != nil {
-		log.G(ctx).WithError(err).Error("error with stdio")
+
+	var src io.Reader = f
+	if stdinClosed != nil {
+		reader := newStdinReader(f, stdinClosed, bufferSize)
+		defer reader.Close()
+		src = reader
 	}
+
+	err := conn.CopyTo(src, buf)
+	conn.Close()
+	f.Close()
+	return err
 }
 
 // Delete the initial process and container
 func (s *service) Delete(ctx context.Context, req *taskAPI.DeleteRequest) (*taskAPI.DeleteResponse, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("delete")
 	resp, err := s.agentClient.Delete(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
+	s.audit.record(ctx, auditEventDelete, req.ID, req.ExecID, map[string]string{"exit_status": strconv.FormatUint(uint64(resp.ExitStatus), 10)})
+
+	if req.ExecID == "" {
+		s.stdins.remove(req.ID)
+		s.monitors.stopExecs(req.ID)
+		s.consoles.removeExecs(req.ID)
+		s.containers.remove(req.ID)
+		s.probes.Delete(req.ID)
+		s.forgetTask(ctx, req.ID)
+	} else {
+		s.monitors.stop(req.ID, req.ExecID)
+		s.consoles.remove(req.ID, req.ExecID)
+	}
+
 	return resp, nil
 }
 
 // Exec an additional process inside the container
 func (s *service) Exec(ctx context.Context, req *taskAPI.ExecProcessRequest) (*ptypes.Empty, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("exec")
+	var consoleSize *specs.Box
+	if req.Terminal {
+		size, err := execConsoleSize(req.Spec)
+		if err != nil {
+			return nil, errdefs.ToGRPC(err)
+		}
+
+		consoleSize = size
+	}
+
 	resp, err := s.agentClient.Exec(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
+	if req.Terminal {
+		s.consoles.add(req.ID, req.ExecID, consoleSize)
+	}
+
+	s.audit.record(ctx, auditEventExec, req.ID, req.ExecID, nil)
+	s.publishEvent(ctx, runtime.TaskExecAddedEventTopic, &eventstypes.TaskExecAdded{
+		ContainerID: req.ID,
+		ExecID:      req.ExecID,
+	})
+
 	return resp, nil
 }
 
 // ResizePty of a process
 func (s *service) ResizePty(ctx context.Context, req *taskAPI.ResizePtyRequest) (*ptypes.Empty, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("resize_pty")
+
+	// The PTY of an exec'd process doesn't exist before it's started, it gets the size then
+	if s.consoles.resize(req.ID, req.ExecID, &specs.Box{Width: uint(req.Width), Height: uint(req.Height)}) {
+		return &ptypes.Empty{}, nil
+	}
+
 	resp, err := s.agentClient.ResizePty(ctx, req)
 	if err != nil {
 		return nil, err
@@ -321,6 +788,7 @@ func (s *service) ResizePty(ctx context.Context, req *taskAPI.ResizePtyRequest)
 
 // State returns runtime state information for a process
 func (s *service) State(ctx context.Context, req *taskAPI.StateRequest) (*taskAPI.StateResponse, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("state")
 	resp, err := s.agentClient.State(ctx, req)
 	if err != nil {
@@ -332,47 +800,125 @@ func (s *service) State(ctx context.Context, req *taskAPI.StateRequest) (*taskAP
 
 // Pause the container
 func (s *service) Pause(ctx context.Context, req *taskAPI.PauseRequest) (*ptypes.Empty, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithField("id", req.ID).Debug("pause")
+	if s.inState(ctx, req.ID, task.StatusPaused) {
+		log.G(ctx).Debugf("task %q is already paused", req.ID)
+		return &ptypes.Empty{}, nil
+	}
+
+	if caps := s.capabilities; caps != nil && !caps.Pause {
+		return nil, errdefs.ToGRPC(errPauseUnsupported)
+	}
+
 	resp, err := s.agentClient.Pause(ctx, req)
 	if err != nil {
+		if errdefs.IsNotImplemented(errdefs.FromGRPC(err)) {
+			return nil, errdefs.ToGRPC(errPauseUnsupported)
+		}
+
 		return nil, err
 	}
 
+	s.audit.record(ctx, auditEventPause, req.ID, "", nil)
+
 	return resp, nil
 }
 
 // Resume the container
 func (s *service) Resume(ctx context.Context, req *taskAPI.ResumeRequest) (*ptypes.Empty, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithField("id", req.ID).Debug("resume")
+	if s.inState(ctx, req.ID, task.StatusRunning) {
+		log.G(ctx).Debugf("task %q is already running", req.ID)
+		return &ptypes.Empty{}, nil
+	}
+
 	resp, err := s.agentClient.Resume(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
+	s.audit.record(ctx, auditEventResume, req.ID, "", nil)
+
 	return resp, nil
 }
 
+// inState checks whether the task is in the given state, errors are treated as "unknown state"
+func (s *service) inState(ctx context.Context, id string, status task.Status) bool {
+	resp, err := s.agentClient.State(ctx, &taskAPI.StateRequest{ID: id})
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to get state of task %q", id)
+		return false
+	}
+
+	return resp.Status == status
+}
+
 // Kill a process with the provided signal
 func (s *service) Kill(ctx context.Context, req *taskAPI.KillRequest) (*ptypes.Empty, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("kill")
-	// right now we want to kill vm always when kill is called
-	// may not be true in multi-container vm
-	defer func() {
-		log.G(ctx).Debug("Stopping VM during kill")
-		if err := s.stopVM(); err != nil {
-			log.G(ctx).WithError(err).Error("failed to stop VM")
+	// Containers depending on this one have to be stopped first, but only if the signal is meant to stop it.
+	// Kill never stops the VM itself, it's stopped once the last container exits (see monitorState),
+	// so signals sent to exec'd processes or other signals (like SIGHUP to reload) leave it alone.
+	if req.ExecID == "" && isTerminalSignal(req.Signal) {
+		for _, id := range s.containers.dependents(req.ID) {
+			log.G(ctx).Debugf("stopping dependent container %q", id)
+			if err := s.stopContainer(ctx, id, req.Signal); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to stop dependent container %q", id)
+			}
 		}
-	}()
+	}
+
 	resp, err := s.agentClient.Kill(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-	s.cancel()
+
+	s.audit.record(ctx, auditEventKill, req.ID, req.ExecID, map[string]string{"signal": strconv.FormatUint(uint64(req.Signal), 10)})
+
 	return resp, nil
 }
 
+// isTerminalSignal returns true if the signal is meant to stop the process
+func isTerminalSignal(signal uint32) bool {
+	switch unix.Signal(signal) {
+	case unix.SIGKILL, unix.SIGTERM, unix.SIGINT, unix.SIGQUIT:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopContainer sends the signal to the container and waits (up to containerStopTimeout) for its exit
+func (s *service) stopContainer(ctx context.Context, id string, signal uint32) error {
+	if _, err := s.agentClient.Kill(ctx, &taskAPI.KillRequest{ID: id, Signal: signal}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, containerStopTimeout)
+	defer cancel()
+
+	_, err := s.agentClient.Wait(ctx, &taskAPI.WaitRequest{ID: id})
+	return err
+}
+
+// drainContainer gracefully stops the container, falling back to SIGKILL if it doesn't exit in time
+func (s *service) drainContainer(ctx context.Context, id string) {
+	log.G(ctx).Debugf("draining container %q", id)
+	if err := s.stopContainer(ctx, id, uint32(unix.SIGTERM)); err == nil {
+		return
+	}
+
+	if err := s.stopContainer(ctx, id, uint32(unix.SIGKILL)); err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to stop container %q", id)
+	}
+}
+
 // Pids returns all pids inside the container
 func (s *service) Pids(ctx context.Context, req *taskAPI.PidsRequest) (*taskAPI.PidsResponse, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithField("id", req.ID).Debug("pids")
 	resp, err := s.agentClient.Pids(ctx, req)
 	if err != nil {
@@ -384,17 +930,25 @@ func (s *service) Pids(ctx context.Context, req *taskAPI.PidsRequest) (*taskAPI.
 
 // CloseIO of a process
 func (s *service) CloseIO(ctx context.Context, req *taskAPI.CloseIORequest) (*ptypes.Empty, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("close_io")
 	resp, err := s.agentClient.CloseIO(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
+	// The client may keep its end of the stdin FIFO open, so the stream is ended here instead of waiting for EOF.
+	// Only the stdin of the given process is closed, other processes in the VM keep theirs.
+	if req.Stdin {
+		s.stdins.close(req.ID, req.ExecID)
+	}
+
 	return resp, nil
 }
 
 // Checkpoint the container
 func (s *service) Checkpoint(ctx context.Context, req *taskAPI.CheckpointTaskRequest) (*ptypes.Empty, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "path": req.Path}).Info("checkpoint")
 	resp, err := s.agentClient.Checkpoint(ctx, req)
 	if err != nil {
@@ -406,7 +960,13 @@ func (s *service) Checkpoint(ctx context.Context, req *taskAPI.CheckpointTaskReq
 
 // Connect returns shim information such as the shim's pid
 func (s *service) Connect(ctx context.Context, req *taskAPI.ConnectRequest) (*taskAPI.ConnectResponse, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithField("id", req.ID).Debug("connect")
+	// Tooling probing the task over Connect learns about an unresponsive VM rather than a hanging call
+	if err := s.checkLiveness(ctx); err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+
 	resp, err := s.agentClient.Connect(ctx, req)
 	if err != nil {
 		return nil, err
@@ -416,45 +976,90 @@ func (s *service) Connect(ctx context.Context, req *taskAPI.ConnectRequest) (*ta
 }
 
 func (s *service) Shutdown(ctx context.Context, req *taskAPI.ShutdownRequest) (*ptypes.Empty, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "now": req.Now}).Debug("shutdown")
-	if _, err := s.agentClient.Shutdown(ctx, req); err != nil {
-		log.G(ctx).WithError(err).Error("failed to shutdown agent")
+	// The VM is shared, don't stop it while other containers are still running
+	if count := s.containers.running(); count > 0 {
+		log.G(ctx).Debugf("%d container(s) still running, skipping shutdown", count)
+		return &ptypes.Empty{}, nil
+	}
+
+	if err := s.shutdown(ctx); err != nil {
+		return nil, err
+	}
+
+	return &ptypes.Empty{}, nil
+}
+
+// shutdown stops the agent and the VM and exits the shim
+func (s *service) shutdown(ctx context.Context) error {
+	s.audit.record(ctx, auditEventShutdown, "", "", nil)
+	// A guest halting on its own takes the agent down with it, the agent has to stay up to receive the request
+	if s.shutdownGracePeriod() == 0 {
+		if _, err := s.agentClient.Shutdown(ctx, &taskAPI.ShutdownRequest{ID: s.id}); err != nil {
+			log.G(ctx).WithError(err).Error("failed to shutdown agent")
+		}
 	}
 	log.G(ctx).Debug("stopping VM")
-	if err := s.stopVM(); err != nil {
+	if err := s.teardownVM(ctx); err != nil {
 		log.G(ctx).WithError(err).Error("failed to stop VM")
-		return nil, err
+		return err
+	}
+	if s.cancel != nil {
+		s.cancel()
 	}
-	s.cancel()
 	// Exit to avoid 'zombie' shim processes
-	defer os.Exit(0)
+	defer exitShim(0)
 	log.G(ctx).Debug("stopping runtime")
-	return &ptypes.Empty{}, nil
+	return nil
 }
 
 func (s *service) Stats(ctx context.Context, req *taskAPI.StatsRequest) (*taskAPI.StatsResponse, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithField("id", req.ID).Debug("stats")
 	resp, err := s.agentClient.Stats(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
+	// Stats of the container are still useful without the VMM's
+	vmm, err := vmmStats(s.vmmPid)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to read VMM stats")
+		return resp, nil
+	}
+
+	stats, err := mergeVMMStats(resp.Stats, vmm)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to add VMM stats")
+		return resp, nil
+	}
+
+	resp.Stats = stats
 	return resp, nil
 }
 
 // Update a running container
 func (s *service) Update(ctx context.Context, req *taskAPI.UpdateTaskRequest) (*ptypes.Empty, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithField("id", req.ID).Debug("update")
 	resp, err := s.agentClient.Update(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
+	// Limits in the guest don't hold back the VMM itself on the host
+	if err := s.updateHostLimits(ctx, req.ID, req.Resources); err != nil {
+		log.G(ctx).WithError(err).Error("failed to update VMM host limits")
+		return nil, errdefs.ToGRPC(err)
+	}
+
 	return resp, nil
 }
 
 // Wait for a process to exit
 func (s *service) Wait(ctx context.Context, req *taskAPI.WaitRequest) (*taskAPI.WaitResponse, error) {
+	defer exitOnPanic()
 	log.G(ctx).WithFields(logrus.Fields{"id": req.ID, "exec_id": req.ExecID}).Debug("wait")
 	resp, err := s.agentClient.Wait(ctx, req)
 	if err != nil {
@@ -466,8 +1071,12 @@ func (s *service) Wait(ctx context.Context, req *taskAPI.WaitRequest) (*taskAPI.
 
 func (s *service) Cleanup(ctx context.Context) (*taskAPI.DeleteResponse, error) {
 	log.G(ctx).Debug("cleanup")
-	// Destroy VM/etc here?
-	// copied from runcs impl, nothing to cleanup atm
+
+	// The shim serving the task is gone, so its VM (if any) has to be destroyed from here
+	if err := s.cleanupVM(ctx); err != nil {
+		return nil, err
+	}
+
 	return &taskAPI.DeleteResponse{
 		ExitedAt:   time.Now(),
 		ExitStatus: 128 + uint32(unix.SIGKILL),
@@ -502,7 +1111,11 @@ func (s *service) newCommand(ctx context.Context, containerdBinary, containerdAd
 
 	cmd := exec.Command(self, args...)
 	cmd.Dir = cwd
-	cmd.Env = append(os.Environ(), "GOMAXPROCS=2")
+	cmd.Env = os.Environ()
+	if s.config.ShimMemoryLimit > 0 {
+		cmd.Env = append(cmd.Env, "GOMEMLIMIT="+strconv.FormatInt(s.config.ShimMemoryLimit, 10))
+	}
+	cmd.Env = append(cmd.Env, "GOMAXPROCS="+strconv.Itoa(s.config.ShimMaxProcs))
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
@@ -515,6 +1128,12 @@ func newServer() (*ttrpc.Server, error) {
 }
 
 func dialVsock(ctx context.Context, contextID uint32, port uint32) (net.Conn, error) {
+	conn, _, err := dialVsockAttempts(ctx, contextID, port)
+	return conn, err
+}
+
+// dialVsockAttempts dials like dialVsock, also returning the number of attempts made
+func dialVsockAttempts(ctx context.Context, contextID uint32, port uint32) (net.Conn, int, error) {
 	// VM should start within 200ms, vsock dial will make retries at 100ms, 200ms, 400ms, 800ms and 1.6s
 	const (
 		retryCount      = 5
@@ -528,166 +1147,579 @@ func dialVsock(ctx context.Context, contextID uint32, port uint32) (net.Conn, er
 		conn, err := vsock.Dial(contextID, port)
 		if err == nil {
 			log.G(ctx).WithField("connection", conn).Debug("Dial succeeded")
-			return conn, nil
+			return conn, i, nil
 		}
 
 		log.G(ctx).WithError(err).Warnf("vsock dial failed (attempt %d of %d), will retry in %s", i, retryCount, currentDelay)
-		time.Sleep(currentDelay)
+		select {
+		case <-ctx.Done():
+			return nil, i, ctx.Err()
+		case <-time.After(currentDelay):
+		}
 
 		lastErr = err
 		currentDelay *= delayMultiplier
 	}
 
 	log.G(ctx).WithError(lastErr).WithFields(logrus.Fields{"context_id": contextID, "port": port}).Error("vsock dial failed")
-	return nil, lastErr
+	return nil, retryCount, lastErr
 }
 
-// findNextAvailableVsockCID finds first available vsock context ID.
-// It uses VHOST_VSOCK_SET_GUEST_CID ioctl which allows some CID ranges to be statically reserved in advance.
-// The ioctl fails with EADDRINUSE if cid is already taken and with EINVAL if the CID is invalid.
-// Taken from https://bugzilla.redhat.com/show_bug.cgi?id=1291851
-func findNextAvailableVsockCID(ctx context.Context) (uint32, error) {
-	const (
-		// Corresponds to VHOST_VSOCK_SET_GUEST_CID in vhost.h
-		ioctlVsockSetGuestCID = uintptr(0x4008AF60)
-		// 0, 1 and 2 are reserved CIDs, see http://man7.org/linux/man-pages/man7/vsock.7.html
-		startCID        = 3
-		maxCID          = math.MaxUint32
-		vsockDevicePath = "/dev/vhost-vsock"
-	)
+// startMachine starts the VMM and the instance, giving up once bootCtx is done.
+// The VMM process might be spawned after that, so it's stopped again when the start call eventually returns.
+func (s *service) startMachine(bootCtx, vmmCtx context.Context) error {
+	started := make(chan error, 1)
+	go func() {
+		started <- s.machine.Start(vmmCtx)
+	}()
 
-	file, err := os.OpenFile(vsockDevicePath, syscall.O_RDWR, 0666)
-	if err != nil {
-		return 0, errors.Wrap(err, "failed to open vsock device")
+	select {
+	case err := <-started:
+		return err
+	case <-bootCtx.Done():
+		go func() {
+			<-started
+			if err := s.stopVM(); err != nil {
+				log.G(bootCtx).WithError(err).Error("failed to stop VMM after boot timeout")
+			}
+		}()
+
+		return bootCtx.Err()
 	}
+}
 
-	defer file.Close()
+func (s *service) startVM(ctx context.Context, request *taskAPI.CreateTaskRequest, opts vmOptions) (_ taskAPI.TaskService, err error) {
+	log.G(ctx).Info("starting VM")
 
-	for contextID := startCID; contextID < maxCID; contextID++ {
-		select {
-		case <-ctx.Done():
-			return 0, ctx.Err()
-		default:
-			cid := contextID
-			_, _, err = sysCall(
-				unix.SYS_IOCTL,
-				file.Fd(),
-				ioctlVsockSetGuestCID,
-				uintptr(unsafe.Pointer(&cid)))
-
-			switch err {
-			case unix.Errno(0):
-				return uint32(contextID), nil
-			case unix.EADDRINUSE:
-				// ID is already taken, try next one
-				continue
-			default:
-				// Fail if we get an error we don't expect
-				return 0, err
-			}
-		}
+	if err := s.config.checkPaths(); err != nil {
+		return nil, errors.Wrap(err, "invalid runtime config")
 	}
 
-	return 0, errors.New("couldn't find any available vsock context id")
-}
+	if err := s.config.checkCPUTemplate(); err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
 
-func (s *service) startVM(ctx context.Context, request *taskAPI.CreateTaskRequest) (taskAPI.TaskService, error) {
-	log.G(ctx).Info("starting VM")
+	// Background work of the VM (stdio, state monitoring, metrics) runs until Shutdown cancels it.
+	// Events are published in the namespace of the task.
+	if s.ctx == nil {
+		bgCtx := namespaces.WithNamespace(log.WithLogger(context.Background(), log.G(ctx)), s.namespace)
+		s.ctx, s.cancel = context.WithCancel(bgCtx)
+	}
 
-	cid, err := findNextAvailableVsockCID(ctx)
+	var profiler *bootProfiler
+	if s.config.BootProfile != "" {
+		profiler = newBootProfiler()
+		defer func() { s.writeBootProfile(ctx, profiler, err) }()
+	}
+
+	capacity, err := s.config.vmCapacity(vmMemSizeMib)
 	if err != nil {
 		return nil, err
 	}
 
+	reservation, err := reserveVsockCID(ctx, s.namespace, s.id, capacity)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+
+	defer reservation.release()
+	cid := reservation.CID
+
+	// On success the CID stays registered until the VM is torn down
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if unregisterErr := unregisterCID(cid); unregisterErr != nil {
+			log.G(ctx).WithError(unregisterErr).Error("failed to unregister CID")
+		}
+	}()
+
 	cfg := firecracker.Config{
 		SocketPath:      s.config.SocketPath,
 		VsockDevices:    []firecracker.VsockDevice{{Path: "root", CID: cid}},
 		KernelImagePath: s.config.KernelImagePath,
-		KernelArgs:      s.config.KernelArgs,
+		KernelArgs:      s.kernelArgs(opts),
 		MachineCfg: models.MachineConfiguration{
-			VcpuCount:   int64(s.config.CPUCount),
-			CPUTemplate: models.CPUTemplate(s.config.CPUTemplate),
-			MemSizeMib:  256,
+			VcpuCount:   int64(opts.vcpuCount),
+			CPUTemplate: s.config.cpuTemplate(),
+			MemSizeMib:  vmMemSizeMib,
 		},
-		LogFifo:     s.config.LogFifo,
-		LogLevel:    s.config.LogLevel,
-		MetricsFifo: s.config.MetricsFifo,
+		LogFifo:     s.logFifo(),
+		LogLevel:    opts.logLevel,
+		MetricsFifo: s.metricsFifo(),
 		Debug:       s.config.Debug,
 	}
 
-	idx := strconv.Itoa(1)
-	cfg.Drives = append(cfg.Drives,
-		models.Drive{
-			DriveID:      &idx,
-			PathOnHost:   &s.config.RootDrive,
-			IsRootDevice: firecracker.Bool(true),
-			IsReadOnly:   firecracker.Bool(false),
-		})
+	drives := &driveAllocator{}
+	if err := attachConfiguredDrives(s.config, opts.rootDrive, drives); err != nil {
+		return nil, err
+	}
 
 	// Attach block devices passed from snapshotter
-	for i, mnt := range request.Rootfs {
-		if mnt.Type != supportedMountFSType {
-			return nil, errors.Errorf("unsupported mount type '%s', expected '%s'", mnt.Type, supportedMountFSType)
-		}
-		idx := strconv.Itoa(i + 2)
-		cfg.Drives = append(cfg.Drives,
-			models.Drive{
-				DriveID:      &idx,
-				PathOnHost:   firecracker.String(mnt.Source),
-				IsRootDevice: firecracker.Bool(false),
-				IsReadOnly:   firecracker.Bool(false),
-			})
-	}
-
-	cmd := firecracker.VMCommandBuilder{}.
-		WithBin(s.config.FirecrackerBinaryPath).
-		WithSocketPath(s.config.SocketPath).
-		Build(ctx)
+	for _, mnt := range request.Rootfs {
+		if !isAllowedFSType(s.config.FSTypes, mnt.Type) {
+			return nil, errors.Errorf("unsupported mount type '%s', expected one of %v (see fs_types)", mnt.Type, allowedFSTypes(s.config.FSTypes))
+		}
+		drives.add(driveRoleRootfs, mnt.Source, false, opts.readOnlyRootfs)
+	}
+
+	volumes, err := attachVolumes(opts.volumes, s.config.FSTypes, drives)
+	if err != nil {
+		return nil, err
+	}
+
+	drives.setRateLimiter(opts.driveRateLimiter.model())
+	cfg.Drives = drives.drives
+	s.drives = drives.inventory()
+
+	if s.config.CNINetworkName != "" {
+		network, iface, err := s.setupNetwork(ctx, newCNI(s.config), cid)
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if err == nil {
+				return
+			}
+
+			if delErr := network.teardown(); delErr != nil {
+				log.G(ctx).WithError(delErr).Error("failed to release CNI network")
+			}
+		}()
+
+		// Guests reach MMDS through their network interface
+		iface.AllowMDDS = opts.metadata != nil
+		cfg.NetworkInterfaces = []firecracker.NetworkInterface{iface}
+		s.network = network
+	}
+
+	var cmd *exec.Cmd
+	if jail := s.vmJail(); jail != nil {
+		defer func() {
+			if err == nil {
+				return
+			}
+
+			if rmErr := os.RemoveAll(jail.dir()); rmErr != nil {
+				log.G(ctx).WithError(rmErr).Error("failed to remove jail")
+			}
+		}()
+
+		if err := jail.prepare(&cfg); err != nil {
+			return nil, errors.Wrap(err, "failed to set up jail")
+		}
+
+		cmd = jail.command(ctx)
+	} else {
+		cmd = firecracker.VMCommandBuilder{}.
+			WithBin(s.config.FirecrackerBinaryPath).
+			WithSocketPath(s.config.SocketPath).
+			Build(ctx)
+	}
+
+	stderr, err := openVMMStderr(request.Bundle)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create VMM stderr file")
+	}
+
+	// The VMM gets a copy of its own once started
+	defer stderr.Close()
+	cmd.Stderr = stderr
+
+	apiTimeout := time.Duration(s.config.APITimeoutMs) * time.Millisecond
+	client := newFirecrackerClient(cfg.SocketPath, apiTimeout, log.G(ctx), s.config.Debug)
 	machineOpts := []firecracker.Opt{
 		firecracker.WithProcessRunner(cmd),
+		firecracker.WithClient(client),
+	}
+
+	// Bounds everything from here until the agent is connected, including a VMM that never comes up
+	bootCtx := ctx
+	if bootTimeout := time.Duration(s.config.BootTimeoutMs) * time.Millisecond; bootTimeout > 0 {
+		var bootCancel context.CancelFunc
+		bootCtx, bootCancel = context.WithTimeout(ctx, bootTimeout)
+		defer bootCancel()
+
+		defer func() {
+			if err != nil && bootCtx.Err() == context.DeadlineExceeded {
+				err = errors.Wrapf(err, "VM didn't boot within %s (boot_timeout_ms)", bootTimeout)
+			}
+		}()
+	}
+
+	if err := s.createVMFifoDir(); err != nil {
+		return nil, err
 	}
 
 	vmmCtx, vmmCancel := context.WithCancel(context.Background())
 	defer vmmCancel()
+	bootStart := time.Now()
 	s.machine, err = firecracker.NewMachine(vmmCtx, cfg, machineOpts...)
 	if err != nil {
 		return nil, err
 	}
 	s.machineCID = cid
+	s.vcpuCount = opts.vcpuCount
+
+	// FIFOs of a jailed VMM have to be placed in the chroot, which the SDK's handler doesn't do
+	jailedFifos := s.vmJail() != nil && s.logFifo() != "" && s.metricsFifo() != ""
+	loggingHandler := firecracker.BootstrapLoggingHandler
+	if s.config.MetricsSnapshotDir != "" || s.config.PublishMetrics || s.config.LogDir != "" || jailedFifos {
+		s.metrics = &metricsRecorder{}
+		if s.config.PublishMetrics {
+			s.metrics.publish = s.publishMetrics
+		}
+
+		loggingHandler = s.bootstrapLoggingHandler(client, opts.logLevel)
+	}
+
+	networkHandler := firecracker.CreateNetworkInterfacesHandler
+	rxLimiter, txLimiter := opts.networkRxRateLimiter.model(), opts.networkTxRateLimiter.model()
+	if rxLimiter != nil || txLimiter != nil {
+		networkHandler = createNetworkInterfacesHandler(client, cfg.NetworkInterfaces, rxLimiter, txLimiter)
+	}
+
+	s.machine.Handlers.FcInit = s.machine.Handlers.FcInit.Swap(profiler.wrap(loggingHandler))
+	s.machine.Handlers.FcInit = s.machine.Handlers.FcInit.Swap(profiler.wrap(networkHandler))
+	if opts.metadata != nil {
+		s.machine.Handlers.FcInit = s.machine.Handlers.FcInit.Append(profiler.wrap(setMetadataHandler(client, opts.metadata)))
+	}
+	if profiler != nil {
+		for _, handler := range []firecracker.Handler{
+			firecracker.StartVMMHandler,
+			firecracker.CreateMachineHandler,
+			firecracker.CreateBootSourceHandler,
+			firecracker.AttachDrivesHandler,
+			firecracker.AddVsocksHandler,
+		} {
+			s.machine.Handlers.FcInit = s.machine.Handlers.FcInit.Swap(profiler.wrap(handler))
+		}
+	}
 
 	log.G(ctx).Info("starting instance")
-	if err := s.machine.Start(vmmCtx); err != nil {
+	err = s.startMachine(bootCtx, vmmCtx)
+	profiler.sinceLast("start_instance", err)
+
+	// VMM holds the CID once the instance is started (or it's gone if the start failed)
+	if releaseErr := reservation.release(); releaseErr != nil {
+		log.G(ctx).WithError(releaseErr).Warn("failed to release CID lock")
+	}
+
+	if err != nil {
+		// VMM process might be running already, a stuck API call must not leave it behind
+		err = withVMMStderr(err, request.Bundle)
+		log.G(ctx).WithError(err).Error("failed to start instance, stopping VMM")
+		if stopErr := s.stopVM(); stopErr != nil {
+			log.G(ctx).WithError(stopErr).Error("failed to stop VMM")
+		}
+
 		return nil, err
 	}
 
+	log.G(ctx).WithField("drives", s.driveInventory()).Debug("attached drives")
+	s.audit.record(ctx, auditEventVMStart, "", "", map[string]string{"cid": strconv.FormatUint(uint64(cid), 10)})
+
+	s.vmmExited = make(chan struct{})
+	go s.waitVMM(ctx)
+
+	s.vmmPid = cmd.Process.Pid
+	s.bundle = request.Bundle
+	state := &vmState{
+		CID:              cid,
+		SocketPath:       cfg.SocketPath,
+		VMMPid:           s.vmmPid,
+		AgentMaxInFlight: opts.agentMaxInFlight,
+		Drives:           s.drives,
+	}
+
+	if jail := s.vmJail(); jail != nil {
+		state.JailRoot = jail.rootDir()
+	}
+	if s.network != nil {
+		state.TapName = s.network.runtime.IfName
+	}
+
+	if socketPath, err := filepath.Abs(state.SocketPath); err == nil {
+		state.SocketPath = socketPath
+	}
+
+	// The VM works without it, it just can't be reattached by a restarted shim
+	if err := saveVMState(s.bundle, state); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to save VM state")
+	}
+
+	// Make sure the VMM doesn't outlive the shim, however it exits.
+	// Stopping the VMM also releases its vsock CID.
+	exitLogger := log.G(ctx)
+	exitHooks.register(func() {
+		if err := s.teardownVM(log.WithLogger(context.Background(), exitLogger)); err != nil {
+			exitLogger.WithError(err).Error("failed to stop VM on shim exit")
+		}
+	})
+
+	// A jailed VMM is put into its cgroups by the jailer
+	if cgroups := s.vmmCgroups(); cgroups != nil && s.vmJail() == nil {
+		if err := joinVMMCgroups(cgroups, cmd.Process.Pid); err != nil {
+			log.G(ctx).WithError(err).Error("failed to set up VMM cgroups, stopping VMM")
+			if stopErr := s.doTeardownVM(ctx); stopErr != nil {
+				log.G(ctx).WithError(stopErr).Error("failed to stop VMM")
+			}
+
+			return nil, err
+		}
+	}
+
+	if len(opts.vcpuAffinity) > 0 {
+		if err := s.applyCPUAffinity(ctx, cmd.Process.Pid, opts.vcpuCount, opts.vcpuAffinity); err != nil {
+			log.G(ctx).WithError(err).Error("failed to pin vCPUs, stopping VMM")
+			if stopErr := s.doTeardownVM(ctx); stopErr != nil {
+				log.G(ctx).WithError(stopErr).Error("failed to stop VMM")
+			}
+
+			return nil, err
+		}
+	}
+
 	log.G(ctx).Info("calling agent")
-	conn, err := dialVsock(ctx, cid, defaultVsockPort)
+	var conn net.Conn
+	var dialAttempts int
+	err = profiler.measure("vsock_connect", func() (err error) {
+		conn, dialAttempts, err = dialVsockAttempts(bootCtx, cid, s.config.agentPort())
+		return err
+	})
+
 	if err != nil {
-		s.stopVM()
+		err = withVMMStderr(err, request.Bundle)
+		if stopErr := s.doTeardownVM(ctx); stopErr != nil {
+			log.G(ctx).WithError(stopErr).Error("failed to stop VMM")
+		}
+
 		return nil, err
 	}
 
 	log.G(ctx).Info("creating clients")
 	rpcClient := ttrpc.NewClient(conn)
 	rpcClient.OnClose(func() { conn.Close() })
-	apiClient := taskAPI.NewTaskClient(rpcClient)
+	agentClient := proto.NewAgentClient(rpcClient)
+	s.guest = agentClient
+
+	// Older agents don't implement capabilities call, features are probed on use then
+	var caps *proto.CapabilitiesResponse
+	err = profiler.measure("agent_ready", func() (err error) {
+		caps, err = agentClient.Capabilities(ctx, &proto.CapabilitiesRequest{})
+		return err
+	})
+
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to query guest capabilities")
+	} else {
+		log.G(ctx).WithFields(logrus.Fields{
+			"pause":              caps.Pause,
+			"cgroup_version":     caps.CgroupVersion,
+			"exit_notifications": caps.ExitNotifications,
+			"oom_notifications":  caps.OOMNotifications,
+		}).Info("guest capabilities")
+		s.capabilities = caps
+	}
+
+	s.reportBoot(ctx, time.Since(bootStart), dialAttempts)
+
+	// Older agents don't report OOM kills, no TaskOOM events are published then
+	if caps != nil && caps.OOMNotifications {
+		go s.monitorOOM(s.ctx)
+	}
+
+	if s.config.LivenessProbe != nil {
+		go s.monitorLiveness(s.ctx)
+	}
+
+	if s.config.DNSVsockPort != 0 {
+		// The proxy runs as long as the VM does, so it's not bound to the request context
+		go s.proxyDNS(log.WithLogger(context.Background(), log.G(ctx)), cid)
+	}
+
+	if len(volumes) > 0 {
+		err := profiler.measure("mount_volumes", func() error {
+			_, err := agentClient.MountVolumes(ctx, &proto.MountVolumesRequest{Volumes: volumes})
+			return err
+		})
+
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to mount volumes")
+			rpcClient.Close()
+			if stopErr := s.doTeardownVM(ctx); stopErr != nil {
+				log.G(ctx).WithError(stopErr).Error("failed to stop VMM")
+			}
+
+			return nil, errors.Wrap(err, "failed to mount volumes")
+		}
+	}
 
-	return apiClient, nil
+	return s.newAgentTaskClient(rpcClient, opts.agentMaxInFlight), nil
+}
+
+// newAgentTaskClient creates the client of the agent's task service. RPCs are bounded by the configured timeouts,
+// and limited to maxInFlight concurrent ones if it's set. Time spent queued doesn't count against the RPC timeout.
+func (s *service) newAgentTaskClient(rpcClient *ttrpc.Client, maxInFlight int) taskAPI.TaskService {
+	var client taskAPI.TaskService = &timeoutTaskService{TaskService: taskAPI.NewTaskClient(rpcClient), config: s.config}
+	if maxInFlight > 0 {
+		queueTimeout := time.Duration(s.config.AgentQueueTimeoutMs) * time.Millisecond
+		client = &limitedTaskService{TaskService: client, limiter: newAgentLimiter(maxInFlight, queueTimeout)}
+	}
+
+	return client
+}
+
+// kernelArgs builds the kernel command line for the VM, appending the settings
+// the agent reads at boot to the configured kernel arguments.
+func (s *service) kernelArgs(opts vmOptions) string {
+	args := []string{
+		mergeKernelArgs(s.config.KernelArgs, opts.extraKernelArgs),
+		internal.FormatBootArg(internal.AgentLogLevelBootArg, s.config.AgentLogLevel),
+		internal.FormatBootArg(internal.StdioBufferSizeBootArg, strconv.Itoa(s.config.StdioBufferSize)),
+	}
+
+	if s.config.VsockBufferSize != 0 {
+		args = append(args, internal.FormatBootArg(internal.VsockBufferSizeBootArg, strconv.Itoa(s.config.VsockBufferSize)))
+	}
+
+	if opts.prefaultMemory {
+		args = append(args, internal.FormatBootArg(internal.PrefaultMemoryBootArg, "1"))
+	}
+
+	if opts.initMode != "" {
+		args = append(args, internal.FormatBootArg(internal.InitModeBootArg, opts.initMode))
+	}
+
+	// Agent assumes default ports if they aren't passed, which keeps older guest images working
+	if port := s.config.agentPort(); port != internal.DefaultVsockPort {
+		args = append(args, internal.FormatBootArg(internal.VsockPortBootArg, strconv.FormatUint(uint64(port), 10)))
+	}
+
+	if s.config.StdioPortBase != 0 {
+		args = append(args, internal.FormatBootArg(internal.StdioPortBaseBootArg, strconv.FormatUint(uint64(s.config.StdioPortBase), 10)))
+	}
+
+	// Stdio ports set one by one override those following the base
+	if ports := s.config.VsockPorts; ports != nil {
+		for _, arg := range []struct {
+			key  string
+			port uint32
+		}{
+			{internal.StdinPortBootArg, ports.Stdin},
+			{internal.StdoutPortBootArg, ports.Stdout},
+			{internal.StderrPortBootArg, ports.Stderr},
+		} {
+			if arg.port != 0 {
+				args = append(args, internal.FormatBootArg(arg.key, strconv.FormatUint(uint64(arg.port), 10)))
+			}
+		}
+	}
+
+	if s.config.DNSVsockPort != 0 {
+		args = append(args, internal.FormatBootArg(internal.DNSPortBootArg, strconv.FormatUint(uint64(s.config.DNSVsockPort), 10)))
+	}
+
+	return strings.Join(args, " ")
+}
+
+// driveInventory returns the drives attached to the running VM, including
+// their host paths, IDs, read-only flags, cache type and rate limiters.
+// The inventory is saved in the VM state file, where the drives action reads it.
+func (s *service) driveInventory() []driveInfo {
+	return s.drives
 }
 
 func (s *service) stopVM() error {
+	atomic.StoreInt32(&s.vmStopping, 1)
+	if s.machine == nil && s.vmmPid != 0 {
+		return stopReattachedVMM(s.vmmPid)
+	}
+
 	return s.machine.StopVMM()
 }
 
-func packBundle(path string, options *ptypes.Any) (*ptypes.Any, error) {
+// isVMStopping returns true if the VMM is being stopped by the runtime, so its exit is expected
+func (s *service) isVMStopping() bool {
+	return atomic.LoadInt32(&s.vmStopping) == 1
+}
+
+// unpackTaskOptions splits runtime options of a create request into runc options passed on to the agent
+// and settings of the VM. Clients pass VM settings as ExtraData (with runc options wrapped inside),
+// any other options are passed on as is.
+func unpackTaskOptions(options *ptypes.Any) (*ptypes.Any, *proto.ExtraData, error) {
+	// containerd client marshals options without the type URL prefix added by ptypes.MarshalAny
+	if options == nil || !(ptypes.Is(options, &proto.ExtraData{}) || typeurl.Is(options, &proto.ExtraData{})) {
+		return options, nil, nil
+	}
+
+	extraData := &proto.ExtraData{}
+	if err := gogoproto.Unmarshal(options.Value, extraData); err != nil {
+		return nil, nil, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid task options: %v", err)
+	}
+
+	if len(extraData.JsonSpec) > 0 {
+		return nil, nil, errors.Wrap(errdefs.ErrInvalidArgument, "task options can't carry a bundle spec")
+	}
+
+	return extraData.RuncOptions, extraData, nil
+}
+
+// validateBundleSpec checks the bundle spec parses as an OCI runtime spec, so a malformed spec fails the task
+// creation with an error pointing at the problem, rather than inside the agent
+func validateBundleSpec(path string, data []byte) error {
+	var spec specs.Spec
+	err := json.Unmarshal(data, &spec)
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case *json.SyntaxError:
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "bundle spec %s is not valid JSON: %v (at offset %d)", path, err, err.Offset)
+	case *json.UnmarshalTypeError:
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "bundle spec %s is not a valid OCI runtime spec: %s should be %s, not %s",
+			path, err.Field, err.Type, err.Value)
+	default:
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "bundle spec %s is not a valid OCI runtime spec: %v", path, err)
+	}
+}
+
+func packBundle(path string, options *ptypes.Any, readOnlyRootfs bool, files []*proto.InjectedFile, maxSize int, seccompBaseline *specs.LinuxSeccomp) (*ptypes.Any, error) {
 	// Add the bundle/config.json to the request so it can be recreated
 	// inside the vm:
-	// Read bundle json
-	jsonBytes, err := ioutil.ReadFile(path)
+	// Read bundle json, no more than the limit (plus a byte to detect oversized files)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrapf(errdefs.ErrNotFound, "bundle %s has no spec (config.json)", filepath.Dir(path))
+	}
+
 	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open bundle spec %s", path)
+	}
+
+	defer file.Close()
+
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(file, int64(maxSize)+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read bundle spec %s", path)
+	}
+
+	if len(jsonBytes) > maxSize {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "bundle spec %s exceeds the limit of %d bytes (see max_bundle_size)", path, maxSize)
+	}
+
+	if err := validateBundleSpec(path, jsonBytes); err != nil {
 		return nil, err
 	}
 
+	if seccompBaseline != nil {
+		if jsonBytes, err = applySeccompBaseline(jsonBytes, seccompBaseline); err != nil {
+			return nil, err
+		}
+	}
+
 	var opts *ptypes.Any
 	if options != nil {
 		// Copy values of existing options over
@@ -701,8 +1733,10 @@ func packBundle(path string, options *ptypes.Any) (*ptypes.Any, error) {
 	// add it to a type
 	// Convert to any
 	extraData := &proto.ExtraData{
-		JsonSpec:    jsonBytes,
-		RuncOptions: opts,
+		JsonSpec:       jsonBytes,
+		RuncOptions:    opts,
+		ReadOnlyRootfs: readOnlyRootfs,
+		Files:          files,
 	}
 	return ptypes.MarshalAny(extraData)
 }
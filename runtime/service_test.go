@@ -15,10 +15,35 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/runtime"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/containerd/fifo"
+	"github.com/containerd/typeurl"
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
 )
 
 func TestFindNextAvailableVsockCID(t *testing.T) {
@@ -40,3 +65,552 @@ func TestFindNextAvailableVsockCID(t *testing.T) {
 	_, err = findNextAvailableVsockCID(ctx)
 	require.Equal(t, context.Canceled, err)
 }
+
+func TestConcurrentEnsureVM(t *testing.T) {
+	var (
+		s      service
+		client = taskAPI.NewTaskClient(nil)
+		starts int32
+		wg     sync.WaitGroup
+	)
+
+	startVM := func() (taskAPI.TaskService, error) {
+		atomic.AddInt32(&starts, 1)
+		return client, nil
+	}
+
+	const count = 16
+	results := make([]taskAPI.TaskService, count)
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			res, err := s.ensureVM(context.Background(), startVM)
+			assert.NoError(t, err)
+			results[i] = res
+		}(i)
+	}
+
+	wg.Wait()
+
+	require.EqualValues(t, 1, starts, "VM must be started exactly once")
+	for _, res := range results {
+		assert.Equal(t, client, res)
+	}
+}
+
+func TestEnsureVMRetriesAfterFailure(t *testing.T) {
+	var s service
+
+	_, err := s.ensureVM(context.Background(), func() (taskAPI.TaskService, error) {
+		return nil, errors.New("boot failed")
+	})
+	require.Error(t, err)
+	require.False(t, s.agentStarted)
+
+	client := taskAPI.NewTaskClient(nil)
+	res, err := s.ensureVM(context.Background(), func() (taskAPI.TaskService, error) {
+		return client, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, client, res)
+}
+
+// BenchmarkStdioBufferSize measures how stdio_buffer_size affects copy throughput over a stream socket
+func BenchmarkStdioBufferSize(b *testing.B) {
+	const payloadSize = 64 * 1024 * 1024
+
+	for _, size := range []int{1024, 4096, 32 * 1024, 128 * 1024} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			b.SetBytes(payloadSize)
+
+			for i := 0; i < b.N; i++ {
+				fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+				require.NoError(b, err)
+
+				writer := os.NewFile(uintptr(fds[0]), "writer")
+				reader := os.NewFile(uintptr(fds[1]), "reader")
+
+				go func() {
+					defer writer.Close()
+					// Hide io.ReaderFrom and io.WriterTo implementations, so copies go through
+					// the buffer of the given size, as they do with vsock connections
+					io.CopyBuffer(struct{ io.Writer }{writer}, io.LimitReader(zeroReader{}, payloadSize), make([]byte, size))
+				}()
+
+				n, err := io.CopyBuffer(ioutil.Discard, struct{ io.Reader }{reader}, make([]byte, size))
+				reader.Close()
+
+				require.NoError(b, err)
+				require.EqualValues(b, payloadSize, n)
+			}
+		})
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// fakeAgent overrides the calls used by pause/resume tests, others panic
+type fakeAgent struct {
+	taskAPI.TaskService
+
+	status   task.Status
+	stateErr error
+	pauseErr error
+	calls    int
+	kills    []string
+	resizes  []string
+}
+
+func (a *fakeAgent) State(ctx context.Context, req *taskAPI.StateRequest) (*taskAPI.StateResponse, error) {
+	if a.stateErr != nil {
+		return nil, a.stateErr
+	}
+
+	return &taskAPI.StateResponse{ID: req.ID, Status: a.status}, nil
+}
+
+func (a *fakeAgent) Pause(ctx context.Context, req *taskAPI.PauseRequest) (*ptypes.Empty, error) {
+	a.calls++
+	return &ptypes.Empty{}, a.pauseErr
+}
+
+func (a *fakeAgent) Resume(ctx context.Context, req *taskAPI.ResumeRequest) (*ptypes.Empty, error) {
+	a.calls++
+	return &ptypes.Empty{}, nil
+}
+
+func (a *fakeAgent) Kill(ctx context.Context, req *taskAPI.KillRequest) (*ptypes.Empty, error) {
+	a.kills = append(a.kills, fmt.Sprintf("%s/%s:%d", req.ID, req.ExecID, req.Signal))
+	return &ptypes.Empty{}, nil
+}
+
+func (a *fakeAgent) Start(ctx context.Context, req *taskAPI.StartRequest) (*taskAPI.StartResponse, error) {
+	return &taskAPI.StartResponse{Pid: 42}, nil
+}
+
+func (a *fakeAgent) Exec(ctx context.Context, req *taskAPI.ExecProcessRequest) (*ptypes.Empty, error) {
+	return &ptypes.Empty{}, nil
+}
+
+func (a *fakeAgent) ResizePty(ctx context.Context, req *taskAPI.ResizePtyRequest) (*ptypes.Empty, error) {
+	a.resizes = append(a.resizes, fmt.Sprintf("%s/%s:%dx%d", req.ID, req.ExecID, req.Width, req.Height))
+	return &ptypes.Empty{}, nil
+}
+
+func (a *fakeAgent) CloseIO(ctx context.Context, req *taskAPI.CloseIORequest) (*ptypes.Empty, error) {
+	return &ptypes.Empty{}, nil
+}
+
+func (a *fakeAgent) Wait(ctx context.Context, req *taskAPI.WaitRequest) (*taskAPI.WaitResponse, error) {
+	return &taskAPI.WaitResponse{}, nil
+}
+
+func TestPauseResumeIdempotent(t *testing.T) {
+	ctx := context.Background()
+	agent := &fakeAgent{status: task.StatusPaused}
+	s := &service{agentClient: agent}
+
+	_, err := s.Pause(ctx, &taskAPI.PauseRequest{ID: "1"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, agent.calls, "already paused task must not be paused again")
+
+	_, err = s.Resume(ctx, &taskAPI.ResumeRequest{ID: "1"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, agent.calls)
+
+	agent.status = task.StatusRunning
+	_, err = s.Resume(ctx, &taskAPI.ResumeRequest{ID: "1"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, agent.calls, "running task must not be resumed again")
+}
+
+func TestPauseUnsupported(t *testing.T) {
+	ctx := context.Background()
+	agent := &fakeAgent{status: task.StatusRunning}
+	s := &service{
+		agentClient:  agent,
+		capabilities: &proto.CapabilitiesResponse{Pause: false},
+	}
+
+	_, err := s.Pause(ctx, &taskAPI.PauseRequest{ID: "1"})
+	assert.True(t, errdefs.IsNotImplemented(errdefs.FromGRPC(err)))
+	assert.Equal(t, 0, agent.calls)
+
+	// Capabilities are unknown with older agents, the error is translated from the pause call
+	s.capabilities = nil
+	agent.pauseErr = errdefs.ToGRPC(errdefs.ErrNotImplemented)
+
+	_, err = s.Pause(ctx, &taskAPI.PauseRequest{ID: "1"})
+	assert.True(t, errdefs.IsNotImplemented(errdefs.FromGRPC(err)))
+	assert.Contains(t, err.Error(), "pause is not supported by the guest")
+	assert.Equal(t, 1, agent.calls)
+}
+
+func TestKillSignals(t *testing.T) {
+	ctx := context.Background()
+	agent := &fakeAgent{}
+	s := &service{agentClient: agent}
+
+	addContainer(t, &s.containers, "db", nil)
+	addContainer(t, &s.containers, "app", map[string]string{internal.DependsOnAnnotation: "db"})
+
+	// Signals that don't stop the container only reach the container (or the exec'd process) itself
+	_, err := s.Kill(ctx, &taskAPI.KillRequest{ID: "db", Signal: uint32(syscall.SIGHUP)})
+	require.NoError(t, err)
+	_, err = s.Kill(ctx, &taskAPI.KillRequest{ID: "db", ExecID: "shell", Signal: uint32(syscall.SIGKILL)})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db/:1", "db/shell:9"}, agent.kills)
+
+	// Dependents are stopped first
+	agent.kills = nil
+	_, err = s.Kill(ctx, &taskAPI.KillRequest{ID: "db", Signal: uint32(syscall.SIGTERM)})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app/:15", "db/:15"}, agent.kills)
+}
+
+func TestPackBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	spec := `{"process": {"args": ["sh"]}}`
+	require.NoError(t, ioutil.WriteFile(path, []byte(spec), 0600))
+
+	packed, err := packBundle(path, nil, false, nil, len(spec), nil)
+	require.NoError(t, err)
+
+	extraData := &proto.ExtraData{}
+	require.NoError(t, ptypes.UnmarshalAny(packed, extraData))
+	assert.Equal(t, spec, string(extraData.JsonSpec))
+	assert.False(t, extraData.ReadOnlyRootfs)
+
+	packed, err = packBundle(path, nil, true, nil, len(spec), nil)
+	require.NoError(t, err)
+	require.NoError(t, ptypes.UnmarshalAny(packed, extraData))
+	assert.True(t, extraData.ReadOnlyRootfs)
+
+	_, err = packBundle(path, nil, false, nil, len(spec)-1, nil)
+	assert.True(t, errdefs.IsInvalidArgument(err), "oversized spec must be rejected")
+
+	large := `{"process": {"env": ["` + strings.Repeat("A", defaultMaxBundleSize) + `"]}}`
+	require.NoError(t, ioutil.WriteFile(path, []byte(large), 0600))
+	_, err = packBundle(path, nil, false, nil, defaultMaxBundleSize, nil)
+	assert.True(t, errdefs.IsInvalidArgument(err))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"process": `), 0600))
+	_, err = packBundle(path, nil, false, nil, defaultMaxBundleSize, nil)
+	assert.True(t, errdefs.IsInvalidArgument(err), "malformed spec must be rejected")
+
+	// Valid JSON, but not a spec
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"process": {"args": "sh"}}`), 0600))
+	_, err = packBundle(path, nil, false, nil, defaultMaxBundleSize, nil)
+	require.True(t, errdefs.IsInvalidArgument(err))
+	assert.Contains(t, err.Error(), "args")
+	assert.Contains(t, err.Error(), path)
+
+	require.NoError(t, os.Remove(path))
+	_, err = packBundle(path, nil, false, nil, defaultMaxBundleSize, nil)
+	require.True(t, errdefs.IsNotFound(err), "missing spec must be reported")
+	assert.Contains(t, err.Error(), dir)
+}
+
+func TestUnpackTaskOptions(t *testing.T) {
+	runcOptions := &ptypes.Any{TypeUrl: "containerd.linux.runc.RuncOptions", Value: []byte{1, 2, 3}}
+
+	options, taskOptions, err := unpackTaskOptions(runcOptions)
+	require.NoError(t, err)
+	assert.Equal(t, runcOptions, options)
+	assert.Nil(t, taskOptions)
+	assert.EqualValues(t, 0, taskOptions.GetVcpuCount())
+
+	packed, err := ptypes.MarshalAny(&proto.ExtraData{VcpuCount: 4, RuncOptions: runcOptions})
+	require.NoError(t, err)
+
+	options, taskOptions, err = unpackTaskOptions(packed)
+	require.NoError(t, err)
+	assert.Equal(t, runcOptions, options)
+	assert.EqualValues(t, 4, taskOptions.GetVcpuCount())
+
+	// As marshaled by containerd client
+	packed, err = typeurl.MarshalAny(&proto.ExtraData{VcpuCount: 2})
+	require.NoError(t, err)
+
+	options, taskOptions, err = unpackTaskOptions(packed)
+	require.NoError(t, err)
+	assert.Nil(t, options)
+	assert.EqualValues(t, 2, taskOptions.GetVcpuCount())
+
+	packed, err = ptypes.MarshalAny(&proto.ExtraData{JsonSpec: []byte("{}")})
+	require.NoError(t, err)
+
+	_, _, err = unpackTaskOptions(packed)
+	assert.True(t, errdefs.IsInvalidArgument(err))
+}
+
+func TestNewCommandMaxProcs(t *testing.T) {
+	s := &service{config: &Config{ShimMaxProcs: 8}}
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+
+	cmd, err := s.newCommand(ctx, "containerd", "/run/containerd/containerd.sock")
+	require.NoError(t, err)
+	assert.Equal(t, "GOMAXPROCS=8", cmd.Env[len(cmd.Env)-1])
+	assert.NotContains(t, cmd.Env, "GOMEMLIMIT=0")
+
+	s.config.ShimMemoryLimit = 64 << 20
+	cmd, err = s.newCommand(ctx, "containerd", "/run/containerd/containerd.sock")
+	require.NoError(t, err)
+	assert.Contains(t, cmd.Env, "GOMEMLIMIT=67108864")
+}
+
+func TestCopyStdinEOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stdio")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stdin")
+	require.NoError(t, syscall.Mkfifo(path, 0700))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, err := fifo.OpenFifo(ctx, path, syscall.O_RDONLY|syscall.O_NONBLOCK, 0700)
+	require.NoError(t, err)
+
+	conn, agent := net.Pipe()
+	copied := make(chan error, 1)
+	go func() {
+		copied <- copyStdio(ctx, f, internal.NewStdioConn(conn, nil), true, nil, 4)
+	}()
+
+	client, err := os.OpenFile(path, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = client.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	// Closing stdin on the client side is passed to the agent as EOF
+	data, err := ioutil.ReadAll(agent)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	assert.NoError(t, <-copied)
+}
+
+func TestStartMachineBootTimeout(t *testing.T) {
+	// VMM setup hangs until released
+	release := make(chan struct{})
+	machine, err := firecracker.NewMachine(context.Background(), firecracker.Config{DisableValidation: true})
+	require.NoError(t, err)
+	machine.Handlers.FcInit = firecracker.HandlerList{}.Append(firecracker.Handler{
+		Name: "hang",
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			<-release
+			return errors.New("released")
+		},
+	})
+
+	s := &service{machine: machine}
+
+	bootCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = s.startMachine(bootCtx, context.Background())
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// VMM is stopped once the start call returns
+	close(release)
+	for i := 0; i < 100 && !s.isVMStopping(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, s.isVMStopping())
+}
+
+type panickingConn struct {
+	net.Conn
+	closed int32
+}
+
+func (c *panickingConn) Read(b []byte) (int, error) {
+	panic("injected read failure")
+}
+
+func (c *panickingConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.Conn.Close()
+}
+
+func TestProxyIOPanic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stdio")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stdout")
+	require.NoError(t, syscall.Mkfifo(path, 0700))
+
+	conn, _ := net.Pipe()
+	failing := &panickingConn{Conn: conn}
+
+	defer func(dial func(cid, port uint32, bufferSize int) (net.Conn, error)) { dialStdio = dial }(dialStdio)
+	dialStdio = func(cid, port uint32, bufferSize int) (net.Conn, error) { return failing, nil }
+
+	// The panic in the copy loop doesn't reach the test (and wouldn't crash the shim)
+	proxyIO(context.Background(), internal.StdioStream{Path: path, Port: 10001}, 3, 16, nil)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&failing.closed))
+}
+
+func TestRedialStdio(t *testing.T) {
+	conn, _ := net.Pipe()
+	attempts := 0
+
+	defer func(dial func(cid, port uint32, bufferSize int) (net.Conn, error)) { dialStdio = dial }(dialStdio)
+	dialStdio = func(cid, port uint32, bufferSize int) (net.Conn, error) {
+		attempts++
+		if attempts < 2 {
+			return nil, errors.New("connection refused")
+		}
+		return conn, nil
+	}
+
+	redialed, err := redialStdio(context.Background(), 3, 10001, 0)
+	require.NoError(t, err)
+	assert.Equal(t, conn, redialed)
+	assert.Equal(t, 2, attempts)
+
+	// Gives up once canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = redialStdio(ctx, 3, 10001, 0)
+	assert.Equal(t, context.Canceled, err)
+}
+
+type fakePublisher struct {
+	mu     sync.Mutex
+	topics []string
+	events []events.Event
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, topic string, event events.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.topics = append(p.topics, topic)
+	p.events = append(p.events, event)
+	return nil
+}
+
+func TestStartPublishesEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// Stops state monitoring right away
+	cancel()
+
+	publisher := &fakePublisher{}
+	s := &service{ctx: ctx, agentClient: &fakeAgent{}, publish: publisher}
+
+	_, err := s.Start(context.Background(), &taskAPI.StartRequest{ID: "1"})
+	require.NoError(t, err)
+	_, err = s.Start(context.Background(), &taskAPI.StartRequest{ID: "1", ExecID: "shell"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{runtime.TaskStartEventTopic, runtime.TaskExecStartedEventTopic}, publisher.topics)
+}
+
+func TestExecPublishesEvents(t *testing.T) {
+	publisher := &fakePublisher{}
+	s := &service{agentClient: &fakeAgent{}, publish: publisher}
+
+	_, err := s.Exec(context.Background(), &taskAPI.ExecProcessRequest{ID: "1", ExecID: "shell"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{runtime.TaskExecAddedEventTopic}, publisher.topics)
+}
+
+func TestExitEvent(t *testing.T) {
+	event := exitEvent("app", "", 42, 1)
+	assert.Equal(t, "app", event.ContainerID)
+	assert.Equal(t, "app", event.ID)
+	assert.EqualValues(t, 42, event.Pid)
+	assert.EqualValues(t, 1, event.ExitStatus)
+
+	event = exitEvent("app", "shell", 43, 0)
+	assert.Equal(t, "app", event.ContainerID)
+	assert.Equal(t, "shell", event.ID)
+}
+
+func TestMonitorStateExecExit(t *testing.T) {
+	publisher := &fakePublisher{}
+	s := &service{id: "1", agentClient: &fakeAgent{status: task.StatusStopped}, publish: publisher}
+	addContainer(t, &s.containers, "1", nil)
+
+	// Exit of an exec'd process is reported, but neither exits the container nor tears the VM down
+	s.monitorState(context.Background(), "1", "shell", 43)
+	assert.Equal(t, []string{runtime.TaskExitEventTopic}, publisher.topics)
+	assert.Equal(t, 1, s.containers.running())
+}
+
+// exitingGuest reports the process exit on the given call of WaitExit
+type exitingGuest struct {
+	proto.AgentService
+
+	exitOn int
+	calls  int
+}
+
+func (g *exitingGuest) WaitExit(ctx context.Context, req *proto.WaitExitRequest) (*proto.WaitExitResponse, error) {
+	g.calls++
+	if g.calls < g.exitOn {
+		return &proto.WaitExitResponse{}, nil
+	}
+
+	return &proto.WaitExitResponse{Exited: true, ExitStatus: 3}, nil
+}
+
+func TestMonitorStateExitNotifications(t *testing.T) {
+	publisher := &fakePublisher{}
+	guest := &exitingGuest{exitOn: 2}
+	s := &service{
+		id:           "1",
+		agentClient:  &fakeAgent{status: task.StatusRunning},
+		guest:        guest,
+		capabilities: &proto.CapabilitiesResponse{ExitNotifications: true},
+		publish:      publisher,
+	}
+
+	s.monitorState(context.Background(), "1", "shell", 43)
+	assert.Equal(t, 2, guest.calls)
+	assert.Equal(t, []string{runtime.TaskExitEventTopic}, publisher.topics)
+
+	// A process deleted before it exited is not reported
+	publisher.topics = nil
+	guest = &exitingGuest{exitOn: 2}
+	s.guest = guest
+	s.agentClient = &fakeAgent{stateErr: errdefs.ToGRPC(errdefs.ErrNotFound)}
+
+	s.monitorState(context.Background(), "1", "shell", 43)
+	assert.Equal(t, 1, guest.calls)
+	assert.Empty(t, publisher.topics)
+}
+
+type panickingAgent struct {
+	fakeAgent
+}
+
+func (a *panickingAgent) State(ctx context.Context, req *taskAPI.StateRequest) (*taskAPI.StateResponse, error) {
+	panic("injected state failure")
+}
+
+func TestMonitorStatePanic(t *testing.T) {
+	agent := &panickingAgent{}
+	publisher := &fakePublisher{}
+	s := &service{id: "1", agentClient: agent, publish: publisher}
+
+	// The task is killed and its exit reported, as it can't be monitored anymore
+	s.monitorState(context.Background(), "1", "", 42)
+	assert.Equal(t, []string{"1/:9"}, agent.kills)
+	assert.Equal(t, []string{runtime.TaskExitEventTopic}, publisher.topics)
+}
@@ -0,0 +1,362 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/containerd/ttrpc"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// vmStateFileName is the file in the bundle directory holding the state of the running VM
+const vmStateFileName = "vm-state.json"
+
+// vmState is what a restarted shim needs to reattach to the VM started by its predecessor
+type vmState struct {
+	CID        uint32 `json:"cid"`
+	SocketPath string `json:"socket_path"`
+	VMMPid     int    `json:"vmm_pid"`
+	TapName    string `json:"tap_name,omitempty"`
+	// Chroot of a jailed VMM, which doesn't have its API socket on its command line
+	JailRoot string `json:"jail_root,omitempty"`
+
+	AgentMaxInFlight int `json:"agent_max_inflight,omitempty"`
+
+	// Drives attached to the VM, so operators can see the effective drive layout
+	Drives []driveInfo `json:"drives,omitempty"`
+
+	// Tasks created in the VM, which a restarted shim takes care of again
+	Tasks []vmTask `json:"tasks,omitempty"`
+}
+
+// vmTask is what a restarted shim needs to monitor a task and proxy its stdio again
+type vmTask struct {
+	ID       string `json:"id"`
+	Bundle   string `json:"bundle"`
+	Stdin    string `json:"stdin,omitempty"`
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	Terminal bool   `json:"terminal,omitempty"`
+}
+
+// saveVMState writes the state to the bundle directory, replacing the previous one atomically
+func saveVMState(bundle string, state *vmState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(bundle, vmStateFileName)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write VM state")
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return errors.Wrap(err, "failed to write VM state")
+	}
+
+	return nil
+}
+
+// loadVMState reads the state from the bundle directory, returns nil if there is none
+func loadVMState(bundle string) (*vmState, error) {
+	data, err := ioutil.ReadFile(filepath.Join(bundle, vmStateFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state vmState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrap(err, "invalid VM state")
+	}
+
+	return &state, nil
+}
+
+// removeVMState removes the state from the bundle directory, it's a no-op if there is none
+func removeVMState(bundle string) error {
+	if err := os.Remove(filepath.Join(bundle, vmStateFileName)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove VM state")
+	}
+
+	return nil
+}
+
+// isVMMRunning returns true if the process described by the state still serves the VM's API socket,
+// so a pid reused by another process isn't mistaken for the VMM.
+func (state *vmState) isVMMRunning() (bool, error) {
+	var (
+		pids []int
+		err  error
+	)
+
+	if state.JailRoot != "" {
+		pids, err = findJailedProcesses(state.JailRoot)
+	} else {
+		pids, err = findVMMProcesses(state.SocketPath)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, pid := range pids {
+		if pid == state.VMMPid && isProcessRunning(pid) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// recoverVM reattaches to the VM left running by a previous shim serving the same task, if any.
+// VMs that are gone are left to Cleanup.
+func (s *service) recoverVM(ctx context.Context, bundle string) error {
+	state, err := loadVMState(bundle)
+	if err != nil || state == nil {
+		return err
+	}
+
+	running, err := state.isVMMRunning()
+	if err != nil {
+		return err
+	}
+
+	if !running {
+		log.G(ctx).WithField("pid", state.VMMPid).Warn("VM of the previous shim is gone, not reattaching")
+		return nil
+	}
+
+	log.G(ctx).WithFields(map[string]interface{}{"cid": state.CID, "pid": state.VMMPid}).Info("reattaching to running VM")
+
+	var network *vmNetwork
+	if state.TapName != "" && s.config.CNINetworkName != "" {
+		if network, err = s.newVMNetwork(newCNI(s.config), state.TapName); err != nil {
+			return err
+		}
+	}
+
+	if err := s.attachVM(ctx, state); err != nil {
+		return err
+	}
+
+	if err := s.reattachTasks(ctx, state.Tasks); err != nil {
+		return err
+	}
+
+	s.network = network
+	s.bundle = bundle
+	s.drives = state.Drives
+	s.agentStarted = true
+
+	return nil
+}
+
+// attachVM connects to the agent of a VM whose VMM isn't a child of this shim (left by a previous shim or
+// taken from the warm pool) and takes care of the VM from now on, like a VM started by this shim
+func (s *service) attachVM(ctx context.Context, state *vmState) error {
+	// The record of the CID still names the process that started the VM, which is gone (or about to go),
+	// so the CID has to be registered to this shim to keep counting as taken
+	if err := registerVMCID(ctx, state.CID, s.namespace, s.id); err != nil {
+		return err
+	}
+
+	conn, err := dialVsock(ctx, state.CID, s.config.agentPort())
+	if err != nil {
+		return errors.Wrap(err, "failed to reconnect to agent")
+	}
+
+	rpcClient := ttrpc.NewClient(conn)
+	rpcClient.OnClose(func() { conn.Close() })
+
+	s.machineCID = state.CID
+	s.vmmPid = state.VMMPid
+	s.agentClient = s.newAgentTaskClient(rpcClient, state.AgentMaxInFlight)
+
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(namespaces.WithNamespace(log.WithLogger(context.Background(), log.G(ctx)), s.namespace))
+	}
+
+	// The VMM isn't a child of this shim, so its exit can only be polled for (and its exit status is unknown)
+	s.vmmExited = make(chan struct{})
+	exitLogger := log.G(ctx)
+	go func() {
+		<-waitProcesses([]int{state.VMMPid})
+		close(s.vmmExited)
+
+		if !s.isVMStopping() {
+			ctx := log.WithLogger(context.Background(), exitLogger)
+			exitErr := errors.Errorf("firecracker (pid %d) exited, its exit status isn't known to a reattached shim", state.VMMPid)
+			log.G(ctx).WithError(exitErr).Error("firecracker exited unexpectedly")
+			s.audit.record(ctx, auditEventVMMExit, "", "", map[string]string{"error": exitErr.Error()})
+			s.handleVMMExit(ctx, exitErr)
+		}
+	}()
+
+	s.guest = proto.NewAgentClient(rpcClient)
+	if caps, err := s.guest.Capabilities(ctx, &proto.CapabilitiesRequest{}); err == nil {
+		s.capabilities = caps
+		if caps.OOMNotifications {
+			go s.monitorOOM(s.ctx)
+		}
+	}
+
+	if s.config.LivenessProbe != nil {
+		go s.monitorLiveness(s.ctx)
+	}
+
+	if s.config.DNSVsockPort != 0 {
+		go s.proxyDNS(log.WithLogger(context.Background(), log.G(ctx)), state.CID)
+	}
+
+	exitHooks.register(func() {
+		if err := s.teardownVM(log.WithLogger(context.Background(), exitLogger)); err != nil {
+			exitLogger.WithError(err).Error("failed to stop VM on shim exit")
+		}
+	})
+
+	return nil
+}
+
+// reattachTasks takes care of the tasks of a reattached VM again: they are registered as containers, their stdio
+// is proxied and their init processes are monitored. Nothing is registered unless all tasks are found in a consistent
+// state, tasks deleted in the meantime are forgotten. Processes exec'd in the tasks aren't saved, so they aren't
+// monitored by the reattached shim.
+func (s *service) reattachTasks(ctx context.Context, tasks []vmTask) error {
+	type reattachedTask struct {
+		vmTask
+		container *containerInfo
+		state     *taskAPI.StateResponse
+	}
+
+	var reattached []reattachedTask
+	for _, t := range tasks {
+		state, err := s.agentClient.State(ctx, &taskAPI.StateRequest{ID: t.ID})
+		if errdefs.IsNotFound(errdefs.FromGRPC(err)) {
+			log.G(ctx).WithField("id", t.ID).Info("task was deleted before the shim restarted, forgetting it")
+			s.forgetTask(ctx, t.ID)
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to get state of task %q", t.ID)
+		}
+
+		annotations, err := readAnnotations(filepath.Join(t.Bundle, "config.json"))
+		if err != nil {
+			return errors.Wrapf(err, "failed to read annotations of task %q", t.ID)
+		}
+
+		container, err := newContainerInfo(t.ID, annotations)
+		if err != nil {
+			return errors.Wrapf(err, "invalid annotations of task %q", t.ID)
+		}
+
+		reattached = append(reattached, reattachedTask{vmTask: t, container: container, state: state})
+	}
+
+	for _, t := range reattached {
+		log.G(ctx).WithFields(map[string]interface{}{"id": t.ID, "status": t.state.Status}).Info("reattaching to task")
+		s.containers.add(t.container)
+
+		if t.state.Status != task.StatusStopped {
+			s.proxyStdio(s.ctx, t.ID, t.Stdin, t.Stdout, t.Stderr, t.Terminal, s.machineCID)
+		}
+
+		// A created task gets monitored once it's started, a stopped one gets its exit reported by its monitor
+		if t.state.Status == task.StatusCreated {
+			continue
+		}
+
+		if monitorCtx, release, ok := s.monitors.start(s.ctx, t.ID, "", t.state.Pid); ok {
+			go func(id string, pid uint32) {
+				defer release()
+				s.monitorState(monitorCtx, id, "", pid)
+			}(t.ID, t.state.Pid)
+		}
+	}
+
+	return nil
+}
+
+// updateVMState changes the saved VM state, it's a no-op if there is none
+func (s *service) updateVMState(fn func(state *vmState)) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	state, err := loadVMState(s.bundle)
+	if err != nil || state == nil {
+		return err
+	}
+
+	fn(state)
+	return saveVMState(s.bundle, state)
+}
+
+// saveTask adds a created task to the saved VM state, so a restarted shim takes care of it again
+func (s *service) saveTask(ctx context.Context, request *taskAPI.CreateTaskRequest) {
+	t := vmTask{
+		ID:       request.ID,
+		Bundle:   request.Bundle,
+		Stdin:    request.Stdin,
+		Stdout:   request.Stdout,
+		Stderr:   request.Stderr,
+		Terminal: request.Terminal,
+	}
+
+	// The task works without it, it just isn't taken care of by a restarted shim
+	if err := s.updateVMState(func(state *vmState) { state.Tasks = append(state.Tasks, t) }); err != nil {
+		log.G(ctx).WithError(err).WithField("id", request.ID).Warn("failed to save task in VM state")
+	}
+}
+
+// forgetTask removes a deleted task from the saved VM state
+func (s *service) forgetTask(ctx context.Context, id string) {
+	err := s.updateVMState(func(state *vmState) {
+		tasks := state.Tasks[:0]
+		for _, t := range state.Tasks {
+			if t.ID != id {
+				tasks = append(tasks, t)
+			}
+		}
+		state.Tasks = tasks
+	})
+
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("id", id).Warn("failed to remove task from VM state")
+	}
+}
+
+// stopReattachedVMM stops a VMM started by a previous shim
+func stopReattachedVMM(pid int) error {
+	if err := unix.Kill(pid, unix.SIGTERM); err != nil && err != unix.ESRCH {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/containerd/errdefs"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVMState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	state, err := loadVMState(dir)
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	expected := &vmState{CID: 42, SocketPath: filepath.Join(dir, "firecracker.sock"), VMMPid: 100, TapName: "fctap42"}
+	require.NoError(t, saveVMState(dir, expected))
+
+	state, err = loadVMState(dir)
+	require.NoError(t, err)
+	assert.Equal(t, expected, state)
+
+	require.NoError(t, removeVMState(dir))
+	require.NoError(t, removeVMState(dir))
+
+	state, err = loadVMState(dir)
+	require.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestRecoverVM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prevProcDir := procDir
+	procDir = filepath.Join(dir, "proc")
+	defer func() { procDir = prevProcDir }()
+
+	require.NoError(t, os.MkdirAll(procDir, 0700))
+
+	s := &service{config: &Config{}}
+
+	// Nothing to reattach to
+	require.NoError(t, s.recoverVM(context.Background(), dir))
+	assert.False(t, s.agentStarted)
+
+	// The pid is reused by another process, so the VM is gone
+	state := &vmState{CID: 42, SocketPath: filepath.Join(dir, "firecracker.sock"), VMMPid: 100}
+	require.NoError(t, saveVMState(dir, state))
+	fakeProcess(t, procDir, 100, dir, "S", "sleep", "10")
+
+	running, err := state.isVMMRunning()
+	require.NoError(t, err)
+	assert.False(t, running)
+
+	require.NoError(t, s.recoverVM(context.Background(), dir))
+	assert.False(t, s.agentStarted)
+
+	fakeProcess(t, procDir, 101, dir, "S", "firecracker", "--api-sock", "./firecracker.sock")
+	state.VMMPid = 101
+
+	running, err = state.isVMMRunning()
+	require.NoError(t, err)
+	assert.True(t, running)
+}
+
+func TestRecoverVMRegistersCID(t *testing.T) {
+	restore := mockCIDAllocation(t)
+	defer restore()
+
+	dir, err := ioutil.TempDir("", "bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prevProcDir := procDir
+	procDir = filepath.Join(dir, "proc")
+	defer func() { procDir = prevProcDir }()
+
+	require.NoError(t, os.MkdirAll(procDir, 0700))
+	fakeProcess(t, procDir, 101, dir, "S", "firecracker", "--api-sock", "./firecracker.sock")
+	require.NoError(t, saveVMState(dir, &vmState{CID: 42, SocketPath: filepath.Join(dir, "firecracker.sock"), VMMPid: 101}))
+
+	// The record still names the previous shim, which is gone
+	require.NoError(t, os.MkdirAll(cidRegistryDir, 0700))
+	require.NoError(t, ioutil.WriteFile(cidRecordPath(42), []byte(`{"cid":42,"namespace":"default","id":"vm","pid":-1}`), 0600))
+	assert.False(t, isCIDRegistered(42))
+
+	// The agent can't be reached here, the CID is taken by the running VM either way
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	s := &service{config: &Config{}, namespace: "default", id: "vm"}
+	assert.Error(t, s.recoverVM(ctx, dir))
+
+	assert.True(t, isCIDRegistered(42))
+	records, err := registeredCIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []cidRecord{{CID: 42, Namespace: "default", ID: "vm", Pid: os.Getpid(), MemSizeMib: vmMemSizeMib}}, records)
+}
+
+// taskStatesAgent reports the given states of tasks, other tasks aren't found
+type taskStatesAgent struct {
+	taskAPI.TaskService
+
+	states map[string]task.Status
+}
+
+func (a *taskStatesAgent) State(ctx context.Context, req *taskAPI.StateRequest) (*taskAPI.StateResponse, error) {
+	status, ok := a.states[req.ID]
+	if !ok {
+		return nil, errdefs.ToGRPC(errdefs.ErrNotFound)
+	}
+
+	return &taskAPI.StateResponse{ID: req.ID, Pid: 42, Status: status}, nil
+}
+
+func TestReattachTasks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, id := range []string{"running", "created"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, id), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, id, "config.json"), []byte(`{"annotations": {}}`), 0600))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &service{
+		bundle:      dir,
+		config:      &Config{},
+		ctx:         ctx,
+		agentClient: &taskStatesAgent{states: map[string]task.Status{"running": task.StatusRunning, "created": task.StatusCreated}},
+	}
+
+	require.NoError(t, saveVMState(dir, &vmState{CID: 42}))
+	for _, id := range []string{"running", "deleted", "created"} {
+		s.saveTask(ctx, &taskAPI.CreateTaskRequest{ID: id, Bundle: filepath.Join(dir, id)})
+	}
+
+	state, err := loadVMState(dir)
+	require.NoError(t, err)
+	require.Len(t, state.Tasks, 3)
+
+	// Tasks still in the VM are taken care of again, deleted ones are forgotten
+	require.NoError(t, s.reattachTasks(ctx, state.Tasks))
+	assert.Equal(t, 2, s.containers.running())
+
+	_, _, monitored := s.monitors.start(ctx, "running", "", 42)
+	assert.False(t, monitored, "running task isn't monitored")
+
+	_, release, monitored := s.monitors.start(ctx, "created", "", 42)
+	assert.True(t, monitored, "created task is monitored before it's started")
+	release()
+
+	state, err = loadVMState(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []vmTask{{ID: "running", Bundle: filepath.Join(dir, "running")}, {ID: "created", Bundle: filepath.Join(dir, "created")}}, state.Tasks)
+
+	// Nothing is registered if any task can't be reattached
+	s = &service{
+		bundle:      dir,
+		config:      &Config{},
+		ctx:         ctx,
+		agentClient: &taskStatesAgent{states: map[string]task.Status{"running": task.StatusRunning, "broken": task.StatusRunning}},
+	}
+
+	err = s.reattachTasks(ctx, append(state.Tasks, vmTask{ID: "broken", Bundle: filepath.Join(dir, "broken")}))
+	assert.Error(t, err)
+	assert.Equal(t, 0, s.containers.running())
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/cgroups"
+	"github.com/containerd/typeurl"
+	gogoproto "github.com/gogo/protobuf/proto"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// Unit of CPU times in /proc/<pid>/stat (USER_HZ), which the kernel fixes at 100 for userspace
+const userHZ = 100
+
+// vmmStats reads resource usage of the VMM process
+func vmmStats(pid int) (*proto.VMMStats, error) {
+	dir := filepath.Join(procDir, strconv.Itoa(pid))
+	rss, err := processRSS(filepath.Join(dir, "status"))
+	if err != nil {
+		return nil, err
+	}
+
+	cpuTime, err := processCPUTime(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	threads, err := vcpuThreads(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	var vcpuTime uint64
+	for _, tid := range threads {
+		// Threads don't go away while the VM is running
+		threadTime, err := processCPUTime(filepath.Join(dir, "task", strconv.Itoa(tid), "stat"))
+		if err != nil {
+			return nil, err
+		}
+
+		vcpuTime += threadTime
+	}
+
+	return &proto.VMMStats{Pid: uint32(pid), RSSBytes: rss, CPUTimeNs: cpuTime, VcpuTimeNs: vcpuTime}, nil
+}
+
+// processRSS reads resident memory of a process from its status file
+func processRSS(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// VmRSS:	  123456 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "VmRSS:" {
+			continue
+		}
+
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid VmRSS in %s", path)
+		}
+
+		return kb * 1024, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, errors.Errorf("no VmRSS in %s", path)
+}
+
+// processCPUTime reads user and system CPU time of a process (or a thread) from its stat file, in nanoseconds
+func processCPUTime(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	// Thread names might contain spaces and parentheses, the fields of interest follow the last ")"
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return 0, errors.Errorf("invalid %s", path)
+	}
+
+	// Fields after the name start with the 3rd one (state), utime and stime are the 14th and 15th
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 13 {
+		return 0, errors.Errorf("invalid %s", path)
+	}
+
+	var ticks uint64
+	for _, field := range fields[11:13] {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid CPU time in %s", path)
+		}
+
+		ticks += value
+	}
+
+	return ticks * (1e9 / userHZ), nil
+}
+
+// mergeVMMStats adds VMM stats to cgroup metrics of a container reported by the agent. The result keeps the type
+// of cgroup metrics, proto.ContainerStats extends it with the VMM stats.
+func mergeVMMStats(stats *ptypes.Any, vmm *proto.VMMStats) (*ptypes.Any, error) {
+	if stats == nil || !typeurl.Is(stats, &cgroups.Metrics{}) {
+		return nil, errors.New("agent didn't report cgroup metrics")
+	}
+
+	var merged proto.ContainerStats
+	if err := gogoproto.Unmarshal(stats.Value, &merged); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal cgroup metrics")
+	}
+
+	merged.VMM = vmm
+	data, err := gogoproto.Marshal(&merged)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ptypes.Any{TypeUrl: stats.TypeUrl, Value: data}, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/cgroups"
+	"github.com/containerd/typeurl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+func TestVMMStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	prevProcDir := procDir
+	procDir = dir
+	defer func() { procDir = prevProcDir }()
+
+	// utime and stime are the 14th and 15th fields
+	stat := func(name string, utime, stime string) string {
+		return "100 (" + name + ") S 1 100 100 0 -1 4194560 1 0 0 0 " + utime + " " + stime + " 0 0 20 0 3 0\n"
+	}
+
+	files := map[string]string{
+		"100/status":        "Name:\tfirecracker\nVmRSS:\t    2048 kB\nThreads:\t3\n",
+		"100/stat":          stat("firecracker", "150", "50"),
+		"100/task/100/comm": "firecracker\n",
+		"100/task/100/stat": stat("firecracker", "10", "5"),
+		"100/task/101/comm": "fc_vcpu 0\n",
+		"100/task/101/stat": stat("fc_vcpu 0", "100", "20"),
+		"100/task/102/comm": "fc_vcpu 1\n",
+		"100/task/102/stat": stat("fc_vcpu 1", "40", "25"),
+		"200/status":        "Name:\tsh\n",
+		"200/stat":          stat("sh) (x", "1", "1"),
+		"300/status":        "Name:\tsh\nVmRSS:\t    4 kB\n",
+		"300/stat":          "300 (sh",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+
+	stats, err := vmmStats(100)
+	require.NoError(t, err)
+	assert.Equal(t, &proto.VMMStats{Pid: 100, RSSBytes: 2 << 20, CPUTimeNs: 2e9, VcpuTimeNs: 1.85e9}, stats)
+
+	// Names with parentheses don't confuse the parser
+	cpuTime, err := processCPUTime(filepath.Join(dir, "200", "stat"))
+	require.NoError(t, err)
+	assert.EqualValues(t, 2e7, cpuTime)
+
+	_, err = vmmStats(200)
+	assert.Error(t, err, "missing VmRSS")
+
+	_, err = vmmStats(300)
+	assert.Error(t, err, "truncated stat")
+}
+
+func TestMergeVMMStats(t *testing.T) {
+	metrics := &cgroups.Metrics{
+		Pids:   &cgroups.PidsStat{Current: 3, Limit: 100},
+		Memory: &cgroups.MemoryStat{Usage: &cgroups.MemoryEntry{Usage: 4096}},
+	}
+
+	packed, err := typeurl.MarshalAny(metrics)
+	require.NoError(t, err)
+
+	vmm := &proto.VMMStats{Pid: 100, RSSBytes: 1 << 20, VcpuTimeNs: 1000}
+	merged, err := mergeVMMStats(packed, vmm)
+	require.NoError(t, err)
+
+	// Clients unaware of VMM stats, like ctr, still get the cgroup metrics
+	unpacked, err := typeurl.UnmarshalAny(merged)
+	require.NoError(t, err)
+	require.IsType(t, &cgroups.Metrics{}, unpacked)
+	assert.Equal(t, metrics.Pids, unpacked.(*cgroups.Metrics).Pids)
+	assert.Equal(t, metrics.Memory.Usage, unpacked.(*cgroups.Metrics).Memory.Usage)
+
+	var stats proto.ContainerStats
+	require.NoError(t, stats.XXX_Unmarshal(merged.Value))
+	assert.Equal(t, metrics.Pids, stats.Pids)
+	assert.Equal(t, vmm.RSSBytes, stats.VMM.RSSBytes)
+	assert.Equal(t, vmm.VcpuTimeNs, stats.VMM.VcpuTimeNs)
+
+	_, err = mergeVMMStats(nil, vmm)
+	assert.Error(t, err)
+
+	packed, err = typeurl.MarshalAny(vmm)
+	require.NoError(t, err)
+	_, err = mergeVMMStats(packed, vmm)
+	assert.Error(t, err)
+}
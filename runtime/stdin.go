@@ -0,0 +1,140 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// stdinReader reads stdin of a process in a goroutine of its own, so the stream can be ended on CloseIO while
+// the client still has the FIFO open for writing. A read blocked on the FIFO can't be interrupted, but the
+// stream doesn't have to wait for it: once closed, reads return EOF as soon as input read before is consumed.
+type stdinReader struct {
+	chunks chan []byte
+	// Set before chunks is closed
+	err     error
+	closed  <-chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	pending []byte
+}
+
+func newStdinReader(src io.Reader, closed <-chan struct{}, bufferSize int) *stdinReader {
+	r := &stdinReader{
+		chunks: make(chan []byte),
+		closed: closed,
+		done:   make(chan struct{}),
+	}
+
+	go r.pump(src, bufferSize)
+	return r
+}
+
+func (r *stdinReader) pump(src io.Reader, bufferSize int) {
+	defer close(r.chunks)
+
+	for {
+		buf := make([]byte, bufferSize)
+		n, err := src.Read(buf)
+		if n > 0 {
+			select {
+			case r.chunks <- buf[:n]:
+			case <-r.done:
+				return
+			}
+		}
+
+		if err != nil {
+			r.err = err
+			return
+		}
+	}
+}
+
+func (r *stdinReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		var ok bool
+		select {
+		case r.pending, ok = <-r.chunks:
+		case <-r.closed:
+			select {
+			case r.pending, ok = <-r.chunks:
+			default:
+				return 0, io.EOF
+			}
+		}
+
+		if !ok {
+			return 0, r.err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Close stops the reading goroutine, once its read of the FIFO returns
+func (r *stdinReader) Close() error {
+	r.once.Do(func() { close(r.done) })
+	return nil
+}
+
+// stdinClosers keeps channels ending the stdin streams of processes, which are closed on CloseIO
+type stdinClosers struct {
+	mu      sync.Mutex
+	closers map[processKey]chan struct{}
+}
+
+// add registers the stdin stream of a process, returning the channel closed when the stream should end
+func (c *stdinClosers) add(id, execID string) <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closers == nil {
+		c.closers = make(map[processKey]chan struct{})
+	}
+
+	closed := make(chan struct{})
+	c.closers[processKey{id: id, execID: execID}] = closed
+	return closed
+}
+
+// close ends the stdin stream of the process, returns false if the process has no stdin stream
+func (c *stdinClosers) close(id, execID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := processKey{id: id, execID: execID}
+	closed, ok := c.closers[key]
+	if ok {
+		close(closed)
+		delete(c.closers, key)
+	}
+
+	return ok
+}
+
+// remove forgets stdin streams of the container's processes
+func (c *stdinClosers) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.closers {
+		if key.id == id {
+			delete(c.closers, key)
+		}
+	}
+}
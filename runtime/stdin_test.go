@@ -0,0 +1,140 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/containerd/fifo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+func TestStdinReader(t *testing.T) {
+	src, client := io.Pipe()
+	defer client.Close()
+
+	closed := make(chan struct{})
+	reader := newStdinReader(src, closed, 4)
+	defer reader.Close()
+
+	go client.Write([]byte("hello"))
+
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// The client keeps stdin open, but the stream ends once it's closed
+	close(closed)
+	n, err := reader.Read(buf)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+
+	// EOF from the source ends the stream as well
+	src, client = io.Pipe()
+	reader = newStdinReader(src, make(chan struct{}), 4)
+	defer reader.Close()
+
+	go func() {
+		client.Write([]byte("bye"))
+		client.Close()
+	}()
+
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(data))
+}
+
+func TestCopyStdinCloseIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stdio")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stdin")
+	require.NoError(t, syscall.Mkfifo(path, 0700))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, err := fifo.OpenFifo(ctx, path, syscall.O_RDONLY|syscall.O_NONBLOCK, 0700)
+	require.NoError(t, err)
+
+	conn, agent := net.Pipe()
+	closed := make(chan struct{})
+	copied := make(chan error, 1)
+	go func() {
+		copied <- copyStdio(ctx, f, internal.NewStdioConn(conn, nil), true, closed, 4)
+	}()
+
+	// The client doesn't close its end of the FIFO
+	client, err := os.OpenFile(path, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("hello world"))
+	require.NoError(t, err)
+
+	buf := make([]byte, len("hello world"))
+	_, err = io.ReadFull(agent, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(buf))
+
+	// CloseIO is passed to the agent as EOF regardless
+	close(closed)
+	data, err := ioutil.ReadAll(agent)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+	assert.NoError(t, <-copied)
+}
+
+func TestCloseIOPerProcess(t *testing.T) {
+	s := &service{agentClient: &fakeAgent{}}
+	closed := s.stdins.add("1", "")
+
+	// Closing stdin of an exec'd process leaves the container's stdin alone
+	_, err := s.CloseIO(context.Background(), &taskAPI.CloseIORequest{ID: "1", ExecID: "shell", Stdin: true})
+	require.NoError(t, err)
+	_, err = s.CloseIO(context.Background(), &taskAPI.CloseIORequest{ID: "2", Stdin: true})
+	require.NoError(t, err)
+
+	select {
+	case <-closed:
+		t.Fatal("stdin of the container was closed")
+	default:
+	}
+
+	_, err = s.CloseIO(context.Background(), &taskAPI.CloseIORequest{ID: "1", Stdin: true})
+	require.NoError(t, err)
+
+	select {
+	case <-closed:
+	default:
+		t.Fatal("stdin of the container wasn't closed")
+	}
+
+	// Closing it again is a no-op
+	_, err = s.CloseIO(context.Background(), &taskAPI.CloseIORequest{ID: "1", Stdin: true})
+	require.NoError(t, err)
+}
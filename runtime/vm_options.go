@@ -0,0 +1,222 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+// vmOptions are VM settings taken from the runtime config, which can be overridden by annotations of
+// the container the VM is started for
+type vmOptions struct {
+	prefaultMemory   bool
+	initMode         string
+	rootDrive        string
+	agentMaxInFlight int
+	vcpuCount        int
+	readOnlyRootfs   bool
+	volumes          []VolumeConfig
+
+	driveRateLimiter     *RateLimiterConfig
+	networkRxRateLimiter *RateLimiterConfig
+	networkTxRateLimiter *RateLimiterConfig
+
+	metadata map[string]interface{}
+
+	// Host CPUs vCPUs are pinned to, not pinned if empty
+	vcpuAffinity []int
+
+	// Kernel args requested by the task, merged with the configured ones
+	extraKernelArgs string
+
+	// Log level of the Firecracker process
+	logLevel string
+}
+
+func (s *service) vmOptions(annotations map[string]string) (vmOptions, error) {
+	opts := vmOptions{
+		prefaultMemory:   s.config.PrefaultMemory,
+		initMode:         s.config.InitMode,
+		rootDrive:        defaultRootDrive(s.config),
+		agentMaxInFlight: s.config.AgentMaxInFlight,
+		vcpuCount:        s.config.CPUCount,
+		volumes:          s.config.Volumes,
+
+		driveRateLimiter:     s.config.DriveRateLimiter,
+		networkRxRateLimiter: s.config.NetworkRxRateLimiter,
+		networkTxRateLimiter: s.config.NetworkTxRateLimiter,
+
+		metadata: s.config.Metadata,
+		logLevel: s.config.LogLevel,
+	}
+
+	if s.config.VcpuAffinity != "" {
+		cpus, err := parseCPUList(s.config.VcpuAffinity)
+		if err != nil {
+			return opts, errors.Wrap(err, "invalid vcpu_affinity")
+		}
+
+		opts.vcpuAffinity = cpus
+	}
+
+	if value, ok := annotations[internal.PrefaultMemoryAnnotation]; ok {
+		prefault, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, errors.Wrapf(err, "invalid %s annotation", internal.PrefaultMemoryAnnotation)
+		}
+
+		opts.prefaultMemory = prefault
+	}
+
+	if value, ok := annotations[internal.InitModeAnnotation]; ok {
+		if err := checkInitMode(value, s.config.KernelArgs); err != nil {
+			return opts, errors.Wrapf(err, "invalid %s annotation", internal.InitModeAnnotation)
+		}
+
+		opts.initMode = value
+	}
+
+	if value, ok := annotations[internal.RootDriveAnnotation]; ok {
+		if !isConfiguredDrive(s.config, value) {
+			return opts, errors.Errorf("invalid %s annotation, drive %q isn't configured", internal.RootDriveAnnotation, value)
+		}
+
+		opts.rootDrive = value
+	}
+
+	if value, ok := annotations[internal.AgentMaxInFlightAnnotation]; ok {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return opts, errors.Errorf("invalid %s annotation, should be a non-negative number", internal.AgentMaxInFlightAnnotation)
+		}
+
+		opts.agentMaxInFlight = limit
+	}
+
+	if value, ok := annotations[internal.VolumesAnnotation]; ok {
+		volumes, err := parseTaskVolumes(value, s.config)
+		if err != nil {
+			return opts, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s annotation: %v", internal.VolumesAnnotation, err)
+		}
+
+		opts.volumes = append(append([]VolumeConfig{}, s.config.Volumes...), volumes...)
+	}
+
+	for _, limiter := range []struct {
+		annotation string
+		opt        **RateLimiterConfig
+	}{
+		{internal.DriveRateLimiterAnnotation, &opts.driveRateLimiter},
+		{internal.NetworkRxRateLimiterAnnotation, &opts.networkRxRateLimiter},
+		{internal.NetworkTxRateLimiterAnnotation, &opts.networkTxRateLimiter},
+	} {
+		value, ok := annotations[limiter.annotation]
+		if !ok {
+			continue
+		}
+
+		parsed, err := parseRateLimiter(value, *limiter.opt)
+		if err != nil {
+			return opts, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s annotation: %v", limiter.annotation, err)
+		}
+
+		*limiter.opt = parsed
+	}
+
+	if value, ok := annotations[internal.MetadataAnnotation]; ok {
+		metadata, err := parseMetadata(value)
+		if err != nil {
+			return opts, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s annotation: %v", internal.MetadataAnnotation, err)
+		}
+
+		if s.config.CNINetworkName == "" {
+			return opts, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s annotation: %v", internal.MetadataAnnotation, errMetadataWithoutNetwork)
+		}
+
+		opts.metadata = metadata
+	}
+
+	if value, ok := annotations[internal.VcpuAffinityAnnotation]; ok {
+		cpus, err := parseCPUList(value)
+		if err != nil {
+			return opts, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s annotation: %v", internal.VcpuAffinityAnnotation, err)
+		}
+
+		if len(opts.vcpuAffinity) > 0 && !isCPUSubset(cpus, opts.vcpuAffinity) {
+			return opts, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s annotation: CPUs should be within vcpu_affinity %s",
+				internal.VcpuAffinityAnnotation, s.config.VcpuAffinity)
+		}
+
+		opts.vcpuAffinity = cpus
+	}
+
+	return opts, nil
+}
+
+// setKernelArgs sets kernel args requested in task options. Parameters of the agent are set by the
+// runtime and init args can only come from the configuration, so the task can't pass either.
+func (opts *vmOptions) setKernelArgs(args string) error {
+	for _, arg := range strings.Fields(args) {
+		if arg == "--" {
+			return errors.Wrap(errdefs.ErrInvalidArgument, "kernel args can't contain init arguments (\"--\")")
+		}
+
+		if strings.HasPrefix(arg, internal.AgentBootArgPrefix) {
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "kernel arg %q is reserved for the runtime", arg)
+		}
+	}
+
+	opts.extraKernelArgs = args
+	return nil
+}
+
+// setVcpuCount overrides the configured vCPU count with the one requested in task options (0 keeps it)
+func (opts *vmOptions) setVcpuCount(requested uint32, max int) error {
+	if requested == 0 {
+		return nil
+	}
+
+	if requested > uint32(max) {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "requested vCPU count %d exceeds the limit of %d (see max_cpu_count)", requested, max)
+	}
+
+	opts.vcpuCount = int(requested)
+	return nil
+}
+
+// firecrackerLogLevels are log levels accepted by Firecracker
+var firecrackerLogLevels = []string{"Error", "Warning", "Info", "Debug"}
+
+// setLogLevel overrides the configured log level of Firecracker with the one requested in task options
+// (empty keeps it). Levels are matched case-insensitively.
+func (opts *vmOptions) setLogLevel(requested string) error {
+	if requested == "" {
+		return nil
+	}
+
+	for _, level := range firecrackerLogLevels {
+		if strings.EqualFold(requested, level) {
+			opts.logLevel = level
+			return nil
+		}
+	}
+
+	return errors.Wrapf(errdefs.ErrInvalidArgument, "invalid log level %q, should be one of %v", requested, firecrackerLogLevels)
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+)
+
+func TestVMOptions(t *testing.T) {
+	s := &service{config: &Config{
+		KernelArgs:      "console=ttyS0",
+		AgentLogLevel:   "info",
+		StdioBufferSize: internal.DefaultBufferSize,
+		PrefaultMemory:  true,
+		InitMode:        internal.InitModeSystemd,
+	}}
+
+	opts, err := s.vmOptions(nil)
+	require.NoError(t, err)
+	assert.Equal(t, vmOptions{prefaultMemory: true, initMode: internal.InitModeSystemd}, opts)
+
+	args := strings.Fields(s.kernelArgs(opts))
+	assert.Contains(t, args, "fc_agent.prefault_memory=1")
+	assert.Contains(t, args, "fc_agent.init_mode=systemd")
+
+	opts, err = s.vmOptions(map[string]string{
+		internal.PrefaultMemoryAnnotation: "false",
+		internal.InitModeAnnotation:       internal.InitModeMinimal,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, vmOptions{initMode: internal.InitModeMinimal}, opts)
+	assert.NotContains(t, strings.Fields(s.kernelArgs(opts)), "fc_agent.prefault_memory=1")
+
+	_, err = s.vmOptions(map[string]string{internal.PrefaultMemoryAnnotation: "sometimes"})
+	assert.Error(t, err)
+
+	_, err = s.vmOptions(map[string]string{internal.InitModeAnnotation: "upstart"})
+	assert.Error(t, err)
+
+	// The kernel doesn't run the agent as init
+	_, err = s.vmOptions(map[string]string{internal.InitModeAnnotation: internal.InitModeAgent})
+	assert.Error(t, err)
+
+	s.config.KernelArgs = "console=ttyS0 init=/usr/local/bin/agent"
+	opts, err = s.vmOptions(map[string]string{internal.InitModeAnnotation: internal.InitModeAgent})
+	require.NoError(t, err)
+	assert.Equal(t, internal.InitModeAgent, opts.initMode)
+}
+
+func TestVMOptionsRootDrive(t *testing.T) {
+	s := &service{config: &Config{
+		RootDrive: "/var/lib/firecracker/root.img",
+		Drives:    []DriveConfig{{ID: "debian", HostPath: "/var/lib/firecracker/debian.img"}},
+	}}
+
+	opts, err := s.vmOptions(nil)
+	require.NoError(t, err)
+	assert.Equal(t, rootDriveID, opts.rootDrive)
+
+	opts, err = s.vmOptions(map[string]string{internal.RootDriveAnnotation: "debian"})
+	require.NoError(t, err)
+	assert.Equal(t, "debian", opts.rootDrive)
+
+	_, err = s.vmOptions(map[string]string{internal.RootDriveAnnotation: "ubuntu"})
+	assert.Error(t, err)
+}
+
+func TestVMOptionsAgentMaxInFlight(t *testing.T) {
+	s := &service{config: &Config{AgentMaxInFlight: 8}}
+
+	opts, err := s.vmOptions(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 8, opts.agentMaxInFlight)
+
+	opts, err = s.vmOptions(map[string]string{internal.AgentMaxInFlightAnnotation: "0"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, opts.agentMaxInFlight)
+
+	_, err = s.vmOptions(map[string]string{internal.AgentMaxInFlightAnnotation: "-1"})
+	assert.Error(t, err)
+}
+
+func TestVMOptionsVcpuCount(t *testing.T) {
+	s := &service{config: &Config{CPUCount: 2, MaxCPUCount: 8}}
+
+	opts, err := s.vmOptions(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, opts.vcpuCount)
+
+	require.NoError(t, opts.setVcpuCount(0, s.config.MaxCPUCount))
+	assert.Equal(t, 2, opts.vcpuCount)
+
+	require.NoError(t, opts.setVcpuCount(8, s.config.MaxCPUCount))
+	assert.Equal(t, 8, opts.vcpuCount)
+
+	assert.Error(t, opts.setVcpuCount(9, s.config.MaxCPUCount))
+	assert.Equal(t, 8, opts.vcpuCount)
+}
+
+func TestVMOptionsVcpuAffinity(t *testing.T) {
+	s := &service{config: &Config{}}
+
+	opts, err := s.vmOptions(map[string]string{internal.VcpuAffinityAnnotation: "2-3"})
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, opts.vcpuAffinity)
+
+	s.config.VcpuAffinity = "0-3"
+	opts, err = s.vmOptions(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2, 3}, opts.vcpuAffinity)
+
+	opts, err = s.vmOptions(map[string]string{internal.VcpuAffinityAnnotation: "1"})
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, opts.vcpuAffinity)
+
+	// Annotation can't widen the configured CPUs
+	_, err = s.vmOptions(map[string]string{internal.VcpuAffinityAnnotation: "3-4"})
+	assert.Error(t, err)
+
+	_, err = s.vmOptions(map[string]string{internal.VcpuAffinityAnnotation: "all"})
+	assert.Error(t, err)
+}
+
+func TestVMOptionsLogLevel(t *testing.T) {
+	s := &service{config: &Config{LogLevel: "Info"}}
+
+	opts, err := s.vmOptions(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Info", opts.logLevel)
+
+	require.NoError(t, opts.setLogLevel(""))
+	assert.Equal(t, "Info", opts.logLevel)
+
+	require.NoError(t, opts.setLogLevel("debug"))
+	assert.Equal(t, "Debug", opts.logLevel)
+
+	err = opts.setLogLevel("trace")
+	assert.True(t, errdefs.IsInvalidArgument(err), "unexpected error %v", err)
+	assert.Equal(t, "Debug", opts.logLevel)
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/runtime"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Exit status reported for processes of a VM whose VMM died, the same as of a process killed by SIGKILL
+const vmmCrashExitStatus = 128 + uint32(unix.SIGKILL)
+
+// vmmExitError describes how the VMM process exited, given the error of waiting for it
+func vmmExitError(err error) error {
+	if err == nil {
+		return errors.New("firecracker exited with status 0")
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return errors.Errorf("firecracker was killed by signal %d (%s)", status.Signal(), status.Signal())
+			}
+
+			return errors.Errorf("firecracker exited with status %d", status.ExitStatus())
+		}
+	}
+
+	return errors.Wrap(err, "firecracker exited")
+}
+
+// waitVMM waits for the Firecracker process to exit, and handles the exit if it's unexpected
+func (s *service) waitVMM(ctx context.Context) {
+	exitErr := s.machine.Wait(context.Background())
+
+	// Checked before the exit is signalled, as a retried start resets vmStopping once this VMM is gone
+	stopping := s.isVMStopping()
+	close(s.vmmExited)
+
+	if stopping {
+		return
+	}
+
+	exitErr = vmmExitError(exitErr)
+	log.G(ctx).WithError(exitErr).Error("firecracker exited unexpectedly")
+	s.audit.record(ctx, auditEventVMMExit, "", "", map[string]string{"error": exitErr.Error()})
+	s.captureMetricsSnapshot(ctx, exitErr)
+	s.handleVMMExit(ctx, exitErr)
+}
+
+// handleVMMExit takes care of the VMM exiting on its own: processes of the VM are reported as exited,
+// as the agent can't report them anymore, and what's left of the VM is torn down along with the shim
+func (s *service) handleVMMExit(ctx context.Context, exitErr error) {
+	s.reportVMMExit(ctx, exitErr)
+
+	if err := s.teardownVM(ctx); err != nil {
+		log.G(ctx).WithError(err).Error("failed to clean up after VMM exit")
+	}
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	s.server.Close()
+	exitShim(1)
+}
+
+// reportVMMExit publishes exit of every process of the VM that is still monitored
+func (s *service) reportVMMExit(ctx context.Context, exitErr error) {
+	for _, process := range s.monitors.stopAll() {
+		log.G(ctx).WithError(exitErr).WithFields(logrus.Fields{"id": process.id, "exec_id": process.execID}).Warn("process is lost along with the VMM")
+		s.publishEvent(ctx, runtime.TaskExitEventTopic, exitEvent(process.id, process.execID, process.pid, vmmCrashExitStatus))
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/runtime"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVMMExitError(t *testing.T) {
+	assert.EqualError(t, vmmExitError(nil), "firecracker exited with status 0")
+
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	require.Error(t, err)
+	assert.EqualError(t, vmmExitError(err), "firecracker exited with status 3")
+
+	err = exec.Command("sh", "-c", "kill -SEGV $$").Run()
+	require.Error(t, err)
+	assert.EqualError(t, vmmExitError(err), "firecracker was killed by signal 11 (segmentation fault)")
+
+	assert.EqualError(t, vmmExitError(errors.New("broken pipe")), "firecracker exited: broken pipe")
+}
+
+func TestReportVMMExit(t *testing.T) {
+	publisher := &fakePublisher{}
+	s := &service{publish: publisher}
+
+	ctx, _, ok := s.monitors.start(context.Background(), "app", "", 42)
+	require.True(t, ok)
+
+	s.reportVMMExit(context.Background(), errors.New("firecracker was killed by signal 9 (killed)"))
+	assert.Error(t, ctx.Err(), "monitoring should be stopped")
+
+	require.Equal(t, []string{runtime.TaskExitEventTopic}, publisher.topics)
+	event := publisher.events[0].(*eventstypes.TaskExit)
+	assert.Equal(t, "app", event.ContainerID)
+	assert.EqualValues(t, 42, event.Pid)
+	assert.Equal(t, vmmCrashExitStatus, event.ExitStatus)
+}
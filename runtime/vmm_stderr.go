@@ -0,0 +1,108 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// File in the bundle directory receiving the VMM's stderr
+	vmmStderrFile = "firecracker.stderr"
+
+	// How much of the VMM's stderr is included in errors starting it
+	vmmStderrTailLines = 20
+	vmmStderrTailBytes = 16 << 10
+)
+
+// openVMMStderr creates the file in the bundle the VMM's stderr is written to. Unlike a pipe, the file
+// outlives the shim, so the VMM can keep writing to it when the shim is gone.
+func openVMMStderr(bundle string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(bundle, vmmStderrFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+}
+
+// readVMMStderr returns the last lines the VMM wrote to stderr, empty if there are none
+func readVMMStderr(bundle string) string {
+	file, err := os.Open(filepath.Join(bundle, vmmStderrFile))
+	if err != nil {
+		return ""
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return ""
+	}
+
+	offset := info.Size() - vmmStderrTailBytes
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return ""
+		}
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return ""
+	}
+
+	text := strings.TrimRight(string(data), "\n")
+	if text == "" {
+		return ""
+	}
+
+	lines := strings.Split(text, "\n")
+	// The first line read from the middle of the file is likely cut
+	if offset > 0 && len(lines) > 1 {
+		lines = lines[1:]
+	}
+
+	if len(lines) > vmmStderrTailLines {
+		lines = lines[len(lines)-vmmStderrTailLines:]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// vmmStartError is an error starting the VMM along with the last lines the VMM wrote to stderr,
+// which usually tell the actual reason (like an unsupported CPU template or a bad kernel image)
+type vmmStartError struct {
+	err    error
+	stderr string
+}
+
+func (e *vmmStartError) Error() string {
+	return fmt.Sprintf("%s, firecracker stderr:\n%s", e.err, e.stderr)
+}
+
+// Cause returns the original error, so its kind is still recognized
+func (e *vmmStartError) Cause() error {
+	return e.err
+}
+
+// withVMMStderr adds the tail of the VMM's stderr to the error starting the VM, if the VMM wrote anything
+func withVMMStderr(err error, bundle string) error {
+	stderr := readVMMStderr(bundle)
+	if stderr == "" {
+		return err
+	}
+
+	return &vmmStartError{err: err, stderr: stderr}
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadVMMStderr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Empty(t, readVMMStderr(dir))
+
+	file, err := openVMMStderr(dir)
+	require.NoError(t, err)
+	defer file.Close()
+
+	assert.Empty(t, readVMMStderr(dir))
+
+	_, err = file.WriteString("Error: unsupported CPU template\n")
+	require.NoError(t, err)
+	assert.Equal(t, "Error: unsupported CPU template", readVMMStderr(dir))
+
+	// Only the last lines are kept
+	for i := 0; i < 100; i++ {
+		_, err = fmt.Fprintf(file, "line %d\n", i)
+		require.NoError(t, err)
+	}
+
+	lines := strings.Split(readVMMStderr(dir), "\n")
+	require.Len(t, lines, vmmStderrTailLines)
+	assert.Equal(t, "line 99", lines[len(lines)-1])
+
+	// A long line is cut to the size limit
+	_, err = file.WriteString(strings.Repeat("x", 2*vmmStderrTailBytes) + "\n")
+	require.NoError(t, err)
+	assert.Len(t, readVMMStderr(dir), vmmStderrTailBytes-1)
+
+	// Opening the file again starts it over
+	file, err = openVMMStderr(dir)
+	require.NoError(t, err)
+	defer file.Close()
+	assert.Empty(t, readVMMStderr(dir))
+}
+
+func TestWithVMMStderr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	startErr := errors.Wrap(errdefs.ErrUnavailable, "failed to start instance")
+	assert.Equal(t, startErr, withVMMStderr(startErr, dir), "nothing to add without stderr")
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, vmmStderrFile), []byte("Error: bad kernel image\n"), 0600))
+
+	err = withVMMStderr(startErr, dir)
+	assert.EqualError(t, err, "failed to start instance: unavailable, firecracker stderr:\nError: bad kernel image")
+	assert.True(t, errdefs.IsUnavailable(err), "kind of the original error should be kept")
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// attachVolumes adds configured volumes to the VM drives and returns what the agent needs to mount them.
+// Guest device names depend on attachment order, so volumes are identified by their filesystem UUID instead.
+// Filesystem type is detected from the image, and has to be one of fsTypes.
+func attachVolumes(volumes []VolumeConfig, fsTypes []string, drives *driveAllocator) ([]*proto.Volume, error) {
+	var (
+		list  []*proto.Volume
+		uuids = make(map[string]string, len(volumes))
+	)
+
+	for _, volume := range volumes {
+		fsType, uuid, err := internal.ReadFilesystem(volume.HostPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read filesystem UUID of volume %s", volume.HostPath)
+		}
+
+		if !isAllowedFSType(fsTypes, fsType) {
+			return nil, errors.Errorf("volume %s has %s filesystem, allowed types are %v (see fs_types)", volume.HostPath, fsType, allowedFSTypes(fsTypes))
+		}
+
+		if other, ok := uuids[uuid]; ok {
+			return nil, errors.Errorf("volumes %s and %s have the same filesystem UUID %s", other, volume.HostPath, uuid)
+		}
+
+		uuids[uuid] = volume.HostPath
+
+		drives.add(driveRoleVolume, volume.HostPath, false, volume.ReadOnly)
+		list = append(list, &proto.Volume{
+			UUID:      uuid,
+			GuestPath: volume.GuestPath,
+			ReadOnly:  volume.ReadOnly,
+			FSType:    fsType,
+		})
+	}
+
+	return list, nil
+}
+
+// validateVolumes checks volumes have host paths and distinct guest paths other than /
+func validateVolumes(volumes []VolumeConfig) error {
+	guestPaths := make(map[string]bool, len(volumes))
+	for _, volume := range volumes {
+		if volume.HostPath == "" {
+			return errors.New("volume host_path can't be empty")
+		}
+
+		if !filepath.IsAbs(volume.GuestPath) || filepath.Clean(volume.GuestPath) == "/" {
+			return errors.Errorf("volume guest_path %q should be an absolute path other than /", volume.GuestPath)
+		}
+
+		if guestPaths[filepath.Clean(volume.GuestPath)] {
+			return errors.Errorf("volume guest_path %q is used more than once", volume.GuestPath)
+		}
+
+		guestPaths[filepath.Clean(volume.GuestPath)] = true
+	}
+
+	return nil
+}
+
+// parseTaskVolumes parses volumes requested by a task (a JSON array of volumes, like the volumes setting).
+// Tasks can only attach images from task_volume_dirs, and can't reuse guest paths of configured volumes.
+func parseTaskVolumes(value string, config *Config) ([]VolumeConfig, error) {
+	var volumes []VolumeConfig
+	if err := json.Unmarshal([]byte(value), &volumes); err != nil {
+		return nil, err
+	}
+
+	for i, volume := range volumes {
+		hostPath, err := taskVolumePath(volume.HostPath, config.TaskVolumeDirs)
+		if err != nil {
+			return nil, err
+		}
+
+		volumes[i].HostPath = hostPath
+	}
+
+	if err := validateVolumes(append(append([]VolumeConfig{}, config.Volumes...), volumes...)); err != nil {
+		return nil, err
+	}
+
+	return volumes, nil
+}
+
+// taskVolumePath resolves the host path of a task volume, which has to be inside one of dirs.
+// Symlinks are resolved first, so they can't point outside of dirs.
+func taskVolumePath(path string, dirs []string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", errors.Errorf("volume host_path %q should be an absolute path", path)
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve volume host_path %q", path)
+	}
+
+	for _, dir := range dirs {
+		resolvedDir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+
+		if rel, err := filepath.Rel(resolvedDir, resolved); err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return resolved, nil
+		}
+	}
+
+	return "", errors.Errorf("volume host_path %q is outside of task_volume_dirs", path)
+}
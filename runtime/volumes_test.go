@@ -0,0 +1,224 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// writeVolume creates an image with ext4 superblock carrying the given UUID
+func writeVolume(t *testing.T, path string, uuid byte) {
+	image := make([]byte, 2048)
+	image[1024+0x38] = 0x53
+	image[1024+0x39] = 0xEF
+	for i := 0; i < 16; i++ {
+		image[1024+0x68+i] = uuid
+	}
+
+	require.NoError(t, ioutil.WriteFile(path, image, 0600))
+}
+
+func TestAttachVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volumes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data.img")
+	logs := filepath.Join(dir, "logs.img")
+	cache := filepath.Join(dir, "cache.img")
+	writeVolume(t, data, 0xaa)
+	writeVolume(t, logs, 0xbb)
+	writeVolume(t, cache, 0xcc)
+
+	drives := &driveAllocator{}
+	drives.add(driveRoleRoot, "/var/lib/firecracker/root.img", true, false)
+	drives.add(driveRoleRootfs, "/dev/mapper/pool-snap-1", false, false)
+
+	volumes, err := attachVolumes([]VolumeConfig{
+		{HostPath: logs, GuestPath: "/var/log/app"},
+		{HostPath: data, GuestPath: "/data", ReadOnly: true},
+		{HostPath: cache, GuestPath: "/cache"},
+	}, nil, drives)
+
+	require.NoError(t, err)
+
+	// Volumes go after the root and rootfs drives, each is identified by its UUID
+	// no matter which guest device it ends up at
+	assert.Equal(t, []*proto.Volume{
+		{UUID: "bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb", GuestPath: "/var/log/app", FSType: internal.FSTypeExt4},
+		{UUID: "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa", GuestPath: "/data", ReadOnly: true, FSType: internal.FSTypeExt4},
+		{UUID: "cccccccc-cccc-cccc-cccc-cccccccccccc", GuestPath: "/cache", FSType: internal.FSTypeExt4},
+	}, volumes)
+
+	inventory := drives.inventory()
+	require.Len(t, inventory, 5)
+	assert.Equal(t, driveRoleVolume, inventory[3].Role)
+	assert.Equal(t, data, inventory[3].PathOnHost)
+	assert.True(t, inventory[3].IsReadOnly)
+
+	// A copy of the same volume can't be told apart in the guest
+	copied := filepath.Join(dir, "copy.img")
+	writeVolume(t, copied, 0xaa)
+
+	_, err = attachVolumes([]VolumeConfig{
+		{HostPath: data, GuestPath: "/data"},
+		{HostPath: copied, GuestPath: "/copy"},
+	}, nil, &driveAllocator{})
+
+	assert.Error(t, err)
+}
+
+func TestAttachVolumesFSType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volumes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data.img")
+	image := make([]byte, 2048)
+	copy(image, "XFSB")
+	require.NoError(t, ioutil.WriteFile(path, image, 0600))
+
+	volumes := []VolumeConfig{{HostPath: path, GuestPath: "/data"}}
+
+	// Only ext4 is allowed by default
+	_, err = attachVolumes(volumes, nil, &driveAllocator{})
+	assert.Error(t, err)
+
+	attached, err := attachVolumes(volumes, []string{internal.FSTypeExt4, internal.FSTypeXFS}, &driveAllocator{})
+	require.NoError(t, err)
+	require.Len(t, attached, 1)
+	assert.Equal(t, internal.FSTypeXFS, attached[0].FSType)
+}
+
+func TestVolumeConfig(t *testing.T) {
+	config := &Config{
+		AgentLogLevel:    defaultAgentLogLevel,
+		StdioBufferSize:  internal.DefaultBufferSize,
+		APITimeoutMs:     defaultAPITimeoutMs,
+		CleanupTimeoutMs: defaultCleanupTimeoutMs,
+		MaxBundleSize:    defaultMaxBundleSize,
+		ShimMaxProcs:     defaultShimMaxProcs,
+		MaxCPUCount:      defaultMaxCPUCount,
+		RootDrive:        "/var/lib/firecracker/root.img",
+		Volumes: []VolumeConfig{
+			{HostPath: "/var/lib/volumes/data.img", GuestPath: "/data"},
+			{HostPath: "/var/lib/volumes/logs.img", GuestPath: "/var/log/app"},
+		},
+	}
+
+	require.NoError(t, config.validate())
+
+	for _, volumes := range [][]VolumeConfig{
+		{{HostPath: "", GuestPath: "/data"}},
+		{{HostPath: "/data.img", GuestPath: "data"}},
+		{{HostPath: "/data.img", GuestPath: "/"}},
+		{{HostPath: "/data.img", GuestPath: "/data"}, {HostPath: "/other.img", GuestPath: "/data/"}},
+	} {
+		config.Volumes = volumes
+		assert.Error(t, config.validate(), volumes)
+	}
+}
+
+func TestVMOptionsTaskVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volumes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	allowed := filepath.Join(dir, "allowed")
+	require.NoError(t, os.Mkdir(allowed, 0700))
+
+	data := filepath.Join(allowed, "data.img")
+	writeVolume(t, data, 0xaa)
+
+	outside := filepath.Join(dir, "outside.img")
+	writeVolume(t, outside, 0xbb)
+
+	// A link inside of the allowed directory to an image outside of it
+	link := filepath.Join(allowed, "link.img")
+	require.NoError(t, os.Symlink(outside, link))
+
+	s := &service{config: &Config{
+		Volumes: []VolumeConfig{{HostPath: "/var/lib/volumes/logs.img", GuestPath: "/var/log/app"}},
+	}}
+
+	opts, err := s.vmOptions(nil)
+	require.NoError(t, err)
+	assert.Equal(t, s.config.Volumes, opts.volumes)
+
+	annotation := `[{"host_path": "` + data + `", "guest_path": "/data", "read_only": true}]`
+
+	// Tasks can't attach volumes unless task_volume_dirs is set
+	_, err = s.vmOptions(map[string]string{internal.VolumesAnnotation: annotation})
+	assert.Error(t, err)
+
+	s.config.TaskVolumeDirs = []string{allowed}
+
+	opts, err = s.vmOptions(map[string]string{internal.VolumesAnnotation: annotation})
+	require.NoError(t, err)
+	assert.Equal(t, []VolumeConfig{
+		{HostPath: "/var/lib/volumes/logs.img", GuestPath: "/var/log/app"},
+		{HostPath: data, GuestPath: "/data", ReadOnly: true},
+	}, opts.volumes)
+
+	for _, value := range []string{
+		`{"host_path": "` + data + `", "guest_path": "/data"}`,
+		`[{"host_path": "` + outside + `", "guest_path": "/data"}]`,
+		`[{"host_path": "` + link + `", "guest_path": "/data"}]`,
+		`[{"host_path": "` + allowed + `/../outside.img", "guest_path": "/data"}]`,
+		`[{"host_path": "data.img", "guest_path": "/data"}]`,
+		`[{"host_path": "` + data + `", "guest_path": "/var/log/app"}]`,
+		`[{"host_path": "` + data + `", "guest_path": "/"}]`,
+	} {
+		_, err = s.vmOptions(map[string]string{internal.VolumesAnnotation: value})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestTaskVolumeDriveIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volumes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data.img")
+	logs := filepath.Join(dir, "logs.img")
+	writeVolume(t, data, 0xaa)
+	writeVolume(t, logs, 0xbb)
+
+	drives := &driveAllocator{}
+	drives.addWithID(rootDriveID, driveRoleRoot, "/var/lib/firecracker/root.img", true, false)
+	drives.addWithID("scratch", driveRoleExtra, "/var/lib/firecracker/scratch.img", false, false)
+	drives.add(driveRoleRootfs, "/dev/mapper/pool-snap-1", false, false)
+
+	_, err = attachVolumes([]VolumeConfig{
+		{HostPath: logs, GuestPath: "/var/log/app"},
+		{HostPath: data, GuestPath: "/data", ReadOnly: true},
+	}, nil, drives)
+	require.NoError(t, err)
+
+	var ids []string
+	for _, drive := range drives.inventory() {
+		ids = append(ids, drive.ID)
+	}
+
+	assert.Equal(t, []string{rootDriveID, "scratch", "3", "4", "5"}, ids)
+}
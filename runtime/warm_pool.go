@@ -0,0 +1,402 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWarmPoolDir              = "/run/firecracker-containerd/warm-pool"
+	defaultWarmPoolRefillIntervalMs = 1000
+
+	// Pooled VMs are registered under this namespace until a shim claims them
+	warmPoolNamespace = "warm-pool"
+
+	// Files of a pooled VM in its directory
+	pooledVMSocketFile  = "firecracker.sock"
+	pooledVMRootfsFile  = "rootfs"
+	pooledVMClaimedFile = "claimed.json"
+	pooledVMReapedFile  = "reaped.json"
+)
+
+// WarmPoolConfig configures the pool of pre-booted VMs kept by the warm-pool process, see Warm pool in README.md
+type WarmPoolConfig struct {
+	Dir              string `json:"dir"`
+	MinSize          int    `json:"min_size"`
+	MaxSize          int    `json:"max_size"`
+	IdleTimeoutMs    int    `json:"idle_timeout_ms"`
+	RefillIntervalMs int    `json:"refill_interval_ms"`
+}
+
+func (c *WarmPoolConfig) dir() string {
+	if c.Dir == "" {
+		return defaultWarmPoolDir
+	}
+
+	return c.Dir
+}
+
+func (c *WarmPoolConfig) refillInterval() time.Duration {
+	if c.RefillIntervalMs == 0 {
+		return defaultWarmPoolRefillIntervalMs * time.Millisecond
+	}
+
+	return time.Duration(c.RefillIntervalMs) * time.Millisecond
+}
+
+func (c *WarmPoolConfig) readyDir() string {
+	return filepath.Join(c.dir(), "ready")
+}
+
+func (c *WarmPoolConfig) vmDir(name string) string {
+	return filepath.Join(c.dir(), "vms", name)
+}
+
+func (c *WarmPoolConfig) readyPath(name string) string {
+	return filepath.Join(c.readyDir(), name+".json")
+}
+
+func (c *WarmPoolConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if c.Dir != "" && !filepath.IsAbs(c.Dir) {
+		return errors.New("dir should be an absolute path")
+	}
+
+	if c.MinSize < 0 || c.MaxSize <= 0 || c.MinSize > c.MaxSize {
+		return errors.New("max_size should be positive and at least min_size")
+	}
+
+	if c.IdleTimeoutMs < 0 || c.RefillIntervalMs < 0 {
+		return errors.New("idle_timeout_ms and refill_interval_ms can't be negative")
+	}
+
+	return nil
+}
+
+// pooledVM is a VM booted by the warm-pool process. While it's ready, it's described by its file in the
+// ready directory. A shim claims it by renaming the file into the VM directory, which only one process can do,
+// and the pool takes it back (to stop it) the same way.
+type pooledVM struct {
+	Name    string    `json:"name"`
+	State   vmState   `json:"state"`
+	ReadyAt time.Time `json:"ready_at"`
+	// Drive with a placeholder image the rootfs of the task is hot-plugged to
+	RootfsDrive string `json:"rootfs_drive"`
+
+	dir string
+	// Closed once the VMM exits, only known to the warm-pool process the VMM is a child of
+	exited <-chan struct{}
+}
+
+func (vm *pooledVM) hasExited() bool {
+	select {
+	case <-vm.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// artifacts lists files of the VM to remove once it's stopped, the directory goes last as only empty ones are removed
+func (vm *pooledVM) artifacts() []string {
+	return []string{
+		vm.State.SocketPath,
+		filepath.Join(vm.dir, pooledVMRootfsFile),
+		filepath.Join(vm.dir, pooledVMClaimedFile),
+		vm.dir,
+	}
+}
+
+func readPooledVM(path string) (*pooledVM, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var vm pooledVM
+	if err := json.Unmarshal(data, &vm); err != nil {
+		return nil, errors.Wrapf(err, "invalid pooled VM %s", path)
+	}
+
+	return &vm, nil
+}
+
+// markReady lists the VM as ready to be claimed
+func (c *WarmPoolConfig) markReady(vm *pooledVM) error {
+	data, err := json.Marshal(vm)
+	if err != nil {
+		return err
+	}
+
+	// Written next to the VM first, so a shim never reads a partially written file
+	tmpPath := filepath.Join(vm.dir, "ready.json")
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, c.readyPath(vm.Name)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// claim takes the VM off the ready list, renaming its file to the given file in the VM directory.
+// Returns false if another process took it first.
+func (c *WarmPoolConfig) claim(name, file string) (bool, error) {
+	err := os.Rename(c.readyPath(name), filepath.Join(c.vmDir(name), file))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// claimVM takes a ready VM, the one waiting the longest first. Returns nil if there's none.
+func (c *WarmPoolConfig) claimVM() (*pooledVM, error) {
+	entries, err := ioutil.ReadDir(c.readyDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().Before(entries[j].ModTime()) })
+
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		if name == entry.Name() {
+			continue
+		}
+
+		claimed, err := c.claim(name, pooledVMClaimedFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if !claimed {
+			continue
+		}
+
+		vm, err := readPooledVM(filepath.Join(c.vmDir(name), pooledVMClaimedFile))
+		if err != nil {
+			return nil, err
+		}
+
+		vm.dir = c.vmDir(name)
+		return vm, nil
+	}
+
+	return nil, nil
+}
+
+// warmPool keeps VMs booted with the configured defaults ready for shims to claim.
+// It keeps at least min_size VMs ready. Each VM claimed by a shim makes it keep one more, up to max_size,
+// and VMs left idle for idle_timeout_ms are stopped until it's back at min_size.
+type warmPool struct {
+	config *WarmPoolConfig
+	boot   func(ctx context.Context, name string) (*pooledVM, error)
+	stop   func(ctx context.Context, vm *pooledVM) error
+	now    func() time.Time
+
+	mu      sync.Mutex
+	vms     map[string]*pooledVM
+	booting int
+	target  int
+	seq     int
+	wg      sync.WaitGroup
+}
+
+func newWarmPool(config *WarmPoolConfig, boot func(context.Context, string) (*pooledVM, error), stop func(context.Context, *pooledVM) error) *warmPool {
+	return &warmPool{
+		config: config,
+		boot:   boot,
+		stop:   stop,
+		now:    time.Now,
+		vms:    make(map[string]*pooledVM),
+		target: config.MinSize,
+	}
+}
+
+// run keeps the pool filled until ctx is canceled, then stops VMs which weren't claimed
+func (p *warmPool) run(ctx context.Context) error {
+	if err := os.MkdirAll(p.config.readyDir(), 0700); err != nil {
+		return errors.Wrap(err, "failed to create warm pool directory")
+	}
+
+	ticker := time.NewTicker(p.config.refillInterval())
+	defer ticker.Stop()
+
+	for {
+		p.sync(ctx)
+
+		select {
+		case <-ctx.Done():
+			return p.drain()
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync forgets VMs claimed by shims, stops VMs idle for too long and boots VMs to get back to the target size
+func (p *warmPool) sync(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name, vm := range p.vms {
+		if _, err := os.Stat(p.config.readyPath(name)); os.IsNotExist(err) {
+			log.G(ctx).WithField("vm", name).Info("pooled VM claimed")
+			delete(p.vms, name)
+			if p.target < p.config.MaxSize {
+				p.target++
+			}
+
+			continue
+		}
+
+		if vm.hasExited() {
+			log.G(ctx).WithField("vm", name).Warn("pooled VM exited")
+			p.release(ctx, vm)
+		}
+	}
+
+	if idleTimeout := time.Duration(p.config.IdleTimeoutMs) * time.Millisecond; idleTimeout > 0 {
+		reaped := false
+		for _, vm := range p.idleVMs(idleTimeout) {
+			if len(p.vms) <= p.config.MinSize {
+				break
+			}
+
+			log.G(ctx).WithField("vm", vm.Name).Info("stopping idle pooled VM")
+			p.release(ctx, vm)
+			reaped = true
+		}
+
+		if reaped {
+			p.target = len(p.vms) + p.booting
+			if p.target < p.config.MinSize {
+				p.target = p.config.MinSize
+			}
+		}
+	}
+
+	for len(p.vms)+p.booting < p.target {
+		p.booting++
+		p.seq++
+		name := fmt.Sprintf("%d-%d", os.Getpid(), p.seq)
+
+		p.wg.Add(1)
+		go p.bootVM(ctx, name)
+	}
+}
+
+// idleVMs returns VMs ready for longer than timeout, the longest idle first
+func (p *warmPool) idleVMs(timeout time.Duration) []*pooledVM {
+	var idle []*pooledVM
+	for _, vm := range p.vms {
+		if p.now().Sub(vm.ReadyAt) >= timeout {
+			idle = append(idle, vm)
+		}
+	}
+
+	sort.Slice(idle, func(i, j int) bool { return idle[i].ReadyAt.Before(idle[j].ReadyAt) })
+	return idle
+}
+
+func (p *warmPool) bootVM(ctx context.Context, name string) {
+	defer p.wg.Done()
+
+	vm, err := p.boot(ctx, name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.booting--
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("vm", name).Error("failed to boot pooled VM")
+		return
+	}
+
+	log.G(ctx).WithField("vm", name).Debug("pooled VM ready")
+	p.vms[name] = vm
+}
+
+// release takes the VM off the ready list and stops it in the background, unless a shim claimed it first.
+// Must be called with the lock held.
+func (p *warmPool) release(ctx context.Context, vm *pooledVM) {
+	delete(p.vms, vm.Name)
+
+	taken, err := p.config.claim(vm.Name, pooledVMReapedFile)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("vm", vm.Name).Error("failed to release pooled VM")
+		return
+	}
+
+	if !taken {
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if err := p.stop(ctx, vm); err != nil {
+			log.G(ctx).WithError(err).WithField("vm", vm.Name).Error("failed to stop pooled VM")
+		}
+	}()
+}
+
+// drain stops the VMs which weren't claimed, once VMs being booted are done
+func (p *warmPool) drain() error {
+	p.wg.Wait()
+
+	p.mu.Lock()
+	vms := p.vms
+	p.vms = make(map[string]*pooledVM)
+	p.mu.Unlock()
+
+	var result *multierror.Error
+	for _, vm := range vms {
+		taken, err := p.config.claim(vm.Name, pooledVMReapedFile)
+		if err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+
+		if taken {
+			if err := p.stop(context.Background(), vm); err != nil {
+				result = multierror.Append(result, errors.Wrapf(err, "failed to stop pooled VM %s", vm.Name))
+			}
+		}
+	}
+
+	return result.ErrorOrNil()
+}
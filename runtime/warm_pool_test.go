@@ -0,0 +1,233 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/api/types"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmPoolConfigValidate(t *testing.T) {
+	assert.NoError(t, (*WarmPoolConfig)(nil).validate())
+	assert.NoError(t, (&WarmPoolConfig{MinSize: 1, MaxSize: 4}).validate())
+	assert.NoError(t, (&WarmPoolConfig{MaxSize: 1}).validate())
+
+	assert.Error(t, (&WarmPoolConfig{}).validate(), "max_size is required")
+	assert.Error(t, (&WarmPoolConfig{MinSize: 2, MaxSize: 1}).validate())
+	assert.Error(t, (&WarmPoolConfig{MaxSize: 1, Dir: "pool"}).validate())
+	assert.Error(t, (&WarmPoolConfig{MaxSize: 1, IdleTimeoutMs: -1}).validate())
+
+	config := &WarmPoolConfig{MaxSize: 1}
+	assert.Equal(t, defaultWarmPoolDir, config.dir())
+	assert.Equal(t, time.Second, config.refillInterval())
+}
+
+// fakePool boots VMs by listing them as ready, without any VMM behind them
+type fakePool struct {
+	config *WarmPoolConfig
+
+	mu      sync.Mutex
+	stopped []string
+}
+
+func (f *fakePool) boot(ctx context.Context, name string) (*pooledVM, error) {
+	vm := &pooledVM{Name: name, ReadyAt: time.Now(), dir: f.config.vmDir(name)}
+	if err := os.MkdirAll(vm.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return vm, f.config.markReady(vm)
+}
+
+func (f *fakePool) stop(ctx context.Context, vm *pooledVM) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopped = append(f.stopped, vm.Name)
+	return os.RemoveAll(vm.dir)
+}
+
+func newTestWarmPool(t *testing.T, config *WarmPoolConfig) (*warmPool, *fakePool, func()) {
+	dir, err := ioutil.TempDir("", "warm-pool-")
+	require.NoError(t, err)
+
+	config.Dir = dir
+	require.NoError(t, os.MkdirAll(config.readyDir(), 0700))
+
+	fake := &fakePool{config: config}
+	return newWarmPool(config, fake.boot, fake.stop), fake, func() { os.RemoveAll(dir) }
+}
+
+func TestWarmPoolClaim(t *testing.T) {
+	pool, _, cleanup := newTestWarmPool(t, &WarmPoolConfig{MinSize: 2, MaxSize: 2})
+	defer cleanup()
+
+	config := pool.config
+
+	// No VMs booted yet
+	vm, err := config.claimVM()
+	require.NoError(t, err)
+	assert.Nil(t, vm)
+
+	pool.sync(context.Background())
+	pool.wg.Wait()
+	require.Len(t, pool.vms, 2)
+
+	first, err := config.claimVM()
+	require.NoError(t, err)
+	require.NotNil(t, first)
+	assert.Equal(t, config.vmDir(first.Name), first.dir)
+	assert.FileExists(t, filepath.Join(first.dir, pooledVMClaimedFile))
+
+	second, err := config.claimVM()
+	require.NoError(t, err)
+	require.NotNil(t, second)
+	assert.NotEqual(t, first.Name, second.Name)
+
+	vm, err = config.claimVM()
+	require.NoError(t, err)
+	assert.Nil(t, vm)
+
+	// Claimed VMs can't be taken back by the pool
+	taken, err := config.claim(first.Name, pooledVMReapedFile)
+	require.NoError(t, err)
+	assert.False(t, taken)
+}
+
+func TestWarmPoolLifecycle(t *testing.T) {
+	pool, fake, cleanup := newTestWarmPool(t, &WarmPoolConfig{MinSize: 1, MaxSize: 3, IdleTimeoutMs: 60000})
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	pool.sync(ctx)
+	pool.wg.Wait()
+	assert.Len(t, pool.vms, 1)
+
+	// Each claim makes the pool keep one more VM ready, up to max_size
+	for i := 0; i < 3; i++ {
+		vm, err := pool.config.claimVM()
+		require.NoError(t, err)
+		require.NotNil(t, vm)
+
+		pool.sync(ctx)
+		pool.wg.Wait()
+	}
+
+	pool.sync(ctx)
+	pool.wg.Wait()
+	assert.Len(t, pool.vms, 3)
+	assert.Equal(t, 3, pool.target)
+	assert.Empty(t, fake.stopped)
+
+	// Idle VMs are stopped down to min_size
+	now = now.Add(2 * time.Minute)
+	pool.sync(ctx)
+	pool.wg.Wait()
+	assert.Len(t, pool.vms, 1)
+	assert.Equal(t, 1, pool.target)
+	assert.Len(t, fake.stopped, 2)
+
+	ready, err := ioutil.ReadDir(pool.config.readyDir())
+	require.NoError(t, err)
+	assert.Len(t, ready, 1)
+
+	// Draining stops whatever is left unclaimed
+	require.NoError(t, pool.drain())
+	assert.Len(t, fake.stopped, 3)
+
+	ready, err = ioutil.ReadDir(pool.config.readyDir())
+	require.NoError(t, err)
+	assert.Empty(t, ready)
+}
+
+func TestWarmPoolRunDrains(t *testing.T) {
+	pool, fake, cleanup := newTestWarmPool(t, &WarmPoolConfig{MinSize: 2, MaxSize: 2, RefillIntervalMs: 10})
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- pool.run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ready, err := ioutil.ReadDir(pool.config.readyDir())
+		require.NoError(t, err)
+		if len(ready) == 2 {
+			break
+		}
+
+		require.True(t, time.Now().Before(deadline), "pool wasn't filled")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	require.NoError(t, <-done)
+	assert.Len(t, fake.stopped, 2)
+}
+
+func TestCanUsePooledVM(t *testing.T) {
+	s := &service{config: &Config{CPUCount: 1, WarmPool: &WarmPoolConfig{MaxSize: 1}}}
+	request := &taskAPI.CreateTaskRequest{Rootfs: []*types.Mount{{Type: "ext4", Source: "/dev/mapper/snap-1"}}}
+
+	opts, err := s.vmOptions(nil)
+	require.NoError(t, err)
+	assert.True(t, s.canUsePooledVM(request, opts))
+
+	custom := opts
+	custom.vcpuCount = 2
+	assert.False(t, s.canUsePooledVM(request, custom), "pooled VMs have the configured vCPU count")
+
+	custom = opts
+	custom.readOnlyRootfs = true
+	assert.False(t, s.canUsePooledVM(request, custom), "placeholder drive is writable")
+
+	assert.False(t, s.canUsePooledVM(&taskAPI.CreateTaskRequest{}, opts), "no rootfs to hot-plug")
+
+	s.config.WarmPool = nil
+	assert.False(t, s.canUsePooledVM(request, opts))
+}
+
+func TestGuestRootfsPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	specPath := filepath.Join(dir, "config.json")
+	for spec, expected := range map[string]string{
+		`{"root": {"path": "rootfs"}}`:      "/container/rootfs",
+		`{"root": {"path": "/mnt/rootfs"}}`: "/mnt/rootfs",
+	} {
+		require.NoError(t, ioutil.WriteFile(specPath, []byte(spec), 0600))
+		path, err := guestRootfsPath(specPath)
+		require.NoError(t, err)
+		assert.Equal(t, expected, path)
+	}
+
+	require.NoError(t, ioutil.WriteFile(specPath, []byte(`{}`), 0600))
+	_, err = guestRootfsPath(specPath)
+	assert.Error(t, err)
+}
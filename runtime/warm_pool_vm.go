@@ -0,0 +1,391 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	taskAPI "github.com/containerd/containerd/runtime/v2/task"
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/internal"
+	"github.com/firecracker-microvm/firecracker-containerd/proto"
+)
+
+// Size of the placeholder image attached in place of the rootfs of a pooled VM
+const pooledVMPlaceholderSize = 1 << 20
+
+// bootPooledVM boots a VM for the warm pool with the configured defaults and a placeholder rootfs drive,
+// and lists it as ready once its agent is reachable. The VMM isn't tied to the warm-pool process,
+// so VMs claimed by shims keep running when it exits.
+func bootPooledVM(ctx context.Context, config *Config, name string) (_ *pooledVM, err error) {
+	dir := config.WarmPool.vmDir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create pooled VM directory")
+	}
+
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	rootfsPath := filepath.Join(dir, pooledVMRootfsFile)
+	if err := createPlaceholder(rootfsPath); err != nil {
+		return nil, err
+	}
+
+	s := &service{config: config}
+	opts, err := s.vmOptions(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	drives := &driveAllocator{}
+	if err := attachConfiguredDrives(config, opts.rootDrive, drives); err != nil {
+		return nil, err
+	}
+
+	drives.add(driveRoleRootfs, rootfsPath, false, false)
+	rootfsDrive := firecracker.StringValue(drives.drives[len(drives.drives)-1].DriveID)
+	drives.setRateLimiter(opts.driveRateLimiter.model())
+
+	capacity, err := config.vmCapacity(vmMemSizeMib)
+	if err != nil {
+		return nil, err
+	}
+
+	reservation, err := reserveVsockCID(ctx, warmPoolNamespace, name, capacity)
+	if err != nil {
+		return nil, err
+	}
+
+	defer reservation.release()
+
+	defer func() {
+		if err != nil {
+			unregisterCID(reservation.CID)
+		}
+	}()
+
+	socketPath := filepath.Join(dir, pooledVMSocketFile)
+	cfg := firecracker.Config{
+		SocketPath:      socketPath,
+		VsockDevices:    []firecracker.VsockDevice{{Path: "root", CID: reservation.CID}},
+		KernelImagePath: config.KernelImagePath,
+		KernelArgs:      s.kernelArgs(opts),
+		MachineCfg: models.MachineConfiguration{
+			VcpuCount:   int64(opts.vcpuCount),
+			CPUTemplate: config.cpuTemplate(),
+			MemSizeMib:  vmMemSizeMib,
+		},
+		Drives: drives.drives,
+		Debug:  config.Debug,
+	}
+
+	// Not bound to ctx, which would kill the VMM once the pool is drained, and in a process group of its own,
+	// so signals sent to the warm-pool process don't reach it
+	cmd := firecracker.VMCommandBuilder{}.
+		WithBin(config.FirecrackerBinaryPath).
+		WithSocketPath(socketPath).
+		Build(context.Background())
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	client := newFirecrackerClient(socketPath, time.Duration(config.APITimeoutMs)*time.Millisecond, log.G(ctx), config.Debug)
+	machine, err := firecracker.NewMachine(context.Background(), cfg, firecracker.WithProcessRunner(cmd), firecracker.WithClient(client))
+	if err != nil {
+		return nil, err
+	}
+
+	// SDK's handler ties the VMM to the process (forwarding signals to it), so the VMM is started here instead.
+	// Config is validated by NewMachine already, validating it again would fail on the socket of the VMM.
+	machine.Handlers.Validation = machine.Handlers.Validation.Remove(firecracker.ValidateCfgHandlerName)
+	machine.Handlers.FcInit = machine.Handlers.FcInit.
+		Remove(firecracker.StartVMMHandlerName).
+		Remove(firecracker.BootstrapLoggingHandlerName)
+
+	bootCtx := ctx
+	if bootTimeout := time.Duration(config.BootTimeoutMs) * time.Millisecond; bootTimeout > 0 {
+		var cancel context.CancelFunc
+		bootCtx, cancel = context.WithTimeout(ctx, bootTimeout)
+		defer cancel()
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "failed to start VMM")
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	vm := &pooledVM{
+		Name:        name,
+		State:       vmState{CID: reservation.CID, SocketPath: socketPath, VMMPid: cmd.Process.Pid, Drives: drives.inventory()},
+		RootfsDrive: rootfsDrive,
+		dir:         dir,
+		exited:      exited,
+	}
+
+	defer func() {
+		if err != nil {
+			if stopErr := stopPooledVM(context.Background(), config, vm); stopErr != nil {
+				log.G(ctx).WithError(stopErr).Error("failed to stop pooled VM")
+			}
+		}
+	}()
+
+	if err := waitForSocket(bootCtx, socketPath, exited); err != nil {
+		return nil, err
+	}
+
+	if err := machine.Start(bootCtx); err != nil {
+		return nil, err
+	}
+
+	// VMM holds the CID now
+	reservation.release()
+
+	conn, err := dialVsock(bootCtx, reservation.CID, config.agentPort())
+	if err != nil {
+		return nil, err
+	}
+
+	conn.Close()
+
+	vm.ReadyAt = time.Now()
+	if err := config.WarmPool.markReady(vm); err != nil {
+		return nil, errors.Wrap(err, "failed to list pooled VM as ready")
+	}
+
+	return vm, nil
+}
+
+// createPlaceholder creates an empty sparse image, which a drive of a pooled VM is backed by
+// until the VM is claimed
+func createPlaceholder(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create placeholder drive")
+	}
+
+	defer file.Close()
+
+	return file.Truncate(pooledVMPlaceholderSize)
+}
+
+// waitForSocket waits for the VMM to create its API socket
+func waitForSocket(ctx context.Context, path string, exited <-chan struct{}) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "VMM didn't create its API socket")
+		case <-exited:
+			return errors.New("VMM exited before creating its API socket")
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopPooledVM stops the VMM of a VM taken back from the pool and removes its files.
+// The VMM is killed if it doesn't exit within cleanup_timeout_ms.
+func stopPooledVM(ctx context.Context, config *Config, vm *pooledVM) error {
+	if !vm.hasExited() {
+		if err := unix.Kill(vm.State.VMMPid, unix.SIGTERM); err != nil && err != unix.ESRCH {
+			return err
+		}
+
+		select {
+		case <-vm.exited:
+		case <-time.After(time.Duration(config.CleanupTimeoutMs) * time.Millisecond):
+			log.G(ctx).WithField("vm", vm.Name).Warn("pooled VMM didn't exit, killing it")
+			if err := unix.Kill(vm.State.VMMPid, unix.SIGKILL); err != nil && err != unix.ESRCH {
+				return err
+			}
+
+			<-vm.exited
+		}
+	}
+
+	if err := os.RemoveAll(vm.dir); err != nil {
+		return errors.Wrap(err, "failed to remove pooled VM directory")
+	}
+
+	return unregisterCID(vm.State.CID)
+}
+
+// canUsePooledVM returns true if a pooled VM, booted with the configured defaults and a single writable rootfs
+// drive, can serve the task in place of a VM started for it
+func (s *service) canUsePooledVM(request *taskAPI.CreateTaskRequest, opts vmOptions) bool {
+	if s.config.WarmPool == nil || len(request.Rootfs) != 1 || opts.readOnlyRootfs {
+		return false
+	}
+
+	defaults, err := s.vmOptions(nil)
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(opts, defaults)
+}
+
+// startPooledVM claims a VM from the warm pool and hot-plugs the rootfs of the task to it, returns nil if no VM
+// is ready. A claimed VM which can't be used is stopped.
+func (s *service) startPooledVM(ctx context.Context, request *taskAPI.CreateTaskRequest, opts vmOptions) (taskAPI.TaskService, error) {
+	for {
+		vm, err := s.config.WarmPool.claimVM()
+		if err != nil || vm == nil {
+			return nil, err
+		}
+
+		running, err := vm.State.isVMMRunning()
+		if err != nil {
+			return nil, err
+		}
+
+		if !running {
+			log.G(ctx).WithField("vm", vm.Name).Warn("pooled VM is gone, trying another one")
+			os.RemoveAll(vm.dir)
+			unregisterCID(vm.State.CID)
+			continue
+		}
+
+		if err := s.attachPooledVM(ctx, request, opts, vm); err != nil {
+			if stopErr := stopReattachedVMM(vm.State.VMMPid); stopErr != nil {
+				log.G(ctx).WithError(stopErr).Error("failed to stop pooled VM")
+			}
+
+			os.RemoveAll(vm.dir)
+			unregisterCID(vm.State.CID)
+			s.pooledVM = nil
+
+			return nil, err
+		}
+
+		return s.agentClient, nil
+	}
+}
+
+func (s *service) attachPooledVM(ctx context.Context, request *taskAPI.CreateTaskRequest, opts vmOptions, vm *pooledVM) error {
+	log.G(ctx).WithFields(map[string]interface{}{"vm": vm.Name, "cid": vm.State.CID}).Info("using pooled VM")
+
+	rootfs := request.Rootfs[0]
+	if !isAllowedFSType(s.config.FSTypes, rootfs.Type) {
+		return errors.Errorf("unsupported mount type '%s', expected one of %v (see fs_types)", rootfs.Type, allowedFSTypes(s.config.FSTypes))
+	}
+
+	_, uuid, err := internal.ReadFilesystem(rootfs.Source)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read filesystem UUID of rootfs %s", rootfs.Source)
+	}
+
+	guestPath, err := guestRootfsPath(filepath.Join(request.Bundle, "config.json"))
+	if err != nil {
+		return err
+	}
+
+	// Swaps the placeholder for the rootfs and has the guest pick up the new image
+	client := newFirecrackerClient(vm.State.SocketPath, time.Duration(s.config.APITimeoutMs)*time.Millisecond, log.G(ctx), s.config.Debug)
+	if _, err := client.PatchGuestDriveByID(ctx, vm.RootfsDrive, rootfs.Source); err != nil {
+		return errors.Wrap(err, "failed to hot-plug rootfs")
+	}
+
+	rescan := &models.InstanceActionInfo{ActionType: models.InstanceActionInfoActionTypeBlockDeviceRescan, Payload: vm.RootfsDrive}
+	if _, err := client.CreateSyncAction(ctx, rescan); err != nil {
+		return errors.Wrap(err, "failed to rescan rootfs drive")
+	}
+
+	vm.dir = s.config.WarmPool.vmDir(vm.Name)
+	s.pooledVM = vm
+	s.vcpuCount = opts.vcpuCount
+
+	state := vm.State
+	state.AgentMaxInFlight = opts.agentMaxInFlight
+	state.Drives = withDrivePath(state.Drives, vm.RootfsDrive, rootfs.Source)
+	if err := s.attachVM(ctx, &state); err != nil {
+		return err
+	}
+
+	// The guest image mounts the rootfs of VMs booted for a task, the pooled VM had only the placeholder then
+	_, err = s.guest.MountVolumes(ctx, &proto.MountVolumesRequest{Volumes: []*proto.Volume{{
+		UUID:      uuid,
+		GuestPath: guestPath,
+		FSType:    rootfs.Type,
+	}}})
+	if err != nil {
+		return errors.Wrap(err, "failed to mount rootfs")
+	}
+
+	s.bundle = request.Bundle
+	s.drives = state.Drives
+	if err := saveVMState(s.bundle, &state); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to save VM state")
+	}
+
+	s.audit.record(ctx, auditEventVMStart, "", "", map[string]string{
+		"cid":    strconv.FormatUint(uint64(state.CID), 10),
+		"pooled": vm.Name,
+	})
+
+	return nil
+}
+
+// guestRootfsPath returns the path the container rootfs is expected at in the guest
+func guestRootfsPath(specPath string) (string, error) {
+	data, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return "", err
+	}
+
+	var spec struct {
+		Root *struct {
+			Path string `json:"path"`
+		} `json:"root"`
+	}
+
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return "", err
+	}
+
+	if spec.Root == nil || spec.Root.Path == "" {
+		return "", errors.New("spec doesn't have root path")
+	}
+
+	if filepath.IsAbs(spec.Root.Path) {
+		return spec.Root.Path, nil
+	}
+
+	return filepath.Join(internal.GuestBundlePath, spec.Root.Path), nil
+}
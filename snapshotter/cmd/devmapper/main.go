@@ -16,6 +16,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 
 	"github.com/containerd/containerd/snapshots"
@@ -30,8 +31,13 @@ const (
 )
 
 func main() {
-	var configPath string
+	var (
+		configPath string
+		validate   bool
+	)
+
 	flag.StringVar(&configPath, "config", "", "Path to devmapper configuration file")
+	flag.BoolVar(&validate, "validate", false, "Validate configuration and exit without creating the pool")
 
 	snapshotter.Run(func(ctx context.Context) (snapshots.Snapshotter, error) {
 		// Flags parsing happens inside Run, so we can't make this checks earlier.
@@ -43,6 +49,26 @@ func main() {
 			configPath = defaultConfigPath
 		}
 
+		if validate {
+			validateConfig(configPath)
+		}
+
 		return devmapper.NewSnapshotter(ctx, configPath)
 	})
 }
+
+// validateConfig checks the configuration file and exits with non-zero status if it's invalid
+func validateConfig(configPath string) {
+	config, err := devmapper.LoadConfig(configPath)
+	if err == nil {
+		err = devmapper.ValidateConfig(config)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration %q: %v\n", configPath, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("configuration %q is valid\n", configPath)
+	os.Exit(0)
+}
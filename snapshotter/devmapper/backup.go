@@ -0,0 +1,168 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	backupTimeFormat = "20060102T150405.000000000Z"
+	backupTempPrefix = ".tmp-"
+)
+
+// startBackups periodically backs up metadata stores in background until returned stop function is called
+func (dm *Snapshotter) startBackups(ctx context.Context) closeFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(dm.config.BackupIntervalDuration)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				path, err := backupMetadata(dm.store, dm.pool.metadata, dm.config.BackupDir, dm.config.PoolName, time.Now())
+				if err != nil {
+					log.G(ctx).WithError(err).Warn("metadata backup failed")
+					continue
+				}
+
+				log.G(ctx).Debugf("backed up metadata to %s", path)
+
+				if err := pruneBackups(dm.config.BackupDir, dm.config.BackupRetention); err != nil {
+					log.G(ctx).WithError(err).Warn("failed to remove old metadata backups")
+				}
+			}
+		}
+	}()
+
+	return func() error {
+		cancel()
+		<-done
+		return nil
+	}
+}
+
+// backupMetadata copies snapshot and pool metadata stores to a new directory under backupDir.
+// Copies are made within read-only transactions, so they are consistent and don't block writers.
+// File names match the ones in root directory, so a backup can be restored by copying the files back.
+func backupMetadata(store *storage.MetaStore, pool *PoolMetadata, backupDir, poolName string, now time.Time) (string, error) {
+	name := now.UTC().Format(backupTimeFormat)
+	tempDir := filepath.Join(backupDir, backupTempPrefix+name)
+
+	if err := os.MkdirAll(tempDir, 0700); err != nil {
+		return "", err
+	}
+
+	defer os.RemoveAll(tempDir)
+
+	err := writeBackupFile(filepath.Join(tempDir, metadataFileName), func(w io.Writer) error {
+		_, t, err := store.TransactionContext(context.Background(), false)
+		if err != nil {
+			return err
+		}
+
+		defer t.Rollback()
+
+		tx, ok := t.(*bolt.Tx)
+		if !ok {
+			return errors.Errorf("unexpected metadata store transaction type %T", t)
+		}
+
+		_, err = tx.WriteTo(w)
+		return err
+	})
+
+	if err != nil {
+		return "", errors.Wrap(err, "failed to backup snapshot metadata")
+	}
+
+	err = writeBackupFile(filepath.Join(tempDir, poolName+".db"), pool.backup)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to backup pool metadata")
+	}
+
+	// Incomplete backups are never visible under the final name
+	path := filepath.Join(backupDir, name)
+	if err := os.Rename(tempDir, path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func writeBackupFile(path string, fn func(w io.Writer) error) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// pruneBackups removes the oldest backups, so no more than retention backups are kept
+func pruneBackups(backupDir string, retention int) error {
+	entries, err := ioutil.ReadDir(backupDir)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), backupTempPrefix) {
+			backups = append(backups, entry.Name())
+		}
+	}
+
+	// Names are timestamps, so lexical order is chronological order
+	sort.Strings(backups)
+
+	for len(backups) > retention {
+		if err := os.RemoveAll(filepath.Join(backupDir, backups[0])); err != nil {
+			return err
+		}
+
+		backups = backups[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+
+	tempDir, err := ioutil.TempDir("", "devmapper-backup-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	store, err := storage.NewMetaStore(filepath.Join(tempDir, metadataFileName))
+	require.NoError(t, err)
+	defer store.Close()
+
+	pool, err := NewPoolMetadata(filepath.Join(tempDir, "pool.db"))
+	require.NoError(t, err)
+	defer pool.Close()
+
+	txCtx, tx, err := store.TransactionContext(ctx, true)
+	require.NoError(t, err)
+	_, err = storage.CreateSnapshot(txCtx, snapshots.KindActive, "snap-1", "")
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+
+	err = pool.AddDevice(ctx, &DeviceInfo{Name: "snap-1", Size: 1024}, func(uint32) error { return nil })
+	require.NoError(t, err)
+
+	// A reader keeps a transaction open, backup must not wait for it
+	_, readTx, err := store.TransactionContext(ctx, false)
+	require.NoError(t, err)
+	defer readTx.Rollback()
+
+	backupDir := filepath.Join(tempDir, "backups")
+	path, err := backupMetadata(store, pool, backupDir, "pool", time.Now())
+	require.NoError(t, err)
+
+	// Restore the backup into a working store
+	restored, err := storage.NewMetaStore(filepath.Join(path, metadataFileName))
+	require.NoError(t, err)
+	defer restored.Close()
+
+	txCtx, tx, err = restored.TransactionContext(ctx, false)
+	require.NoError(t, err)
+	snap, err := storage.GetSnapshot(txCtx, "snap-1")
+	require.NoError(t, tx.Rollback())
+	require.NoError(t, err)
+	assert.Equal(t, snapshots.KindActive, snap.Kind)
+
+	restoredPool, err := NewPoolMetadata(filepath.Join(path, "pool.db"))
+	require.NoError(t, err)
+	defer restoredPool.Close()
+
+	info, err := restoredPool.GetDevice(ctx, "snap-1")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1024, info.Size)
+}
+
+func TestPruneBackups(t *testing.T) {
+	backupDir, err := ioutil.TempDir("", "devmapper-backup-")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupDir)
+
+	now := time.Now()
+	var names []string
+	for i := 0; i < 5; i++ {
+		name := now.Add(time.Duration(i) * time.Hour).UTC().Format(backupTimeFormat)
+		require.NoError(t, os.Mkdir(filepath.Join(backupDir, name), 0700))
+		names = append(names, name)
+	}
+
+	// Backup in progress is left alone
+	require.NoError(t, os.Mkdir(filepath.Join(backupDir, backupTempPrefix+names[0]), 0700))
+
+	require.NoError(t, pruneBackups(backupDir, 2))
+
+	entries, err := ioutil.ReadDir(backupDir)
+	require.NoError(t, err)
+
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+
+	assert.ElementsMatch(t, []string{backupTempPrefix + names[0], names[3], names[4]}, left)
+}
@@ -16,6 +16,9 @@ package devmapper
 import (
 	"encoding/json"
 	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"time"
 
 	"github.com/docker/go-units"
 	"github.com/hashicorp/go-multierror"
@@ -28,11 +31,27 @@ const (
 	// See https://www.kernel.org/doc/Documentation/device-mapper/thin-provisioning.txt for details
 	dataBlockMinSize = 128
 	dataBlockMaxSize = 2097152
+
+	defaultTrimTimeout = time.Minute
+
+	defaultTxRetryBackoff = 10 * time.Millisecond
+	maxTxRetryCount       = 10
+
+	defaultRemoveRetryCount   = 5
+	defaultRemoveRetryBackoff = time.Second
+
+	defaultBackupDirName   = "backups"
+	defaultBackupRetention = 3
+
+	defaultPoolUsageInterval = time.Minute
+	defaultPoolHighWatermark = 90
+	defaultPoolFullWatermark = 98
 )
 
 var (
-	errInvalidBlockSize      = errors.Errorf("block size should be between %d and %d", dataBlockMinSize, dataBlockMaxSize)
-	errInvalidBlockAlignment = errors.Errorf("block size should be multiple of %d sectors", dataBlockMinSize)
+	errInvalidBlockSize = errors.Errorf("data_block_size should be between %d sectors (64KB) and %d sectors (1GB)",
+		dataBlockMinSize, dataBlockMaxSize)
+	errInvalidBlockAlignment = errors.Errorf("data_block_size should be a multiple of %d sectors (64KB)", dataBlockMinSize)
 )
 
 // Config represents device mapper configuration loaded from file.
@@ -60,6 +79,95 @@ type Config struct {
 	// Defines how much space to allocate when creating base image for container
 	BaseImageSize      string `json:"base_image_size"`
 	BaseImageSizeBytes uint64 `json:"-"`
+
+	// Filesystem to create on base images, either "ext4" (default) or "xfs".
+	// Snapshots keep the filesystem of their base image, so it can't be changed once snapshots are created.
+	FSType string `json:"fs_type"`
+
+	// Arguments added to mkfs of base images made with fs_type (like ["-O", "^has_journal"]), after the default ones.
+	// Snapshots can replace them with their mkfs options label.
+	MkfsOptions []string `json:"mkfs_options"`
+
+	// Defines how often idle snapshot devices are trimmed to return unused blocks to the pool (like "1h").
+	// Trimming is disabled when empty.
+	TrimInterval         string        `json:"trim_interval"`
+	TrimIntervalDuration time.Duration `json:"-"`
+
+	// Upper bound for a single trim pass over all target devices (defaults to 1m)
+	TrimTimeout         string        `json:"trim_timeout"`
+	TrimTimeoutDuration time.Duration `json:"-"`
+
+	// Snapshot kinds to trim, only "active" (the default) is supported as committed snapshots are read-only
+	TrimKinds []string `json:"trim_kinds"`
+
+	// How many times to retry metadata transactions failed due to transient contention (disabled by default)
+	TxRetryCount int `json:"tx_retry_count"`
+
+	// Initial delay between transaction retries, doubled after each attempt (defaults to 10ms)
+	TxRetryBackoff         string        `json:"tx_retry_backoff"`
+	TxRetryBackoffDuration time.Duration `json:"-"`
+
+	// How many times to retry removal of a device failed when removing its snapshot (defaults to 5)
+	RemoveRetryCount int `json:"remove_retry_count"`
+
+	// Initial delay between device removal retries, doubled after each attempt (defaults to 1s)
+	RemoveRetryBackoff         string        `json:"remove_retry_backoff"`
+	RemoveRetryBackoffDuration time.Duration `json:"-"`
+
+	// How many mkfs processes may run at once when creating base devices (defaults to half of available CPUs)
+	MaxConcurrentMkfs int `json:"max_concurrent_mkfs"`
+
+	// Defines how often thin-pool space usage is checked (defaults to 1m), periodic checks are disabled when "0s"
+	PoolUsageInterval         string        `json:"pool_usage_interval"`
+	PoolUsageIntervalDuration time.Duration `json:"-"`
+
+	// Percentage of data or metadata space of the pool in use, above which warnings are logged (defaults to 90)
+	PoolHighWatermark int `json:"pool_high_watermark"`
+
+	// Percentage of data or metadata space of the pool in use, above which new snapshots are rejected (defaults to 98)
+	PoolFullWatermark int `json:"pool_full_watermark"`
+
+	// Directory of raw filesystem images which snapshots can be created from (see SourceImageLabel),
+	// creating snapshots from images is disabled when empty
+	SourceImageDir string `json:"source_image_dir"`
+
+	// Whether to remove the lost+found directory that mkfs.ext4 makes on new base devices (defaults to false)
+	RemoveLostFound bool `json:"remove_lost_found"`
+
+	// Defines how often metadata stores are backed up (like "6h"), backups are disabled when empty
+	BackupInterval         string        `json:"backup_interval"`
+	BackupIntervalDuration time.Duration `json:"-"`
+
+	// Directory to keep metadata backups in (defaults to "backups" under root path)
+	BackupDir string `json:"backup_dir"`
+
+	// How many most recent backups to keep (defaults to 3)
+	BackupRetention int `json:"backup_retention"`
+
+	// How to wait for device nodes of activated devices, either "uevent" (default), "poll" or "none"
+	DeviceWait string `json:"device_wait"`
+
+	// What to do if uevents aren't available (like without udev), either "poll" (default) or "none"
+	DeviceWaitFallback string `json:"device_wait_fallback"`
+
+	// How long to wait for a device node to appear (defaults to 10s)
+	DeviceWaitTimeout         string        `json:"device_wait_timeout"`
+	DeviceWaitTimeoutDuration time.Duration `json:"-"`
+
+	// Interval between checks in poll mode (defaults to 10ms)
+	DevicePollInterval         string        `json:"device_poll_interval"`
+	DevicePollIntervalDuration time.Duration `json:"-"`
+
+	// Delete thin devices without snapshots in the metastore on startup (disabled by default)
+	ReconcileOnStart bool `json:"reconcile_on_start"`
+
+	// Remove thin devices and the pool when the snapshotter is closed, instead of leaving them active (disabled by
+	// default). Devices in use are left active, and so is the pool then.
+	DeactivatePoolOnClose bool `json:"deactivate_pool_on_close"`
+
+	// Share one device between committed snapshots of the same image layers (same chain ID), like image layers
+	// unpacked in different namespaces, instead of keeping a device for each (disabled by default)
+	ShareBaseLayers bool `json:"share_base_layers"`
 }
 
 // LoadConfig reads devmapper configuration file JSON format from disk
@@ -85,6 +193,14 @@ func LoadConfig(path string) (*Config, error) {
 	return &config, nil
 }
 
+func defaultMaxConcurrentMkfs() int {
+	if count := runtime.NumCPU() / 2; count > 1 {
+		return count
+	}
+
+	return 1
+}
+
 func (c *Config) parse() error {
 	var result *multierror.Error
 
@@ -100,6 +216,104 @@ func (c *Config) parse() error {
 		c.BaseImageSizeBytes = uint64(baseImageSize)
 	}
 
+	if c.FSType == "" {
+		c.FSType = fsTypeExt4
+	}
+
+	if c.TrimInterval != "" {
+		if interval, err := time.ParseDuration(c.TrimInterval); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse trim interval: %q", c.TrimInterval))
+		} else {
+			c.TrimIntervalDuration = interval
+		}
+	}
+
+	c.TrimTimeoutDuration = defaultTrimTimeout
+	if c.TrimTimeout != "" {
+		if timeout, err := time.ParseDuration(c.TrimTimeout); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse trim timeout: %q", c.TrimTimeout))
+		} else {
+			c.TrimTimeoutDuration = timeout
+		}
+	}
+
+	if c.RemoveRetryCount == 0 {
+		c.RemoveRetryCount = defaultRemoveRetryCount
+	}
+
+	c.RemoveRetryBackoffDuration = defaultRemoveRetryBackoff
+	if c.RemoveRetryBackoff != "" {
+		if backoff, err := time.ParseDuration(c.RemoveRetryBackoff); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse remove retry backoff: %q", c.RemoveRetryBackoff))
+		} else {
+			c.RemoveRetryBackoffDuration = backoff
+		}
+	}
+
+	if c.BackupInterval != "" {
+		if interval, err := time.ParseDuration(c.BackupInterval); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse backup interval: %q", c.BackupInterval))
+		} else {
+			c.BackupIntervalDuration = interval
+		}
+	}
+
+	if c.BackupDir == "" && c.RootPath != "" {
+		c.BackupDir = filepath.Join(c.RootPath, defaultBackupDirName)
+	}
+
+	if c.BackupRetention == 0 {
+		c.BackupRetention = defaultBackupRetention
+	}
+
+	if c.MaxConcurrentMkfs == 0 {
+		c.MaxConcurrentMkfs = defaultMaxConcurrentMkfs()
+	}
+
+	c.TxRetryBackoffDuration = defaultTxRetryBackoff
+	if c.TxRetryBackoff != "" {
+		if backoff, err := time.ParseDuration(c.TxRetryBackoff); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse transaction retry backoff: %q", c.TxRetryBackoff))
+		} else {
+			c.TxRetryBackoffDuration = backoff
+		}
+	}
+
+	c.PoolUsageIntervalDuration = defaultPoolUsageInterval
+	if c.PoolUsageInterval != "" {
+		if interval, err := time.ParseDuration(c.PoolUsageInterval); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse pool usage interval: %q", c.PoolUsageInterval))
+		} else {
+			c.PoolUsageIntervalDuration = interval
+		}
+	}
+
+	if c.PoolHighWatermark == 0 {
+		c.PoolHighWatermark = defaultPoolHighWatermark
+	}
+
+	if c.PoolFullWatermark == 0 {
+		c.PoolFullWatermark = defaultPoolFullWatermark
+	}
+
+	c.DeviceWaitTimeoutDuration = defaultDeviceWaitTimeout
+	if c.DeviceWaitTimeout != "" {
+		if timeout, err := time.ParseDuration(c.DeviceWaitTimeout); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse device wait timeout: %q", c.DeviceWaitTimeout))
+		} else {
+			c.DeviceWaitTimeoutDuration = timeout
+		}
+	}
+
+	c.DevicePollIntervalDuration = defaultDevicePollInterval
+	if c.DevicePollInterval != "" {
+		if interval, err := time.ParseDuration(c.DevicePollInterval); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to parse device poll interval: %q", c.DevicePollInterval))
+		} else {
+			c.DevicePollIntervalDuration = interval
+		}
+	}
+
 	return result.ErrorOrNil()
 }
 
@@ -130,5 +344,78 @@ func (c *Config) validate() error {
 		result = multierror.Append(result, errInvalidBlockAlignment)
 	}
 
+	if _, ok := mkfsArgs[c.FSType]; !ok && c.FSType != "" {
+		result = multierror.Append(result, errors.Errorf("unsupported fs_type %q, should be either %q or %q", c.FSType, fsTypeExt4, fsTypeXFS))
+	}
+
+	if c.SourceImageDir != "" && !filepath.IsAbs(c.SourceImageDir) {
+		result = multierror.Append(result, errors.Errorf("source_image_dir %q should be an absolute path", c.SourceImageDir))
+	}
+
+	if err := validateMkfsOptions(c.MkfsOptions); err != nil {
+		result = multierror.Append(result, errors.Wrap(err, "invalid mkfs_options"))
+	}
+
+	if c.TrimIntervalDuration < 0 || c.TrimTimeoutDuration < 0 {
+		result = multierror.Append(result, errors.New("trim interval and timeout can't be negative"))
+	}
+
+	for _, kind := range c.TrimKinds {
+		if _, ok := trimKinds[kind]; !ok {
+			result = multierror.Append(result, errors.Errorf("invalid trim kind %q, only \"active\" snapshots are trimmed", kind))
+		}
+	}
+
+	if c.TxRetryCount < 0 || c.TxRetryCount > maxTxRetryCount {
+		result = multierror.Append(result, errors.Errorf("tx_retry_count should be between 0 and %d", maxTxRetryCount))
+	}
+
+	if c.BackupIntervalDuration < 0 {
+		result = multierror.Append(result, errors.New("backup_interval can't be negative"))
+	}
+
+	if c.BackupRetention < 0 {
+		result = multierror.Append(result, errors.New("backup_retention can't be negative"))
+	}
+
+	if c.MaxConcurrentMkfs < 0 {
+		result = multierror.Append(result, errors.New("max_concurrent_mkfs can't be negative"))
+	}
+
+	if c.TxRetryBackoffDuration < 0 {
+		result = multierror.Append(result, errors.New("tx_retry_backoff can't be negative"))
+	}
+
+	if c.RemoveRetryCount < 0 || c.RemoveRetryBackoffDuration < 0 {
+		result = multierror.Append(result, errors.New("remove_retry_count and remove_retry_backoff can't be negative"))
+	}
+
+	if c.PoolUsageIntervalDuration < 0 {
+		result = multierror.Append(result, errors.New("pool_usage_interval can't be negative"))
+	}
+
+	if c.PoolHighWatermark < 0 || c.PoolHighWatermark > 100 || c.PoolFullWatermark < 0 || c.PoolFullWatermark > 100 {
+		result = multierror.Append(result, errors.New("pool_high_watermark and pool_full_watermark should be between 1 and 100"))
+	} else if c.PoolHighWatermark > c.PoolFullWatermark {
+		result = multierror.Append(result, errors.Errorf("pool_high_watermark %d is above pool_full_watermark %d",
+			c.PoolHighWatermark, c.PoolFullWatermark))
+	}
+
+	switch c.DeviceWait {
+	case "", deviceWaitUevent, deviceWaitPoll, deviceWaitNone:
+	default:
+		result = multierror.Append(result, errors.Errorf("invalid device_wait %q", c.DeviceWait))
+	}
+
+	switch c.DeviceWaitFallback {
+	case "", deviceWaitPoll, deviceWaitNone:
+	default:
+		result = multierror.Append(result, errors.Errorf("invalid device_wait_fallback %q", c.DeviceWaitFallback))
+	}
+
+	if c.DeviceWaitTimeoutDuration < 0 || c.DevicePollIntervalDuration < 0 {
+		result = multierror.Append(result, errors.New("device_wait_timeout and device_poll_interval can't be negative"))
+	}
+
 	return result.ErrorOrNil()
 }
@@ -17,8 +17,10 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/assert"
@@ -106,3 +108,250 @@ func TestFieldValidation(t *testing.T) {
 	assert.Equal(t, multErr.Errors[4], errInvalidBlockSize)
 	assert.Equal(t, multErr.Errors[5], errInvalidBlockAlignment)
 }
+
+func TestParseTrimConfig(t *testing.T) {
+	config := Config{
+		DataBlockSize: "64Kb",
+		BaseImageSize: "16Mb",
+	}
+
+	err := config.parse()
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, config.TrimIntervalDuration)
+	assert.Equal(t, defaultTrimTimeout, config.TrimTimeoutDuration)
+
+	config.TrimInterval = "1h"
+	config.TrimTimeout = "30s"
+
+	err = config.parse()
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, config.TrimIntervalDuration)
+	assert.Equal(t, 30*time.Second, config.TrimTimeoutDuration)
+
+	config.TrimInterval = "often"
+	err = config.parse()
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "failed to parse trim interval: \"often\""))
+}
+
+func TestTrimKindsValidation(t *testing.T) {
+	config := Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: dataBlockMinSize,
+		TrimKinds:            []string{"active"},
+	}
+
+	require.NoError(t, config.validate())
+
+	config.TrimKinds = []string{"view"}
+	require.Error(t, config.validate())
+
+	// Committed snapshots are read-only
+	config.TrimKinds = []string{"active", "committed"}
+	require.Error(t, config.validate())
+}
+
+func TestTxRetryConfig(t *testing.T) {
+	config := Config{
+		DataBlockSize: "64Kb",
+		BaseImageSize: "16Mb",
+	}
+
+	require.NoError(t, config.parse())
+	assert.Equal(t, 0, config.TxRetryCount)
+	assert.Equal(t, defaultTxRetryBackoff, config.TxRetryBackoffDuration)
+
+	config.TxRetryBackoff = "50ms"
+	require.NoError(t, config.parse())
+	assert.Equal(t, 50*time.Millisecond, config.TxRetryBackoffDuration)
+
+	config = Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: dataBlockMinSize,
+		TxRetryCount:         maxTxRetryCount + 1,
+	}
+
+	require.Error(t, config.validate())
+}
+
+func TestMaxConcurrentMkfsConfig(t *testing.T) {
+	config := Config{
+		DataBlockSize: "64Kb",
+		BaseImageSize: "16Mb",
+	}
+
+	require.NoError(t, config.parse())
+	assert.True(t, config.MaxConcurrentMkfs >= 1)
+	assert.True(t, config.MaxConcurrentMkfs <= runtime.NumCPU())
+
+	config.MaxConcurrentMkfs = 3
+	require.NoError(t, config.parse())
+	assert.Equal(t, 3, config.MaxConcurrentMkfs)
+
+	config = Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: dataBlockMinSize,
+		MaxConcurrentMkfs:    -1,
+	}
+
+	require.Error(t, config.validate())
+}
+
+func TestBackupConfig(t *testing.T) {
+	config := Config{
+		RootPath:      "/var/lib/containerd/devmapper",
+		DataBlockSize: "64Kb",
+		BaseImageSize: "16Mb",
+	}
+
+	require.NoError(t, config.parse())
+	assert.Equal(t, time.Duration(0), config.BackupIntervalDuration)
+	assert.Equal(t, "/var/lib/containerd/devmapper/backups", config.BackupDir)
+	assert.Equal(t, defaultBackupRetention, config.BackupRetention)
+
+	config.BackupInterval = "6h"
+	config.BackupDir = "/backups"
+	require.NoError(t, config.parse())
+	assert.Equal(t, 6*time.Hour, config.BackupIntervalDuration)
+	assert.Equal(t, "/backups", config.BackupDir)
+
+	config.BackupInterval = "often"
+	assert.Error(t, config.parse())
+}
+
+func TestDeviceWaitConfig(t *testing.T) {
+	config := Config{
+		DataBlockSize: "64Kb",
+		BaseImageSize: "16Mb",
+	}
+
+	require.NoError(t, config.parse())
+	assert.Equal(t, defaultDeviceWaitTimeout, config.DeviceWaitTimeoutDuration)
+	assert.Equal(t, defaultDevicePollInterval, config.DevicePollIntervalDuration)
+
+	config.DeviceWaitTimeout = "30s"
+	config.DevicePollInterval = "5ms"
+	require.NoError(t, config.parse())
+	assert.Equal(t, 30*time.Second, config.DeviceWaitTimeoutDuration)
+	assert.Equal(t, 5*time.Millisecond, config.DevicePollIntervalDuration)
+
+	config.DevicePollInterval = "often"
+	assert.Error(t, config.parse())
+
+	config = Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: dataBlockMinSize,
+		DeviceWait:           deviceWaitPoll,
+		DeviceWaitFallback:   deviceWaitNone,
+	}
+
+	require.NoError(t, config.validate())
+
+	config.DeviceWait = "udev"
+	require.Error(t, config.validate())
+
+	config.DeviceWait = deviceWaitUevent
+	config.DeviceWaitFallback = deviceWaitUevent
+	require.Error(t, config.validate())
+}
+
+func TestFSTypeConfig(t *testing.T) {
+	config := Config{
+		PoolName:       "test",
+		RootPath:       "/tmp",
+		DataDevice:     "/dev/loop0",
+		MetadataDevice: "/dev/loop1",
+		DataBlockSize:  "64Kb",
+		BaseImageSize:  "16Mb",
+	}
+
+	require.NoError(t, config.parse())
+	assert.Equal(t, fsTypeExt4, config.FSType)
+	require.NoError(t, config.validate())
+
+	config.FSType = fsTypeXFS
+	require.NoError(t, config.parse())
+	assert.Equal(t, fsTypeXFS, config.FSType)
+	require.NoError(t, config.validate())
+
+	config.FSType = "btrfs"
+	assert.Error(t, config.validate())
+
+	config.FSType = fsTypeExt4
+	config.MkfsOptions = []string{"-O", "^has_journal", "-i", "8192"}
+	assert.NoError(t, config.validate())
+
+	config.MkfsOptions = []string{"-O", "^has_journal", "/dev/loop2"}
+	assert.Error(t, config.validate())
+}
+
+func TestPoolUsageConfig(t *testing.T) {
+	config := Config{
+		PoolName:       "test",
+		RootPath:       "/tmp",
+		DataDevice:     "/dev/loop0",
+		MetadataDevice: "/dev/loop1",
+		DataBlockSize:  "64Kb",
+		BaseImageSize:  "16Mb",
+	}
+
+	require.NoError(t, config.parse())
+	assert.Equal(t, defaultPoolUsageInterval, config.PoolUsageIntervalDuration)
+	assert.Equal(t, defaultPoolHighWatermark, config.PoolHighWatermark)
+	assert.Equal(t, defaultPoolFullWatermark, config.PoolFullWatermark)
+	require.NoError(t, config.validate())
+
+	config.PoolUsageInterval = "0s"
+	require.NoError(t, config.parse())
+	assert.EqualValues(t, 0, config.PoolUsageIntervalDuration)
+
+	config.PoolHighWatermark = 99
+	assert.Error(t, config.validate(), "high watermark above full watermark")
+
+	config.PoolHighWatermark = 80
+	config.PoolFullWatermark = 101
+	assert.Error(t, config.validate())
+}
+
+func TestRemoveRetryConfig(t *testing.T) {
+	config := Config{
+		DataBlockSize: "64Kb",
+		BaseImageSize: "16Mb",
+	}
+
+	require.NoError(t, config.parse())
+	assert.Equal(t, defaultRemoveRetryCount, config.RemoveRetryCount)
+	assert.Equal(t, defaultRemoveRetryBackoff, config.RemoveRetryBackoffDuration)
+
+	config.RemoveRetryCount = 2
+	config.RemoveRetryBackoff = "100ms"
+	require.NoError(t, config.parse())
+	assert.Equal(t, 2, config.RemoveRetryCount)
+	assert.Equal(t, 100*time.Millisecond, config.RemoveRetryBackoffDuration)
+
+	config.RemoveRetryBackoff = "often"
+	assert.Error(t, config.parse())
+
+	config = Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           "/dev/loop0",
+		MetadataDevice:       "/dev/loop1",
+		DataBlockSizeSectors: dataBlockMinSize,
+		RemoveRetryCount:     -1,
+	}
+
+	require.Error(t, config.validate())
+}
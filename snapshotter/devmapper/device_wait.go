@@ -0,0 +1,180 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Device wait modes
+	deviceWaitUevent = "uevent"
+	deviceWaitPoll   = "poll"
+	deviceWaitNone   = "none"
+
+	defaultDeviceWaitTimeout  = 10 * time.Second
+	defaultDevicePollInterval = 10 * time.Millisecond
+
+	// Control socket of udev daemon, it exists only while udev is running
+	udevControlPath = "/run/udev/control"
+	// Netlink multicast group udev broadcasts events to, once it's done processing them (device nodes are created)
+	udevEventGroup = 2
+	// Upper bound of time between checks while waiting for uevents, in case an event is missed
+	ueventRecheckInterval = 100 * time.Millisecond
+)
+
+// deviceWaiter waits for device nodes of activated devices to show up, as udev creates them asynchronously
+type deviceWaiter struct {
+	mode        string
+	fallback    string
+	timeout     time.Duration
+	interval    time.Duration
+	udevControl string
+}
+
+func newDeviceWaiter(config *Config) *deviceWaiter {
+	waiter := &deviceWaiter{
+		mode:        config.DeviceWait,
+		fallback:    config.DeviceWaitFallback,
+		timeout:     config.DeviceWaitTimeoutDuration,
+		interval:    config.DevicePollIntervalDuration,
+		udevControl: udevControlPath,
+	}
+
+	if waiter.mode == "" {
+		waiter.mode = deviceWaitUevent
+	}
+
+	if waiter.fallback == "" {
+		waiter.fallback = deviceWaitPoll
+	}
+
+	if waiter.timeout == 0 {
+		waiter.timeout = defaultDeviceWaitTimeout
+	}
+
+	if waiter.interval == 0 {
+		waiter.interval = defaultDevicePollInterval
+	}
+
+	return waiter
+}
+
+// wait blocks until the device node at path exists.
+// In uevent mode, it falls back to the configured mode if udev isn't running or uevents can't be received.
+func (w *deviceWaiter) wait(ctx context.Context, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	mode := w.mode
+	if mode == deviceWaitUevent {
+		monitor, err := w.openMonitor()
+		if err == nil {
+			defer unix.Close(monitor)
+			return w.waitUevents(ctx, monitor, path)
+		}
+
+		log.G(ctx).WithError(err).Debugf("uevents not available, falling back to %q", w.fallback)
+		mode = w.fallback
+	}
+
+	switch mode {
+	case deviceWaitPoll:
+		return w.poll(ctx, path)
+	default:
+		return nil
+	}
+}
+
+// openMonitor subscribes to device events processed by udev
+func (w *deviceWaiter) openMonitor() (int, error) {
+	// Without udev nobody broadcasts the events, dmsetup creates device nodes by itself then
+	if _, err := os.Stat(w.udevControl); err != nil {
+		return -1, errors.Wrap(err, "udev is not running")
+	}
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return -1, errors.Wrap(err, "failed to open uevent socket")
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: udevEventGroup}); err != nil {
+		unix.Close(fd)
+		return -1, errors.Wrap(err, "failed to bind uevent socket")
+	}
+
+	timeout := unix.NsecToTimeval(ueventRecheckInterval.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return -1, errors.Wrap(err, "failed to set uevent socket timeout")
+	}
+
+	return fd, nil
+}
+
+// waitUevents checks for the device node whenever udev reports an event.
+// Events aren't parsed, as a check is cheap and the device might be known under several names.
+func (w *deviceWaiter) waitUevents(ctx context.Context, monitor int, path string) error {
+	buf := make([]byte, os.Getpagesize())
+	for {
+		if exists, err := deviceExists(path); err != nil || exists {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return errors.Wrapf(err, "device %s didn't appear", path)
+		}
+
+		// Returns on an event or after the receive timeout
+		if _, _, err := unix.Recvfrom(monitor, buf, 0); err != nil && err != unix.EAGAIN && err != unix.EINTR {
+			return errors.Wrap(err, "failed to receive uevent")
+		}
+	}
+}
+
+func (w *deviceWaiter) poll(ctx context.Context, path string) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if exists, err := deviceExists(path); err != nil || exists {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "device %s didn't appear", path)
+		case <-ticker.C:
+		}
+	}
+}
+
+func deviceExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return false, err
+}
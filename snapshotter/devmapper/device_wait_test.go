@@ -0,0 +1,73 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceWaiter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "device-wait-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	udevControl := filepath.Join(dir, "control")
+	require.NoError(t, ioutil.WriteFile(udevControl, nil, 0600))
+
+	tests := []struct {
+		name        string
+		mode        string
+		fallback    string
+		udevControl string
+	}{
+		{name: "poll", mode: deviceWaitPoll},
+		{name: "uevent", mode: deviceWaitUevent, fallback: deviceWaitNone, udevControl: udevControl},
+		{name: "uevent without udev", mode: deviceWaitUevent, fallback: deviceWaitPoll, udevControl: filepath.Join(dir, "missing")},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			waiter := newDeviceWaiter(&Config{DeviceWait: test.mode, DeviceWaitFallback: test.fallback})
+			waiter.udevControl = test.udevControl
+
+			path := filepath.Join(dir, test.name)
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				ioutil.WriteFile(path, nil, 0600)
+			}()
+
+			require.NoError(t, waiter.wait(context.Background(), path))
+
+			_, err := os.Stat(path)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDeviceWaiterTimeout(t *testing.T) {
+	waiter := newDeviceWaiter(&Config{DeviceWait: deviceWaitPoll, DeviceWaitTimeoutDuration: 50 * time.Millisecond})
+	assert.Error(t, waiter.wait(context.Background(), "/dev/mapper/does-not-exist"))
+
+	waiter = newDeviceWaiter(&Config{DeviceWait: deviceWaitNone})
+	assert.NoError(t, waiter.wait(context.Background(), "/dev/mapper/does-not-exist"))
+}
@@ -19,13 +19,17 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/docker/go-units"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -36,8 +40,43 @@ import (
 const (
 	metadataFileName = "metadata.db"
 	fsTypeExt4       = "ext4"
+	fsTypeXFS        = "xfs"
+
+	// ReadOnlyLabel set to "true" on an active snapshot makes its mounts read-only, for containers
+	// that must not change their rootfs
+	ReadOnlyLabel = "containerd.io/snapshot/firecracker.readonly"
+
+	// SizeLabel is set on committed snapshots to the number of bytes mapped by their thin device (same as
+	// reported by Usage), so tools listing snapshots can tell their sizes without querying usage of each one
+	SizeLabel = "containerd.io/snapshot/firecracker.size"
+
+	// DeviceSizeLabel sets the virtual size of the thin device of a new snapshot (like "10GB"), instead of
+	// base_image_size for snapshots without a parent, or the size of the parent's device otherwise
+	DeviceSizeLabel = "containerd.io/snapshot/firecracker.device_size"
+
+	// FSTypeLabel picks the filesystem ("ext4" or "xfs") of a new snapshot without a parent instead of fs_type.
+	// Child snapshots share the filesystem of their parent, and inherit the label from it.
+	FSTypeLabel = "containerd.io/snapshot/firecracker.fs_type"
+
+	// MkfsOptionsLabel adds arguments (like "-b 4096") to mkfs of a new snapshot without a parent
+	MkfsOptionsLabel = "containerd.io/snapshot/firecracker.mkfs_options"
+
+	// MountOptionsLabel adds comma-separated options (like "noatime") to mounts of a snapshot
+	MountOptionsLabel = "containerd.io/snapshot/firecracker.mount_options"
+
+	// SourceImageLabel names a raw filesystem image (relative to source_image_dir), which is copied to the device
+	// of a new snapshot without a parent instead of making a new filesystem
+	SourceImageLabel = "containerd.io/snapshot/firecracker.source_image"
 )
 
+// mkfsArgs are arguments of mkfs.<fs_type> for supported filesystems, a device path is appended to them
+var mkfsArgs = map[string][]string{
+	// We don't want any zeroing in advance when running mkfs on thin devices (see "man mkfs.ext4")
+	fsTypeExt4: {"-E", "nodiscard,lazy_itable_init=0,lazy_journal_init=0"},
+	// Same for XFS, don't discard blocks of the empty device (see "man mkfs.xfs")
+	fsTypeXFS: {"-K"},
+}
+
 type closeFunc func() error
 
 // devmapper implements containerd's snapshotter (https://godoc.org/github.com/containerd/containerd/snapshots#Snapshotter)
@@ -48,6 +87,11 @@ type Snapshotter struct {
 	config    *Config
 	cleanupFn []closeFunc
 	closeOnce sync.Once
+	// Limits the number of mkfs processes running at once
+	mkfsSlots chan struct{}
+	remover   *deviceRemover
+	// Serializes sharing devices of committed snapshots with releasing devices of removed ones
+	shareLock sync.Mutex
 }
 
 func NewSnapshotter(ctx context.Context, configPath string) (*Snapshotter, error) {
@@ -60,6 +104,10 @@ func NewSnapshotter(ctx context.Context, configPath string) (*Snapshotter, error
 		return nil, err
 	}
 
+	if err := config.validateDevices(); err != nil {
+		return nil, err
+	}
+
 	if err := os.MkdirAll(config.RootPath, 0755); err != nil && !os.IsExist(err) {
 		return nil, errors.Wrapf(err, "failed to create root directory: %s", config.RootPath)
 	}
@@ -76,14 +124,54 @@ func NewSnapshotter(ctx context.Context, configPath string) (*Snapshotter, error
 		return nil, err
 	}
 
-	cleanupFn = append(cleanupFn, poolDevice.Close)
+	cleanupFn = append(cleanupFn, func() error {
+		return poolDevice.Close(ctx, true, config.DeactivatePoolOnClose)
+	})
 
-	return &Snapshotter{
+	dm := &Snapshotter{
 		store:     store,
 		config:    config,
 		pool:      poolDevice,
 		cleanupFn: cleanupFn,
-	}, nil
+		mkfsSlots: make(chan struct{}, config.MaxConcurrentMkfs),
+	}
+
+	if config.ReconcileOnStart {
+		// Leftover devices only waste pool space, the snapshotter can work without reclaiming them
+		if err := dm.reconcile(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to reconcile pool devices with snapshots")
+		}
+	}
+
+	dm.remover = newDeviceRemover(ctx, func(ctx context.Context, deviceName string) error {
+		return poolDevice.RemoveDevice(ctx, deviceName, true)
+	}, config.RemoveRetryCount, config.RemoveRetryBackoffDuration)
+
+	// Retry removals left by the previous run, the remover must be stopped before closing metadata stores
+	dm.cleanupFn = append([]closeFunc{dm.remover.close}, dm.cleanupFn...)
+	if err := dm.retryPendingRemovals(ctx); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to list devices pending removal")
+	}
+
+	if config.TrimIntervalDuration > 0 {
+		log.G(ctx).Infof("trimming idle devices every %s", config.TrimIntervalDuration)
+
+		// Trimmer should be stopped before closing metadata stores
+		dm.cleanupFn = append([]closeFunc{dm.startTrimmer(ctx)}, dm.cleanupFn...)
+	}
+
+	if config.PoolUsageIntervalDuration > 0 {
+		dm.cleanupFn = append([]closeFunc{dm.startUsageChecks(ctx)}, dm.cleanupFn...)
+	}
+
+	if config.BackupIntervalDuration > 0 {
+		log.G(ctx).Infof("backing up metadata to %s every %s", config.BackupDir, config.BackupIntervalDuration)
+
+		// Same as trimmer, backups must be stopped before closing metadata stores
+		dm.cleanupFn = append([]closeFunc{dm.startBackups(ctx)}, dm.cleanupFn...)
+	}
+
+	return dm, nil
 }
 
 func (dm *Snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
@@ -105,19 +193,89 @@ func (dm *Snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, er
 func (dm *Snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (snapshots.Info, error) {
 	log.G(ctx).Debugf("update: %s", strings.Join(fieldpaths, ", "))
 
-	var err error
+	size, resize, err := requestedResize(info, fieldpaths)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+
+	var (
+		snap    storage.Snapshot
+		options snapshotOptions
+		resized bool
+	)
+
 	err = dm.withTransaction(ctx, true, func(ctx context.Context) error {
+		_, current, _, err := storage.GetInfo(ctx, info.Name)
+		if err != nil {
+			return err
+		}
+
 		info, err = storage.UpdateInfo(ctx, info, fieldpaths...)
+		if err != nil {
+			return err
+		}
+
+		if options, err = parseSnapshotOptions(info.Labels, dm.config); err != nil {
+			return err
+		}
+
+		// Filesystem of a snapshot is made once
+		if info.Labels[FSTypeLabel] != current.Labels[FSTypeLabel] {
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "%s label of existing snapshot %q can't be changed", FSTypeLabel, info.Name)
+		}
+
+		if !resize {
+			return nil
+		}
+
+		snap, err = storage.GetSnapshot(ctx, info.Name)
+		if err != nil {
+			return err
+		}
+
+		resized, err = dm.resizeSnapshot(ctx, snap, size)
 		return err
 	})
 
-	return info, err
+	if err != nil || !resized {
+		return info, err
+	}
+
+	if err := dm.growFilesystem(ctx, snap, options.fsType); err != nil {
+		return info, errors.Wrapf(err, "resized device of snapshot %q, but failed to grow its filesystem", info.Name)
+	}
+
+	return info, nil
 }
 
+// Usage returns the space mapped by the snapshot's thin device, including blocks shared with its parent.
+// Inodes are not counted, as that would require mounting the device.
+// Usage of committed snapshots is recorded at commit time, the device doesn't change afterwards.
 func (dm *Snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, error) {
 	log.G(ctx).WithField("key", key).Debug("usage")
 
-	return snapshots.Usage{}, errors.New("usage not implemented")
+	var (
+		id    string
+		err   error
+		info  snapshots.Info
+		usage snapshots.Usage
+	)
+
+	err = dm.withTransaction(ctx, false, func(ctx context.Context) error {
+		id, info, usage, err = storage.GetInfo(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		if info.Kind == snapshots.KindActive {
+			deviceName := dm.getDeviceName(id)
+			usage.Size, err = dm.pool.GetUsage(deviceName)
+		}
+
+		return err
+	})
+
+	return usage, err
 }
 
 func (dm *Snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
@@ -125,79 +283,157 @@ func (dm *Snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, e
 
 	var (
 		snap storage.Snapshot
+		info snapshots.Info
 		err  error
 	)
 
 	err = dm.withTransaction(ctx, false, func(ctx context.Context) error {
 		snap, err = storage.GetSnapshot(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		_, info, _, err = storage.GetInfo(ctx, key)
 		return err
 	})
 
-	return dm.buildMounts(snap), nil
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := parseSnapshotOptions(info.Labels, dm.config)
+	if err != nil {
+		return nil, err
+	}
+
+	return dm.buildMounts(snap, options), nil
 }
 
 func (dm *Snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
 	log.G(ctx).WithFields(logrus.Fields{"key": key, "parent": parent}).Debug("prepare")
 
-	var (
-		mounts []mount.Mount
-		err    error
-	)
-
-	err = dm.withTransaction(ctx, true, func(ctx context.Context) error {
-		mounts, err = dm.createSnapshot(ctx, snapshots.KindActive, key, parent, opts...)
-		return err
-	})
-
-	return mounts, err
+	return dm.prepareSnapshot(ctx, snapshots.KindActive, key, parent, opts...)
 }
 
 func (dm *Snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
 	log.G(ctx).WithFields(logrus.Fields{"key": key, "parent": parent}).Debug("prepare")
 
+	return dm.prepareSnapshot(ctx, snapshots.KindView, key, parent, opts...)
+}
+
+func (dm *Snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	log.G(ctx).WithFields(logrus.Fields{"name": name, "key": key}).Debug("commit")
+
 	var (
-		mounts []mount.Mount
-		err    error
+		id   string
+		info snapshots.Info
 	)
 
-	err = dm.withTransaction(ctx, true, func(ctx context.Context) error {
-		mounts, err = dm.createSnapshot(ctx, snapshots.KindView, key, parent, opts...)
-		return err
-	})
+	err := dm.withTransaction(ctx, true, func(ctx context.Context) error {
+		var err error
+		id, info, _, err = storage.GetInfo(ctx, key)
+		if err != nil {
+			return err
+		}
 
-	return mounts, err
-}
+		size, err := dm.pool.GetUsage(dm.getDeviceName(id))
+		if err != nil {
+			return err
+		}
 
-func (dm *Snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
-	log.G(ctx).WithFields(logrus.Fields{"name": name, "key": key}).Debug("commit")
+		// Committed snapshot keeps the filesystem of the active one
+		commitOpts := append(opts[:len(opts):len(opts)], withSizeLabel(size))
+		if fsType, ok := info.Labels[FSTypeLabel]; ok {
+			var committed snapshots.Info
+			for _, opt := range opts {
+				if err := opt(&committed); err != nil {
+					return err
+				}
+			}
 
-	return dm.withTransaction(ctx, true, func(ctx context.Context) error {
-		_, err := storage.CommitActive(ctx, key, name, snapshots.Usage{}, opts...)
+			if err := checkFSTypeLabel(committed.Labels, fsType, key); err != nil {
+				return err
+			}
+
+			commitOpts = append(commitOpts, withLabel(FSTypeLabel, fsType))
+		}
+
+		_, err = storage.CommitActive(ctx, key, name, snapshots.Usage{Size: size}, commitOpts...)
 		return err
 	})
+
+	if err != nil || !dm.config.ShareBaseLayers {
+		return err
+	}
+
+	// Sharing only saves pool space, the committed snapshot works with its own device as well
+	if err := dm.shareCommitted(ctx, id, name, dm.fsType(info.Labels)); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to share device of snapshot %q", name)
+	}
+
+	return nil
 }
 
 func (dm *Snapshotter) Remove(ctx context.Context, key string) error {
 	log.G(ctx).WithField("key", key).Debug("remove")
 
-	return dm.withTransaction(ctx, true, func(ctx context.Context) error {
-		return dm.removeDevice(ctx, key)
+	var snapID string
+	err := dm.withTransaction(ctx, true, func(ctx context.Context) error {
+		var err error
+		snapID, _, err = storage.Remove(ctx, key)
+		return err
 	})
-}
 
-func (dm *Snapshotter) removeDevice(ctx context.Context, key string) error {
-	snapID, _, err := storage.Remove(ctx, key)
 	if err != nil {
 		return err
 	}
 
-	deviceName := dm.getDeviceName(snapID)
-	if err := dm.pool.RemoveDevice(ctx, deviceName, true); err != nil {
-		log.G(ctx).WithError(err).Errorf("failed to remove device")
-		return err
+	dm.removeDevice(ctx, snapID)
+	return nil
+}
+
+// removeDevice removes the device of a snapshot once the snapshot is removed from the metastore, unless other
+// snapshots share it. If the device fails to be removed, it's marked pending removal and removed later. Devices
+// left behind if the snapshotter stops in the meantime are deleted by reconcile.
+func (dm *Snapshotter) removeDevice(ctx context.Context, snapID string) {
+	// Devices can't be shared while they are released
+	dm.shareLock.Lock()
+	defer dm.shareLock.Unlock()
+
+	deviceName, last, err := dm.pool.metadata.ReleaseDevice(ctx, dm.getDeviceName(snapID))
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("device", deviceName).Error("failed to release device of removed snapshot")
+		return
 	}
 
-	return nil
+	if !last {
+		log.G(ctx).WithField("device", deviceName).Debug("device is still used by other snapshots")
+		return
+	}
+
+	err = dm.pool.RemoveDevice(ctx, deviceName, true)
+	if err == nil {
+		return
+	}
+
+	if errors.Cause(err) == ErrNotFound {
+		log.G(ctx).WithField("device", deviceName).Warn("device of removed snapshot doesn't exist")
+		return
+	}
+
+	log.G(ctx).WithError(err).WithField("device", deviceName).Warn("failed to remove device, will retry later")
+	if err := dm.pool.SetPendingRemoval(ctx, deviceName, true); err != nil {
+		log.G(ctx).WithError(err).WithField("device", deviceName).Error("failed to mark device pending removal")
+		return
+	}
+
+	dm.remover.schedule(deviceName)
+}
+
+// StuckDevices returns the number of devices left behind by removed snapshots which failed to be
+// removed after all retries. They are retried again when the snapshotter restarts.
+func (dm *Snapshotter) StuckDevices() int {
+	return dm.remover.stuckDevices()
 }
 
 func (dm *Snapshotter) Walk(ctx context.Context, fn func(context.Context, snapshots.Info) error) error {
@@ -222,60 +458,180 @@ func (dm *Snapshotter) Close() error {
 	return result.ErrorOrNil()
 }
 
-func (dm *Snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
-	snap, err := storage.CreateSnapshot(ctx, kind, key, parent, opts...)
+// prepareSnapshot creates a snapshot device and makes a filesystem on it (or copies an image to it) if the
+// snapshot has no parent.
+// Waiting for the device node and mkfs are slow, so they run outside of metadata transaction which allows
+// concurrent creates (up to max_concurrent_mkfs for mkfs) instead of serializing them on the store lock.
+func (dm *Snapshotter) prepareSnapshot(ctx context.Context, kind snapshots.Kind, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	var info snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&info); err != nil {
+			return nil, err
+		}
+	}
+
+	size, err := deviceSize(info.Labels)
 	if err != nil {
 		return nil, err
 	}
 
+	options, err := parseSnapshotOptions(info.Labels, dm.config)
+	if err != nil {
+		return nil, err
+	}
+
+	var image string
+	if parent == "" {
+		imageSize := size
+		if imageSize == 0 {
+			imageSize = dm.config.BaseImageSizeBytes
+		}
+
+		if image, err = dm.sourceImage(info.Labels, imageSize); err != nil {
+			return nil, err
+		}
+	}
+
+	// Checked before taking the store lock, so requests fail fast when the pool is nearly full
+	if err := dm.checkPoolSpace(ctx); err != nil {
+		return nil, err
+	}
+
+	var (
+		snap  storage.Snapshot
+		start = time.Now()
+	)
+
+	err = dm.withTransaction(ctx, true, func(ctx context.Context) error {
+		createOpts := opts
+		if parent != "" {
+			fsTypeOpt, err := dm.inheritFilesystem(ctx, parent, info.Labels, &options)
+			if err != nil {
+				return err
+			}
+
+			if fsTypeOpt != nil {
+				createOpts = append(createOpts[:len(createOpts):len(createOpts)], fsTypeOpt)
+			}
+		}
+
+		var err error
+		snap, err = dm.createSnapshot(ctx, kind, key, parent, size, createOpts...)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	deviceName := dm.getDeviceName(snap.ID)
+	created := time.Now()
+
+	if err := dm.pool.WaitDevice(ctx, deviceName); err != nil {
+		dm.cleanupPrepared(ctx, key)
+		return nil, errors.Wrapf(err, "failed to wait for device %q of snapshot %q", deviceName, key)
+	}
+
+	activated := time.Now()
+	mounts := dm.buildMounts(snap, options)
+
+	if image != "" {
+		if err := dm.copyImage(ctx, image, deviceName); err != nil {
+			dm.cleanupPrepared(ctx, key)
+			return nil, errors.Wrapf(err, "failed to create snapshot %q (device %q) from image", key, deviceName)
+		}
+	} else if len(snap.ParentIDs) == 0 {
+		if err := dm.mkfs(ctx, deviceName, options); err != nil {
+			dm.cleanupPrepared(ctx, key)
+			return nil, errors.Wrapf(err, "failed to create filesystem for snapshot %q (device %q)", key, deviceName)
+		}
+
+		// mkfs.ext4 makes lost+found, which isn't expected by container images (nor by containerd's
+		// snapshotter test suite), but removing it takes a mount, so it's only done on request
+		if dm.config.RemoveLostFound {
+			_ = mount.WithTempMount(ctx, mounts, func(root string) error {
+				return os.Remove(filepath.Join(root, "lost+found"))
+			})
+		}
+	}
+
+	log.G(ctx).WithFields(logrus.Fields{
+		"key":      key,
+		"device":   deviceName,
+		"create":   created.Sub(start),
+		"activate": activated.Sub(created),
+		"mkfs":     time.Since(activated),
+		"total":    time.Since(start),
+	}).Debug("prepared snapshot")
+
+	return mounts, nil
+}
+
+// cleanupPrepared removes a snapshot which failed to be prepared after its device was created
+func (dm *Snapshotter) cleanupPrepared(ctx context.Context, key string) {
+	if err := dm.Remove(ctx, key); err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to cleanup snapshot %q", key)
+	}
+}
+
+// createSnapshot creates a snapshot along with its thin device of the given size, zero size picks the default
+func (dm *Snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, key, parent string, size uint64, opts ...snapshots.Opt) (storage.Snapshot, error) {
+	snap, err := storage.CreateSnapshot(ctx, kind, key, parent, opts...)
+	if err != nil {
+		return storage.Snapshot{}, err
+	}
+
 	if len(snap.ParentIDs) == 0 {
 		deviceName := dm.getDeviceName(snap.ID)
 		log.G(ctx).Debugf("creating new thin device '%s'", deviceName)
 
-		err := dm.pool.CreateThinDevice(ctx, deviceName, dm.config.BaseImageSizeBytes)
-		if err != nil {
-			log.G(ctx).WithError(err).Errorf("failed to create thin device for snapshot %s", snap.ID)
-			return nil, err
+		if size == 0 {
+			size = dm.config.BaseImageSizeBytes
 		}
 
-		if err := dm.mkfs(ctx, deviceName); err != nil {
-			return nil, err
+		err := dm.pool.CreateThinDevice(ctx, deviceName, size)
+		if err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to create thin device for snapshot %s", snap.ID)
+			return storage.Snapshot{}, err
 		}
 	} else {
-		parentDeviceName := dm.getDeviceName(snap.ParentIDs[0])
+		parentDeviceName, err := dm.resolveDeviceName(ctx, snap.ParentIDs[0])
+		if err != nil {
+			return storage.Snapshot{}, err
+		}
+
 		snapDeviceName := dm.getDeviceName(snap.ID)
 		log.G(ctx).Debugf("creating snapshot device '%s' from '%s'", snapDeviceName, parentDeviceName)
 
-		err := dm.pool.CreateSnapshotDevice(ctx, parentDeviceName, snapDeviceName, dm.config.BaseImageSizeBytes)
+		err = dm.pool.CreateSnapshotDevice(ctx, parentDeviceName, snapDeviceName, size)
 		if err != nil {
 			log.G(ctx).WithError(err).Errorf("failed to create snapshot device from parent %s", parentDeviceName)
-			return nil, err
+			return storage.Snapshot{}, err
 		}
 	}
 
-	mounts := dm.buildMounts(snap)
-
-	// Remove default directories not expected by the container image
-	_ = mount.WithTempMount(ctx, mounts, func(root string) error {
-		return os.Remove(filepath.Join(root, "lost+found"))
-	})
-
-	return mounts, nil
+	return snap, nil
 }
 
-func (dm *Snapshotter) mkfs(ctx context.Context, deviceName string) error {
-	args := []string{
-		"-E",
-		// We don't want any zeroing in advance when running mkfs on thin devices (see "man mkfs.ext4")
-		"nodiscard,lazy_itable_init=0,lazy_journal_init=0",
-		dmsetup.GetFullDevicePath(deviceName),
+// mkfs makes a filesystem of the given snapshot options on a device, mkfs options of the snapshot follow
+// the default ones, so they take precedence
+func (dm *Snapshotter) mkfs(ctx context.Context, deviceName string, options snapshotOptions) error {
+	select {
+	case dm.mkfsSlots <- struct{}{}:
+		defer func() { <-dm.mkfsSlots }()
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	log.G(ctx).Debugf("mkfs.ext4 %s", strings.Join(args, " "))
-	output, err := exec.Command("mkfs.ext4", args...).CombinedOutput()
+	binary := "mkfs." + options.fsType
+	args := append(append([]string{}, mkfsArgs[options.fsType]...), options.mkfsOptions...)
+	args = append(args, dmsetup.GetFullDevicePath(deviceName))
+
+	log.G(ctx).Debugf("%s %s", binary, strings.Join(args, " "))
+	output, err := exec.Command(binary, args...).CombinedOutput()
 	if err != nil {
-		log.G(ctx).WithError(err).Errorf("failed to write fs:\n%s", string(output))
-		return err
+		log.G(ctx).WithError(err).Errorf("failed to write fs on device %q:\n%s", deviceName, string(output))
+		return errors.Wrapf(err, "%s failed: %s", binary, string(output))
 	}
 
 	log.G(ctx).Debugf("mkfs:\n%s", string(output))
@@ -292,17 +648,59 @@ func (dm *Snapshotter) getDevicePath(snap storage.Snapshot) string {
 	return dmsetup.GetFullDevicePath(name)
 }
 
-func (dm *Snapshotter) buildMounts(snap storage.Snapshot) []mount.Mount {
+// deviceSize returns the thin device size requested by snapshot labels, or zero if not requested
+func deviceSize(labels map[string]string) (uint64, error) {
+	value, ok := labels[DeviceSizeLabel]
+	if !ok {
+		return 0, nil
+	}
+
+	size, err := units.RAMInBytes(value)
+	if err != nil || size <= 0 {
+		return 0, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s label %q", DeviceSizeLabel, value)
+	}
+
+	return uint64(size), nil
+}
+
+// withSizeLabel adds SizeLabel to labels of a snapshot, keeping labels set by other options
+func withSizeLabel(size int64) snapshots.Opt {
+	return withLabel(SizeLabel, strconv.FormatInt(size, 10))
+}
+
+// withLabel adds a label to labels of a snapshot, keeping labels set by other options
+func withLabel(key, value string) snapshots.Opt {
+	return func(info *snapshots.Info) error {
+		// Labels may be shared with the caller, so they're copied instead of changed in place
+		labels := make(map[string]string, len(info.Labels)+1)
+		for k, v := range info.Labels {
+			labels[k] = v
+		}
+
+		labels[key] = value
+		info.Labels = labels
+		return nil
+	}
+}
+
+func (dm *Snapshotter) buildMounts(snap storage.Snapshot, snapOptions snapshotOptions) []mount.Mount {
+	return buildDeviceMounts(dm.getDeviceName(snap.ID), snap.Kind, snapOptions)
+}
+
+// buildDeviceMounts returns mounts of the given device, for committed snapshots which may share devices
+func buildDeviceMounts(deviceName string, kind snapshots.Kind, snapOptions snapshotOptions) []mount.Mount {
 	var options []string
 
-	if snap.Kind != snapshots.KindActive {
+	if kind != snapshots.KindActive || snapOptions.readOnly {
 		options = append(options, "ro")
 	}
 
+	options = append(options, snapOptions.mountOptions...)
+
 	mounts := []mount.Mount{
 		{
-			Source:  dm.getDevicePath(snap),
-			Type:    fsTypeExt4,
+			Source:  dmsetup.GetFullDevicePath(deviceName),
+			Type:    snapOptions.fsType,
 			Options: options,
 		},
 	}
@@ -310,12 +708,43 @@ func (dm *Snapshotter) buildMounts(snap storage.Snapshot) []mount.Mount {
 	return mounts
 }
 
-// withTransaction wraps fn callback with containerd's meta store transaction.
-// If callback returns an error or transaction is not writable, database transaction will be discarded.
+// withTransaction runs fn within metadata store transaction.
+// Transactions that failed to start due to transient store contention (like a lock timeout) are retried
+// with exponential backoff according to tx_retry_count and tx_retry_backoff. Once fn has been called,
+// the transaction is never retried as fn may have already changed the state of the pool.
 func (dm *Snapshotter) withTransaction(ctx context.Context, writable bool, fn func(ctx context.Context) error) error {
-	ctx, trans, err := dm.store.TransactionContext(ctx, writable)
+	backoff := dm.config.TxRetryBackoffDuration
+
+	for attempt := 0; ; attempt++ {
+		retryable, err := dm.runTransaction(ctx, writable, fn)
+		if err == nil || !retryable || attempt >= dm.config.TxRetryCount {
+			return err
+		}
+
+		log.G(ctx).WithError(err).Debugf("transaction failed, retrying in %s (attempt %d of %d)",
+			backoff, attempt+1, dm.config.TxRetryCount)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
+
+// beginTransaction starts a new metadata store transaction, replaced in tests to simulate store contention.
+var beginTransaction = func(ctx context.Context, store *storage.MetaStore, writable bool) (context.Context, storage.Transactor, error) {
+	return store.TransactionContext(ctx, writable)
+}
+
+// runTransaction makes a single transaction attempt.
+// Returned error is retryable only when the transaction failed to start, so fn hasn't been called.
+func (dm *Snapshotter) runTransaction(ctx context.Context, writable bool, fn func(ctx context.Context) error) (bool, error) {
+	ctx, trans, err := beginTransaction(ctx, dm.store, writable)
 	if err != nil {
-		return err
+		return isTransientError(err), err
 	}
 
 	var result *multierror.Error
@@ -343,11 +772,11 @@ func (dm *Snapshotter) withTransaction(ctx context.Context, writable bool, fn fu
 
 		// Unwrap if just one error
 		if result.Len() == 1 {
-			return result.Errors[0]
+			return false, result.Errors[0]
 		}
 
-		return err
+		return false, err
 	}
 
-	return nil
+	return false, nil
 }
@@ -22,7 +22,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/containerd/snapshots/testsuite"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -46,6 +48,8 @@ func TestSnapshotterSuite(t *testing.T) {
 			MetadataDevice: loopMetaDevice,
 			DataBlockSize:  "64Kb",
 			BaseImageSize:  "16Mb",
+			// The suite expects new snapshots to be empty
+			RemoveLostFound: true,
 		}
 
 		configPath := filepath.Join(root, "config.json")
@@ -83,3 +87,60 @@ func saveConfig(t *testing.T, path string, config *Config) {
 	err = ioutil.WriteFile(path, data, 0700)
 	require.NoError(t, err)
 }
+
+func TestBuildMountsReadOnly(t *testing.T) {
+	dm := &Snapshotter{config: &Config{PoolName: "pool", FSType: fsTypeExt4}}
+
+	mounts := dm.buildMounts(storage.Snapshot{ID: "1", Kind: snapshots.KindActive}, snapshotOptions{fsType: fsTypeExt4})
+	require.Len(t, mounts, 1)
+	assert.Equal(t, "/dev/mapper/pool-snap-1", mounts[0].Source)
+	assert.Equal(t, fsTypeExt4, mounts[0].Type)
+	assert.Empty(t, mounts[0].Options)
+
+	options, err := parseSnapshotOptions(map[string]string{ReadOnlyLabel: "true"}, &Config{FSType: fsTypeExt4})
+	require.NoError(t, err)
+	mounts = dm.buildMounts(storage.Snapshot{ID: "1", Kind: snapshots.KindActive}, options)
+	assert.Equal(t, []string{"ro"}, mounts[0].Options)
+
+	mounts = dm.buildMounts(storage.Snapshot{ID: "2", Kind: snapshots.KindView}, snapshotOptions{fsType: fsTypeExt4})
+	assert.Equal(t, []string{"ro"}, mounts[0].Options)
+
+	options, err = parseSnapshotOptions(map[string]string{ReadOnlyLabel: "false"}, &Config{FSType: fsTypeExt4})
+	require.NoError(t, err)
+	assert.False(t, options.readOnly)
+
+	options, err = parseSnapshotOptions(nil, &Config{FSType: fsTypeExt4})
+	require.NoError(t, err)
+	assert.False(t, options.readOnly)
+}
+
+func TestSizeLabel(t *testing.T) {
+	var info snapshots.Info
+	require.NoError(t, withSizeLabel(4096)(&info))
+	assert.Equal(t, map[string]string{SizeLabel: "4096"}, info.Labels)
+
+	info = snapshots.Info{}
+	labels := map[string]string{"foo": "bar"}
+	opts := []snapshots.Opt{snapshots.WithLabels(labels), withSizeLabel(0)}
+	for _, opt := range opts {
+		require.NoError(t, opt(&info))
+	}
+
+	assert.Equal(t, map[string]string{"foo": "bar", SizeLabel: "0"}, info.Labels)
+	assert.Equal(t, map[string]string{"foo": "bar"}, labels)
+}
+
+func TestDeviceSize(t *testing.T) {
+	size, err := deviceSize(nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, size)
+
+	size, err = deviceSize(map[string]string{DeviceSizeLabel: "10GB"})
+	require.NoError(t, err)
+	assert.EqualValues(t, 10*1024*1024*1024, size)
+
+	for _, value := range []string{"", "big", "0", "-1GB"} {
+		_, err = deviceSize(map[string]string{DeviceSizeLabel: value})
+		assert.Truef(t, errdefs.IsInvalidArgument(err), "expected invalid argument error for %q, got %v", value, err)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// lost+found is made by mkfs.ext4 on new devices, it's not a part of the snapshot's content
+const lostAndFound = "lost+found"
+
+// Mount options keeping filesystems from writing to their devices (replaying their journals) when mounted
+// read-only. XFS also refuses to mount a snapshot next to its parent, which has the same UUID, unless told to.
+var exportMountOptions = map[string][]string{
+	fsTypeExt4: {"noload"},
+	fsTypeXFS:  {"norecovery", "nouuid"},
+}
+
+// exportTarget is a committed snapshot to mount for export
+type exportTarget struct {
+	name   string
+	snap   storage.Snapshot
+	device string
+	fsType string
+}
+
+// Export writes the filesystem of a committed snapshot to w as a tar stream. If parent is given (the name of
+// a committed ancestor of the snapshot), only the changes since the parent are written: the thin device of a
+// snapshot starts as a copy of its parent's, so files are compared between both filesystems, and files removed
+// since the parent are written as whiteouts (like in OCI image layers).
+// Devices are mounted read-only without journal recovery, so neither of the snapshots is changed.
+func (dm *Snapshotter) Export(ctx context.Context, w io.Writer, name, parent string) error {
+	log.G(ctx).WithFields(logrus.Fields{"name": name, "parent": parent}).Debug("export")
+
+	var targets []exportTarget
+	err := dm.withTransaction(ctx, false, func(ctx context.Context) error {
+		target, err := dm.exportTarget(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		targets = append(targets, target)
+		if parent == "" {
+			return nil
+		}
+
+		if err := checkAncestor(ctx, name, parent); err != nil {
+			return err
+		}
+
+		target, err = dm.exportTarget(ctx, parent)
+		if err != nil {
+			return err
+		}
+
+		targets = append(targets, target)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return mount.WithTempMount(ctx, dm.exportMounts(targets[0]), func(root string) error {
+		if len(targets) == 1 {
+			return writeFilteredDiff(ctx, w, "", root)
+		}
+
+		return mount.WithTempMount(ctx, dm.exportMounts(targets[1]), func(parentRoot string) error {
+			return writeFilteredDiff(ctx, w, parentRoot, root)
+		})
+	})
+}
+
+// exportTarget looks up a committed snapshot whose device is active, so it can be mounted
+func (dm *Snapshotter) exportTarget(ctx context.Context, name string) (exportTarget, error) {
+	id, info, _, err := storage.GetInfo(ctx, name)
+	if err != nil {
+		return exportTarget{}, err
+	}
+
+	if info.Kind != snapshots.KindCommitted {
+		return exportTarget{}, errors.Wrapf(errdefs.ErrFailedPrecondition, "snapshot %q isn't committed", name)
+	}
+
+	deviceName, err := dm.resolveDeviceName(ctx, id)
+	if err != nil {
+		return exportTarget{}, err
+	}
+
+	device, err := dm.pool.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return exportTarget{}, errors.Wrapf(err, "failed to query device %q", deviceName)
+	}
+
+	if !device.IsActivated {
+		return exportTarget{}, errors.Wrapf(errdefs.ErrFailedPrecondition, "device %q of snapshot %q isn't active", deviceName, name)
+	}
+
+	return exportTarget{
+		name:   name,
+		snap:   storage.Snapshot{ID: id, Kind: info.Kind},
+		device: deviceName,
+		fsType: dm.fsType(info.Labels),
+	}, nil
+}
+
+// exportMounts returns read-only mounts of the snapshot, which don't write to the device either
+func (dm *Snapshotter) exportMounts(target exportTarget) []mount.Mount {
+	mounts := buildDeviceMounts(target.device, target.snap.Kind, snapshotOptions{fsType: target.fsType, readOnly: true})
+	for i := range mounts {
+		mounts[i].Options = append(mounts[i].Options, exportMountOptions[target.fsType]...)
+	}
+
+	return mounts
+}
+
+// checkAncestor checks parent is one of the snapshots the named one is based on
+func checkAncestor(ctx context.Context, name, parent string) error {
+	for current := name; ; {
+		_, info, _, err := storage.GetInfo(ctx, current)
+		if err != nil {
+			return err
+		}
+
+		if info.Parent == "" {
+			return errors.Wrapf(errdefs.ErrInvalidArgument, "snapshot %q isn't based on %q", name, parent)
+		}
+
+		if info.Parent == parent {
+			return nil
+		}
+
+		current = info.Parent
+	}
+}
+
+// writeFilteredDiff writes the changes of upper since lower (everything in upper if lower is empty)
+// as a tar stream, leaving out lost+found in the root of the filesystem
+func writeFilteredDiff(ctx context.Context, w io.Writer, lower, upper string) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(archive.WriteDiff(ctx, writer, lower, upper))
+	}()
+
+	err := filterTar(w, reader, isLostAndFound)
+	// Unblocks the diff if filtering failed
+	reader.CloseWithError(err)
+	return err
+}
+
+// isLostAndFound returns true for lost+found in the root of the filesystem, its content or its whiteout
+func isLostAndFound(name string) bool {
+	name = strings.TrimPrefix(name, "/")
+	return name == lostAndFound || name == lostAndFound+"/" || name == ".wh."+lostAndFound ||
+		strings.HasPrefix(name, lostAndFound+"/")
+}
+
+// filterTar copies the tar stream from r to w, leaving out entries exclude returns true for
+func filterTar(w io.Writer, r io.Reader, exclude func(name string) bool) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "failed to read tar stream")
+		}
+
+		if exclude(hdr.Name) {
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "failed to write header of %q", hdr.Name)
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.Wrapf(err, "failed to write %q", hdr.Name)
+		}
+	}
+
+	return tw.Close()
+}
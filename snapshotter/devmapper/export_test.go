@@ -0,0 +1,136 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tarNames returns the sorted names of entries in the tar stream
+func tarNames(t *testing.T, r io.Reader) []string {
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func TestWriteFilteredDiff(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "export-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	modTime := time.Unix(1500000000, 0)
+	lower := filepath.Join(tempDir, "lower")
+	upper := filepath.Join(tempDir, "upper")
+	for _, root := range []string{lower, upper} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, lostAndFound), 0700))
+		require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("vm"), 0644))
+		// Files a snapshot shares with its parent have the same metadata
+		require.NoError(t, os.Chtimes(filepath.Join(root, "etc", "hostname"), modTime, modTime))
+	}
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(lower, "etc", "motd"), []byte("hello"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(upper, "app"), []byte("binary"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(upper, lostAndFound, "#12"), []byte("orphan"), 0600))
+
+	var full bytes.Buffer
+	require.NoError(t, writeFilteredDiff(context.Background(), &full, "", upper))
+	assert.Equal(t, []string{"app", "etc/", "etc/hostname"}, tarNames(t, &full))
+
+	// Only changes since lower, removed files as whiteouts
+	var diff bytes.Buffer
+	require.NoError(t, writeFilteredDiff(context.Background(), &diff, lower, upper))
+	assert.Equal(t, []string{"app", "etc/", "etc/.wh.motd"}, tarNames(t, &diff))
+}
+
+func TestIsLostAndFound(t *testing.T) {
+	for _, name := range []string{"lost+found", "lost+found/", "/lost+found/#12", ".wh.lost+found"} {
+		assert.True(t, isLostAndFound(name), name)
+	}
+
+	for _, name := range []string{"etc/lost+found", "lost+found.txt", "app"} {
+		assert.False(t, isLostAndFound(name), name)
+	}
+}
+
+func TestExportMounts(t *testing.T) {
+	dm := &Snapshotter{config: &Config{PoolName: "pool"}}
+	snap := storage.Snapshot{ID: "3", Kind: snapshots.KindCommitted}
+
+	mounts := dm.exportMounts(exportTarget{snap: snap, device: "pool-snap-3", fsType: fsTypeExt4})
+	require.Len(t, mounts, 1)
+	assert.Equal(t, "/dev/mapper/pool-snap-3", mounts[0].Source)
+	assert.Equal(t, []string{"ro", "noload"}, mounts[0].Options)
+
+	mounts = dm.exportMounts(exportTarget{snap: snap, device: "pool-snap-3", fsType: fsTypeXFS})
+	assert.Equal(t, []string{"ro", "norecovery", "nouuid"}, mounts[0].Options)
+}
+
+func TestCheckAncestor(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "export-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	store, err := storage.NewMetaStore(filepath.Join(tempDir, metadataFileName))
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx, tx, err := store.TransactionContext(context.Background(), true)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	parent := ""
+	for _, name := range []string{"base", "layer-1", "layer-2"} {
+		_, err := storage.CreateSnapshot(ctx, snapshots.KindActive, name+"-active", parent)
+		require.NoError(t, err)
+		_, err = storage.CommitActive(ctx, name+"-active", name, snapshots.Usage{})
+		require.NoError(t, err)
+		parent = name
+	}
+
+	assert.NoError(t, checkAncestor(ctx, "layer-2", "layer-1"))
+	assert.NoError(t, checkAncestor(ctx, "layer-2", "base"))
+
+	err = checkAncestor(ctx, "layer-1", "layer-2")
+	assert.True(t, errdefs.IsInvalidArgument(err))
+
+	err = checkAncestor(ctx, "missing", "base")
+	assert.True(t, errdefs.IsNotFound(err))
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+// sourceImage returns the path of the raw image a new snapshot without a parent is created from, or an empty
+// string if the snapshot gets a new filesystem instead. Images have to be regular files under source_image_dir
+// which fit into the snapshot's device of deviceSize bytes.
+func (dm *Snapshotter) sourceImage(labels map[string]string, deviceSize uint64) (string, error) {
+	value, ok := labels[SourceImageLabel]
+	if !ok {
+		return "", nil
+	}
+
+	if dm.config.SourceImageDir == "" {
+		return "", errors.Wrapf(errdefs.ErrInvalidArgument, "%s label requires source_image_dir to be configured", SourceImageLabel)
+	}
+
+	if _, ok := labels[MkfsOptionsLabel]; ok {
+		return "", errors.Wrapf(errdefs.ErrInvalidArgument, "%s label can't be combined with %s, images have a filesystem already",
+			MkfsOptionsLabel, SourceImageLabel)
+	}
+
+	dir, err := filepath.EvalSymlinks(dm.config.SourceImageDir)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve source_image_dir %q", dm.config.SourceImageDir)
+	}
+
+	// Cleaning the value as an absolute path drops ".." elements leading out of the directory, symlinks
+	// are resolved for the same reason
+	path, err := filepath.EvalSymlinks(filepath.Join(dir, filepath.Clean("/"+value)))
+	if err != nil {
+		return "", errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s label %q: %v", SourceImageLabel, value, err)
+	}
+
+	if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", errors.Wrapf(errdefs.ErrInvalidArgument, "%s label %q points outside of source_image_dir", SourceImageLabel, value)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to stat image %q", path)
+	}
+
+	if !stat.Mode().IsRegular() || stat.Size() == 0 {
+		return "", errors.Wrapf(errdefs.ErrInvalidArgument, "image %q is not a regular non-empty file", path)
+	}
+
+	if uint64(stat.Size()) > deviceSize {
+		return "", errors.Wrapf(errdefs.ErrInvalidArgument, "image %q of %d bytes doesn't fit into device of %d bytes, set %s label",
+			path, stat.Size(), deviceSize, DeviceSizeLabel)
+	}
+
+	return path, nil
+}
+
+// copyImage writes a raw image to a device. Like mkfs, copies are limited by max_concurrent_mkfs.
+func (dm *Snapshotter) copyImage(ctx context.Context, image, deviceName string) error {
+	select {
+	case dm.mkfsSlots <- struct{}{}:
+		defer func() { <-dm.mkfsSlots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	src, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	dst, err := os.OpenFile(dmsetup.GetFullDevicePath(deviceName), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	defer dst.Close()
+
+	blockSize := int(dm.config.DataBlockSizeSectors) * dmsetup.SectorSize
+	written, err := copySparse(ctx, dst, src, blockSize)
+	if err != nil {
+		return errors.Wrapf(err, "failed to copy image %q", image)
+	}
+
+	if err := dst.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to flush device %q", deviceName)
+	}
+
+	log.G(ctx).Debugf("copied %d bytes of image %q to device %q", written, image, deviceName)
+	return nil
+}
+
+// copySparse copies src to dst in chunks of blockSize bytes, skipping chunks of zeros. Blocks never written
+// stay unallocated in the pool (and read as zeros), so only the data of an image takes space. Chunks match
+// pool blocks, as partially written blocks aren't zeroed by pools with skip_block_zeroing.
+// Returns the number of bytes written.
+func copySparse(ctx context.Context, dst io.WriterAt, src io.Reader, blockSize int) (int64, error) {
+	var (
+		buf     = make([]byte, blockSize)
+		zeros   = make([]byte, blockSize)
+		offset  int64
+		written int64
+	)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		n, err := io.ReadFull(src, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zeros[:n]) {
+			if _, err := dst.WriteAt(buf[:n], offset); err != nil {
+				return written, err
+			}
+
+			written += int64(n)
+		}
+
+		offset += int64(n)
+
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return written, nil
+		default:
+			return written, err
+		}
+	}
+}
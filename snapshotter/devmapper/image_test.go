@@ -0,0 +1,89 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopySparse(t *testing.T) {
+	const blockSize = 4096
+
+	data := make([]byte, 3*blockSize+100)
+	copy(data[10:], "first block")
+	copy(data[2*blockSize+blockSize/2:], "third block")
+	copy(data[3*blockSize:], "tail")
+
+	dst, err := ioutil.TempFile("", "devmapper-copy-")
+	require.NoError(t, err)
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	written, err := copySparse(context.Background(), dst, bytes.NewReader(data), blockSize)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2*blockSize+100, written, "second block of zeros should be skipped")
+
+	copied, err := ioutil.ReadFile(dst.Name())
+	require.NoError(t, err)
+	assert.Equal(t, data, copied)
+}
+
+func TestSourceImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devmapper-images-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	imagesDir := filepath.Join(dir, "images")
+	require.NoError(t, os.Mkdir(imagesDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(imagesDir, "golden.img"), make([]byte, 1024), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret.img"), make([]byte, 1024), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "secret.img"), filepath.Join(imagesDir, "link.img")))
+
+	dm := &Snapshotter{config: &Config{}}
+
+	image, err := dm.sourceImage(nil, 4096)
+	require.NoError(t, err)
+	assert.Empty(t, image)
+
+	_, err = dm.sourceImage(map[string]string{SourceImageLabel: "golden.img"}, 4096)
+	assert.True(t, errdefs.IsInvalidArgument(err), "images are disabled without source_image_dir, got %v", err)
+
+	dm.config.SourceImageDir = imagesDir
+	image, err = dm.sourceImage(map[string]string{SourceImageLabel: "golden.img"}, 4096)
+	require.NoError(t, err)
+	assert.Equal(t, "golden.img", filepath.Base(image))
+
+	_, err = dm.sourceImage(map[string]string{SourceImageLabel: "golden.img"}, 512)
+	assert.True(t, errdefs.IsInvalidArgument(err), "image larger than device should be rejected, got %v", err)
+
+	for _, labels := range []map[string]string{
+		{SourceImageLabel: "../secret.img"},
+		{SourceImageLabel: "link.img"},
+		{SourceImageLabel: "missing.img"},
+		{SourceImageLabel: "."},
+		{SourceImageLabel: "golden.img", MkfsOptionsLabel: "-b 4096"},
+	} {
+		_, err := dm.sourceImage(labels, 4096)
+		assert.Truef(t, errdefs.IsInvalidArgument(err), "labels %v should be rejected, got %v", labels, err)
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"strconv"
 
 	"github.com/pkg/errors"
@@ -35,6 +36,16 @@ type DeviceInfo struct {
 	ParentName string `json:"parent_name"`
 	// IsActivated indicates whether thin device was actived
 	IsActivated bool `json:"is_active"`
+	// PendingRemoval indicates that the device's snapshot is gone, but the device failed to be deactivated
+	PendingRemoval bool `json:"pending_removal"`
+}
+
+// SharedDevice is a committed device used by all snapshots committed for the same chain of layers
+type SharedDevice struct {
+	// DeviceName is the name of the device in /dev/mapper/, the one of the first snapshot committed for the chain
+	DeviceName string `json:"device_name"`
+	// Refs are the device names of the snapshots using the device, it's deleted once none are left
+	Refs []string `json:"refs"`
 }
 
 type (
@@ -55,8 +66,11 @@ const (
 
 // Bucket names
 var (
-	devicesBucketName  = []byte("devices")    // Contains thin devices metadata <device_name>=<DeviceInfo>
-	deviceIDBucketName = []byte("device_ids") // Tracks used device ids <device_id_[0..maxDeviceID)>=<byte_[0/1]>
+	devicesBucketName    = []byte("devices")     // Contains thin devices metadata <device_name>=<DeviceInfo>
+	deviceIDBucketName   = []byte("device_ids")  // Tracks used device ids <device_id_[0..maxDeviceID)>=<byte_[0/1]>
+	sharedBucketName     = []byte("shared")      // Committed devices shared by snapshots <chain_key>=<SharedDevice>
+	sharedKeysBucketName = []byte("shared_keys") // Chain keys of shared devices <shared_device_name>=<chain_key>
+	aliasesBucketName    = []byte("aliases")     // Devices replaced by shared ones <device_name>=<shared_device_name>
 )
 
 var (
@@ -94,6 +108,31 @@ func (m *PoolMetadata) ensureDatabaseInitialized() error {
 			return err
 		}
 
+		if _, err := tx.CreateBucketIfNotExists(sharedBucketName); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(aliasesBucketName); err != nil {
+			return err
+		}
+
+		// Databases with shared devices recorded before the index existed get it built
+		if tx.Bucket(sharedKeysBucketName) == nil {
+			keys, err := tx.CreateBucket(sharedKeysBucketName)
+			if err != nil {
+				return err
+			}
+
+			return tx.Bucket(sharedBucketName).ForEach(func(k, v []byte) error {
+				var device SharedDevice
+				if err := json.Unmarshal(v, &device); err != nil {
+					return errors.Wrapf(err, "failed to unmarshal object with key %q", string(k))
+				}
+
+				return putObject(keys, device.DeviceName, string(k), true)
+			})
+		}
+
 		return nil
 	})
 }
@@ -288,6 +327,178 @@ func (m *PoolMetadata) GetDeviceNames(ctx context.Context) ([]string, error) {
 	return names, nil
 }
 
+// ShareDevice records the device of a committed snapshot under the given chain key and returns the device to use
+// instead of it: the device first recorded under the key, or the given one itself if it's the first.
+// A device replaced this way becomes an alias of the shared one (see ResolveDevice). Sharing a device again
+// is a no-op.
+func (m *PoolMetadata) ShareDevice(ctx context.Context, key, name string) (string, error) {
+	shared := name
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sharedBucketName)
+
+		device := SharedDevice{DeviceName: name}
+		if err := getObject(bucket, key, &device); err == ErrNotFound {
+			if err := putObject(tx.Bucket(sharedKeysBucketName), name, key, true); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		shared = device.DeviceName
+		for _, ref := range device.Refs {
+			if ref == name {
+				return nil
+			}
+		}
+
+		if device.DeviceName != name {
+			if err := putObject(tx.Bucket(aliasesBucketName), name, device.DeviceName, true); err != nil {
+				return err
+			}
+		}
+
+		device.Refs = append(device.Refs, name)
+		return putObject(bucket, key, &device, true)
+	})
+
+	return shared, err
+}
+
+// ResolveDevice returns the name of the device used by the snapshot the device name was made for, which is
+// the name itself unless the device was replaced by a shared one
+func (m *PoolMetadata) ResolveDevice(ctx context.Context, name string) (string, error) {
+	resolved := name
+	err := m.db.View(func(tx *bolt.Tx) error {
+		if err := getObject(tx.Bucket(aliasesBucketName), name, &resolved); err != nil && err != ErrNotFound {
+			return err
+		}
+
+		return nil
+	})
+
+	return resolved, err
+}
+
+// ReleaseDevice drops the reference of a snapshot's device name to the device it uses. It returns the device
+// used and whether it was the last reference, so the device can be removed. Devices which aren't shared
+// have a single reference. It must only be called once the snapshot is removed from the metastore,
+// as the reference can't be restored if the removal is rolled back.
+func (m *PoolMetadata) ReleaseDevice(ctx context.Context, name string) (string, bool, error) {
+	var (
+		device = name
+		last   = true
+	)
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		aliases := tx.Bucket(aliasesBucketName)
+		if err := getObject(aliases, name, &device); err == nil {
+			if err := aliases.Delete([]byte(name)); err != nil {
+				return errors.Wrapf(err, "failed to delete alias %q", name)
+			}
+		} else if err != ErrNotFound {
+			return err
+		}
+
+		var key string
+		if err := getObject(tx.Bucket(sharedKeysBucketName), device, &key); err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		refs, err := releaseRefs(tx, key, func(ref string) bool { return ref != name })
+		last = refs == 0
+		return err
+	})
+
+	return device, last, err
+}
+
+// PruneSharedDevices drops references of device names whose snapshots are gone (left behind if the snapshotter
+// stopped between removing a snapshot and releasing its device), so shared devices without snapshots become
+// orphans. live tells whether the snapshot a device name was made for still exists. Returns the dropped names.
+func (m *PoolMetadata) PruneSharedDevices(ctx context.Context, live func(name string) bool) ([]string, error) {
+	var dropped []string
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		// Buckets can't be changed while iterating over them
+		var keys []string
+		if err := tx.Bucket(sharedBucketName).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			_, err := releaseRefs(tx, key, func(ref string) bool {
+				if live(ref) {
+					return true
+				}
+
+				dropped = append(dropped, ref)
+				return false
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		aliases := tx.Bucket(aliasesBucketName)
+		for _, name := range dropped {
+			if err := aliases.Delete([]byte(name)); err != nil {
+				return errors.Wrapf(err, "failed to delete alias %q", name)
+			}
+		}
+
+		return nil
+	})
+
+	return dropped, err
+}
+
+// releaseRefs keeps the references of the shared device recorded under the key for which keep returns true,
+// deleting the device from the shared ones if none are left. Returns the number of references left.
+func releaseRefs(tx *bolt.Tx, key string, keep func(ref string) bool) (int, error) {
+	bucket := tx.Bucket(sharedBucketName)
+
+	var device SharedDevice
+	if err := getObject(bucket, key, &device); err != nil {
+		return 0, err
+	}
+
+	var refs []string
+	for _, ref := range device.Refs {
+		if keep(ref) {
+			refs = append(refs, ref)
+		}
+	}
+
+	if len(refs) > 0 {
+		device.Refs = refs
+		return len(refs), putObject(bucket, key, &device, true)
+	}
+
+	if err := bucket.Delete([]byte(key)); err != nil {
+		return 0, errors.Wrapf(err, "failed to delete shared device %q", key)
+	}
+
+	if err := tx.Bucket(sharedKeysBucketName).Delete([]byte(device.DeviceName)); err != nil {
+		return 0, errors.Wrapf(err, "failed to delete shared device %q", device.DeviceName)
+	}
+
+	return 0, nil
+}
+
+// backup writes a consistent copy of the database, concurrent updates are not blocked
+func (m *PoolMetadata) backup(w io.Writer) error {
+	return m.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
 // Close closes metadata store
 func (m *PoolMetadata) Close() error {
 	if err := m.db.Close(); err != nil && err != bolt.ErrDatabaseNotOpen {
@@ -168,6 +168,118 @@ func TestPoolMetadata_GetDeviceNames(t *testing.T) {
 	assert.Equal(t, "test2", names[1])
 }
 
+func TestPoolMetadata_ShareDevice(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	shared, err := store.ShareDevice(testCtx, "chain-1", "dev-1")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-1", shared, "first device of a chain is shared")
+
+	shared, err = store.ShareDevice(testCtx, "chain-1", "dev-2")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-1", shared)
+
+	shared, err = store.ShareDevice(testCtx, "chain-2", "dev-3")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-3", shared)
+
+	resolved, err := store.ResolveDevice(testCtx, "dev-2")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-1", resolved)
+
+	resolved, err = store.ResolveDevice(testCtx, "dev-4")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-4", resolved, "device which isn't shared resolves to itself")
+
+	// The device outlives the snapshot it was made for
+	device, last, err := store.ReleaseDevice(testCtx, "dev-1")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-1", device)
+	assert.False(t, last)
+
+	device, last, err = store.ReleaseDevice(testCtx, "dev-2")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-1", device)
+	assert.True(t, last)
+
+	resolved, err = store.ResolveDevice(testCtx, "dev-2")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-2", resolved)
+
+	device, last, err = store.ReleaseDevice(testCtx, "dev-4")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-4", device)
+	assert.True(t, last)
+
+	// Chain without devices starts over
+	shared, err = store.ShareDevice(testCtx, "chain-1", "dev-5")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-5", shared)
+}
+
+func TestPoolMetadata_ShareDeviceTwice(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	_, err := store.ShareDevice(testCtx, "chain-1", "dev-1")
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		shared, err := store.ShareDevice(testCtx, "chain-1", "dev-2")
+		require.NoError(t, err)
+		assert.Equal(t, "dev-1", shared)
+	}
+
+	device, last, err := store.ReleaseDevice(testCtx, "dev-2")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-1", device)
+	assert.False(t, last, "device shared twice holds a single reference")
+
+	// Releasing again doesn't drop other references
+	_, last, err = store.ReleaseDevice(testCtx, "dev-2")
+	require.NoError(t, err)
+	assert.True(t, last)
+
+	_, last, err = store.ReleaseDevice(testCtx, "dev-1")
+	require.NoError(t, err)
+	assert.True(t, last)
+}
+
+func TestPoolMetadata_PruneSharedDevices(t *testing.T) {
+	tempDir, store := createStore(t)
+	defer cleanupStore(t, tempDir, store)
+
+	for _, name := range []string{"dev-1", "dev-2", "dev-3"} {
+		_, err := store.ShareDevice(testCtx, "chain-1", name)
+		require.NoError(t, err)
+	}
+
+	_, err := store.ShareDevice(testCtx, "chain-2", "dev-4")
+	require.NoError(t, err)
+
+	dropped, err := store.PruneSharedDevices(testCtx, func(name string) bool {
+		return name == "dev-2"
+	})
+
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"dev-1", "dev-3", "dev-4"}, dropped)
+
+	resolved, err := store.ResolveDevice(testCtx, "dev-3")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-3", resolved, "alias of a dropped name is deleted")
+
+	device, last, err := store.ReleaseDevice(testCtx, "dev-2")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-1", device)
+	assert.True(t, last)
+
+	// Chain without references starts over
+	shared, err := store.ShareDevice(testCtx, "chain-2", "dev-5")
+	require.NoError(t, err)
+	assert.Equal(t, "dev-5", shared)
+}
+
 func createStore(t *testing.T) (tempDir string, store *PoolMetadata) {
 	tempDir, err := ioutil.TempDir("", "pool-metadata-")
 	require.NoErrorf(t, err, "couldn't create temp directory for metadata tests")
@@ -0,0 +1,163 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+)
+
+// snapshotOptions are settings of a snapshot given by its labels, labels not recognized are kept but ignored
+type snapshotOptions struct {
+	fsType       string
+	mkfsOptions  []string
+	mountOptions []string
+	readOnly     bool
+}
+
+// parseSnapshotOptions reads settings of a snapshot from its labels, config settings apply unless labels replace them.
+// Configured mkfs options only apply to the configured filesystem.
+func parseSnapshotOptions(labels map[string]string, config *Config) (snapshotOptions, error) {
+	options := snapshotOptions{fsType: config.FSType, mkfsOptions: config.MkfsOptions}
+
+	if value, ok := labels[FSTypeLabel]; ok {
+		if _, supported := mkfsArgs[value]; !supported {
+			return options, errors.Wrapf(errdefs.ErrInvalidArgument, "unsupported %s label %q, should be either %q or %q",
+				FSTypeLabel, value, fsTypeExt4, fsTypeXFS)
+		}
+
+		if value != config.FSType {
+			options.mkfsOptions = nil
+		}
+
+		options.fsType = value
+	}
+
+	if value, ok := labels[ReadOnlyLabel]; ok {
+		readOnly, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s label %q", ReadOnlyLabel, value)
+		}
+
+		options.readOnly = readOnly
+	}
+
+	if value, ok := labels[MkfsOptionsLabel]; ok {
+		mkfsOptions := strings.Fields(value)
+		if err := validateMkfsOptions(mkfsOptions); err != nil {
+			return options, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s label %q: %v", MkfsOptionsLabel, value, err)
+		}
+
+		options.mkfsOptions = mkfsOptions
+	}
+
+	if value := labels[MountOptionsLabel]; value != "" {
+		for _, option := range strings.Split(value, ",") {
+			option = strings.TrimSpace(option)
+			switch option {
+			case "":
+				return options, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid %s label %q", MountOptionsLabel, value)
+			case "ro", "rw":
+				// Views and committed snapshots are always mounted read-only
+				return options, errors.Wrapf(errdefs.ErrInvalidArgument, "%s label can't contain %q, use %s instead",
+					MountOptionsLabel, option, ReadOnlyLabel)
+			}
+
+			options.mountOptions = append(options.mountOptions, option)
+		}
+	}
+
+	return options, nil
+}
+
+// fsType returns the filesystem of a snapshot with the given (valid) labels
+func (dm *Snapshotter) fsType(labels map[string]string) string {
+	if value, ok := labels[FSTypeLabel]; ok {
+		return value
+	}
+
+	return dm.config.FSType
+}
+
+// validateMkfsOptions checks that mkfs options can't be taken for the device path, which follows them.
+// Values of options have to follow their flags (like "-b 4096" or "-b4096"), any other argument would be
+// a device, which is passed by the snapshotter.
+func validateMkfsOptions(options []string) error {
+	valueAllowed := false
+	for _, option := range options {
+		switch {
+		case option == "--":
+			return errors.New(`"--" would turn the following options into a device`)
+		case strings.HasPrefix(option, "/dev/"):
+			return errors.Errorf("device %q can't be passed, snapshot devices are passed by the snapshotter", option)
+		case strings.HasPrefix(option, "-") && option != "-":
+			valueAllowed = true
+		case valueAllowed:
+			valueAllowed = false
+		default:
+			return errors.Errorf("%q doesn't follow an option, it would be taken for a device", option)
+		}
+	}
+
+	return nil
+}
+
+// inheritFilesystem makes options of a new child snapshot use the filesystem of its parent. Labels of the
+// child can't ask for another filesystem, nor for mkfs options, as the child's device is a snapshot of the
+// parent's (nor can they be created from an image). Returns an option copying FSTypeLabel of the parent to the child, if the parent has one.
+func (dm *Snapshotter) inheritFilesystem(ctx context.Context, parent string, labels map[string]string, options *snapshotOptions) (snapshots.Opt, error) {
+	_, info, _, err := storage.GetInfo(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	parentOptions, err := parseSnapshotOptions(info.Labels, dm.config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid labels of parent snapshot %q", parent)
+	}
+
+	for _, label := range []string{MkfsOptionsLabel, SourceImageLabel} {
+		if _, ok := labels[label]; ok {
+			return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "%s label only applies to snapshots without a parent, "+
+				"snapshots of %q share its filesystem", label, parent)
+		}
+	}
+
+	if err := checkFSTypeLabel(labels, parentOptions.fsType, parent); err != nil {
+		return nil, err
+	}
+
+	options.fsType = parentOptions.fsType
+	if fsType, ok := info.Labels[FSTypeLabel]; ok {
+		return withLabel(FSTypeLabel, fsType), nil
+	}
+
+	return nil, nil
+}
+
+// checkFSTypeLabel returns an error if labels ask for another filesystem than fsType of the given snapshot
+func checkFSTypeLabel(labels map[string]string, fsType, key string) error {
+	if value, ok := labels[FSTypeLabel]; ok && value != fsType {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "%s label %q conflicts with filesystem %q of snapshot %q",
+			FSTypeLabel, value, fsType, key)
+	}
+
+	return nil
+}
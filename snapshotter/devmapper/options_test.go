@@ -0,0 +1,125 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSnapshotOptions(t *testing.T) {
+	options, err := parseSnapshotOptions(map[string]string{
+		FSTypeLabel:       fsTypeXFS,
+		MkfsOptionsLabel:  "-b size=4096  -m reflink=1",
+		MountOptionsLabel: "noatime, nouuid",
+		ReadOnlyLabel:     "true",
+		"foo":             "bar",
+	}, &Config{FSType: fsTypeExt4})
+	require.NoError(t, err)
+	assert.Equal(t, snapshotOptions{
+		fsType:       fsTypeXFS,
+		mkfsOptions:  []string{"-b", "size=4096", "-m", "reflink=1"},
+		mountOptions: []string{"noatime", "nouuid"},
+		readOnly:     true,
+	}, options)
+
+	dm := &Snapshotter{config: &Config{PoolName: "pool", FSType: fsTypeExt4}}
+	mounts := dm.buildMounts(storage.Snapshot{ID: "1", Kind: snapshots.KindActive}, options)
+	assert.Equal(t, fsTypeXFS, mounts[0].Type)
+	assert.Equal(t, []string{"ro", "noatime", "nouuid"}, mounts[0].Options)
+
+	options, err = parseSnapshotOptions(map[string]string{"foo": "bar"}, &Config{FSType: fsTypeExt4})
+	require.NoError(t, err)
+	assert.Equal(t, snapshotOptions{fsType: fsTypeExt4}, options)
+
+	for _, labels := range []map[string]string{
+		{FSTypeLabel: "btrfs"},
+		{ReadOnlyLabel: "yes"},
+		{MountOptionsLabel: "noatime,,nodiratime"},
+		{MountOptionsLabel: "rw"},
+		{MountOptionsLabel: "noatime,ro"},
+	} {
+		_, err := parseSnapshotOptions(labels, &Config{FSType: fsTypeExt4})
+		assert.Truef(t, errdefs.IsInvalidArgument(err), "expected invalid argument error for %v, got %v", labels, err)
+	}
+}
+
+func TestMkfsOptions(t *testing.T) {
+	config := &Config{FSType: fsTypeExt4, MkfsOptions: []string{"-O", "^has_journal"}}
+
+	options, err := parseSnapshotOptions(nil, config)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-O", "^has_journal"}, options.mkfsOptions)
+
+	// Label replaces configured options
+	options, err = parseSnapshotOptions(map[string]string{MkfsOptionsLabel: "-i 8192"}, config)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-i", "8192"}, options.mkfsOptions)
+
+	options, err = parseSnapshotOptions(map[string]string{MkfsOptionsLabel: ""}, config)
+	require.NoError(t, err)
+	assert.Empty(t, options.mkfsOptions)
+
+	// Configured options are meant for the configured filesystem
+	options, err = parseSnapshotOptions(map[string]string{FSTypeLabel: fsTypeXFS}, config)
+	require.NoError(t, err)
+	assert.Empty(t, options.mkfsOptions)
+
+	_, err = parseSnapshotOptions(map[string]string{MkfsOptionsLabel: "-b 4096 /dev/sda"}, config)
+	assert.True(t, errdefs.IsInvalidArgument(err))
+}
+
+func TestValidateMkfsOptions(t *testing.T) {
+	for _, options := range [][]string{
+		nil,
+		{"-F"},
+		{"-b", "4096", "-O", "^has_journal", "-q"},
+		{"-b4096", "-d", "/var/lib/seed"},
+	} {
+		assert.NoErrorf(t, validateMkfsOptions(options), "options %v", options)
+	}
+
+	for _, options := range [][]string{
+		{"/dev/mapper/pool-snap-1"},
+		{"-L", "/dev/sda"},
+		{"-b", "4096", "1024"},
+		{"8192"},
+		{"--", "-q"},
+		{"-"},
+	} {
+		assert.Errorf(t, validateMkfsOptions(options), "options %v", options)
+	}
+}
+
+func TestFSTypeLabel(t *testing.T) {
+	dm := &Snapshotter{config: &Config{FSType: fsTypeExt4}}
+	assert.Equal(t, fsTypeExt4, dm.fsType(nil))
+	assert.Equal(t, fsTypeXFS, dm.fsType(map[string]string{FSTypeLabel: fsTypeXFS}))
+
+	assert.NoError(t, checkFSTypeLabel(nil, fsTypeXFS, "base"))
+	assert.NoError(t, checkFSTypeLabel(map[string]string{FSTypeLabel: fsTypeXFS}, fsTypeXFS, "base"))
+
+	err := checkFSTypeLabel(map[string]string{FSTypeLabel: fsTypeExt4}, fsTypeXFS, "base")
+	assert.True(t, errdefs.IsInvalidArgument(err))
+	assert.Contains(t, err.Error(), `conflicts with filesystem "xfs" of snapshot "base"`)
+
+	var info snapshots.Info
+	require.NoError(t, withLabel(FSTypeLabel, fsTypeXFS)(&info))
+	assert.Equal(t, map[string]string{FSTypeLabel: fsTypeXFS}, info.Labels)
+}
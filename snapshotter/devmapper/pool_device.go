@@ -17,7 +17,9 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"strconv"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
@@ -27,8 +29,10 @@ import (
 
 // PoolDevice ties together data and metadata volumes, represents thin-pool and manages volumes, snapshots and device ids.
 type PoolDevice struct {
-	poolName string
-	metadata *PoolMetadata
+	poolName             string
+	dataBlockSizeSectors uint32
+	metadata             *PoolMetadata
+	waiter               *deviceWaiter
 }
 
 // NewPoolDevice creates new thin-pool from existing data and metadata volumes.
@@ -67,10 +71,51 @@ func NewPoolDevice(ctx context.Context, config *Config) (*PoolDevice, error) {
 		}
 	}
 
-	return &PoolDevice{
-		poolName: config.PoolName,
-		metadata: poolMetaStore,
-	}, nil
+	pool := &PoolDevice{
+		poolName:             config.PoolName,
+		dataBlockSizeSectors: config.DataBlockSizeSectors,
+		metadata:             poolMetaStore,
+		waiter:               newDeviceWaiter(config),
+	}
+
+	if err := pool.activateDevices(ctx); err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+// activateDevices activates thin devices which should be active but aren't, like after the pool was deactivated
+// on close or the host rebooted. Thin devices are kept in the pool's metadata volume, so they're activated by ID.
+// Only failing to read the metadata is an error.
+func (p *PoolDevice) activateDevices(ctx context.Context) error {
+	deviceNames, err := p.metadata.GetDeviceNames(ctx)
+	if err != nil {
+		return errors.Wrap(err, "can't query device names")
+	}
+
+	for _, name := range deviceNames {
+		info, err := p.metadata.GetDevice(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get device info %q", name)
+		}
+
+		if !info.IsActivated {
+			continue
+		}
+
+		if _, err := os.Stat(dmsetup.GetFullDevicePath(name)); err == nil {
+			continue
+		}
+
+		// Snapshots of a device missing from the pool fail on use, the others can still be used
+		log.G(ctx).Debugf("activating device %q", name)
+		if err := dmsetup.ActivateDevice(p.poolName, info.Name, info.DeviceID, info.Size, ""); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to activate device %q", name)
+		}
+	}
+
+	return nil
 }
 
 func (p *PoolDevice) CreateThinDevice(ctx context.Context, deviceName string, virtualSizeBytes uint64) error {
@@ -88,21 +133,28 @@ func (p *PoolDevice) CreateThinDevice(ctx context.Context, deviceName string, vi
 		return err
 	}
 
-	// Activate thin device
-	err = p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
+	// Activate thin device, its device node is created asynchronously (see WaitDevice)
+	return p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
 		info.IsActivated = true
 		return dmsetup.ActivateDevice(p.poolName, info.Name, info.DeviceID, info.Size, "")
 	})
-
-	return err
 }
 
+// CreateSnapshotDevice creates a thin snapshot of the given device. The snapshot can be larger than its origin,
+// but not smaller as thin devices can't shrink, zero virtual size makes it the same size as its origin.
 func (p *PoolDevice) CreateSnapshotDevice(ctx context.Context, deviceName string, snapshotName string, virtualSizeBytes uint64) error {
 	baseDeviceInfo, err := p.metadata.GetDevice(ctx, deviceName)
 	if err != nil {
 		return err
 	}
 
+	if virtualSizeBytes == 0 {
+		virtualSizeBytes = baseDeviceInfo.Size
+	} else if virtualSizeBytes < baseDeviceInfo.Size {
+		return errors.Wrapf(errdefs.ErrInvalidArgument,
+			"snapshot size %d is smaller than size %d of device %q", virtualSizeBytes, baseDeviceInfo.Size, deviceName)
+	}
+
 	// Suspend thin device if it was activated previously
 	isActivated := baseDeviceInfo.IsActivated
 	if isActivated {
@@ -131,12 +183,118 @@ func (p *PoolDevice) CreateSnapshotDevice(ctx context.Context, deviceName string
 		}
 	}
 
-	err = p.metadata.UpdateDevice(ctx, snapshotName, func(info *DeviceInfo) error {
+	return p.metadata.UpdateDevice(ctx, snapshotName, func(info *DeviceInfo) error {
 		info.IsActivated = true
 		return dmsetup.ActivateDevice(p.poolName, info.Name, info.DeviceID, info.Size, "")
 	})
+}
+
+// GetUsage reports the number of bytes mapped by the thin device, including blocks shared with its origin
+func (p *PoolDevice) GetUsage(deviceName string) (int64, error) {
+	status, err := dmsetup.Status(deviceName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get status of device %q", deviceName)
+	}
+
+	if status.Target != "thin" || len(status.Params) == 0 {
+		return 0, errors.Errorf("device %q is not a thin device", deviceName)
+	}
+
+	// The first value is "Fail" if the device failed
+	sectors, err := strconv.ParseInt(status.Params[0], 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse mapped sectors of device %q", deviceName)
+	}
+
+	return sectors * dmsetup.SectorSize, nil
+}
+
+// ResizeDevice grows the virtual size of an existing thin device, which is done online if the device is active.
+// Growth beyond the free space of the pool is rejected, so that writing to the new space can't exhaust the pool.
+func (p *PoolDevice) ResizeDevice(ctx context.Context, deviceName string, virtualSizeBytes uint64) error {
+	return p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
+		if virtualSizeBytes < info.Size {
+			return errors.Wrapf(errdefs.ErrInvalidArgument,
+				"device %q can't shrink from %d to %d bytes", deviceName, info.Size, virtualSizeBytes)
+		}
+
+		if virtualSizeBytes == info.Size {
+			return nil
+		}
+
+		free, err := p.freeSpace()
+		if err != nil {
+			return err
+		}
+
+		if growth := virtualSizeBytes - info.Size; growth > free {
+			return errors.Wrapf(errdefs.ErrFailedPrecondition,
+				"not enough free space in pool %q to grow device %q by %d bytes (%d bytes free)", p.poolName, deviceName, growth, free)
+		}
+
+		if info.IsActivated {
+			if err := dmsetup.ReloadDevice(p.poolName, info.Name, info.DeviceID, virtualSizeBytes, ""); err != nil {
+				return errors.Wrapf(err, "failed to reload device %q", deviceName)
+			}
+
+			// Suspending flushes in-flight I/O, resuming switches to the new table
+			if err := dmsetup.SuspendDevice(info.Name); err != nil {
+				return errors.Wrapf(err, "failed to suspend device %q", deviceName)
+			}
+
+			if err := dmsetup.ResumeDevice(info.Name); err != nil {
+				return errors.Wrapf(err, "failed to resume device %q", deviceName)
+			}
+		}
+
+		info.Size = virtualSizeBytes
+		return nil
+	})
+}
+
+// freeSpace reports the number of bytes in the data volume not yet allocated by any thin device
+func (p *PoolDevice) freeSpace() (uint64, error) {
+	usage, err := p.Usage()
+	if err != nil {
+		return 0, err
+	}
+
+	return usage.freeDataBlocks() * uint64(p.dataBlockSizeSectors) * dmsetup.SectorSize, nil
+}
+
+// Usage reports how many data and metadata blocks of the pool are in use
+func (p *PoolDevice) Usage() (PoolUsage, error) {
+	status, err := dmsetup.Status(p.poolName)
+	if err != nil {
+		return PoolUsage{}, errors.Wrapf(err, "failed to get status of pool %q", p.poolName)
+	}
+
+	usage, err := parsePoolUsage(status)
+	if err != nil {
+		return PoolUsage{}, errors.Wrapf(err, "unexpected status of pool %q", p.poolName)
+	}
 
-	return err
+	return usage, nil
+}
+
+// freeDataBlocks parses the number of free data blocks out of thin-pool status
+func freeDataBlocks(status *dmsetup.DeviceStatus) (uint64, error) {
+	usage, err := parsePoolUsage(status)
+	if err != nil {
+		return 0, err
+	}
+
+	return usage.freeDataBlocks(), nil
+}
+
+// WaitDevice waits for the device node of an activated device, so it can be used right away.
+// Devices are activated without waiting for their nodes, so callers can wait outside of metadata transactions.
+func (p *PoolDevice) WaitDevice(ctx context.Context, deviceName string) error {
+	if p.waiter == nil {
+		return nil
+	}
+
+	return p.waiter.wait(ctx, dmsetup.GetFullDevicePath(deviceName))
 }
 
 func (p *PoolDevice) RemoveDevice(ctx context.Context, deviceName string, deferred bool) error {
@@ -147,10 +305,58 @@ func (p *PoolDevice) RemoveDevice(ctx context.Context, deviceName string, deferr
 
 	return p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
 		info.IsActivated = false
+		info.PendingRemoval = false
 		return dmsetup.RemoveDevice(deviceName, opts...)
 	})
 }
 
+// SetPendingRemoval marks (or unmarks) the device to be removed later, as its snapshot no longer exists
+func (p *PoolDevice) SetPendingRemoval(ctx context.Context, deviceName string, pending bool) error {
+	return p.metadata.UpdateDevice(ctx, deviceName, func(info *DeviceInfo) error {
+		info.PendingRemoval = pending
+		return nil
+	})
+}
+
+// GetPendingRemovals returns names of devices marked to be removed later
+func (p *PoolDevice) GetPendingRemovals(ctx context.Context) ([]string, error) {
+	deviceNames, err := p.metadata.GetDeviceNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, name := range deviceNames {
+		info, err := p.metadata.GetDevice(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.PendingRemoval {
+			pending = append(pending, name)
+		}
+	}
+
+	return pending, nil
+}
+
+// DeleteDevice deactivates the thin device and deletes it from the pool, which releases its blocks and device ID
+func (p *PoolDevice) DeleteDevice(ctx context.Context, deviceName string) error {
+	return p.metadata.RemoveDevice(ctx, deviceName, func(info *DeviceInfo) error {
+		if _, err := os.Stat(dmsetup.GetFullDevicePath(deviceName)); err == nil {
+			if err := dmsetup.RemoveDevice(deviceName, dmsetup.RemoveWithForce, dmsetup.RemoveWithRetries); err != nil {
+				return errors.Wrapf(err, "failed to deactivate device %q", deviceName)
+			}
+		}
+
+		if err := dmsetup.DeleteDevice(p.poolName, int(info.DeviceID)); err != nil {
+			return errors.Wrapf(err, "failed to delete device %q (id %d)", deviceName, info.DeviceID)
+		}
+
+		return nil
+	})
+}
+
 func (p *PoolDevice) RemovePool(ctx context.Context) error {
 	deviceNames, err := p.metadata.GetDeviceNames(ctx)
 	if err != nil {
@@ -180,6 +386,75 @@ func (p *PoolDevice) RemovePool(ctx context.Context) error {
 	return result.ErrorOrNil()
 }
 
-func (p *PoolDevice) Close() error {
-	return p.metadata.Close()
+// FlushMetadata commits the open metadata transaction of the thin-pool to its metadata volume. The kernel commits
+// it every second and whenever the pool is suspended, so the pool is suspended and resumed right away, which holds
+// I/O of its thin devices for as long.
+func (p *PoolDevice) FlushMetadata(ctx context.Context) error {
+	if err := dmsetup.SuspendDevice(p.poolName); err != nil {
+		return errors.Wrapf(err, "failed to suspend pool %q", p.poolName)
+	}
+
+	if err := dmsetup.ResumeDevice(p.poolName); err != nil {
+		// Thin devices can't be used until the pool is resumed
+		log.G(ctx).WithError(err).Errorf("pool %q left suspended, resume it with \"dmsetup resume %s\"", p.poolName, p.poolName)
+		return errors.Wrapf(err, "failed to resume pool %q", p.poolName)
+	}
+
+	return nil
+}
+
+// deactivate removes the thin devices and the pool, which commits its metadata. Unlike RemovePool, devices are
+// never forced: devices still in use (like drives of running VMs) are left active, and so is the pool then.
+// Devices stay marked active in metadata, so they're activated again along with the pool.
+func (p *PoolDevice) deactivate(ctx context.Context) error {
+	deviceNames, err := p.metadata.GetDeviceNames(ctx)
+	if err != nil {
+		return errors.Wrap(err, "can't query device names")
+	}
+
+	var result *multierror.Error
+	for _, name := range deviceNames {
+		if _, err := os.Stat(dmsetup.GetFullDevicePath(name)); err != nil {
+			continue
+		}
+
+		if err := dmsetup.RemoveDevice(name, dmsetup.RemoveWithRetries); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "failed to deactivate device %q", name))
+		}
+	}
+
+	if result != nil {
+		return errors.Wrapf(result, "pool %q left active", p.poolName)
+	}
+
+	if err := dmsetup.RemoveDevice(p.poolName, dmsetup.RemoveWithRetries); err != nil {
+		return errors.Wrapf(err, "failed to deactivate pool %q", p.poolName)
+	}
+
+	return nil
+}
+
+// Close closes the metadata store of the pool. With flush, the thin-pool's metadata is committed to its metadata
+// volume first (see FlushMetadata). With deactivate, the thin devices and the pool are removed, unless some devices
+// are still in use, in which case the metadata is flushed if asked to.
+func (p *PoolDevice) Close(ctx context.Context, flush, deactivate bool) error {
+	var result *multierror.Error
+
+	if deactivate {
+		if err := p.deactivate(ctx); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	if _, err := os.Stat(dmsetup.GetFullDevicePath(p.poolName)); flush && err == nil {
+		if err := p.FlushMetadata(ctx); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	if err := p.metadata.Close(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	return result.ErrorOrNil()
 }
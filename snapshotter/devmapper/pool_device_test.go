@@ -21,6 +21,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/docker/go-units"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -48,7 +49,7 @@ const (
 // - Take 'thin-1' snapshot 'snap-1'
 // - Change v1 file to v2 on 'thin-1'
 // - Mount 'snap-1' and make sure test file is v1
-// - Unmount volumes and remove all devices
+// - Unmount volumes, flush pool metadata and remove all devices
 func TestPoolDevice(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 	ctx := context.Background()
@@ -128,6 +129,16 @@ func TestPoolDevice(t *testing.T) {
 	output, err = exec.Command("umount", thin1MountPath, snap1MountPath).CombinedOutput()
 	assert.NoErrorf(t, err, "failed to unmount devices: %s", string(output))
 
+	t.Run("FlushMetadata", func(t *testing.T) {
+		err := pool.FlushMetadata(ctx)
+		require.NoError(t, err)
+
+		infos, err := dmsetup.Info(config.PoolName)
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		assert.False(t, infos[0].Suspended, "pool should be resumed after flush")
+	})
+
 	t.Run("RemoveDevice", func(t *testing.T) {
 		testRemoveThinDevice(t, pool)
 	})
@@ -139,6 +150,9 @@ func testCreateThinDevice(t *testing.T, pool *PoolDevice) {
 	err := pool.CreateThinDevice(ctx, thinDevice1, device1Size)
 	require.NoError(t, err, "can't create first thin device")
 
+	err = pool.WaitDevice(ctx, thinDevice1)
+	require.NoError(t, err, "device node of first thin device didn't appear")
+
 	err = pool.CreateThinDevice(ctx, thinDevice1, device1Size)
 	require.Error(t, err, "device pool allows duplicated device names")
 
@@ -167,8 +181,14 @@ func testMakeFileSystem(t *testing.T, pool *PoolDevice) {
 }
 
 func testCreateSnapshot(t *testing.T, pool *PoolDevice) {
-	err := pool.CreateSnapshotDevice(context.Background(), thinDevice1, snapDevice1, device1Size)
-	assert.NoErrorf(t, err, "failed to create snapshot from '%s' volume", thinDevice1)
+	err := pool.CreateSnapshotDevice(context.Background(), thinDevice1, snapDevice1, device1Size-1)
+	assert.Truef(t, errdefs.IsInvalidArgument(err), "snapshot can't be smaller than its origin, got %v", err)
+
+	err = pool.CreateSnapshotDevice(context.Background(), thinDevice1, snapDevice1, device1Size)
+	require.NoErrorf(t, err, "failed to create snapshot from '%s' volume", thinDevice1)
+
+	err = pool.WaitDevice(context.Background(), snapDevice1)
+	assert.NoErrorf(t, err, "device node of '%s' didn't appear", snapDevice1)
 }
 
 func testRemoveThinDevice(t *testing.T, pool *PoolDevice) {
@@ -214,3 +234,20 @@ func createLoopbackDevice(t *testing.T, dir string) (string, string) {
 
 	return imagePath, loopDevice
 }
+
+func TestFreeDataBlocks(t *testing.T) {
+	status := &dmsetup.DeviceStatus{
+		Target: "thin-pool",
+		Params: []string{"1", "151/4161600", "1220/8192", "-", "rw", "discard_passdown", "queue_if_no_space", "-"},
+	}
+
+	blocks, err := freeDataBlocks(status)
+	require.NoError(t, err)
+	assert.EqualValues(t, 8192-1220, blocks)
+
+	_, err = freeDataBlocks(&dmsetup.DeviceStatus{Target: "thin", Params: []string{"0", "-"}})
+	assert.Error(t, err)
+
+	_, err = freeDataBlocks(&dmsetup.DeviceStatus{Target: "thin-pool", Params: []string{"Fail"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+// PoolUsage is the number of used and total blocks of the data and metadata volumes of a thin-pool
+type PoolUsage struct {
+	UsedDataBlocks      uint64
+	TotalDataBlocks     uint64
+	UsedMetadataBlocks  uint64
+	TotalMetadataBlocks uint64
+}
+
+// DataPercent returns the percentage of data blocks in use
+func (u PoolUsage) DataPercent() float64 {
+	return percent(u.UsedDataBlocks, u.TotalDataBlocks)
+}
+
+// MetadataPercent returns the percentage of metadata blocks in use
+func (u PoolUsage) MetadataPercent() float64 {
+	return percent(u.UsedMetadataBlocks, u.TotalMetadataBlocks)
+}
+
+// above reports whether data or metadata usage reached the given percentage
+func (u PoolUsage) above(watermark int) bool {
+	return u.DataPercent() >= float64(watermark) || u.MetadataPercent() >= float64(watermark)
+}
+
+func (u PoolUsage) freeDataBlocks() uint64 {
+	if u.UsedDataBlocks > u.TotalDataBlocks {
+		return 0
+	}
+
+	return u.TotalDataBlocks - u.UsedDataBlocks
+}
+
+func (u PoolUsage) fields() logrus.Fields {
+	return logrus.Fields{
+		"data_used":        u.UsedDataBlocks,
+		"data_total":       u.TotalDataBlocks,
+		"data_percent":     strconv.FormatFloat(u.DataPercent(), 'f', 1, 64),
+		"metadata_used":    u.UsedMetadataBlocks,
+		"metadata_total":   u.TotalMetadataBlocks,
+		"metadata_percent": strconv.FormatFloat(u.MetadataPercent(), 'f', 1, 64),
+	}
+}
+
+func percent(used, total uint64) float64 {
+	if total == 0 {
+		return 100
+	}
+
+	return float64(used) * 100 / float64(total)
+}
+
+// parsePoolUsage parses block usage out of thin-pool status, which starts with
+// "<transaction id> <used metadata blocks>/<total metadata blocks> <used data blocks>/<total data blocks>"
+func parsePoolUsage(status *dmsetup.DeviceStatus) (PoolUsage, error) {
+	if status.Target != "thin-pool" || len(status.Params) < 3 {
+		return PoolUsage{}, errors.Errorf("not a thin-pool status: %s %v", status.Target, status.Params)
+	}
+
+	var (
+		usage PoolUsage
+		err   error
+	)
+
+	usage.UsedMetadataBlocks, usage.TotalMetadataBlocks, err = parseBlocks(status.Params[1], "metadata")
+	if err != nil {
+		return PoolUsage{}, err
+	}
+
+	usage.UsedDataBlocks, usage.TotalDataBlocks, err = parseBlocks(status.Params[2], "data")
+	if err != nil {
+		return PoolUsage{}, err
+	}
+
+	return usage, nil
+}
+
+// parseBlocks parses "<used blocks>/<total blocks>"
+func parseBlocks(value, kind string) (uint64, uint64, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("invalid %s blocks %q", kind, value)
+	}
+
+	used, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to parse used %s blocks", kind)
+	}
+
+	total, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to parse total %s blocks", kind)
+	}
+
+	return used, total, nil
+}
+
+// PoolUsage reports the current space usage of the thin-pool
+func (dm *Snapshotter) PoolUsage() (PoolUsage, error) {
+	return dm.pool.Usage()
+}
+
+// checkPoolSpace fails with a "pool nearly full" error if the pool usage reached pool_full_watermark, so snapshots
+// aren't created on devices which can't be written
+func (dm *Snapshotter) checkPoolSpace(ctx context.Context) error {
+	if dm.config.PoolFullWatermark <= 0 {
+		return nil
+	}
+
+	usage, err := dm.pool.Usage()
+	if err != nil {
+		return err
+	}
+
+	if usage.above(dm.config.PoolFullWatermark) {
+		log.G(ctx).WithFields(usage.fields()).Error("pool nearly full, rejecting new snapshot")
+		return errors.Wrapf(errdefs.ErrFailedPrecondition,
+			"pool %q nearly full: %.1f%% of data and %.1f%% of metadata space used (pool_full_watermark is %d%%)",
+			dm.config.PoolName, usage.DataPercent(), usage.MetadataPercent(), dm.config.PoolFullWatermark)
+	}
+
+	return nil
+}
+
+// startUsageChecks periodically logs pool usage, warning once it reaches pool_high_watermark,
+// until returned stop function is called
+func (dm *Snapshotter) startUsageChecks(ctx context.Context) closeFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(dm.config.PoolUsageIntervalDuration)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				dm.logPoolUsage(ctx)
+			}
+		}
+	}()
+
+	return func() error {
+		cancel()
+		<-done
+		return nil
+	}
+}
+
+func (dm *Snapshotter) logPoolUsage(ctx context.Context) {
+	usage, err := dm.pool.Usage()
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to check pool usage")
+		return
+	}
+
+	logger := log.G(ctx).WithFields(usage.fields())
+	if usage.above(dm.config.PoolHighWatermark) {
+		logger.Warnf("pool %q usage is above %d%%", dm.config.PoolName, dm.config.PoolHighWatermark)
+		return
+	}
+
+	logger.Debug("pool usage")
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+func TestParsePoolUsage(t *testing.T) {
+	status := &dmsetup.DeviceStatus{
+		Target: "thin-pool",
+		Params: []string{"1", "3900/4000", "1220/8192", "-", "rw", "discard_passdown", "queue_if_no_space", "-"},
+	}
+
+	usage, err := parsePoolUsage(status)
+	require.NoError(t, err)
+	assert.Equal(t, PoolUsage{
+		UsedDataBlocks:      1220,
+		TotalDataBlocks:     8192,
+		UsedMetadataBlocks:  3900,
+		TotalMetadataBlocks: 4000,
+	}, usage)
+
+	assert.InDelta(t, 14.9, usage.DataPercent(), 0.1)
+	assert.InDelta(t, 97.5, usage.MetadataPercent(), 0.1)
+	assert.EqualValues(t, 8192-1220, usage.freeDataBlocks())
+
+	assert.True(t, usage.above(90), "metadata usage is above watermark")
+	assert.False(t, usage.above(98))
+
+	status.Params[1] = "x/4000"
+	_, err = parsePoolUsage(status)
+	assert.Error(t, err)
+}
+
+func TestPoolUsageEmpty(t *testing.T) {
+	var usage PoolUsage
+	assert.True(t, usage.above(98), "pool without blocks is full")
+	assert.EqualValues(t, 0, usage.freeDataBlocks())
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// reconcile deletes thin devices whose snapshots are gone from the metastore, which are left behind
+// if the snapshotter stops between removing a snapshot and its device. Snapshots whose devices are
+// gone can't be repaired, they are only reported.
+func (dm *Snapshotter) reconcile(ctx context.Context) error {
+	snapshotNames, err := dm.snapshotDeviceNames(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list snapshots")
+	}
+
+	// Shared devices are released after their snapshots are removed, references of snapshots removed right
+	// before the snapshotter stopped are left behind
+	dropped, err := dm.pool.metadata.PruneSharedDevices(ctx, func(name string) bool {
+		_, ok := snapshotNames[name]
+		return ok
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "failed to prune shared devices")
+	}
+
+	for _, name := range dropped {
+		log.G(ctx).WithField("device", name).Info("dropped reference of removed snapshot to shared device")
+	}
+
+	// Snapshots sharing a device keep it from being an orphan
+	snapshotDevices := make(map[string]string, len(snapshotNames))
+	for name, snapshot := range snapshotNames {
+		deviceName, err := dm.pool.metadata.ResolveDevice(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		snapshotDevices[deviceName] = snapshot
+	}
+
+	deviceNames, err := dm.pool.metadata.GetDeviceNames(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list pool devices")
+	}
+
+	orphans, missing := diffDevices(deviceNames, snapshotDevices, dm.getDeviceName(""))
+
+	for _, name := range missing {
+		log.G(ctx).WithField("device", name).Warnf("device of snapshot %q is missing from the pool", snapshotDevices[name])
+	}
+
+	var result *multierror.Error
+	for _, name := range orphans {
+		log.G(ctx).WithField("device", name).Info("deleting device without snapshot")
+		if err := dm.pool.DeleteDevice(ctx, name); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+// snapshotDeviceNames returns the snapshots of the metastore by the names of the devices made for them
+func (dm *Snapshotter) snapshotDeviceNames(ctx context.Context) (map[string]string, error) {
+	names := make(map[string]string)
+	err := dm.withTransaction(ctx, false, func(ctx context.Context) error {
+		return storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+			id, _, _, err := storage.GetInfo(ctx, info.Name)
+			if err != nil {
+				return err
+			}
+
+			names[dm.getDeviceName(id)] = info.Name
+			return nil
+		})
+	})
+
+	return names, err
+}
+
+// diffDevices compares snapshot devices of the pool (named with the given prefix) with the devices
+// snapshots in the metastore expect, returning devices without snapshots and devices missing from the pool
+func diffDevices(deviceNames []string, snapshotDevices map[string]string, prefix string) (orphans, missing []string) {
+	inPool := make(map[string]bool, len(deviceNames))
+	for _, name := range deviceNames {
+		inPool[name] = true
+		if _, ok := snapshotDevices[name]; !ok && strings.HasPrefix(name, prefix) {
+			orphans = append(orphans, name)
+		}
+	}
+
+	for name := range snapshotDevices {
+		if !inPool[name] {
+			missing = append(missing, name)
+		}
+	}
+
+	sort.Strings(orphans)
+	sort.Strings(missing)
+	return orphans, missing
+}
@@ -0,0 +1,42 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffDevices(t *testing.T) {
+	deviceNames := []string{
+		"pool-snap-3",
+		"pool-snap-1",
+		"pool-snap-4",
+		"pool-thin",
+	}
+
+	snapshotDevices := map[string]string{
+		"pool-snap-1": "default/1/layer",
+		"pool-snap-2": "default/2/container",
+	}
+
+	orphans, missing := diffDevices(deviceNames, snapshotDevices, "pool-snap-")
+	assert.Equal(t, []string{"pool-snap-3", "pool-snap-4"}, orphans)
+	assert.Equal(t, []string{"pool-snap-2"}, missing)
+
+	orphans, missing = diffDevices(nil, nil, "pool-snap-")
+	assert.Empty(t, orphans)
+	assert.Empty(t, missing)
+}
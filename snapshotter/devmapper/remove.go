@@ -0,0 +1,113 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+type removeFunc func(ctx context.Context, deviceName string) error
+
+// deviceRemover retries removal of devices left behind by removed snapshots in background
+type deviceRemover struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	remove  removeFunc
+	retries int
+	backoff time.Duration
+
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	stuck map[string]bool
+}
+
+func newDeviceRemover(ctx context.Context, remove removeFunc, retries int, backoff time.Duration) *deviceRemover {
+	ctx, cancel := context.WithCancel(ctx)
+	return &deviceRemover{
+		ctx:     ctx,
+		cancel:  cancel,
+		remove:  remove,
+		retries: retries,
+		backoff: backoff,
+		stuck:   make(map[string]bool),
+	}
+}
+
+// schedule starts retrying removal of the given device, with exponential backoff between attempts.
+// If all attempts fail, the device is counted as stuck until the snapshotter restarts.
+func (r *deviceRemover) schedule(deviceName string) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		logger := log.G(r.ctx).WithField("device", deviceName)
+		backoff := r.backoff
+
+		for attempt := 1; attempt <= r.retries; attempt++ {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			err := r.remove(r.ctx, deviceName)
+			if err == nil {
+				logger.Info("removed device pending removal")
+				return
+			}
+
+			logger.WithError(err).Debugf("failed to remove device (attempt %d of %d)", attempt, r.retries)
+			backoff *= 2
+		}
+
+		r.mu.Lock()
+		r.stuck[deviceName] = true
+		count := len(r.stuck)
+		r.mu.Unlock()
+
+		logger.WithField("stuck_devices", count).Errorf("failed to remove device after %d attempts", r.retries)
+	}()
+}
+
+func (r *deviceRemover) stuckDevices() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.stuck)
+}
+
+// close stops retries in progress, devices not removed yet stay pending removal
+func (r *deviceRemover) close() error {
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
+
+// retryPendingRemovals schedules removal of devices marked pending removal by previous runs
+func (dm *Snapshotter) retryPendingRemovals(ctx context.Context) error {
+	pending, err := dm.pool.GetPendingRemovals(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, deviceName := range pending {
+		log.G(ctx).WithField("device", deviceName).Info("retrying removal of device")
+		dm.remover.schedule(deviceName)
+	}
+
+	return nil
+}
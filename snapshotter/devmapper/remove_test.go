@@ -0,0 +1,69 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceRemoverRetry(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string]int)
+	)
+
+	remove := func(ctx context.Context, deviceName string) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts[deviceName]++
+		if deviceName == "flaky" && attempts[deviceName] == 3 {
+			return nil
+		}
+
+		return errors.New("busy")
+	}
+
+	remover := newDeviceRemover(context.Background(), remove, 3, time.Millisecond)
+	remover.schedule("flaky")
+	remover.schedule("stuck")
+	remover.wg.Wait()
+
+	assert.Equal(t, 3, attempts["flaky"])
+	assert.Equal(t, 3, attempts["stuck"])
+	assert.Equal(t, 1, remover.stuckDevices())
+
+	require.NoError(t, remover.close())
+}
+
+func TestDeviceRemoverClose(t *testing.T) {
+	called := false
+	remover := newDeviceRemover(context.Background(), func(ctx context.Context, deviceName string) error {
+		called = true
+		return nil
+	}, 3, time.Hour)
+
+	remover.schedule("device")
+	require.NoError(t, remover.close())
+
+	assert.False(t, called)
+	assert.Equal(t, 0, remover.stuckDevices())
+}
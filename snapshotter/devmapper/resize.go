@@ -0,0 +1,109 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+// requestedResize returns the device size to resize a snapshot to, if an update of its labels asks for one
+func requestedResize(info snapshots.Info, fieldpaths []string) (uint64, bool, error) {
+	// No fieldpaths replace all labels
+	wanted := len(fieldpaths) == 0
+	for _, path := range fieldpaths {
+		if path == "labels" || path == "labels."+DeviceSizeLabel {
+			wanted = true
+		}
+	}
+
+	if !wanted {
+		return 0, false, nil
+	}
+
+	size, err := deviceSize(info.Labels)
+	if err != nil || size == 0 {
+		return 0, false, err
+	}
+
+	return size, true, nil
+}
+
+// resizeSnapshot grows the thin device of an active snapshot, returns false if the device has the size already.
+// Devices in use can't be resized, as neither the filesystem mounted by the guest can be grown from the host,
+// nor Firecracker notices the new size of an attached drive.
+func (dm *Snapshotter) resizeSnapshot(ctx context.Context, snap storage.Snapshot, size uint64) (bool, error) {
+	deviceName := dm.getDeviceName(snap.ID)
+
+	device, err := dm.pool.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return false, err
+	}
+
+	if device.Size == size {
+		return false, nil
+	}
+
+	if snap.Kind != snapshots.KindActive {
+		return false, errors.Wrap(errdefs.ErrFailedPrecondition, "only active snapshots can be resized")
+	}
+
+	infos, err := dmsetup.Info(deviceName)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to query device %q", deviceName)
+	}
+
+	if len(infos) != 1 || infos[0].OpenCount > 0 {
+		return false, errors.Wrapf(errdefs.ErrFailedPrecondition, "device %q is in use, it can be resized once released", deviceName)
+	}
+
+	log.G(ctx).Debugf("resizing device %q from %d to %d bytes", deviceName, device.Size, size)
+	return true, dm.pool.ResizeDevice(ctx, deviceName, size)
+}
+
+// growFilesystem grows the filesystem of a resized snapshot to the size of its device.
+// The filesystem is grown online, mounting it spares a full check that resize2fs requires otherwise.
+func (dm *Snapshotter) growFilesystem(ctx context.Context, snap storage.Snapshot, fsType string) error {
+	mounts := dm.buildMounts(snap, snapshotOptions{fsType: fsType})
+	for i := range mounts {
+		mounts[i].Options = nil
+	}
+
+	return mount.WithTempMount(ctx, mounts, func(root string) error {
+		var cmd *exec.Cmd
+		switch fsType {
+		case fsTypeXFS:
+			cmd = exec.CommandContext(ctx, "xfs_growfs", root)
+		default:
+			cmd = exec.CommandContext(ctx, "resize2fs", dm.getDevicePath(snap))
+		}
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(err, "%s failed: %s", cmd.Args[0], string(output))
+		}
+
+		log.G(ctx).Debugf("%s:\n%s", cmd.Args[0], string(output))
+		return nil
+	})
+}
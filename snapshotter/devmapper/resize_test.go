@@ -0,0 +1,52 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestedResize(t *testing.T) {
+	info := snapshots.Info{Labels: map[string]string{DeviceSizeLabel: "1GB", "foo": "bar"}}
+
+	size, resize, err := requestedResize(info, []string{"labels." + DeviceSizeLabel})
+	require.NoError(t, err)
+	assert.True(t, resize)
+	assert.EqualValues(t, 1024*1024*1024, size)
+
+	_, resize, err = requestedResize(info, nil)
+	require.NoError(t, err)
+	assert.True(t, resize, "updating all fields updates the size label too")
+
+	_, resize, err = requestedResize(info, []string{"labels"})
+	require.NoError(t, err)
+	assert.True(t, resize)
+
+	_, resize, err = requestedResize(info, []string{"labels.foo"})
+	require.NoError(t, err)
+	assert.False(t, resize)
+
+	_, resize, err = requestedResize(snapshots.Info{}, []string{"labels"})
+	require.NoError(t, err)
+	assert.False(t, resize, "removing the size label doesn't resize the device")
+
+	info.Labels[DeviceSizeLabel] = "huge"
+	_, _, err = requestedResize(info, []string{"labels." + DeviceSizeLabel})
+	assert.True(t, errdefs.IsInvalidArgument(err))
+}
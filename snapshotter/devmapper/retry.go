@@ -0,0 +1,40 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// isTransientError returns true if error is caused by temporary contention on the metadata store
+// (lock timeout, busy or interrupted system call), so the operation is worth retrying.
+// Everything else (including not found, already exists, etc) is treated as a permanent failure.
+func isTransientError(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case nil:
+		return false
+	case syscall.Errno:
+		return err == syscall.EAGAIN || err == syscall.EBUSY || err == syscall.EINTR
+	case *os.PathError:
+		return isTransientError(err.Err)
+	case *os.SyscallError:
+		return isTransientError(err.Err)
+	default:
+		return err == bolt.ErrTimeout
+	}
+}
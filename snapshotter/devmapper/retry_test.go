@@ -0,0 +1,120 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestIsTransientError(t *testing.T) {
+	assert.True(t, isTransientError(syscall.EBUSY))
+	assert.True(t, isTransientError(errors.Wrap(syscall.EAGAIN, "commit")))
+	assert.True(t, isTransientError(&os.PathError{Op: "open", Path: "metadata.db", Err: syscall.EINTR}))
+	assert.True(t, isTransientError(bolt.ErrTimeout))
+
+	assert.False(t, isTransientError(nil))
+	assert.False(t, isTransientError(syscall.ENOSPC))
+	assert.False(t, isTransientError(errdefs.ErrAlreadyExists))
+	assert.False(t, isTransientError(errors.New("permanent")))
+}
+
+func TestTransactionRetry(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "devmapper-retry-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	store, err := storage.NewMetaStore(filepath.Join(tempDir, metadataFileName))
+	require.NoError(t, err)
+	defer store.Close()
+
+	dm := &Snapshotter{
+		store: store,
+		config: &Config{
+			TxRetryCount:           2,
+			TxRetryBackoffDuration: time.Millisecond,
+		},
+	}
+
+	ctx := context.Background()
+
+	// Failures to start a transaction are retried
+	origBeginTransaction := beginTransaction
+	defer func() { beginTransaction = origBeginTransaction }()
+
+	begins := 0
+	beginTransaction = func(ctx context.Context, store *storage.MetaStore, writable bool) (context.Context, storage.Transactor, error) {
+		begins++
+		if begins < 3 {
+			return nil, nil, bolt.ErrTimeout
+		}
+		return origBeginTransaction(ctx, store, writable)
+	}
+
+	calls := 0
+	err = dm.withTransaction(ctx, true, func(ctx context.Context) error {
+		calls++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, begins)
+	assert.Equal(t, 1, calls)
+
+	// Give up after tx_retry_count attempts
+	begins = 0
+	calls = 0
+	beginTransaction = func(ctx context.Context, store *storage.MetaStore, writable bool) (context.Context, storage.Transactor, error) {
+		begins++
+		return nil, nil, bolt.ErrTimeout
+	}
+	err = dm.withTransaction(ctx, true, func(ctx context.Context) error {
+		calls++
+		return nil
+	})
+	assert.Equal(t, bolt.ErrTimeout, err)
+	assert.Equal(t, 3, begins)
+	assert.Equal(t, 0, calls)
+
+	beginTransaction = origBeginTransaction
+
+	// Transient errors of fn are not retried, as the pool may have been changed already
+	calls = 0
+	err = dm.withTransaction(ctx, true, func(ctx context.Context) error {
+		calls++
+		return syscall.EBUSY
+	})
+	assert.Equal(t, syscall.EBUSY, err)
+	assert.Equal(t, 1, calls)
+
+	// Permanent errors are returned right away
+	calls = 0
+	err = dm.withTransaction(ctx, true, func(ctx context.Context) error {
+		calls++
+		return errdefs.ErrNotFound
+	})
+	assert.Equal(t, errdefs.ErrNotFound, err)
+	assert.Equal(t, 1, calls)
+}
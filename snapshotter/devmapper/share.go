@@ -0,0 +1,92 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+// chainIDPattern matches names of snapshots committed for image layers, which are the chain IDs of the layers
+// (following the namespace and ID containerd's metadata store prefixes them with). A chain ID is a digest of
+// the layer along with all layers below it, so snapshots with the same chain ID have the same content.
+var chainIDPattern = regexp.MustCompile(`(?:^|/)(sha256:[a-f0-9]{64})$`)
+
+// sharedDeviceKey returns the key devices of committed snapshots are shared by, empty if the snapshot isn't
+// an image layer. Devices are only shared between snapshots of the same filesystem and size.
+func sharedDeviceKey(name, fsType string, size uint64) string {
+	match := chainIDPattern.FindStringSubmatch(name)
+	if match == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%s/%s/%d", match[1], fsType, size)
+}
+
+// shareCommitted makes a snapshot just committed use the device of another snapshot committed for the same
+// chain of layers, if any, and deletes its own device. Otherwise its device is recorded to be shared with
+// snapshots committed for the chain later. Devices in use are never replaced.
+func (dm *Snapshotter) shareCommitted(ctx context.Context, id, name, fsType string) error {
+	// The snapshot may be removed concurrently, its device is either released before (and isn't found) or after
+	// it's shared
+	dm.shareLock.Lock()
+	defer dm.shareLock.Unlock()
+
+	deviceName := dm.getDeviceName(id)
+	device, err := dm.pool.metadata.GetDevice(ctx, deviceName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query device %q", deviceName)
+	}
+
+	key := sharedDeviceKey(name, fsType, device.Size)
+	if key == "" {
+		return nil
+	}
+
+	infos, err := dmsetup.Info(deviceName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query device %q", deviceName)
+	}
+
+	if len(infos) != 1 || infos[0].OpenCount > 0 {
+		log.G(ctx).Debugf("not sharing device %q as it's in use", deviceName)
+		return nil
+	}
+
+	shared, err := dm.pool.metadata.ShareDevice(ctx, key, deviceName)
+	if err != nil || shared == deviceName {
+		return err
+	}
+
+	log.G(ctx).WithField("device", shared).Debugf("snapshot %q shares device of the same layers", name)
+
+	// The snapshot uses the shared device already, its own one only takes space
+	if err := dm.pool.DeleteDevice(ctx, deviceName); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to delete device %q replaced by shared %q", deviceName, shared)
+	}
+
+	return nil
+}
+
+// resolveDeviceName returns the name of the device a snapshot uses, which is the shared one for a committed
+// snapshot sharing a device
+func (dm *Snapshotter) resolveDeviceName(ctx context.Context, snapID string) (string, error) {
+	return dm.pool.metadata.ResolveDevice(ctx, dm.getDeviceName(snapID))
+}
@@ -0,0 +1,31 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedDeviceKey(t *testing.T) {
+	chainID := "sha256:7bff100f35cb359a368537bb07829b055fe8e0b1cb01085a3a628ae9c187c7b8"
+
+	assert.Equal(t, chainID+"/ext4/1048576", sharedDeviceKey("default/12/"+chainID, "ext4", 1048576))
+	assert.Equal(t, chainID+"/xfs/1048576", sharedDeviceKey(chainID, "xfs", 1048576))
+
+	for _, name := range []string{"default/12/my-snapshot", "default/12/sha256:1234", chainID + "/extra", ""} {
+		assert.Empty(t, sharedDeviceKey(name, "ext4", 1048576), name)
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/firecracker-microvm/firecracker-containerd/snapshotter/pkg/dmsetup"
+)
+
+// Snapshot kinds that can be trimmed. Committed snapshots are read-only and never trimmed.
+var trimKinds = map[string]snapshots.Kind{
+	"active": snapshots.KindActive,
+}
+
+// startTrimmer runs periodic trim passes in background until returned stop function is called
+func (dm *Snapshotter) startTrimmer(ctx context.Context) closeFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(dm.config.TrimIntervalDuration)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := dm.trimDevices(ctx); err != nil {
+					log.G(ctx).WithError(err).Warn("trim pass failed")
+				}
+			}
+		}
+	}()
+
+	return func() error {
+		cancel()
+		<-done
+		return nil
+	}
+}
+
+// trimDevices discards unused blocks of idle snapshot devices, so the freed space is returned back to thin-pool.
+// Devices opened by anyone else (for instance attached to a running microVM or mounted) are skipped, so the
+// trim never races with a filesystem in use. The whole pass is bounded by the configured trim timeout.
+func (dm *Snapshotter) trimDevices(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dm.config.TrimTimeoutDuration)
+	defer cancel()
+
+	targets, err := dm.trimTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.G(ctx).Debugf("trimming %d snapshot device(s)", len(targets))
+
+	for _, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "trim pass didn't complete in time")
+		}
+
+		if err := dm.trimSnapshot(ctx, target); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to trim snapshot %s", target.snap.ID)
+		}
+	}
+
+	return nil
+}
+
+// trimTarget is a snapshot to trim along with its device and filesystem
+type trimTarget struct {
+	snap   storage.Snapshot
+	device string
+	fsType string
+}
+
+func (dm *Snapshotter) trimTargets(ctx context.Context) ([]trimTarget, error) {
+	kinds := dm.config.TrimKinds
+	if len(kinds) == 0 {
+		kinds = []string{"active"}
+	}
+
+	wanted := make(map[snapshots.Kind]bool, len(kinds))
+	for _, kind := range kinds {
+		wanted[trimKinds[kind]] = true
+	}
+
+	var (
+		targets []trimTarget
+		devices = make(map[string]bool)
+	)
+
+	err := dm.withTransaction(ctx, false, func(ctx context.Context) error {
+		return storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+			if !wanted[info.Kind] {
+				return nil
+			}
+
+			snap, err := storage.GetSnapshot(ctx, info.Name)
+			if err != nil {
+				return err
+			}
+
+			// A shared device is trimmed once
+			deviceName, err := dm.resolveDeviceName(ctx, snap.ID)
+			if err != nil || devices[deviceName] {
+				return err
+			}
+
+			devices[deviceName] = true
+			targets = append(targets, trimTarget{snap: snap, device: deviceName, fsType: dm.fsType(info.Labels)})
+			return nil
+		})
+	})
+
+	return targets, err
+}
+
+// trimSnapshot discards free blocks of the snapshot's ext4 filesystem straight on the device, which is held open
+// exclusively for the whole trim. The filesystem is never mounted, so nothing on it (journal or superblock) changes,
+// and an exclusive open fails while the device is mounted on the host.
+func (dm *Snapshotter) trimSnapshot(ctx context.Context, target trimTarget) error {
+	deviceName := target.device
+	if target.fsType != fsTypeExt4 {
+		log.G(ctx).Debugf("skipping trim of device %q as only ext4 is supported", deviceName)
+		return nil
+	}
+
+	devicePath := dmsetup.GetFullDevicePath(deviceName)
+	fd, err := unix.Open(devicePath, unix.O_RDWR|unix.O_EXCL|unix.O_CLOEXEC, 0)
+	if err == unix.EBUSY {
+		log.G(ctx).Debugf("skipping trim of device %q as it's in use", deviceName)
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to open device %q", deviceName)
+	}
+
+	defer unix.Close(fd)
+
+	// Microvms don't open devices exclusively, the open count tells whether anyone but us has the device
+	if inUse, err := deviceInUse(deviceName); err != nil || inUse {
+		if err == nil {
+			log.G(ctx).Debugf("skipping trim of device %q as it's in use", deviceName)
+		}
+
+		return err
+	}
+
+	output, err := exec.CommandContext(ctx, "dumpe2fs", devicePath).Output()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read filesystem of device %q", deviceName)
+	}
+
+	ranges, err := parseFreeBlocks(output)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read free blocks of device %q", deviceName)
+	}
+
+	for _, r := range ranges {
+		// Blocks free now may be taken by a user opening the device meanwhile, so the trim stops then
+		if inUse, err := deviceInUse(deviceName); err != nil || inUse {
+			if err == nil {
+				log.G(ctx).Debugf("stopping trim of device %q as it's been opened", deviceName)
+			}
+
+			return err
+		}
+
+		if err := blkDiscard(fd, r); err != nil {
+			return errors.Wrapf(err, "failed to discard blocks of device %q", deviceName)
+		}
+	}
+
+	log.G(ctx).Debugf("trimmed %d free range(s) of device %q", len(ranges), deviceName)
+	return nil
+}
+
+// deviceInUse tells whether the device is opened by anyone but the trimmer
+func deviceInUse(deviceName string) (bool, error) {
+	infos, err := dmsetup.Info(deviceName)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to query device %q", deviceName)
+	}
+
+	return len(infos) != 1 || infos[0].OpenCount > 1, nil
+}
+
+// byteRange is a range of a device in bytes, laid out as BLKDISCARD expects it
+type byteRange struct {
+	start  uint64
+	length uint64
+}
+
+// blkDiscardIoctl is BLKDISCARD, _IO(0x12, 119)
+const blkDiscardIoctl = 0x1277
+
+func blkDiscard(fd int, r byteRange) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), blkDiscardIoctl, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// parseFreeBlocks reads free block ranges of an ext4 filesystem from dumpe2fs output. A filesystem with
+// a journal to replay is refused, its free block bitmaps may not account for blocks taken since.
+func parseFreeBlocks(output []byte) ([]byteRange, error) {
+	var (
+		blockSize uint64
+		ranges    []byteRange
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "Filesystem features:"):
+			for _, feature := range strings.Fields(strings.TrimPrefix(line, "Filesystem features:")) {
+				if feature == "needs_recovery" {
+					return nil, errors.New("filesystem journal needs recovery")
+				}
+			}
+		case strings.HasPrefix(line, "Block size:"):
+			size, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "Block size:")), 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid block size line %q", line)
+			}
+
+			blockSize = size
+		case strings.HasPrefix(line, "  Free blocks:"):
+			// Free blocks of a group, like "  Free blocks: 1026-2047, 4096"
+			for _, item := range strings.Split(strings.TrimPrefix(line, "  Free blocks:"), ",") {
+				if item = strings.TrimSpace(item); item == "" {
+					continue
+				}
+
+				bounds := strings.SplitN(item, "-", 2)
+				first, err := strconv.ParseUint(bounds[0], 10, 64)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid free blocks %q", item)
+				}
+
+				last := first
+				if len(bounds) == 2 {
+					if last, err = strconv.ParseUint(bounds[1], 10, 64); err != nil || last < first {
+						return nil, errors.Errorf("invalid free blocks %q", item)
+					}
+				}
+
+				ranges = append(ranges, byteRange{start: first, length: last - first + 1})
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if blockSize == 0 {
+		return nil, errors.New("block size not found")
+	}
+
+	for i := range ranges {
+		ranges[i].start *= blockSize
+		ranges[i].length *= blockSize
+	}
+
+	return ranges, nil
+}
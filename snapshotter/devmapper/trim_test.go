@@ -0,0 +1,54 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dumpe2fsOutput = `Filesystem volume name:   <none>
+Filesystem features:      has_journal ext_attr resize_inode dir_index filetype extent 64bit flex_bg sparse_super
+Free blocks:              30000
+Block size:               4096
+
+Group 0: (Blocks 0-32767) csum 0x1234 [ITABLE_ZEROED]
+  Primary superblock at 0, Group descriptors at 1-1
+  Free blocks: 2000-2999, 4096
+  Free inodes: 12-8192
+Group 1: (Blocks 32768-65535) csum 0x5678 [INODE_UNINIT, BLOCK_UNINIT]
+  Free blocks: 
+  Free inodes: 8193-16384
+`
+
+func TestParseFreeBlocks(t *testing.T) {
+	ranges, err := parseFreeBlocks([]byte(dumpe2fsOutput))
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{
+		{start: 2000 * 4096, length: 1000 * 4096},
+		{start: 4096 * 4096, length: 4096},
+	}, ranges)
+
+	// Bitmaps of a filesystem with a journal to replay can't be trusted
+	_, err = parseFreeBlocks([]byte("Filesystem features:      has_journal needs_recovery extent\nBlock size: 4096\n"))
+	assert.Error(t, err)
+
+	_, err = parseFreeBlocks([]byte("  Free blocks: 1-2\n"))
+	assert.Error(t, err, "block size is required")
+
+	_, err = parseFreeBlocks([]byte("Block size: 4096\n  Free blocks: 9-3\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// sysfsDir is where block devices and their holders are looked up, tests point it to a fake tree
+var sysfsDir = "/sys"
+
+// ValidateConfig checks that a parsed configuration can be used to set up the thin-pool on this host:
+// the data and metadata devices have to be distinct block devices, which aren't used by device-mapper
+// devices other than the pool itself (so the pool of another snapshotter can't be taken over).
+// It doesn't change anything on the host, so it's suitable for checking configuration before deployment.
+func ValidateConfig(config *Config) error {
+	var result *multierror.Error
+
+	if err := config.validate(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if err := config.validateDevices(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	return result.ErrorOrNil()
+}
+
+// validateDevices checks the data and metadata devices of the pool
+func (c *Config) validateDevices() error {
+	var result *multierror.Error
+
+	devices := []struct {
+		path string
+		name string
+	}{
+		{c.DataDevice, "data_device"},
+		{c.MetadataDevice, "meta_device"},
+	}
+
+	var rdevs []uint64
+	for _, device := range devices {
+		if device.path == "" {
+			continue
+		}
+
+		rdev, err := blockDevice(device.path)
+		if err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "invalid %s", device.name))
+			continue
+		}
+
+		if err := checkHolders(rdev, c.PoolName); err != nil {
+			result = multierror.Append(result, errors.Wrapf(err, "invalid %s %q", device.name, device.path))
+		}
+
+		rdevs = append(rdevs, rdev)
+	}
+
+	if len(rdevs) == 2 && rdevs[0] == rdevs[1] {
+		result = multierror.Append(result, errors.Errorf("data_device %q and meta_device %q are the same device",
+			c.DataDevice, c.MetadataDevice))
+	}
+
+	return result.ErrorOrNil()
+}
+
+// blockDevice returns the device number of a block device
+func blockDevice(path string) (uint64, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0, errors.Wrapf(err, "failed to stat %q", path)
+	}
+
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, errors.Errorf("%q is not a block device", path)
+	}
+
+	return uint64(stat.Rdev), nil
+}
+
+// checkHolders fails if a block device is held by a device-mapper device other than the given pool
+func checkHolders(rdev uint64, poolName string) error {
+	dir := filepath.Join(sysfsDir, "dev", "block", fmt.Sprintf("%d:%d", unix.Major(rdev), unix.Minor(rdev)), "holders")
+	holders, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return errors.Wrapf(err, "failed to list holders of device %d:%d", unix.Major(rdev), unix.Minor(rdev))
+	}
+
+	for _, holder := range holders {
+		data, err := ioutil.ReadFile(filepath.Join(sysfsDir, "block", holder.Name(), "dm", "name"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Not a device-mapper device (like a partition or md array), it's still busy though
+				return errors.Errorf("device is in use by %q", holder.Name())
+			}
+
+			return errors.Wrapf(err, "failed to get name of holder %q", holder.Name())
+		}
+
+		if name := strings.TrimSpace(string(data)); name != poolName {
+			return errors.Errorf("device is in use by device-mapper device %q", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package devmapper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestValidateConfigDevices(t *testing.T) {
+	file, err := ioutil.TempFile("", "devmapper-validate-")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	require.NoError(t, file.Close())
+
+	config := Config{
+		PoolName:             "test",
+		RootPath:             "/tmp",
+		DataDevice:           file.Name(),
+		MetadataDevice:       "/dev/null",
+		DataBlockSizeSectors: dataBlockMinSize,
+	}
+
+	err = ValidateConfig(&config)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid data_device")
+	assert.Contains(t, err.Error(), "invalid meta_device")
+	assert.Contains(t, err.Error(), "is not a block device")
+
+	config.DataDevice = "/dev/not-existing-device"
+	config.DataBlockSizeSectors = dataBlockMinSize + 1
+	err = ValidateConfig(&config)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to stat \"/dev/not-existing-device\"")
+	assert.Contains(t, err.Error(), errInvalidBlockAlignment.Error())
+}
+
+func TestCheckHolders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devmapper-sysfs-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldSysfsDir := sysfsDir
+	sysfsDir = dir
+	defer func() { sysfsDir = oldSysfsDir }()
+
+	addHolder := func(device, holder, dmName string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "dev", "block", device, "holders", holder), 0755))
+		if dmName != "" {
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "block", holder, "dm"), 0755))
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "block", holder, "dm", "name"), []byte(dmName+"\n"), 0644))
+		}
+	}
+
+	addHolder("7:0", "dm-0", "test")
+	addHolder("7:1", "dm-1", "other-pool")
+	addHolder("7:2", "md0", "")
+
+	assert.NoError(t, checkHolders(unix.Mkdev(7, 0), "test"), "device held by the pool itself")
+	assert.NoError(t, checkHolders(unix.Mkdev(7, 3), "test"), "device without holders")
+
+	err = checkHolders(unix.Mkdev(7, 1), "test")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "other-pool")
+
+	assert.Error(t, checkHolders(unix.Mkdev(7, 2), "test"))
+}
@@ -44,6 +44,16 @@ type DeviceInfo struct {
 	EventNumber     uint32 // Last event sequence number (used by wait)
 }
 
+// DeviceStatus represents the status of a device target returned by "dmsetup status"
+type DeviceStatus struct {
+	Offset int64
+	Length int64
+	Target string
+	// Target specific status values, for thin devices these are the number of mapped sectors
+	// and the highest mapped sector (see "thin-provisioning.txt" in kernel documentation)
+	Params []string
+}
+
 var errTable map[string]unix.Errno
 
 func init() {
@@ -122,6 +132,14 @@ func ActivateDevice(poolName string, deviceName string, deviceID uint32, size ui
 	return err
 }
 
+// ReloadDevice loads a table of the given size into the inactive slot of an active thin-device,
+// it takes effect once the device is suspended and resumed
+func ReloadDevice(poolName string, deviceName string, deviceID uint32, size uint64, external string) error {
+	mapping := makeThinMapping(poolName, deviceID, size, external)
+	_, err := dmsetup("reload", deviceName, "--table", mapping)
+	return err
+}
+
 // makeThinMapping makes thin target table entry
 func makeThinMapping(poolName string, deviceID uint32, sizeBytes uint64, externalOriginDevice string) string {
 	lengthSectors := sizeBytes / SectorSize
@@ -245,6 +263,36 @@ func Info(deviceName string) ([]*DeviceInfo, error) {
 	return devices, nil
 }
 
+// Status returns the status of the device target (see "dmsetup status").
+// Devices with more than one target are not supported.
+func Status(deviceName string) (*DeviceStatus, error) {
+	output, err := dmsetup("status", deviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Output format is "<offset> <length> <target> <params>..."
+	fields := strings.Fields(output)
+	if len(fields) < 3 || strings.Contains(output, "\n") {
+		return nil, errors.Errorf("unexpected status of device %q: %q", deviceName, output)
+	}
+
+	status := &DeviceStatus{
+		Target: fields[2],
+		Params: fields[3:],
+	}
+
+	if status.Offset, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse offset of device %q", deviceName)
+	}
+
+	if status.Length, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse length of device %q", deviceName)
+	}
+
+	return status, nil
+}
+
 // Version returns "dmsetup version" output
 func Version() (string, error) {
 	return dmsetup("version")
@@ -76,6 +76,7 @@ func TestDMSetup(t *testing.T) {
 	t.Run("DeleteSnapshot", testDeleteSnapshot)
 
 	t.Run("ActivateDevice", testActivateDevice)
+	t.Run("Status", testStatus)
 	t.Run("SuspendResumeDevice", testSuspendResumeDevice)
 	t.Run("RemoveDevice", testRemoveDevice)
 
@@ -132,6 +133,16 @@ func testActivateDevice(t *testing.T) {
 	assert.True(t, info.TableLive)
 }
 
+func testStatus(t *testing.T) {
+	status, err := Status(testDeviceName)
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 0, status.Offset)
+	assert.EqualValues(t, 2, status.Length)
+	assert.Equal(t, "thin", status.Target)
+	assert.Equal(t, []string{"0", "-"}, status.Params)
+}
+
 func testSuspendResumeDevice(t *testing.T) {
 	err := SuspendDevice(testDeviceName)
 	assert.NoError(t, err)